@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"github.com/liabio/ingressgroup/pkg/features"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	"net/http"
+)
+
+// redactedFlags are the flags whose values /debug/config hides, since they
+// reveal paths on the controller's host.
+var redactedFlags = map[string]bool{
+	"kubeconfig": true,
+}
+
+// effectiveConfig is the resolved configuration of the controller as served
+// on /debug/config.
+type effectiveConfig struct {
+	// Flags holds the value of every flag, defaults included.
+	Flags map[string]string `json:"flags"`
+	// IngressAPIVersion is the API version the controller writes Ingresses
+	// with, ServedIngressAPIVersions the ones the cluster serves.
+	IngressAPIVersion        string          `json:"ingressAPIVersion"`
+	ServedIngressAPIVersions []string        `json:"servedIngressAPIVersions"`
+	FeatureGates             map[string]bool `json:"featureGates"`
+	// Namespaces are the namespaces watched, [""] for all of them.
+	Namespaces []string `json:"namespaces"`
+	// LeaderElection tells whether the replicas elect a leader, Leader
+	// whether this replica reconciles. Without leader election every replica
+	// does.
+	LeaderElection bool `json:"leaderElection"`
+	Leader         bool `json:"leader"`
+}
+
+// newEffectiveConfig resolves the configuration of the controller from the
+// parsed flags and what it discovered at startup.
+func newEffectiveConfig(gates *features.FeatureGate, servedIngressAPIs, namespaces []string, leaderElection bool) *effectiveConfig {
+	config := &effectiveConfig{
+		Flags:                    map[string]string{},
+		IngressAPIVersion:        extensionsv1beta1.SchemeGroupVersion.String(),
+		ServedIngressAPIVersions: servedIngressAPIs,
+		FeatureGates:             map[string]bool{},
+		Namespaces:               namespaces,
+		LeaderElection:           leaderElection,
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if redactedFlags[f.Name] && value != "" {
+			value = "<redacted>"
+		}
+		config.Flags[f.Name] = value
+	})
+	for _, feature := range features.Known() {
+		config.FeatureGates[feature] = gates.Enabled(features.Feature(feature))
+	}
+	return config
+}
+
+// debugConfigHandler serves the effective configuration as JSON, with whether
+// the replica currently leads.
+func debugConfigHandler(config *effectiveConfig, leading func() bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		current := *config
+		current.Leader = leading()
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&current); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
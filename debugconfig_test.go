@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"github.com/liabio/ingressgroup/pkg/features"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDebugConfigHandler(t *testing.T) {
+	// The flags are defined by main, which the tests do not run.
+	if flag.Lookup("kubeconfig") == nil {
+		flag.String("kubeconfig", "", "")
+	}
+	gates := features.NewFeatureGate()
+	gates.SetEnabled(features.ServiceDiscovery, true)
+
+	tests := []struct {
+		name           string
+		kubeconfig     string
+		leaderElection bool
+		leading        bool
+		wantKubeconfig string
+	}{
+		{name: "no kubeconfig", wantKubeconfig: ""},
+		{name: "kubeconfig redacted", kubeconfig: "/home/admin/.kube/config", wantKubeconfig: "<redacted>"},
+		{name: "leader", leaderElection: true, leading: true},
+		{name: "standby", leaderElection: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := flag.Set("kubeconfig", test.kubeconfig); err != nil {
+				t.Fatalf("failed to set the kubeconfig flag: %v", err)
+			}
+			defer flag.Set("kubeconfig", "")
+
+			config := newEffectiveConfig(gates, []string{"extensions/v1beta1", "networking.k8s.io/v1beta1"}, []string{"team-a", "team-b"}, test.leaderElection)
+			recorder := httptest.NewRecorder()
+			debugConfigHandler(config, func() bool { return test.leading })(recorder, httptest.NewRequest(http.MethodGet, "/debug/config", nil))
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("got status %v, want %v", recorder.Code, http.StatusOK)
+			}
+			if got := recorder.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("got content type %q, want application/json", got)
+			}
+			var body map[string]json.RawMessage
+			if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+				t.Fatalf("failed to decode the body: %v", err)
+			}
+			var keys []string
+			for key := range body {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			wantKeys := []string{"featureGates", "flags", "ingressAPIVersion", "leader", "leaderElection", "namespaces", "servedIngressAPIVersions"}
+			if !reflect.DeepEqual(keys, wantKeys) {
+				t.Fatalf("got keys %v, want %v", keys, wantKeys)
+			}
+
+			var got effectiveConfig
+			if err := json.Unmarshal(recorder.Body.Bytes(), &got); err != nil {
+				t.Fatalf("failed to decode the body: %v", err)
+			}
+			if kubeconfig := got.Flags["kubeconfig"]; kubeconfig != test.wantKubeconfig {
+				t.Errorf("got kubeconfig flag %q, want %q", kubeconfig, test.wantKubeconfig)
+			}
+			if got.IngressAPIVersion != "extensions/v1beta1" {
+				t.Errorf("got Ingress API version %q, want extensions/v1beta1", got.IngressAPIVersion)
+			}
+			if !got.FeatureGates[string(features.ServiceDiscovery)] {
+				t.Errorf("got feature gates %v, want %v enabled", got.FeatureGates, features.ServiceDiscovery)
+			}
+			if len(got.FeatureGates) != len(features.Known()) {
+				t.Errorf("got %v feature gates, want all %v", len(got.FeatureGates), len(features.Known()))
+			}
+			if !reflect.DeepEqual(got.Namespaces, []string{"team-a", "team-b"}) {
+				t.Errorf("got namespaces %v, want team-a and team-b", got.Namespaces)
+			}
+			if got.LeaderElection != test.leaderElection || got.Leader != test.leading {
+				t.Errorf("got leader election %v and leader %v, want %v and %v", got.LeaderElection, got.Leader, test.leaderElection, test.leading)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"github.com/liabio/ingressgroup/pkg/controller"
+	"io"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+)
+
+// importIngresses prints an IngressGroup manifest for every Ingress of the
+// namespace the controller did not generate itself, translating what it can
+// of the Ingress into the group's spec. What cannot be represented is listed
+// in comments above the manifest. Nothing is written to the cluster.
+func importIngresses(kubeClient clientset.Interface, namespace, prefix string, out io.Writer) error {
+	list, err := kubeClient.ExtensionsV1beta1().Ingresses(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list ingresses in namespace %v: %v", namespace, err)
+	}
+	ingresses := list.Items
+	sort.Slice(ingresses, func(i, j int) bool { return ingresses[i].Name < ingresses[j].Name })
+
+	for i := range ingresses {
+		ing := &ingresses[i]
+		if _, ok := ing.Labels[controller.IngressGroupLabel]; ok {
+			continue
+		}
+		ig, unsupported := ingressToGroup(ing, prefix)
+		if err := controller.Validate(ig.DeepCopy()); err != nil {
+			unsupported = append(unsupported, fmt.Sprintf("the translated group is invalid: %v", err))
+		}
+
+		data, err := yaml.Marshal(ig)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "---\n# Imported from ingress %v/%v.\n", ing.Namespace, ing.Name)
+		for _, reason := range unsupported {
+			fmt.Fprintf(out, "# Not represented: %v\n", reason)
+		}
+		out.Write(data)
+	}
+	return nil
+}
+
+// ingressToGroup translates the Ingress into an IngressGroup of the same name,
+// the reverse of rendering a group into Ingresses. It returns what of the
+// Ingress the group cannot represent.
+func ingressToGroup(ing *extensionsv1beta1.Ingress, prefix string) (*v1.IngressGroup, []string) {
+	ig := &v1.IngressGroup{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1.SchemeGroupVersion.String(),
+			Kind:       "IngressGroup",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ing.Name,
+			Namespace: ing.Namespace,
+		},
+	}
+	var unsupported []string
+
+	annotations := map[string]string{}
+	for key, value := range ing.Annotations {
+		if strings.HasPrefix(key, prefix+"/") {
+			annotations[strings.TrimPrefix(key, prefix+"/")] = value
+		}
+	}
+	var rewriteTarget string
+	var pathType v1.PathType
+	for _, name := range sortedKeys(annotations) {
+		value := annotations[name]
+		switch name {
+		case "auth-type":
+			if value != "basic" {
+				unsupported = append(unsupported, fmt.Sprintf("auth-type %q, only basic is supported", value))
+			}
+		case "auth-secret":
+			ig.Spec.BasicAuthSecret = value
+		case "auth-realm":
+			ig.Spec.BasicAuthRealm = value
+		case "server-snippet":
+			ig.Spec.ServerSnippet = value
+		case "rewrite-target":
+			rewriteTarget = value
+		case "use-regex":
+			if value == "true" {
+				pathType = v1.PathTypeImplementationSpecific
+			}
+		default:
+			unsupported = append(unsupported, fmt.Sprintf("annotation %v/%v", prefix, name))
+		}
+	}
+	if ing.Spec.Backend != nil {
+		unsupported = append(unsupported, fmt.Sprintf("default backend %v", ing.Spec.Backend.ServiceName))
+	}
+	// The class annotation is not under the prefix.
+	ig.Spec.IngressClassName = ing.Annotations["kubernetes.io/ingress.class"]
+	for _, tls := range ing.Spec.TLS {
+		ig.Spec.TLS = append(ig.Spec.TLS, v1.IngressTLS{Hosts: tls.Hosts, SecretName: tls.SecretName})
+	}
+
+	// Paths routing to the same backend under several hosts become a single
+	// item listing the hosts.
+	index := map[string]int{}
+	for _, rule := range ing.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			item := v1.ServiceItem{
+				Name:          path.Backend.ServiceName,
+				Namespace:     ing.Namespace,
+				Path:          path.Path,
+				PathType:      pathType,
+				RewriteTarget: rewriteTarget,
+			}
+			if path.Backend.ServicePort.Type == intstr.Int {
+				item.Port = path.Backend.ServicePort.IntVal
+			} else {
+				item.PortName = path.Backend.ServicePort.StrVal
+			}
+			key := fmt.Sprintf("%s:%d:%s %s", item.Name, item.Port, item.PortName, item.Path)
+			i, ok := index[key]
+			if !ok {
+				i = len(ig.Spec.Services)
+				index[key] = i
+				ig.Spec.Services = append(ig.Spec.Services, item)
+			}
+			if rule.Host != "" {
+				ig.Spec.Services[i].Hosts = append(ig.Spec.Services[i].Hosts, rule.Host)
+			}
+		}
+	}
+	return ig, unsupported
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
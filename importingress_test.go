@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"github.com/liabio/ingressgroup/pkg/controller"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ingressRule returns a rule of the host routing each path to the backend
+// following it, given as path, service, port.
+func ingressRule(host string, paths ...interface{}) extensionsv1beta1.IngressRule {
+	rule := extensionsv1beta1.IngressRule{
+		Host:             host,
+		IngressRuleValue: extensionsv1beta1.IngressRuleValue{HTTP: &extensionsv1beta1.HTTPIngressRuleValue{}},
+	}
+	for i := 0; i+2 < len(paths); i += 3 {
+		var port intstr.IntOrString
+		switch p := paths[i+2].(type) {
+		case int:
+			port = intstr.FromInt(p)
+		case string:
+			port = intstr.FromString(p)
+		}
+		rule.HTTP.Paths = append(rule.HTTP.Paths, extensionsv1beta1.HTTPIngressPath{
+			Path:    paths[i].(string),
+			Backend: extensionsv1beta1.IngressBackend{ServiceName: paths[i+1].(string), ServicePort: port},
+		})
+	}
+	return rule
+}
+
+func newImportedIngress(annotations map[string]string, rules ...extensionsv1beta1.IngressRule) *extensionsv1beta1.Ingress {
+	return &extensionsv1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "shop", Annotations: annotations},
+		Spec:       extensionsv1beta1.IngressSpec{Rules: rules},
+	}
+}
+
+func TestIngressToGroup(t *testing.T) {
+	tests := []struct {
+		name            string
+		ingress         *extensionsv1beta1.Ingress
+		want            v1.IngressGroupSpec
+		wantUnsupported []string
+	}{
+		{
+			name:    "paths of one host",
+			ingress: newImportedIngress(nil, ingressRule("shop.example.com", "/", "web", 80, "/api", "api", 8080)),
+			want: v1.IngressGroupSpec{Services: []v1.ServiceItem{
+				{Name: "web", Namespace: "team-a", Port: 80, Path: "/", Hosts: []string{"shop.example.com"}},
+				{Name: "api", Namespace: "team-a", Port: 8080, Path: "/api", Hosts: []string{"shop.example.com"}},
+			}},
+		},
+		{
+			name: "backend under several hosts",
+			ingress: newImportedIngress(nil,
+				ingressRule("a.example.com", "/", "web", 80),
+				ingressRule("b.example.com", "/", "web", 80)),
+			want: v1.IngressGroupSpec{Services: []v1.ServiceItem{
+				{Name: "web", Namespace: "team-a", Port: 80, Path: "/", Hosts: []string{"a.example.com", "b.example.com"}},
+			}},
+		},
+		{
+			name:    "hostless rule with a named port",
+			ingress: newImportedIngress(nil, ingressRule("", "/", "web", "http")),
+			want: v1.IngressGroupSpec{Services: []v1.ServiceItem{
+				{Name: "web", Namespace: "team-a", PortName: "http", Path: "/"},
+			}},
+		},
+		{
+			name: "recognized annotations",
+			ingress: newImportedIngress(map[string]string{
+				"nginx.ingress.kubernetes.io/auth-type":      "basic",
+				"nginx.ingress.kubernetes.io/auth-secret":    "shop-auth",
+				"nginx.ingress.kubernetes.io/rewrite-target": "/$1",
+				"nginx.ingress.kubernetes.io/use-regex":      "true",
+				"kubernetes.io/ingress.class":                "internal",
+			}, ingressRule("", "/shop/(.*)", "web", 80)),
+			want: v1.IngressGroupSpec{
+				BasicAuthSecret:  "shop-auth",
+				IngressClassName: "internal",
+				Services: []v1.ServiceItem{{
+					Name:          "web",
+					Namespace:     "team-a",
+					Port:          80,
+					Path:          "/shop/(.*)",
+					PathType:      v1.PathTypeImplementationSpecific,
+					RewriteTarget: "/$1",
+				}},
+			},
+		},
+		{
+			name: "unsupported annotations",
+			ingress: newImportedIngress(map[string]string{
+				"nginx.ingress.kubernetes.io/auth-type":    "digest",
+				"nginx.ingress.kubernetes.io/ssl-redirect": "false",
+			}, ingressRule("", "/", "web", 80)),
+			want: v1.IngressGroupSpec{Services: []v1.ServiceItem{
+				{Name: "web", Namespace: "team-a", Port: 80, Path: "/"},
+			}},
+			wantUnsupported: []string{
+				`auth-type "digest", only basic is supported`,
+				"annotation nginx.ingress.kubernetes.io/ssl-redirect",
+			},
+		},
+		{
+			name: "default backend",
+			ingress: func() *extensionsv1beta1.Ingress {
+				ing := newImportedIngress(nil)
+				ing.Spec.Backend = &extensionsv1beta1.IngressBackend{ServiceName: "fallback", ServicePort: intstr.FromInt(80)}
+				return ing
+			}(),
+			wantUnsupported: []string{"default backend fallback"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ig, unsupported := ingressToGroup(test.ingress, "nginx.ingress.kubernetes.io")
+			if ig.Namespace != "team-a" || ig.Name != "shop" || ig.Kind != "IngressGroup" {
+				t.Errorf("got group %v %v/%v, want IngressGroup team-a/shop", ig.Kind, ig.Namespace, ig.Name)
+			}
+			if !reflect.DeepEqual(ig.Spec, test.want) {
+				t.Errorf("got spec %+v, want %+v", ig.Spec, test.want)
+			}
+			if !reflect.DeepEqual(unsupported, test.wantUnsupported) {
+				t.Errorf("got unsupported %q, want %q", unsupported, test.wantUnsupported)
+			}
+		})
+	}
+}
+
+func TestImportIngresses(t *testing.T) {
+	legacy := newImportedIngress(nil, ingressRule("shop.example.com", "/", "web", 80))
+	generated := newImportedIngress(nil, ingressRule("", "/", "blog", 80))
+	generated.Name = "blog"
+	generated.Labels = map[string]string{controller.IngressGroupLabel: "blog"}
+	kubeClient := kubefake.NewSimpleClientset(legacy, generated)
+
+	var out bytes.Buffer
+	if err := importIngresses(kubeClient, "team-a", "nginx.ingress.kubernetes.io", &out); err != nil {
+		t.Fatalf("failed to import the ingresses: %v", err)
+	}
+	got := out.String()
+	if !strings.Contains(got, "# Imported from ingress team-a/shop.") || !strings.Contains(got, "kind: IngressGroup") {
+		t.Errorf("got output %q, want the manifest of the group of team-a/shop", got)
+	}
+	if strings.Contains(got, "blog") {
+		t.Errorf("got output %q, want the generated ingress skipped", got)
+	}
+	if strings.Contains(got, "Not represented") {
+		t.Errorf("got output %q, want the ingress fully represented", got)
+	}
+}
@@ -4,39 +4,189 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"github.com/liabio/ingressgroup/pkg/controller"
+	"github.com/liabio/ingressgroup/pkg/features"
+	"github.com/liabio/ingressgroup/pkg/manager"
+	"github.com/liabio/ingressgroup/pkg/metrics"
+	"github.com/liabio/ingressgroup/pkg/webhook"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io/ioutil"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
 	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	extensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apiserver/pkg/util/logs"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/pkg/version"
 	restclient "k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v2alpha1"
 	igclient "k8s.io/ingress-nginx/pkg/client/clientset/versioned"
-	inggroupInformers "k8s.io/ingress-nginx/pkg/client/informers/externalversions"
 	"k8s.io/klog"
 	"k8s.io/kubernetes/pkg/version/verflag"
+	"math/rand"
+	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 type OperatorManagerServer struct {
-	Master     string
-	Kubeconfig string
+	Master                string
+	Kubeconfig            string
+	ControllerName        string
+	InstallCRD            bool
+	AllowSnippets         bool
+	AllowCrossNamespace   bool
+	FeatureGates          *features.FeatureGate
+	DeletionPropagation   string
+	ClusterDomain         string
+	IngressNamespace      string
+	HTTPAddress           string
+	EnableDebugEndpoints  bool
+	FieldSelector         string
+	Namespaces            string
+	WebhookAddress        string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSMinVersion         string
+	RequeueAfter          time.Duration
+	InformerResync        time.Duration
+	ShutdownTimeout       time.Duration
+	Workers               int
+	APIErrorThreshold     int
+	APIErrorCoolDown      time.Duration
+	MaxConcurrentAPICalls int
+	ServerDryRun          bool
+	RequireNamespaceOptIn bool
+	ObserveOnly           bool
+	ValidateIngressClass  bool
+	TCPServicesConfigMap  string
+	UDPServicesConfigMap  string
+	ValidateDir           string
+	ImportNamespace       string
+	AnnotationsPrefix     string
+	MinWatchTimeout       time.Duration
+	KubeAPIQPS            float64
+	KubeAPIBurst          int
+	EventQPS              float64
+	EventBurst            int
+	APFFlowSchema         string
+	EnqueueDebounce       time.Duration
+	StartupJitter         time.Duration
+	CRDWaitTimeout        time.Duration
+	SyncIngressStatus     bool
+	StatusUpdateInterval  time.Duration
+	AnnotationsAllowlist  string
+	LeaderElect           bool
+	LeaderElectNamespace  string
+	LeaderElectLeaseName  string
+	LeaderElectLease      time.Duration
+	LeaderElectRenew      time.Duration
+	LeaderElectRetry      time.Duration
 }
 
 func NewOMServer() *OperatorManagerServer {
-	s := OperatorManagerServer{}
+	s := OperatorManagerServer{
+		ControllerName:        "ingressgroup-controller",
+		InstallCRD:            true,
+		HTTPAddress:           ":10254",
+		WebhookAddress:        ":8443",
+		TLSMinVersion:         "1.2",
+		ClusterDomain:         "cluster.local",
+		ShutdownTimeout:       30 * time.Second,
+		Workers:               2,
+		APIErrorThreshold:     5,
+		APIErrorCoolDown:      30 * time.Second,
+		MaxConcurrentAPICalls: 10,
+		AnnotationsPrefix:     controller.DefaultAnnotationsPrefix,
+		MinWatchTimeout:       5 * time.Minute,
+		FeatureGates:          features.NewFeatureGate(),
+		DeletionPropagation:   string(metav1.DeletePropagationBackground),
+		KubeAPIQPS:            100,
+		KubeAPIBurst:          100,
+		EventQPS:              10,
+		EventBurst:            50,
+		StartupJitter:         500 * time.Millisecond,
+		CRDWaitTimeout:        time.Minute,
+		SyncIngressStatus:     true,
+		LeaderElectLease:      15 * time.Second,
+		LeaderElectRenew:      10 * time.Second,
+		LeaderElectRetry:      2 * time.Second,
+	}
 	return &s
 }
 
 func main() {
+	// Seed the jitters so replicas started together spread out.
+	rand.Seed(time.Now().UnixNano())
+
 	s := NewOMServer()
 	flag.StringVar(&s.Master, "master", s.Master, "The address of the Kubernetes API server (overrides any value in kubeconfig)")
 	flag.StringVar(&s.Kubeconfig, "kubeconfig", s.Kubeconfig, "Path to kubeconfig file with authorization and master location information.")
+	flag.StringVar(&s.ControllerName, "controller-name", s.ControllerName, "Name the controller identifies as: its user agent, the source of its events and the value of the app.kubernetes.io/managed-by label of the objects it generates. Objects labeled with a previous name are taken over through their owner reference.")
+	flag.BoolVar(&s.InstallCRD, "install-crd", s.InstallCRD, "Create the IngressGroup CRD at startup. When false the CRD must already be installed, and the controller needs no RBAC to write CRDs.")
+	flag.StringVar(&s.HTTPAddress, "http-address", s.HTTPAddress, "The address the controller's HTTP server (metrics, /healthz and /readyz probes, debug endpoints) listens on.")
+	flag.BoolVar(&s.EnableDebugEndpoints, "enable-debug-endpoints", s.EnableDebugEndpoints, "Serve /debug/state, dumping the controller's cached view of all IngressGroups, and /debug/config, the controller's effective configuration.")
+	flag.StringVar(&s.FieldSelector, "field-selector", s.FieldSelector, "Only watch IngressGroups matching this field selector, e.g. metadata.namespace!=kube-system. The API server only supports metadata.name and metadata.namespace for custom resources.")
+	flag.StringVar(&s.WebhookAddress, "webhook-address", s.WebhookAddress, "The address the HTTPS webhook server listens on.")
+	flag.StringVar(&s.TLSCertFile, "tls-cert-file", s.TLSCertFile, "Certificate for the webhook server. The webhook server only runs when this is set. Changes to the file are picked up without a restart.")
+	flag.StringVar(&s.TLSKeyFile, "tls-key-file", s.TLSKeyFile, "Private key matching --tls-cert-file.")
+	flag.StringVar(&s.TLSMinVersion, "tls-min-version", s.TLSMinVersion, "Minimum TLS version accepted by the webhook server: 1.0, 1.1, 1.2 or 1.3.")
+	flag.StringVar(&s.Namespaces, "namespaces", s.Namespaces, "Comma-separated namespaces to watch IngressGroups in, all namespaces if empty. With a list, a Role and RoleBinding granting access to ingressgroups, ingresses, services and secrets in each namespace replace the ClusterRole; the controller still needs to list and watch namespaces cluster-wide, and get on the services groups reference in other namespaces, which are read from the API server rather than watched.")
+	flag.Var(s.FeatureGates, "feature-gates", "Comma-separated Name=true|false pairs enabling or disabling features of IngressGroups. Known features: "+strings.Join(features.Known(), ", ")+".")
+	flag.BoolVar(&s.AllowSnippets, "allow-snippets", s.AllowSnippets, "Shorthand for --feature-gates=Snippets=true: render raw nginx snippets and response headers from IngressGroups. Snippets can reach other tenants' traffic, so only enable this on trusted clusters.")
+	flag.BoolVar(&s.AllowCrossNamespace, "allow-cross-namespace", s.AllowCrossNamespace, "Shorthand for --feature-gates=CrossNamespace=true: route to services in other namespaces than their IngressGroup through ExternalName Services created in the group's namespace. Without it such services are skipped.")
+	flag.StringVar(&s.AnnotationsPrefix, "annotations-prefix", s.AnnotationsPrefix, "Prefix of the annotations set on the generated Ingresses. Must match the --annotations-prefix of ingress-nginx.")
+	flag.StringVar(&s.ClusterDomain, "cluster-domain", s.ClusterDomain, "DNS domain of the cluster, used to address services bridged from other namespaces.")
+	flag.StringVar(&s.IngressNamespace, "ingress-namespace", s.IngressNamespace, "Namespace to generate the Ingresses of every IngressGroup in instead of the group's namespace. The services of a group are bridged there through ExternalName Services, and its TLS and basic auth Secrets are read from there. Owner references cannot cross namespaces, so the groups get the "+controller.CleanupFinalizer+" finalizer and their Ingresses and bridges are deleted before they are; changing the flag leaves the objects generated in the previous namespace behind. Groups of different namespaces must not generate Ingresses of the same name, set spec.ingressName to tell them apart.")
+	flag.DurationVar(&s.RequeueAfter, "reconcile-requeue-after", s.RequeueAfter, "Reconcile every IngressGroup again this long after it synced successfully, correcting drift of the generated Ingresses. 0 disables it. Exclusive with --informer-resync.")
+	flag.DurationVar(&s.InformerResync, "informer-resync", s.InformerResync, "Resync period of the IngressGroup informers: every period, all cached IngressGroups are delivered again and reconciled, without contacting the API server. 0 only reconciles on events. Exclusive with --reconcile-requeue-after.")
+	flag.IntVar(&s.APIErrorThreshold, "api-error-threshold", s.APIErrorThreshold, "Pause all syncs after this many consecutive throttling or server errors from the API server. 0 disables it.")
+	flag.DurationVar(&s.APIErrorCoolDown, "api-error-cool-down", s.APIErrorCoolDown, "How long to pause the syncs once --api-error-threshold is reached.")
+	flag.IntVar(&s.MaxConcurrentAPICalls, "max-concurrent-api-calls", s.MaxConcurrentAPICalls, "Maximum number of write calls to the API server in flight at once. 0 leaves them unbounded.")
+	flag.StringVar(&s.TCPServicesConfigMap, "tcp-services-configmap", s.TCPServicesConfigMap, "Namespace/name of the ConfigMap ingress-nginx reads TCP services from, the --tcp-services-configmap of ingress-nginx. The tcpServices of IngressGroups are added to it; without it they are skipped.")
+	flag.StringVar(&s.UDPServicesConfigMap, "udp-services-configmap", s.UDPServicesConfigMap, "Namespace/name of the ConfigMap ingress-nginx reads UDP services from, the --udp-services-configmap of ingress-nginx. The udpServices of IngressGroups are added to it; without it they are skipped.")
+	flag.BoolVar(&s.ValidateIngressClass, "validate-ingress-class", s.ValidateIngressClass, "Mark IngressGroups invalid when the group or one of its services uses an ingress class that does not exist as a networking.k8s.io/v1 IngressClass. Needs RBAC to get ingressclasses; skipped with a warning on clusters not serving that API.")
+	flag.BoolVar(&s.ObserveOnly, "observe-only", s.ObserveOnly, "Compute the Ingresses, Services and ConfigMap entries of every IngressGroup and report the outcome in its status, but never create, update or delete them; the skipped writes are logged at V(2). Useful to run the controller alongside another tool before taking over.")
+	flag.BoolVar(&s.RequireNamespaceOptIn, "require-namespace-optin", s.RequireNamespaceOptIn, "Only process IngressGroups in namespaces labeled "+controller.NamespaceOptInLabel+"=true, skipping the others, so the controller can be rolled out namespace by namespace. Groups of a namespace labeled later are picked up on their next change or --reconcile-requeue-after.")
+	flag.BoolVar(&s.SyncIngressStatus, "sync-ingress-status", s.SyncIngressStatus, "Copy the load balancer addresses published on the generated Ingresses into the status of their IngressGroups and sync a group when they change. Disable it when another tool owns the status of Ingresses; the groups then report no addresses and no Addressed condition.")
+	flag.DurationVar(&s.StatusUpdateInterval, "status-update-interval", s.StatusUpdateInterval, "Hold back the status updates of IngressGroups and write them in the background every interval, so a group whose status changes several times within the interval is written once, with its last status. Pending updates are written on shutdown. 0 writes every status update right away.")
+	flag.StringVar(&s.AnnotationsAllowlist, "annotations-allowlist", s.AnnotationsAllowlist, "Comma-separated annotation keys IngressGroups may pass through to their Ingresses with spec.annotations; a key ending in * allows the keys starting with the rest, such as nginx.ingress.kubernetes.io/proxy-*. The other keys are dropped and reported on the AnnotationsAccepted condition. Any key is allowed if empty. Snippet annotations also need --allow-snippets.")
+	flag.BoolVar(&s.ServerDryRun, "server-dry-run", s.ServerDryRun, "Send every write of a generated Ingress as a server-side dry run first and report rejections by the API server or its admission webhooks in the Admitted condition of the group.")
+	flag.DurationVar(&s.MinWatchTimeout, "min-watch-timeout", s.MinWatchTimeout, "Minimum duration of the informers' watches; each watch is closed after a random duration between this and twice this and re-established. Lower it when a proxy or load balancer silently drops long-lived connections.")
+	flag.StringVar(&s.DeletionPropagation, "deletion-propagation", s.DeletionPropagation, "Propagation policy of the deletes of generated objects a group no longer needs: Background, Foreground or Orphan. Deleting a group itself leaves its objects to the garbage collector.")
+	flag.Float64Var(&s.KubeAPIQPS, "kube-api-qps", s.KubeAPIQPS, "Queries per second to the API server, shared by all the controller's clients.")
+	flag.IntVar(&s.KubeAPIBurst, "kube-api-burst", s.KubeAPIBurst, "Burst of queries to the API server above --kube-api-qps, shared by all the controller's clients.")
+	flag.Float64Var(&s.EventQPS, "event-qps", s.EventQPS, "Queries per second the controller may send to the API server to record events, separate from --kube-api-qps so a storm of events and the syncs do not starve each other. Every event is also logged, including the ones the event sink throttles or aggregates.")
+	flag.IntVar(&s.EventBurst, "event-burst", s.EventBurst, "Burst of event writes above --event-qps.")
+	flag.StringVar(&s.APFFlowSchema, "apf-flow-schema", s.APFFlowSchema, "Name of the FlowSchema the controller's requests are expected to match, appended to its user agent. API Priority and Fairness matches FlowSchemas on the controller's service account, not its user agent: create a FlowSchema matching the service account with a PriorityLevelConfiguration of its own to give the controller a dedicated concurrency share. The user agent makes that intent visible in audit logs.")
+	flag.DurationVar(&s.CRDWaitTimeout, "crd-wait-timeout", s.CRDWaitTimeout, "How long to wait at startup for the API server to serve IngressGroups, which takes a moment after the CRD is created, before giving up. 0 does not wait.")
+	flag.DurationVar(&s.StartupJitter, "startup-jitter", s.StartupJitter, "Wait a random duration up to this long before listing and watching, so replicas started together by a rollout do not list at the same time. 0 starts right away.")
+	flag.DurationVar(&s.EnqueueDebounce, "enqueue-debounce", s.EnqueueDebounce, "Delay the sync of an IngressGroup by this long after an event about it or its Ingresses, so a burst of events results in a single sync. 0 syncs right away.")
+	flag.BoolVar(&s.LeaderElect, "leader-elect", s.LeaderElect, "Elect a leader among the replicas of the controller through a coordination.k8s.io Lease, so several can run and only the leader reconciles. The others keep serving the webhook and metrics. Needs RBAC to get, create and update leases in the namespace of the Lease.")
+	flag.StringVar(&s.LeaderElectNamespace, "leader-elect-namespace", s.LeaderElectNamespace, "Namespace of the leader election Lease, the namespace of the controller's service account if empty.")
+	flag.StringVar(&s.LeaderElectLeaseName, "leader-elect-lease-name", s.LeaderElectLeaseName, "Name of the leader election Lease, the --controller-name if empty.")
+	flag.DurationVar(&s.LeaderElectLease, "leader-elect-lease-duration", s.LeaderElectLease, "How long the other replicas wait before taking over a Lease its leader no longer renews.")
+	flag.DurationVar(&s.LeaderElectRenew, "leader-elect-renew-deadline", s.LeaderElectRenew, "How long the leader retries renewing its Lease before it stops reconciling and exits. Must be less than --leader-elect-lease-duration.")
+	flag.DurationVar(&s.LeaderElectRetry, "leader-elect-retry-period", s.LeaderElectRetry, "How often the replicas try to acquire or renew the Lease.")
+	flag.IntVar(&s.Workers, "workers", s.Workers, "Number of IngressGroups reconciled concurrently. A group is never reconciled by two workers at once, and the failed reconciles are retried with an exponential backoff. The writes of all workers stay bounded by --max-concurrent-api-calls.")
+	flag.DurationVar(&s.ShutdownTimeout, "shutdown-timeout", s.ShutdownTimeout, "How long to wait on SIGTERM for in-flight reconciles to finish before exiting anyway.")
+	flag.StringVar(&s.ImportNamespace, "import-namespace", s.ImportNamespace, "Print an IngressGroup manifest for every Ingress of this namespace not generated by the controller, noting in comments what cannot be represented, and exit. Nothing is written to the cluster.")
+	flag.StringVar(&s.ValidateDir, "validate-dir", s.ValidateDir, "Validate the IngressGroups in the YAML files under this directory, print a report and exit, non-zero if any is invalid. No cluster is needed.")
 
 	flag.Parse()
 
@@ -45,6 +195,25 @@ func main() {
 
 	verflag.PrintAndExitIfRequested()
 
+	if s.ValidateDir != "" {
+		if !validateDir(s.ValidateDir, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if s.ImportNamespace != "" {
+		kubeClient, _, _, err := createClients(s)
+		if err == nil {
+			err = importIngresses(kubeClient, s.ImportNamespace, strings.TrimSuffix(s.AnnotationsPrefix, "/"), os.Stdout)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if err := Run(s); err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
@@ -56,59 +225,400 @@ func Run(s *OperatorManagerServer) error {
 	// To help debugging, immediately log version
 	klog.Infof("Version: %+v", version.Get())
 
-	_, extensionCRClient, kubeconfig, err := createClients(s)
-	//kubeClient, leaderElectionClient, _, kubeconfig, err := createClients(s)
+	switch metav1.DeletionPropagation(s.DeletionPropagation) {
+	case metav1.DeletePropagationBackground, metav1.DeletePropagationForeground, metav1.DeletePropagationOrphan:
+	default:
+		return fmt.Errorf("invalid --deletion-propagation %q: must be Background, Foreground or Orphan", s.DeletionPropagation)
+	}
+
+	// Both knobs periodically reconcile every group; together each group
+	// would be reconciled twice per period.
+	if s.InformerResync > 0 && s.RequeueAfter > 0 {
+		return fmt.Errorf("--informer-resync and --reconcile-requeue-after both reconcile every IngressGroup periodically, set only one")
+	}
 
+	if s.Workers < 1 {
+		return fmt.Errorf("invalid --workers %d: must be at least 1", s.Workers)
+	}
+
+	if s.IngressNamespace != "" {
+		if errs := validation.IsDNS1123Label(s.IngressNamespace); len(errs) > 0 {
+			return fmt.Errorf("invalid --ingress-namespace %q: %v", s.IngressNamespace, strings.Join(errs, ", "))
+		}
+	}
+
+	for flagName, configMap := range map[string]string{"tcp-services-configmap": s.TCPServicesConfigMap, "udp-services-configmap": s.UDPServicesConfigMap} {
+		if configMap == "" {
+			continue
+		}
+		if parts := strings.Split(configMap, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid --%v %q: must be namespace/name", flagName, configMap)
+		}
+	}
+
+	if s.AllowSnippets {
+		s.FeatureGates.SetEnabled(features.Snippets, true)
+	}
+	if s.AllowCrossNamespace {
+		s.FeatureGates.SetEnabled(features.CrossNamespace, true)
+	}
+	klog.Infof("Feature gates: %v", s.FeatureGates)
+
+	fieldSelector, err := fields.ParseSelector(s.FieldSelector)
+	if err != nil {
+		return fmt.Errorf("invalid --field-selector %q: %v", s.FieldSelector, err)
+	}
+	if fieldSelector.Empty() {
+		klog.Infof("Watching all IngressGroups")
+	} else {
+		klog.Infof("Watching IngressGroups matching field selector %q", fieldSelector.String())
+	}
+
+	tlsMinVersion, err := webhook.ParseTLSVersion(s.TLSMinVersion)
+	if err != nil {
+		return fmt.Errorf("invalid --tls-min-version: %v", err)
+	}
+	if (s.TLSCertFile == "") != (s.TLSKeyFile == "") {
+		return fmt.Errorf("--tls-cert-file and --tls-key-file must be set together")
+	}
+
+	// The HTTP server starts first so the probes and metrics answer while
+	// the controller waits for the CRD and its caches.
+	ready := &readiness{}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", healthzHandler())
+	mux.Handle("/readyz", readyzHandler(ready))
+	go func() {
+		klog.Fatal(http.ListenAndServe(s.HTTPAddress, mux))
+	}()
+
+	kubeClient, extensionCRClient, kubeconfig, err := createClients(s)
 	if err != nil {
 		return err
 	}
 
-	err = CreateIngressGroupCRD(extensionCRClient)
+	servedIngressAPIs, err := checkIngressAPI(kubeClient)
 	if err != nil {
-		if errors.IsAlreadyExists(err) {
-			klog.Infof("redis cluster crd is already created.")
-		} else {
-			fmt.Fprint(os.Stderr, err)
+		return err
+	}
+	if s.IngressNamespace != "" {
+		// The groups report a missing namespace until it is created.
+		if _, err := kubeClient.CoreV1().Namespaces().Get(s.IngressNamespace, metav1.GetOptions{}); errors.IsNotFound(err) {
+			klog.Warningf("Ingress namespace %v does not exist, no Ingress is generated until it is created", s.IngressNamespace)
+		} else if err != nil {
+			return fmt.Errorf("failed to get the ingress namespace %v: %v", s.IngressNamespace, err)
+		}
+	}
+	if s.ValidateIngressClass {
+		served, err := checkIngressClassAPI(kubeClient)
+		if err != nil {
 			return err
 		}
+		if !served {
+			klog.Warningf("Cluster does not serve networking.k8s.io/v1 IngressClasses, ingress classes will not be validated")
+			s.ValidateIngressClass = false
+		}
+	}
+
+	if s.InstallCRD {
+		err = CreateIngressGroupCRD(extensionCRClient)
+		if err != nil {
+			if errors.IsAlreadyExists(err) {
+				metrics.CRDInstalls.WithLabelValues("already_exists").Inc()
+				klog.Infof("redis cluster crd is already created.")
+			} else {
+				metrics.CRDInstalls.WithLabelValues("failed").Inc()
+				fmt.Fprint(os.Stderr, err)
+				return err
+			}
+		} else {
+			metrics.CRDInstalls.WithLabelValues("created").Inc()
+		}
+	} else if err := checkIngressGroupCRD(extensionCRClient); err != nil {
+		return err
+	}
+	missingCRDFields := checkCRDDrift(extensionCRClient)
+	if err := waitForIngressGroupAPI(kubeClient, s.CRDWaitTimeout); err != nil {
+		return err
 	}
+	ready.setCRDServed()
 
-	versionedClient, err := igclient.NewForConfig(kubeconfig)
+	versionedClient, err := igclient.NewForConfig(restclient.AddUserAgent(kubeconfig, s.userAgent()))
 	if err != nil {
 		klog.Fatal(err)
 	}
 
-	sharedInformers := inggroupInformers.NewSharedInformerFactory(versionedClient, time.Duration(0)*time.Second)
+	// An empty list watches all namespaces.
+	namespaces := []string{metav1.NamespaceAll}
+	if s.Namespaces != "" {
+		namespaceSet := sets.NewString(strings.Split(s.Namespaces, ",")...)
+		namespaceSet.Delete("")
+		namespaces = namespaceSet.List()
+	}
+	if s.Namespaces == "" {
+		klog.Infof("Watching IngressGroups in all namespaces")
+	} else {
+		klog.Infof("Watching IngressGroups in namespaces %v", strings.Join(namespaces, ", "))
+	}
+
+	var annotationsAllowlist []string
+	if s.AnnotationsAllowlist != "" {
+		allowlist := sets.NewString(strings.Split(s.AnnotationsAllowlist, ",")...)
+		allowlist.Delete("")
+		annotationsAllowlist = allowlist.List()
+	}
 
-	ctx := context.TODO()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	stopCh := ctx.Done()
 
-	//watch ingress group
-	ingGroupEventHandler := cache.ResourceEventHandlerFuncs{
-		//create ingress group
-		AddFunc: func(obj interface{}) {
-			addIngGroup := obj.(*v1.IngressGroup)
-			klog.Warningf("addIngGroup: %v/%v", addIngGroup.Namespace, addIngGroup.Name)
-		},
-		//delete ingress group
-		DeleteFunc: func(obj interface{}) {
-			delIngGroup, _ := obj.(*v1.IngressGroup)
-			klog.Warningf("delIngGroup: %v/%v", delIngGroup.Namespace, delIngGroup.Name)
-		},
-		//update ingress group
-		UpdateFunc: func(old, cur interface{}) {
-			oldIngGroup := old.(*v1.IngressGroup)
-			curIngGroup := cur.(*v1.IngressGroup)
-			klog.Warningf("oldIngGroup: %v/%v ; curIngGroup: %v/%v", oldIngGroup.Namespace, oldIngGroup.Name, curIngGroup.Namespace, curIngGroup.Name)
+	go func() {
+		signals := make(chan os.Signal, 2)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		sig := <-signals
+		klog.Infof("Received %v, shutting down", sig)
+		cancel()
+		<-signals
+		klog.Fatalf("Received a second signal, exiting immediately")
+	}()
+
+	// Events are written through a client of their own, rate limited apart
+	// from the syncs.
+	eventConfig := restclient.CopyConfig(kubeconfig)
+	eventConfig.QPS = float32(s.EventQPS)
+	eventConfig.Burst = s.EventBurst
+	eventConfig.RateLimiter = flowcontrol.NewTokenBucketRateLimiter(eventConfig.QPS, eventConfig.Burst)
+	eventClient, err := clientset.NewForConfig(restclient.AddUserAgent(eventConfig, s.userAgent()))
+	if err != nil {
+		return err
+	}
+
+	var leaderElection *manager.LeaderElectionConfig
+	if s.LeaderElect {
+		if leaderElection, err = s.leaderElection(kubeconfig); err != nil {
+			return err
+		}
+	}
+
+	if s.APIErrorThreshold <= 0 {
+		klog.Warningf("--api-error-threshold is 0, syncs will not pause on API server errors")
+	}
+
+	ctrl, err := manager.New(manager.Config{
+		KubeClient:      kubeClient,
+		VersionedClient: versionedClient,
+		EventClient:     eventClient,
+		Namespaces:      namespaces,
+		FieldSelector:   fieldSelector,
+		InformerResync:  s.InformerResync,
+		MinWatchTimeout: s.MinWatchTimeout,
+		RequeueAfter:    s.RequeueAfter,
+		EnqueueDebounce: s.EnqueueDebounce,
+		Workers:         s.Workers,
+		ShutdownTimeout: s.ShutdownTimeout,
+		LeaderElection:  leaderElection,
+		Reconciler: controller.Config{
+			ControllerName:           s.ControllerName,
+			FeatureGates:             s.FeatureGates,
+			DeletionPropagation:      metav1.DeletionPropagation(s.DeletionPropagation),
+			ClusterDomain:            s.ClusterDomain,
+			APIErrorThreshold:        s.APIErrorThreshold,
+			APIErrorCoolDown:         s.APIErrorCoolDown,
+			MaxConcurrentAPICalls:    s.MaxConcurrentAPICalls,
+			ServerDryRun:             s.ServerDryRun,
+			RequireNamespaceOptIn:    s.RequireNamespaceOptIn,
+			ObserveOnly:              s.ObserveOnly,
+			ValidateIngressClass:     s.ValidateIngressClass,
+			TCPServicesConfigMap:     s.TCPServicesConfigMap,
+			UDPServicesConfigMap:     s.UDPServicesConfigMap,
+			MissingCRDFields:         missingCRDFields,
+			AnnotationsPrefix:        strings.TrimSuffix(s.AnnotationsPrefix, "/"),
+			DisableIngressStatusSync: !s.SyncIngressStatus,
+			StatusUpdateInterval:     s.StatusUpdateInterval,
+			AnnotationsAllowlist:     annotationsAllowlist,
+			IngressNamespace:         s.IngressNamespace,
 		},
+	})
+	if err != nil {
+		return err
+	}
+
+	ready.setController(ctrl)
+	if s.EnableDebugEndpoints {
+		mux.Handle("/debug/state", controller.DebugStateHandler(ctrl.IngressGroupLister(), ctrl.IngressLister(), s.IngressNamespace))
+		mux.Handle("/debug/config", debugConfigHandler(newEffectiveConfig(s.FeatureGates, servedIngressAPIs, namespaces, s.LeaderElect), ctrl.Leading))
+	}
+
+	if s.TLSCertFile != "" {
+		certWatcher, err := webhook.NewCertWatcher(s.TLSCertFile, s.TLSKeyFile)
+		if err != nil {
+			return err
+		}
+		go certWatcher.Run(stopCh)
+
+		webhookMux := http.NewServeMux()
+		webhookMux.Handle("/validate", webhook.ValidateHandler())
+		server := &http.Server{
+			Addr:      s.WebhookAddress,
+			Handler:   webhookMux,
+			TLSConfig: webhook.NewTLSConfig(certWatcher, tlsMinVersion),
+		}
+		go func() {
+			klog.Fatal(server.ListenAndServeTLS("", ""))
+		}()
+	}
+
+	if delay := startupDelay(s.StartupJitter); delay > 0 {
+		klog.Infof("Waiting %v before starting informers", delay)
+		select {
+		case <-time.After(delay):
+		case <-stopCh:
+			return nil
+		}
+	}
+
+	return ctrl.Start(ctx)
+}
+
+// serviceAccountNamespaceFile holds the namespace of the service account of
+// a pod.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// leaderElection returns the leader election of the replicas, through a
+// client of its own so the syncs never hold back the renewals of the Lease.
+func (s *OperatorManagerServer) leaderElection(kubeconfig *restclient.Config) (*manager.LeaderElectionConfig, error) {
+	if s.LeaderElectLease <= s.LeaderElectRenew {
+		return nil, fmt.Errorf("--leader-elect-lease-duration must be greater than --leader-elect-renew-deadline")
+	}
+	if s.LeaderElectRetry <= 0 || s.LeaderElectRenew <= s.LeaderElectRetry {
+		return nil, fmt.Errorf("--leader-elect-retry-period must be positive and less than --leader-elect-renew-deadline")
+	}
+	namespace := s.LeaderElectNamespace
+	if namespace == "" {
+		data, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("--leader-elect-namespace is not set and the namespace of the service account is unknown: %v", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+	name := s.LeaderElectLeaseName
+	if name == "" {
+		name = s.ControllerName
 	}
 
-	sharedInformers.Cr().V1().IngressGroups().Informer().AddEventHandler(ingGroupEventHandler)
+	leConfig := restclient.CopyConfig(kubeconfig)
+	leConfig.RateLimiter = flowcontrol.NewTokenBucketRateLimiter(leConfig.QPS, leConfig.Burst)
+	client, err := clientset.NewForConfig(restclient.AddUserAgent(leConfig, s.userAgent()+"-leader-election"))
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("Electing a leader through lease %v/%v", namespace, name)
+	return &manager.LeaderElectionConfig{
+		Client:        client,
+		Namespace:     namespace,
+		Name:          name,
+		LeaseDuration: s.LeaderElectLease,
+		RenewDeadline: s.LeaderElectRenew,
+		RetryPeriod:   s.LeaderElectRetry,
+	}, nil
+}
+
+// startupDelay returns a random delay in [0, jitter), 0 if jitter is not
+// positive.
+func startupDelay(jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
+
+// unauthorizedCounter counts the requests the API server answers with 401
+// Unauthorized.
+type unauthorizedCounter struct {
+	next http.RoundTripper
+}
+
+func (c *unauthorizedCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := c.next.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		verb := req.Method
+		if req.URL.Query().Get("watch") == "true" {
+			verb = "WATCH"
+		}
+		metrics.APIUnauthorized.WithLabelValues(verb).Inc()
+	}
+	return resp, err
+}
+
+// wrapTransport counts the requests of the clients built from the config
+// that the API server rejects as unauthorized, such as the watches of the
+// informers retrying with an expired token. In-cluster configs carry the path
+// of the service account token, but the vendored client only reads the token
+// once; a rejected request re-reads it and is retried once with the rotated
+// token, so the informers recover without a restart.
+func wrapTransport(config *restclient.Config) {
+	wrap := config.WrapTransport
+	tokenFile := config.BearerTokenFile
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		if wrap != nil {
+			rt = wrap(rt)
+		}
+		rt = &unauthorizedCounter{next: rt}
+		if tokenFile != "" {
+			rt = &tokenFileRefresher{path: tokenFile, next: rt}
+		}
+		return rt
+	}
+}
+
+// tokenFileRefresher re-reads the bearer token from its file when the API
+// server rejects a request as unauthorized, and retries the request once with
+// the token read if it changed. The requests after it carry the token read.
+type tokenFileRefresher struct {
+	path string
+	next http.RoundTripper
+
+	mu    sync.Mutex
+	token string
+}
+
+func (r *tokenFileRefresher) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	token := r.token
+	r.mu.Unlock()
+	if token != "" {
+		req = utilnet.CloneRequest(req)
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 
-	sharedInformers.Start(stopCh)
+	resp, err := r.next.RoundTrip(req)
+	// Requests with a body cannot be sent twice.
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || req.Body != nil {
+		return resp, err
+	}
+	data, readErr := ioutil.ReadFile(r.path)
+	refreshed := strings.TrimSpace(string(data))
+	if readErr != nil || refreshed == "" || req.Header.Get("Authorization") == "Bearer "+refreshed {
+		return resp, err
+	}
+	klog.Infof("Retrying %v %v with the token re-read from %v", req.Method, req.URL.Path, r.path)
+	r.mu.Lock()
+	r.token = refreshed
+	r.mu.Unlock()
+	resp.Body.Close()
 
-	<-stopCh
-	return fmt.Errorf("unreachable")
+	req = utilnet.CloneRequest(req)
+	req.Header.Set("Authorization", "Bearer "+refreshed)
+	return r.next.RoundTrip(req)
+}
+
+// userAgent returns the user agent suffix of the controller's clients.
+func (s *OperatorManagerServer) userAgent() string {
+	if s.APFFlowSchema == "" {
+		return s.ControllerName
+	}
+	return s.ControllerName + " flow-schema/" + s.APFFlowSchema
 }
 
 func createClients(s *OperatorManagerServer) (*clientset.Clientset, *extensionsclient.Clientset, *restclient.Config, error) {
@@ -117,15 +627,20 @@ func createClients(s *OperatorManagerServer) (*clientset.Clientset, *extensionsc
 		return nil, nil, nil, err
 	}
 
-	kubeconfig.QPS = 100
-	kubeconfig.Burst = 100
+	// A single rate limiter is shared by all the clients built from the
+	// config so they stay within the limit together.
+	kubeconfig.QPS = float32(s.KubeAPIQPS)
+	kubeconfig.Burst = s.KubeAPIBurst
+	kubeconfig.RateLimiter = flowcontrol.NewTokenBucketRateLimiter(kubeconfig.QPS, kubeconfig.Burst)
+
+	wrapTransport(kubeconfig)
 
-	kubeClient, err := clientset.NewForConfig(restclient.AddUserAgent(kubeconfig, "operator-manager"))
+	kubeClient, err := clientset.NewForConfig(restclient.AddUserAgent(kubeconfig, s.userAgent()))
 	if err != nil {
 		klog.Fatalf("Invalid API configuration: %v", err)
 	}
 
-	extensionClient, err := extensionsclient.NewForConfig(restclient.AddUserAgent(kubeconfig, "operator-manager"))
+	extensionClient, err := extensionsclient.NewForConfig(restclient.AddUserAgent(kubeconfig, s.userAgent()))
 	if err != nil {
 		klog.Fatalf("Invalid API configuration: %v", err)
 	}
@@ -133,8 +648,203 @@ func createClients(s *OperatorManagerServer) (*clientset.Clientset, *extensionsc
 	return kubeClient, extensionClient, kubeconfig, nil
 }
 
+// checkIngressAPI returns and logs the Ingress APIs the cluster serves and
+// fails if it does not serve extensions/v1beta1, the only one the controller
+// can write.
+func checkIngressAPI(kubeClient clientset.Interface) ([]string, error) {
+	var served []string
+	for _, groupVersion := range []string{"networking.k8s.io/v1", "networking.k8s.io/v1beta1", "extensions/v1beta1"} {
+		resources, err := kubeClient.Discovery().ServerResourcesForGroupVersion(groupVersion)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover %v: %v", groupVersion, err)
+		}
+		for _, resource := range resources.APIResources {
+			if resource.Name == "ingresses" {
+				served = append(served, groupVersion)
+				break
+			}
+		}
+	}
+	klog.Infof("Cluster serves Ingresses as %v", strings.Join(served, ", "))
+
+	for _, groupVersion := range served {
+		if groupVersion == extensionsv1beta1.SchemeGroupVersion.String() {
+			return served, nil
+		}
+	}
+	return nil, fmt.Errorf("cluster does not serve extensions/v1beta1 Ingresses, the only version this controller generates")
+}
+
+// checkIngressClassAPI reports whether the cluster serves
+// networking.k8s.io/v1 IngressClasses, which clusters before 1.19 do not.
+func checkIngressClassAPI(kubeClient clientset.Interface) (bool, error) {
+	resources, err := kubeClient.Discovery().ServerResourcesForGroupVersion("networking.k8s.io/v1")
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to discover networking.k8s.io/v1: %v", err)
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == "ingressclasses" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkIngressGroupCRD verifies that the IngressGroup CRD was installed by
+// other means.
+func checkIngressGroupCRD(extensionCRClient *extensionsclient.Clientset) error {
+	name := "ingressgroups." + v1.SchemeGroupVersion.Group
+	_, err := extensionCRClient.ApiextensionsV1beta1().CustomResourceDefinitions().Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return fmt.Errorf("CRD %v is not installed; install it or run with --install-crd", name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get CRD %v: %v", name, err)
+	}
+	return nil
+}
+
+// waitForIngressGroupAPI polls discovery until the API server serves
+// IngressGroups, giving up after timeout. A CRD is only served a moment after
+// it is created, and listing it before fails.
+func waitForIngressGroupAPI(kubeClient clientset.Interface, timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	groupVersion := v1.SchemeGroupVersion.String()
+	err := wait.PollImmediate(time.Second, timeout, func() (bool, error) {
+		resources, err := kubeClient.Discovery().ServerResourcesForGroupVersion(groupVersion)
+		if err != nil && !errors.IsNotFound(err) {
+			klog.Warningf("failed to discover %v, retrying: %v", groupVersion, err)
+			return false, nil
+		}
+		if err == nil {
+			for _, resource := range resources.APIResources {
+				if resource.Name == "ingressgroups" {
+					return true, nil
+				}
+			}
+		}
+		klog.Infof("Waiting for the API server to serve %v ingressgroups", groupVersion)
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("API server did not serve %v ingressgroups within %v", groupVersion, timeout)
+	}
+	return nil
+}
+
+// streamServicesSchema returns the schema of a list of stream services.
+func streamServicesSchema() v1beta1.JSONSchemaProps {
+	port := v1beta1.JSONSchemaProps{
+		Type:    "integer",
+		Minimum: float64Ptr(1),
+		Maximum: float64Ptr(65535),
+	}
+	return v1beta1.JSONSchemaProps{
+		Type: "array",
+		Items: &v1beta1.JSONSchemaPropsOrArray{
+			Schema: &v1beta1.JSONSchemaProps{
+				Type:     "object",
+				Required: []string{"port", "service", "servicePort"},
+				Properties: map[string]v1beta1.JSONSchemaProps{
+					"port":        port,
+					"service":     {Type: "string"},
+					"servicePort": port,
+				},
+			},
+		},
+	}
+}
+
 func CreateIngressGroupCRD(extensionCRClient *extensionsclient.Clientset) error {
-	crd := &v1beta1.CustomResourceDefinition{
+	_, err := extensionCRClient.ApiextensionsV1beta1().CustomResourceDefinitions().Create(newIngressGroupCRD())
+	return err
+}
+
+// checkCRDDrift compares the installed IngressGroup CRD with the one the
+// controller would install, reporting whether they differ through the drift
+// gauge. It returns the fields the schema of the installed CRD lacks.
+func checkCRDDrift(extensionCRClient *extensionsclient.Clientset) []string {
+	desired := newIngressGroupCRD()
+	current, err := extensionCRClient.ApiextensionsV1beta1().CustomResourceDefinitions().Get(desired.Name, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("failed to get CRD %v to check it for drift: %v", desired.Name, err)
+		return nil
+	}
+
+	var drifted []string
+	if !apiequality.Semantic.DeepEqual(current.Spec.Validation, desired.Spec.Validation) {
+		drifted = append(drifted, "validation")
+	}
+	if !apiequality.Semantic.DeepEqual(current.Spec.Subresources, desired.Spec.Subresources) {
+		drifted = append(drifted, "subresources")
+	}
+	if !apiequality.Semantic.DeepEqual(current.Spec.Versions, desired.Spec.Versions) {
+		drifted = append(drifted, "versions")
+	}
+	if current.Spec.Scope != desired.Spec.Scope {
+		drifted = append(drifted, "scope")
+	}
+	if current.Spec.Names.Kind != desired.Spec.Names.Kind ||
+		current.Spec.Names.Plural != desired.Spec.Names.Plural ||
+		!apiequality.Semantic.DeepEqual(current.Spec.Names.ShortNames, desired.Spec.Names.ShortNames) ||
+		!apiequality.Semantic.DeepEqual(current.Spec.Names.Categories, desired.Spec.Names.Categories) {
+		drifted = append(drifted, "names")
+	}
+
+	if len(drifted) == 0 {
+		metrics.CRDDrift.Set(0)
+		return nil
+	}
+	klog.Warningf("installed CRD %v differs from the one this controller expects in: %v", desired.Name, strings.Join(drifted, ", "))
+	metrics.CRDDrift.Set(1)
+
+	if current.Spec.Validation == nil || current.Spec.Validation.OpenAPIV3Schema == nil {
+		return nil
+	}
+	missing := missingSchemaFields("", current.Spec.Validation.OpenAPIV3Schema, desired.Spec.Validation.OpenAPIV3Schema)
+	if len(missing) > 0 {
+		klog.Warningf("installed CRD %v lacks the fields %v, which the API server may drop from IngressGroups", desired.Name, strings.Join(missing, ", "))
+	}
+	return missing
+}
+
+// missingSchemaFields returns the paths of the fields the desired schema
+// defines but the current one does not, below the given path. A field whose
+// current schema leaves its properties open is not descended into.
+func missingSchemaFields(path string, current, desired *v1beta1.JSONSchemaProps) []string {
+	var missing []string
+	for name, desiredField := range desired.Properties {
+		fieldPath := name
+		if path != "" {
+			fieldPath = path + "." + name
+		}
+		currentField, ok := current.Properties[name]
+		if !ok {
+			if len(current.Properties) > 0 {
+				missing = append(missing, fieldPath)
+			}
+			continue
+		}
+		missing = append(missing, missingSchemaFields(fieldPath, &currentField, &desiredField)...)
+	}
+	if current.Items != nil && current.Items.Schema != nil && desired.Items != nil && desired.Items.Schema != nil {
+		missing = append(missing, missingSchemaFields(path+"[]", current.Items.Schema, desired.Items.Schema)...)
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// newIngressGroupCRD returns the IngressGroup CRD the controller installs.
+func newIngressGroupCRD() *v1beta1.CustomResourceDefinition {
+	return &v1beta1.CustomResourceDefinition{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: "ingressgroups." + v1.SchemeGroupVersion.Group,
 		},
@@ -148,8 +858,19 @@ func CreateIngressGroupCRD(extensionCRClient *extensionsclient.Clientset) error
 					// Storage flags the version as storage version. There must be exactly one flagged as storage version
 					Storage: true,
 				},
+				{
+					// v2alpha1 mirrors v1 and is registered ahead of its
+					// first incompatible change; it is served once
+					// conversion from v1 exists.
+					Served:  false,
+					Name:    v2alpha1.SchemeGroupVersion.Version,
+					Storage: false,
+				},
 			},
 			Scope: v1beta1.NamespaceScoped,
+			Subresources: &v1beta1.CustomResourceSubresources{
+				Status: &v1beta1.CustomResourceSubresourceStatus{},
+			},
 			Names: v1beta1.CustomResourceDefinitionNames{
 				Kind:       "IngressGroup",
 				ListKind:   "IngressGroupList",
@@ -168,7 +889,11 @@ func CreateIngressGroupCRD(extensionCRClient *extensionsclient.Clientset) error
 									Items: &v1beta1.JSONSchemaPropsOrArray{
 										Schema: &v1beta1.JSONSchemaProps{
 											Type:     "object",
-											Required: []string{"name", "namespace"},
+											Required: []string{"namespace"},
+											// port and portName are exclusive.
+											Not: &v1beta1.JSONSchemaProps{
+												Required: []string{"port", "portName"},
+											},
 											Properties: map[string]v1beta1.JSONSchemaProps{
 												"name": {
 													Type: "string",
@@ -176,10 +901,143 @@ func CreateIngressGroupCRD(extensionCRClient *extensionsclient.Clientset) error
 												"namespace": {
 													Type: "string",
 												},
+												"port": {
+													Type:    "integer",
+													Minimum: float64Ptr(1),
+													Maximum: float64Ptr(65535),
+												},
+												"portName": {
+													Type:      "string",
+													MaxLength: int64Ptr(15),
+													Pattern:   "^[a-z0-9]([-a-z0-9]*[a-z0-9])?$",
+												},
+												"path": {
+													Type:    "string",
+													Pattern: "^/",
+												},
+												"pathType": {
+													Type: "string",
+													Enum: []v1beta1.JSON{
+														{Raw: []byte(`"Prefix"`)},
+														{Raw: []byte(`"Exact"`)},
+														{Raw: []byte(`"ImplementationSpecific"`)},
+													},
+												},
+												"priority": {
+													Type: "integer",
+												},
+												"weight": {
+													Type:    "integer",
+													Minimum: float64Ptr(0),
+													Maximum: float64Ptr(100),
+												},
+												"rewriteTarget": {
+													Type: "string",
+												},
+												"hosts": {
+													Type: "array",
+													Items: &v1beta1.JSONSchemaPropsOrArray{
+														Schema: &v1beta1.JSONSchemaProps{Type: "string"},
+													},
+												},
+												"ingressClassName": {
+													Type: "string",
+												},
+												"selector": {
+													Type: "object",
+													AdditionalProperties: &v1beta1.JSONSchemaPropsOrBool{
+														Allows: true,
+														Schema: &v1beta1.JSONSchemaProps{Type: "string"},
+													},
+												},
+											},
+										},
+									},
+								},
+								"basicAuthSecret": {
+									Type: "string",
+								},
+								"basicAuthRealm": {
+									Type: "string",
+								},
+								"serverSnippet": {
+									Type: "string",
+								},
+								"tcpServices": streamServicesSchema(),
+								"udpServices": streamServicesSchema(),
+								"ingressClassName": {
+									Type: "string",
+								},
+								"annotations": {
+									Type: "object",
+									AdditionalProperties: &v1beta1.JSONSchemaPropsOrBool{
+										Allows: true,
+										Schema: &v1beta1.JSONSchemaProps{Type: "string"},
+									},
+								},
+								"responseHeaders": {
+									Type: "object",
+									AdditionalProperties: &v1beta1.JSONSchemaPropsOrBool{
+										Allows: true,
+										Schema: &v1beta1.JSONSchemaProps{Type: "string"},
+									},
+								},
+								"ingressName": {
+									Type:      "string",
+									MaxLength: int64Ptr(253),
+									Pattern:   `^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`,
+								},
+								"defaultPath": {
+									Type:    "string",
+									Pattern: "^/",
+								},
+								"hosts": {
+									Type: "array",
+									Items: &v1beta1.JSONSchemaPropsOrArray{
+										Schema: &v1beta1.JSONSchemaProps{Type: "string"},
+									},
+								},
+								"tls": {
+									Type: "array",
+									Items: &v1beta1.JSONSchemaPropsOrArray{
+										Schema: &v1beta1.JSONSchemaProps{
+											Type:     "object",
+											Required: []string{"secretName"},
+											Properties: map[string]v1beta1.JSONSchemaProps{
+												"hosts": {
+													Type: "array",
+													Items: &v1beta1.JSONSchemaPropsOrArray{
+														Schema: &v1beta1.JSONSchemaProps{Type: "string"},
+													},
+												},
+												"secretName": {
+													Type: "string",
+												},
 											},
 										},
 									},
 								},
+								"serviceSelector": {
+									Type:     "object",
+									Required: []string{"selector"},
+									Properties: map[string]v1beta1.JSONSchemaProps{
+										"namespace": {
+											Type: "string",
+										},
+										"selector": {
+											Type: "object",
+										},
+										"port": {
+											Type:    "integer",
+											Minimum: float64Ptr(1),
+											Maximum: float64Ptr(65535),
+										},
+									},
+								},
+								"pruneStrategy": {
+									Type:    "string",
+									Pattern: "^(immediate|confirm|grace:.+)$",
+								},
 							},
 						},
 					},
@@ -187,6 +1045,12 @@ func CreateIngressGroupCRD(extensionCRClient *extensionsclient.Clientset) error
 			},
 		},
 	}
-	_, err := extensionCRClient.ApiextensionsV1beta1().CustomResourceDefinitions().Create(crd)
-	return err
+}
+
+func float64Ptr(f float64) *float64 {
+	return &f
+}
+
+func int64Ptr(i int64) *int64 {
+	return &i
 }
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"fmt"
+	"github.com/liabio/ingressgroup/pkg/manager"
+	"github.com/liabio/ingressgroup/pkg/metrics"
+	dto "github.com/prometheus/client_model/go"
+	"io/ioutil"
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	clientset "k8s.io/client-go/kubernetes"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v2alpha1"
+	versionedfake "k8s.io/ingress-nginx/pkg/client/clientset/versioned/fake"
+	igscheme "k8s.io/ingress-nginx/pkg/client/clientset/versioned/scheme"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSchemeDecodesServedVersions(t *testing.T) {
+	tests := []struct {
+		apiVersion string
+		want       runtime.Object
+	}{
+		{apiVersion: v1.SchemeGroupVersion.String(), want: &v1.IngressGroup{}},
+		{apiVersion: v2alpha1.SchemeGroupVersion.String(), want: &v2alpha1.IngressGroup{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.apiVersion, func(t *testing.T) {
+			data := []byte(`{"apiVersion":"` + test.apiVersion + `","kind":"IngressGroup",` +
+				`"metadata":{"name":"shop","namespace":"default"},` +
+				`"spec":{"services":[{"name":"web","namespace":"default","port":80}]}}`)
+			obj, gvk, err := igscheme.Codecs.UniversalDeserializer().Decode(data, nil, nil)
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			if gvk.GroupVersion().String() != test.apiVersion || gvk.Kind != "IngressGroup" {
+				t.Errorf("got kind %v, want IngressGroup of %v", gvk, test.apiVersion)
+			}
+			if reflect.TypeOf(obj) != reflect.TypeOf(test.want) {
+				t.Fatalf("got %T, want %T", obj, test.want)
+			}
+			if accessor, err := meta.Accessor(obj); err != nil || accessor.GetName() != "shop" {
+				t.Errorf("got %#v, want the group named shop", obj)
+			}
+		})
+	}
+}
+
+func TestIngressGroupCRDVersions(t *testing.T) {
+	storage := 0
+	for _, version := range newIngressGroupCRD().Spec.Versions {
+		if version.Storage {
+			storage++
+			if version.Name != v1.SchemeGroupVersion.Version || !version.Served {
+				t.Errorf("got storage version %v served %v, want the served v1", version.Name, version.Served)
+			}
+		}
+	}
+	if storage != 1 {
+		t.Errorf("got %d storage versions, want 1", storage)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	newController := func(election *manager.LeaderElectionConfig) *manager.Controller {
+		config := manager.Config{
+			KubeClient:      kubefake.NewSimpleClientset(),
+			VersionedClient: versionedfake.NewSimpleClientset(),
+			LeaderElection:  election,
+		}
+		config.Reconciler.ControllerName = "ingressgroup"
+		ctrl, err := manager.New(config)
+		if err != nil {
+			t.Fatalf("failed to create the controller: %v", err)
+		}
+		return ctrl
+	}
+	tests := []struct {
+		name       string
+		crdServed  bool
+		ctrl       *manager.Controller
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "CRD not served", wantStatus: http.StatusServiceUnavailable},
+		{name: "controller not started", crdServed: true, wantStatus: http.StatusServiceUnavailable},
+		{
+			name:       "leader with caches not synced",
+			crdServed:  true,
+			ctrl:       newController(nil),
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "standby",
+			crdServed:  true,
+			ctrl:       newController(&manager.LeaderElectionConfig{Namespace: "kube-system", Name: "ingressgroup"}),
+			wantStatus: http.StatusOK,
+			wantBody:   "ok: standby",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ready := &readiness{}
+			if test.crdServed {
+				ready.setCRDServed()
+			}
+			if test.ctrl != nil {
+				ready.setController(test.ctrl)
+			}
+			w := httptest.NewRecorder()
+			readyzHandler(ready)(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if w.Code != test.wantStatus {
+				t.Errorf("got status %v, want %v", w.Code, test.wantStatus)
+			}
+			if test.wantBody != "" && w.Body.String() != test.wantBody {
+				t.Errorf("got body %q, want %q", w.Body.String(), test.wantBody)
+			}
+		})
+	}
+}
+
+// discoveryClientset is a fake clientset whose discovery serves the resource
+// lists of the fake and answers not found for the other group versions, as
+// the API server does.
+type discoveryClientset struct {
+	*kubefake.Clientset
+}
+
+func newDiscoveryClientset(resources ...*metav1.APIResourceList) *discoveryClientset {
+	client := kubefake.NewSimpleClientset()
+	client.Resources = resources
+	return &discoveryClientset{Clientset: client}
+}
+
+func (c *discoveryClientset) Discovery() discovery.DiscoveryInterface {
+	return &notFoundDiscovery{FakeDiscovery: c.Clientset.Discovery().(*fakediscovery.FakeDiscovery)}
+}
+
+type notFoundDiscovery struct {
+	*fakediscovery.FakeDiscovery
+}
+
+func (d *notFoundDiscovery) ServerResourcesForGroupVersion(groupVersion string) (*metav1.APIResourceList, error) {
+	for _, resources := range d.Resources {
+		if resources.GroupVersion == groupVersion {
+			return resources, nil
+		}
+	}
+	return nil, errors.NewNotFound(schema.GroupResource{}, groupVersion)
+}
+
+// resourceList returns the resource list of the group version serving the
+// resources with the given names.
+func resourceList(groupVersion string, names ...string) *metav1.APIResourceList {
+	list := &metav1.APIResourceList{GroupVersion: groupVersion}
+	for _, name := range names {
+		list.APIResources = append(list.APIResources, metav1.APIResource{Name: name})
+	}
+	return list
+}
+
+func TestCheckIngressAPI(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources []*metav1.APIResourceList
+		want      []string
+		wantErr   bool
+	}{
+		{
+			name:      "extensions only",
+			resources: []*metav1.APIResourceList{resourceList("extensions/v1beta1", "ingresses", "deployments")},
+			want:      []string{"extensions/v1beta1"},
+		},
+		{
+			name: "networking and extensions",
+			resources: []*metav1.APIResourceList{
+				resourceList("networking.k8s.io/v1", "ingresses", "networkpolicies"),
+				resourceList("networking.k8s.io/v1beta1", "ingresses"),
+				resourceList("extensions/v1beta1", "ingresses"),
+			},
+			want: []string{"networking.k8s.io/v1", "networking.k8s.io/v1beta1", "extensions/v1beta1"},
+		},
+		{
+			name:      "networking only",
+			resources: []*metav1.APIResourceList{resourceList("networking.k8s.io/v1", "ingresses")},
+			wantErr:   true,
+		},
+		{
+			name:      "extensions without ingresses",
+			resources: []*metav1.APIResourceList{resourceList("extensions/v1beta1", "deployments")},
+			wantErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := checkIngressAPI(newDiscoveryClientset(test.resources...))
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got served APIs %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckIngressClassAPI(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources []*metav1.APIResourceList
+		want      bool
+	}{
+		{
+			name:      "ingress classes served",
+			resources: []*metav1.APIResourceList{resourceList("networking.k8s.io/v1", "ingresses", "ingressclasses")},
+			want:      true,
+		},
+		{
+			name:      "networking without ingress classes",
+			resources: []*metav1.APIResourceList{resourceList("networking.k8s.io/v1", "networkpolicies")},
+		},
+		{
+			name:      "networking not served",
+			resources: []*metav1.APIResourceList{resourceList("extensions/v1beta1", "ingresses")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := checkIngressClassAPI(newDiscoveryClientset(test.resources...))
+			if err != nil {
+				t.Fatalf("failed to check the ingress class API: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("got served %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStartupDelay(t *testing.T) {
+	tests := []struct {
+		name   string
+		jitter time.Duration
+	}{
+		{name: "disabled", jitter: 0},
+		{name: "negative", jitter: -time.Second},
+		{name: "one nanosecond", jitter: 1},
+		{name: "default", jitter: 500 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 1000; i++ {
+				delay := startupDelay(test.jitter)
+				if test.jitter <= 0 {
+					if delay != 0 {
+						t.Fatalf("got delay %v, want 0 when disabled", delay)
+					}
+					continue
+				}
+				if delay < 0 || delay >= test.jitter {
+					t.Fatalf("got delay %v, want it in [0, %v)", delay, test.jitter)
+				}
+			}
+		})
+	}
+}
+
+// delayedDiscoveryClientset is a fake clientset whose discovery starts serving
+// its resources after a number of calls, failing the calls before with
+// err, or not found if nil.
+type delayedDiscoveryClientset struct {
+	*discoveryClientset
+	servedAfter int
+	err         error
+	calls       int
+}
+
+func (c *delayedDiscoveryClientset) Discovery() discovery.DiscoveryInterface {
+	return &delayedDiscovery{DiscoveryInterface: c.discoveryClientset.Discovery(), client: c}
+}
+
+type delayedDiscovery struct {
+	discovery.DiscoveryInterface
+	client *delayedDiscoveryClientset
+}
+
+func (d *delayedDiscovery) ServerResourcesForGroupVersion(groupVersion string) (*metav1.APIResourceList, error) {
+	d.client.calls++
+	if d.client.calls <= d.client.servedAfter {
+		if d.client.err != nil {
+			return nil, d.client.err
+		}
+		return nil, errors.NewNotFound(schema.GroupResource{}, groupVersion)
+	}
+	return d.DiscoveryInterface.ServerResourcesForGroupVersion(groupVersion)
+}
+
+func TestWaitForIngressGroupAPI(t *testing.T) {
+	served := resourceList(v1.SchemeGroupVersion.String(), "ingressgroups")
+	tests := []struct {
+		name        string
+		resources   []*metav1.APIResourceList
+		servedAfter int
+		err         error
+		timeout     time.Duration
+		wantCalls   int
+		wantErr     bool
+	}{
+		{name: "served", resources: []*metav1.APIResourceList{served}, timeout: 5 * time.Second, wantCalls: 1},
+		{name: "served after a retry", resources: []*metav1.APIResourceList{served}, servedAfter: 1, timeout: 5 * time.Second, wantCalls: 2},
+		{
+			name:        "discovery failing at first",
+			resources:   []*metav1.APIResourceList{served},
+			servedAfter: 1,
+			err:         errors.NewServiceUnavailable("etcd is unavailable"),
+			timeout:     5 * time.Second,
+			wantCalls:   2,
+		},
+		{
+			name:      "group served without ingressgroups",
+			resources: []*metav1.APIResourceList{resourceList(v1.SchemeGroupVersion.String())},
+			timeout:   1500 * time.Millisecond,
+			wantErr:   true,
+		},
+		{name: "never served", timeout: 1500 * time.Millisecond, wantErr: true},
+		{name: "waiting disabled", wantCalls: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &delayedDiscoveryClientset{
+				discoveryClientset: newDiscoveryClientset(test.resources...),
+				servedAfter:        test.servedAfter,
+				err:                test.err,
+			}
+			err := waitForIngressGroupAPI(client, test.timeout)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr && client.calls != test.wantCalls {
+				t.Errorf("got %v discovery calls, want %v", client.calls, test.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRunRejectsInvalidFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(s *OperatorManagerServer)
+	}{
+		{name: "invalid deletion propagation", set: func(s *OperatorManagerServer) { s.DeletionPropagation = "Cascade" }},
+		{
+			name: "informer resync and requeue after",
+			set: func(s *OperatorManagerServer) {
+				s.InformerResync = time.Minute
+				s.RequeueAfter = time.Minute
+			},
+		},
+		{name: "no workers", set: func(s *OperatorManagerServer) { s.Workers = 0 }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewOMServer()
+			test.set(s)
+			if err := Run(s); err == nil {
+				t.Errorf("got no error, want the flags rejected")
+			}
+		})
+	}
+}
+
+func TestMissingSchemaFields(t *testing.T) {
+	tests := []struct {
+		name string
+		// prune removes fields from the schema of the installed CRD.
+		prune func(schema *v1beta1.JSONSchemaProps)
+		want  []string
+	}{
+		{name: "up to date", prune: func(*v1beta1.JSONSchemaProps) {}},
+		{
+			name: "service port pruned",
+			prune: func(schema *v1beta1.JSONSchemaProps) {
+				delete(schema.Properties["spec"].Properties["services"].Items.Schema.Properties, "port")
+			},
+			want: []string{"spec.services[].port"},
+		},
+		{
+			name: "spec fields pruned",
+			prune: func(schema *v1beta1.JSONSchemaProps) {
+				delete(schema.Properties["spec"].Properties, "tcpServices")
+				delete(schema.Properties["spec"].Properties, "udpServices")
+			},
+			want: []string{"spec.tcpServices", "spec.udpServices"},
+		},
+		{
+			name: "open spec",
+			prune: func(schema *v1beta1.JSONSchemaProps) {
+				schema.Properties["spec"] = v1beta1.JSONSchemaProps{Type: "object"}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			desired := newIngressGroupCRD().Spec.Validation.OpenAPIV3Schema
+			current := desired.DeepCopy()
+			test.prune(current)
+			if got := missingSchemaFields("", current, desired); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got missing fields %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// apiUnauthorized returns the count of unauthorized requests of the verb.
+func apiUnauthorized(t *testing.T, verb string) float64 {
+	metric := &dto.Metric{}
+	if err := metrics.APIUnauthorized.WithLabelValues(verb).Write(metric); err != nil {
+		t.Fatalf("failed to read the unauthorized requests: %v", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+// roundTripperFunc answers requests with the status it returns.
+type roundTripperFunc func(req *http.Request) int
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: f(req), Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestUnauthorizedCounter(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		status   int
+		wantVerb string
+	}{
+		{name: "authorized", method: http.MethodGet, url: "/api/v1/namespaces", status: http.StatusOK},
+		{name: "forbidden", method: http.MethodGet, url: "/api/v1/namespaces", status: http.StatusForbidden},
+		{name: "unauthorized get", method: http.MethodGet, url: "/api/v1/namespaces", status: http.StatusUnauthorized, wantVerb: "GET"},
+		{name: "unauthorized watch", method: http.MethodGet, url: "/api/v1/namespaces?watch=true", status: http.StatusUnauthorized, wantVerb: "WATCH"},
+		{name: "unauthorized update", method: http.MethodPut, url: "/api/v1/namespaces/default", status: http.StatusUnauthorized, wantVerb: "PUT"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verbs := []string{"GET", "WATCH", "PUT"}
+			before := map[string]float64{}
+			for _, verb := range verbs {
+				before[verb] = apiUnauthorized(t, verb)
+			}
+
+			counter := &unauthorizedCounter{next: roundTripperFunc(func(*http.Request) int { return test.status })}
+			if _, err := counter.RoundTrip(httptest.NewRequest(test.method, test.url, nil)); err != nil {
+				t.Fatalf("failed to send the request: %v", err)
+			}
+			for _, verb := range verbs {
+				want := before[verb]
+				if verb == test.wantVerb {
+					want++
+				}
+				if got := apiUnauthorized(t, verb); got != want {
+					t.Errorf("got %v unauthorized %v requests, want %v", got, verb, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenFileRefresh(t *testing.T) {
+	tokenFile, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatalf("failed to create the token file: %v", err)
+	}
+	defer os.Remove(tokenFile.Name())
+	writeToken := func(token string) {
+		if err := ioutil.WriteFile(tokenFile.Name(), []byte(token+"\n"), 0600); err != nil {
+			t.Fatalf("failed to write the token: %v", err)
+		}
+	}
+	writeToken("expired")
+
+	var mu sync.Mutex
+	valid := "expired"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("Authorization") != "Bearer "+valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"apiVersion":"v1","kind":"Status","status":"Failure","reason":"Unauthorized","code":401}`)
+			return
+		}
+		fmt.Fprint(w, `{"apiVersion":"v1","kind":"NamespaceList","metadata":{},"items":[]}`)
+	}))
+	defer server.Close()
+
+	// An in-cluster config, with the token read at startup.
+	config := &restclient.Config{Host: server.URL, BearerToken: "expired", BearerTokenFile: tokenFile.Name()}
+	wrapTransport(config)
+	kubeClient, err := clientset.NewForConfig(config)
+	if err != nil {
+		t.Fatalf("failed to create the client: %v", err)
+	}
+	list := func() error {
+		_, err := kubeClient.CoreV1().Namespaces().List(metav1.ListOptions{})
+		return err
+	}
+
+	if err := list(); err != nil {
+		t.Fatalf("failed to list with a valid token: %v", err)
+	}
+
+	// The token expires before the kubelet rotates the file.
+	mu.Lock()
+	valid = "rotated"
+	mu.Unlock()
+	before := apiUnauthorized(t, "GET")
+	if err := list(); !errors.IsUnauthorized(err) {
+		t.Fatalf("got error %v with an expired token, want unauthorized", err)
+	}
+	if got := apiUnauthorized(t, "GET"); got != before+1 {
+		t.Errorf("got %v unauthorized requests, want %v", got, before+1)
+	}
+
+	// The request after the rotation is retried with the token re-read.
+	writeToken("rotated")
+	if err := list(); err != nil {
+		t.Fatalf("failed to list after the token was rotated: %v", err)
+	}
+	if got := apiUnauthorized(t, "GET"); got != before+2 {
+		t.Errorf("got %v unauthorized requests, want %v", got, before+2)
+	}
+	// The next requests carry the rotated token right away.
+	if err := list(); err != nil {
+		t.Fatalf("failed to list with the rotated token: %v", err)
+	}
+	if got := apiUnauthorized(t, "GET"); got != before+2 {
+		t.Errorf("got %v unauthorized requests, want no more than %v", got, before+2)
+	}
+}
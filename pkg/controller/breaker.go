@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"context"
+	"github.com/liabio/ingressgroup/pkg/metrics"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog"
+	"sync"
+	"time"
+)
+
+// circuitBreaker pauses the syncs after a run of consecutive throttling or
+// server errors from the API server, so a struggling API server is not
+// hammered by every requeued group at once. A threshold of 0 disables it.
+type circuitBreaker struct {
+	threshold int
+	coolDown  time.Duration
+
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, coolDown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, coolDown: coolDown}
+}
+
+// wait blocks while the breaker is open. It returns early with the context's
+// error when the context is cancelled, so an open breaker never holds up
+// shutdown.
+func (b *circuitBreaker) wait(ctx context.Context) error {
+	b.lock.Lock()
+	remaining := time.Until(b.openUntil)
+	b.lock.Unlock()
+	if remaining <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// record updates the breaker with the outcome of a sync. Any outcome other
+// than a throttling or server error ends the run of failures.
+func (b *circuitBreaker) record(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !isServerError(err) {
+		if b.failures >= b.threshold {
+			klog.Infof("API server errors stopped, resuming normal syncs")
+			metrics.APICircuitOpen.Set(0)
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.coolDown)
+		klog.Warningf("%d consecutive API server errors, pausing syncs for %v: %v", b.failures, b.coolDown, err)
+		metrics.APICircuitOpen.Set(1)
+	}
+}
+
+// isServerError reports whether err is the API server throttling the
+// controller or failing on its side.
+func isServerError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.IsTooManyRequests(err) || errors.IsServerTimeout(err) || errors.IsTimeout(err) {
+		return true
+	}
+	if status, ok := err.(errors.APIStatus); ok {
+		return status.Status().Code >= 500
+	}
+	return false
+}
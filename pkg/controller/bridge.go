@@ -0,0 +1,246 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/liabio/ingressgroup/pkg/features"
+	"hash/fnv"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"k8s.io/klog"
+)
+
+// An Ingress can only route to services of its own namespace. With
+// --allow-cross-namespace, a service of another namespace is reached through
+// a bridge: an ExternalName Service in the group's namespace that resolves to
+// the remote service's cluster DNS name, <service>.<namespace>.svc.<domain>.
+// ingress-nginx resolves that name itself, so traffic goes to the remote
+// service's cluster IP rather than straight to its endpoints.
+//
+// Bridges are labeled and owned like the generated Ingresses: they are
+// garbage collected along with the group, and a bridge the group no longer
+// references is deleted once the Ingresses stop routing to it.
+//
+// With --ingress-namespace the Ingresses live in a namespace of their own, so
+// every service of a group is bridged there, its own and its selector
+// Services included. Those bridges carry no owner reference and are deleted
+// with the Ingresses when the group is, see CleanupFinalizer.
+
+// bridgeServiceNamePrefixMax is the longest group name prefix of a bridge
+// Service name, whose -bridge- and hash suffix take 16 characters.
+const bridgeServiceNamePrefixMax = validation.DNS1035LabelMaxLength - 16
+
+// bridgeServiceName returns the name of the Service bridging the given
+// namespace, where the Ingresses of the group live, to the service in another
+// namespace. It is derived from a hash of the remote service so it stays
+// within the Service name length limit. Longer group names are truncated, and
+// then hashed along with the remote service so two groups sharing the
+// truncated prefix get distinct bridges; so is the namespace of a group whose
+// bridges live elsewhere, where groups of other namespaces put theirs too.
+func bridgeServiceName(ig *v1.IngressGroup, namespace string, item v1.ServiceItem) string {
+	h := fnv.New32a()
+	prefix := ig.Name
+	if namespace != ig.Namespace {
+		h.Write([]byte(ig.Namespace + "/"))
+	}
+	if len(prefix) > bridgeServiceNamePrefixMax {
+		prefix = prefix[:bridgeServiceNamePrefixMax]
+		h.Write([]byte(ig.Name + "/"))
+	}
+	h.Write([]byte(item.Namespace + "/" + item.Name))
+	return fmt.Sprintf("%s-bridge-%08x", prefix, h.Sum32())
+}
+
+// newBridgeService returns the ExternalName Service bridging the group's
+// namespace to the remote service, exposing the same ports.
+func newBridgeService(ig *v1.IngressGroup, name string, remote *corev1.Service, clusterDomain string) *corev1.Service {
+	var ports []corev1.ServicePort
+	for _, port := range remote.Spec.Ports {
+		ports = append(ports, corev1.ServicePort{
+			Name:     port.Name,
+			Protocol: port.Protocol,
+			Port:     port.Port,
+			// The API server defaults the target port to the port; setting
+			// it keeps the existing bridge equal to the desired one.
+			TargetPort: intstr.FromInt(int(port.Port)),
+		})
+	}
+
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ig.Namespace,
+			Labels: map[string]string{
+				IngressGroupLabel: ig.Name,
+			},
+			Annotations: map[string]string{
+				ownerAnnotation: ig.Namespace + "/" + ig.Name,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(ig, v1.SchemeGroupVersion.WithKind("IngressGroup")),
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:         corev1.ServiceTypeExternalName,
+			ExternalName: fmt.Sprintf("%s.%s.svc.%s", remote.Name, remote.Namespace, clusterDomain),
+			Ports:        ports,
+		},
+	}
+}
+
+// applyService creates the Service generated for the group, a bridge or a
+// selector Service, or updates the existing one if it differs. An existing
+// Service that was not created for the group is left alone.
+func (r *Reconciler) applyService(ig *v1.IngressGroup, svc *corev1.Service) error {
+	svc.Labels[managedByLabel] = r.config.ControllerName
+	svcClient := r.kubeClient.CoreV1().Services(svc.Namespace)
+
+	existing, err := svcClient.Get(svc.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		if r.observing("ingress group %v/%v: would create service %v", ig.Namespace, ig.Name, svc.Name) {
+			return nil
+		}
+		if err := r.writes.do(func() error {
+			_, err := svcClient.Create(svc)
+			return err
+		}); err != nil {
+			return err
+		}
+		r.recorder.Eventf(ig, corev1.EventTypeNormal, "ServiceCreated", "Created service %v", svc.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !r.managedBy(existing, ig) {
+		return &nameConflictError{kind: "service", name: svc.Name}
+	}
+
+	if existing.Spec.Type == svc.Spec.Type &&
+		existing.Spec.ExternalName == svc.Spec.ExternalName &&
+		apiequality.Semantic.DeepEqual(existing.Spec.Selector, svc.Spec.Selector) &&
+		apiequality.Semantic.DeepEqual(existing.Spec.Ports, svc.Spec.Ports) &&
+		apiequality.Semantic.DeepEqual(existing.Labels, svc.Labels) &&
+		apiequality.Semantic.DeepEqual(existing.Annotations, svc.Annotations) {
+		return nil
+	}
+
+	existing = existing.DeepCopy()
+	existing.Labels = svc.Labels
+	existing.Annotations = svc.Annotations
+	existing.OwnerReferences = svc.OwnerReferences
+	existing.Spec.Type = svc.Spec.Type
+	existing.Spec.ExternalName = svc.Spec.ExternalName
+	existing.Spec.Selector = svc.Spec.Selector
+	existing.Spec.Ports = svc.Spec.Ports
+	if r.observing("ingress group %v/%v: would update service %v", ig.Namespace, ig.Name, svc.Name) {
+		return nil
+	}
+	if err := r.writes.do(func() error {
+		_, err := svcClient.Update(existing)
+		return err
+	}); err != nil {
+		return err
+	}
+	r.recorder.Eventf(ig, corev1.EventTypeNormal, "ServiceUpdated", "Updated service %v", svc.Name)
+	return nil
+}
+
+// bridgeServiceNames returns the names of the bridge Services the group
+// needs in the namespace of its Ingresses.
+func (r *Reconciler) bridgeServiceNames(ig *v1.IngressGroup) sets.String {
+	names := sets.NewString()
+	namespace := r.ingressNamespace(ig)
+	for _, item := range ig.Spec.Services {
+		if len(item.Selector) > 0 {
+			if namespace != ig.Namespace && r.config.FeatureGates.Enabled(features.SelectorServices) {
+				names.Insert(bridgeServiceName(ig, namespace, selectorItem(ig, item)))
+			}
+			continue
+		}
+		if r.bridged(ig, item) {
+			names.Insert(bridgeServiceName(ig, namespace, item))
+		}
+	}
+	return names
+}
+
+// bridged reports whether the service, which the item names, is reached
+// through a bridge: it lives outside the namespace of the Ingresses and, if it
+// also lives outside the group's, cross-namespace services are enabled.
+func (r *Reconciler) bridged(ig *v1.IngressGroup, item v1.ServiceItem) bool {
+	if item.Namespace == r.ingressNamespace(ig) {
+		return false
+	}
+	return item.Namespace == ig.Namespace || r.config.FeatureGates.Enabled(features.CrossNamespace)
+}
+
+// selectorItem returns the item naming the selector Service of the item with
+// a selector.
+func selectorItem(ig *v1.IngressGroup, item v1.ServiceItem) v1.ServiceItem {
+	item.Name, item.Namespace, item.Selector = selectorServiceName(ig, item.Selector), ig.Namespace, nil
+	return item
+}
+
+// generatedServiceNames returns the names of the bridge and selector
+// Services the group needs.
+func (r *Reconciler) generatedServiceNames(ig *v1.IngressGroup) sets.String {
+	names := r.bridgeServiceNames(ig)
+	for name := range r.selectorServices(ig) {
+		names.Insert(name)
+	}
+	return names
+}
+
+// pruneServices deletes the bridge and selector Services of the group that
+// none of its services reference anymore.
+func (r *Reconciler) pruneServices(ig *v1.IngressGroup) error {
+	desired := sets.NewString()
+	for name := range r.selectorServices(ig) {
+		desired.Insert(name)
+	}
+	bridges := r.bridgeServiceNames(ig)
+	if namespace := r.ingressNamespace(ig); namespace != ig.Namespace {
+		if err := r.pruneServicesIn(ig, namespace, bridges); err != nil {
+			return err
+		}
+	} else {
+		desired = desired.Union(bridges)
+	}
+	return r.pruneServicesIn(ig, ig.Namespace, desired)
+}
+
+// pruneServicesIn deletes the Services generated for the group in the
+// namespace that are not desired.
+func (r *Reconciler) pruneServicesIn(ig *v1.IngressGroup, namespace string, desired sets.String) error {
+	svcClient := r.kubeClient.CoreV1().Services(namespace)
+	list, err := svcClient.List(metav1.ListOptions{
+		LabelSelector: labels.Set{IngressGroupLabel: ig.Name}.String(),
+	})
+	if err != nil {
+		return err
+	}
+	for i := range list.Items {
+		svc := &list.Items[i]
+		if desired.Has(svc.Name) || !r.generatedFor(svc, ig) {
+			continue
+		}
+		if r.observing("ingress group %v/%v: would delete stale service %v", ig.Namespace, ig.Name, svc.Name) {
+			continue
+		}
+		klog.Infof("ingress group %v/%v: deleting stale service %v", ig.Namespace, ig.Name, svc.Name)
+		if err := r.writes.do(func() error {
+			return svcClient.Delete(svc.Name, r.deleteOptions())
+		}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		r.recorder.Eventf(ig, corev1.EventTypeNormal, "ServiceDeleted", "Deleted service %v", svc.Name)
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"github.com/liabio/ingressgroup/pkg/features"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewBridgeService(t *testing.T) {
+	remote := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "backend"},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports: []corev1.ServicePort{
+				{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080},
+			},
+		},
+	}
+	ig := newTestGroup("shop")
+	svc := newBridgeService(ig, "shop-bridge", remote, "cluster.local")
+
+	if svc.Namespace != testNamespace {
+		t.Errorf("got namespace %v, want %v", svc.Namespace, testNamespace)
+	}
+	if svc.Spec.Type != corev1.ServiceTypeExternalName || svc.Spec.ExternalName != "web.backend.svc.cluster.local" {
+		t.Errorf("got %v service to %q, want an ExternalName service to web.backend.svc.cluster.local",
+			svc.Spec.Type, svc.Spec.ExternalName)
+	}
+	wantPorts := []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt(80)}}
+	if !reflect.DeepEqual(svc.Spec.Ports, wantPorts) {
+		t.Errorf("got ports %v, want %v", svc.Spec.Ports, wantPorts)
+	}
+	if !metav1.IsControlledBy(svc, ig) {
+		t.Errorf("bridge service is not controlled by the group")
+	}
+}
+
+func TestBridgeServiceName(t *testing.T) {
+	item := v1.ServiceItem{Name: "web", Namespace: "backend"}
+	tests := []struct {
+		name       string
+		groupName  string
+		wantPrefix string
+	}{
+		{name: "short name", groupName: "shop", wantPrefix: "shop-bridge-"},
+		{
+			name:       "name at the limit",
+			groupName:  strings.Repeat("a", bridgeServiceNamePrefixMax),
+			wantPrefix: strings.Repeat("a", bridgeServiceNamePrefixMax) + "-bridge-",
+		},
+		{
+			name:       "name over the limit",
+			groupName:  strings.Repeat("a", validation.DNS1123SubdomainMaxLength),
+			wantPrefix: strings.Repeat("a", bridgeServiceNamePrefixMax) + "-bridge-",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := bridgeServiceName(newTestGroup(test.groupName), testNamespace, item)
+			if !strings.HasPrefix(got, test.wantPrefix) {
+				t.Errorf("got %q, want prefix %q", got, test.wantPrefix)
+			}
+			if errs := validation.IsDNS1035Label(got); len(errs) > 0 {
+				t.Errorf("%q is not a valid service name: %v", got, errs)
+			}
+		})
+	}
+
+	long := strings.Repeat("a", bridgeServiceNamePrefixMax)
+	if bridgeServiceName(newTestGroup(long+"-one"), testNamespace, item) == bridgeServiceName(newTestGroup(long+"-two"), testNamespace, item) {
+		t.Errorf("groups sharing a truncated name got the same bridge service")
+	}
+}
+
+func TestReconcileCrossNamespace(t *testing.T) {
+	shop := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: "backend", Port: 80})
+	bridge := bridgeServiceName(shop, testNamespace, shop.Spec.Services[0])
+	remote := newTestService("web", 80)
+	remote.Namespace = "backend"
+	stale := newBridgeService(shop, "shop-bridge-stale", remote, "cluster.local")
+
+	tests := []struct {
+		name          string
+		crossNS       bool
+		objects       []runtime.Object
+		wantIngresses map[string][]string
+		wantServices  map[string]string
+	}{
+		{
+			name:          "skipped without the feature gate",
+			objects:       []runtime.Object{shop, remote},
+			wantIngresses: map[string][]string{},
+			wantServices:  map[string]string{},
+		},
+		{
+			name:    "routed through a bridge",
+			crossNS: true,
+			objects: []runtime.Object{shop, remote},
+			wantIngresses: map[string][]string{
+				"shop": {"/->" + bridge + ":80"},
+			},
+			wantServices: map[string]string{
+				bridge: "web.backend.svc.cluster.local",
+			},
+		},
+		{
+			name:    "stale bridge deleted",
+			crossNS: true,
+			objects: []runtime.Object{shop, remote, stale},
+			wantIngresses: map[string][]string{
+				"shop": {"/->" + bridge + ":80"},
+			},
+			wantServices: map[string]string{
+				bridge: "web.backend.svc.cluster.local",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gates := features.NewFeatureGate()
+			gates.SetEnabled(features.CrossNamespace, test.crossNS)
+			f := newFixture(t, Config{ControllerName: "ingressgroup", FeatureGates: gates, ClusterDomain: "cluster.local"},
+				test.objects...)
+			f.reconcile(t, "shop")
+
+			if got := f.ingresses(t); !reflect.DeepEqual(got, test.wantIngresses) {
+				t.Errorf("got ingresses %v, want %v", got, test.wantIngresses)
+			}
+			if got := f.services(t); !reflect.DeepEqual(got, test.wantServices) {
+				t.Errorf("got services %v, want %v", got, test.wantServices)
+			}
+		})
+	}
+}
+
+func TestReconcileBridgeUnchanged(t *testing.T) {
+	shop := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: "backend", Port: 80})
+	remote := newTestService("web", 80)
+	remote.Namespace = "backend"
+	gates := features.NewFeatureGate()
+	gates.SetEnabled(features.CrossNamespace, true)
+	f := newFixture(t, Config{ControllerName: "ingressgroup", FeatureGates: gates, ClusterDomain: "cluster.local"},
+		shop, remote)
+	f.reconcile(t, "shop")
+
+	// Default the target ports of the bridge as the API server does.
+	bridge, err := f.kubeClient.CoreV1().Services(testNamespace).Get(bridgeServiceName(shop, testNamespace, shop.Spec.Services[0]), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get the bridge service: %v", err)
+	}
+	for i := range bridge.Spec.Ports {
+		if bridge.Spec.Ports[i].TargetPort == (intstr.IntOrString{}) {
+			bridge.Spec.Ports[i].TargetPort = intstr.FromInt(int(bridge.Spec.Ports[i].Port))
+		}
+	}
+	if _, err := f.kubeClient.CoreV1().Services(testNamespace).Update(bridge); err != nil {
+		t.Fatalf("failed to update the bridge service: %v", err)
+	}
+	f.refreshCaches(t)
+	f.kubeClient.ClearActions()
+	f.reconcile(t, "shop")
+
+	for _, action := range f.kubeClient.Actions() {
+		if action.GetVerb() == "update" && action.GetResource().Resource == "services" {
+			t.Errorf("got the bridge service updated on the second sync, want it left alone")
+		}
+	}
+}
+
+func TestReconcileUnreadableService(t *testing.T) {
+	remote := newTestService("web", 80)
+	remote.Namespace = "backend"
+	tests := []struct {
+		name string
+		// watched are the namespaces the Services are cached in, all if
+		// empty.
+		watched []string
+		// forbidden makes the API server forbid reading the Services.
+		forbidden     bool
+		objects       []runtime.Object
+		wantErr       bool
+		wantForbidden corev1.ConditionStatus
+		wantReason    string
+		wantRequeue   time.Duration
+	}{
+		{
+			name:          "found",
+			objects:       []runtime.Object{remote},
+			wantForbidden: corev1.ConditionUnknown,
+			wantReason:    v1.ReasonReady,
+		},
+		{
+			name:          "not found",
+			wantErr:       true,
+			wantForbidden: corev1.ConditionUnknown,
+			wantReason:    v1.ReasonSyncFailed,
+		},
+		{
+			name:          "namespace not watched",
+			watched:       []string{testNamespace},
+			objects:       []runtime.Object{remote},
+			wantForbidden: corev1.ConditionUnknown,
+			wantReason:    v1.ReasonReady,
+		},
+		{
+			name:          "namespace not watched and forbidden",
+			watched:       []string{testNamespace},
+			forbidden:     true,
+			objects:       []runtime.Object{remote},
+			wantForbidden: corev1.ConditionTrue,
+			wantReason:    v1.ReasonServiceForbidden,
+			wantRequeue:   unresolvedRequeue,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gates := features.NewFeatureGate()
+			gates.SetEnabled(features.CrossNamespace, true)
+			objects := append([]runtime.Object{newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: "backend", Port: 80})},
+				test.objects...)
+			f := newFixture(t, Config{ControllerName: "ingressgroup", FeatureGates: gates, ClusterDomain: "cluster.local"},
+				objects...)
+			if len(test.watched) > 0 {
+				listers := map[string]corelisters.ServiceLister{}
+				for _, namespace := range test.watched {
+					listers[namespace] = f.reconciler.svcLister
+				}
+				f.reconciler.svcLister = NewMultiNamespaceServiceLister(listers, f.kubeClient.CoreV1())
+			}
+			if test.forbidden {
+				f.kubeClient.PrependReactor("get", "services", func(action clienttesting.Action) (bool, runtime.Object, error) {
+					get := action.(clienttesting.GetAction)
+					return true, nil, errors.NewForbidden(corev1.Resource("services"), get.GetName(), fmt.Errorf("RBAC denied"))
+				})
+			}
+
+			requeue, err := f.reconciler.Reconcile(context.Background(), testNamespace+"/shop")
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if got := f.condition(t, "shop", v1.IngressGroupServiceForbidden); got != test.wantForbidden {
+				t.Errorf("got ServiceForbidden condition %v, want %v", got, test.wantForbidden)
+			}
+			if got := f.reason(t, "shop", v1.IngressGroupReady); got != test.wantReason {
+				t.Errorf("got Ready reason %q, want %q", got, test.wantReason)
+			}
+			if requeue != test.wantRequeue {
+				t.Errorf("got requeue after %v, want %v", requeue, test.wantRequeue)
+			}
+		})
+	}
+}
+
+func TestReconcileManagedResources(t *testing.T) {
+	shop := newTestGroup("shop",
+		v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80},
+		v1.ServiceItem{Name: "api", Namespace: testNamespace, Port: 8080, Path: "/api", RewriteTarget: "/"},
+		v1.ServiceItem{Name: "search", Namespace: "backend", Port: 80, Path: "/search"})
+	bridge := bridgeServiceName(shop, testNamespace, shop.Spec.Services[2])
+	rewrite := ingressName(shop, ingressKey{rewriteTarget: "/"})
+	remote := newTestService("search", 80)
+	remote.Namespace = "backend"
+	staleIngress := newTestIngress("shop-stale", "shop", shop, "/old", "web", 80)
+	staleBridge := newBridgeService(shop, "shop-bridge-stale", remote, "cluster.local")
+
+	gates := features.NewFeatureGate()
+	gates.SetEnabled(features.CrossNamespace, true)
+	f := newFixture(t, Config{ControllerName: "ingressgroup", FeatureGates: gates, ClusterDomain: "cluster.local"},
+		shop, newTestService("web", 80), newTestService("api", 8080), remote, staleIngress, staleBridge)
+	f.reconcile(t, "shop")
+
+	ig, err := f.versionedClient.CrV1().IngressGroups(testNamespace).Get("shop", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get the group: %v", err)
+	}
+	var got []string
+	for _, ref := range ig.Status.ManagedResources {
+		got = append(got, ref.APIVersion+"/"+ref.Kind+"/"+ref.Name)
+	}
+	sort.Strings(got)
+	want := []string{
+		"extensions/v1beta1/Ingress/" + rewrite,
+		"extensions/v1beta1/Ingress/shop",
+		"v1/Service/" + bridge,
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got managed resources %v, want %v", got, want)
+	}
+
+	copied := ig.Status.DeepCopy()
+	copied.ManagedResources[0].Name = "changed"
+	if ig.Status.ManagedResources[0].Name == "changed" {
+		t.Errorf("DeepCopy shares the managed resources")
+	}
+}
@@ -0,0 +1,153 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"strings"
+)
+
+// knownConditionTypes are the condition types the controller sets. It owns
+// the conditions of IngressGroups, so any other type is stale.
+var knownConditionTypes = map[v1.IngressGroupConditionType]bool{
+	v1.IngressGroupReady:               true,
+	v1.IngressGroupBasicAuthReady:      true,
+	v1.IngressGroupSnippetsAccepted:    true,
+	v1.IngressGroupValid:               true,
+	v1.IngressGroupNameConflict:        true,
+	v1.IngressGroupAddressed:           true,
+	v1.IngressGroupAdmitted:            true,
+	v1.IngressGroupServiceForbidden:    true,
+	v1.IngressGroupFeatureDisabled:     true,
+	v1.IngressGroupPortsResolved:       true,
+	v1.IngressGroupOutdatedCRD:         true,
+	v1.IngressGroupPrunePending:        true,
+	v1.IngressGroupSynced:              true,
+	v1.IngressGroupDegraded:            true,
+	v1.IngressGroupTLSReady:            true,
+	v1.IngressGroupAnnotationsAccepted: true,
+}
+
+// legacyReasons maps the reasons previous versions of the controller set to
+// the ones it sets now, by condition type.
+var legacyReasons = map[v1.IngressGroupConditionType]map[string]string{
+	v1.IngressGroupNameConflict: {"IngressNotManaged": v1.ReasonNotManaged},
+}
+
+// pruneConditions drops the conditions of unknown types, such as types a
+// previous version of the controller set, and all but the first condition of
+// each type, so the list holds at most one condition per known type. The
+// conditions left are migrated from the format of previous versions: legacy
+// reasons are renamed, statuses are normalized to True, False or Unknown and
+// a missing transition time is set to now.
+func pruneConditions(status *v1.IngressGroupStatus) {
+	seen := map[v1.IngressGroupConditionType]bool{}
+	var conditions []v1.IngressGroupCondition
+	for _, cond := range status.Conditions {
+		if !knownConditionTypes[cond.Type] || seen[cond.Type] {
+			continue
+		}
+		seen[cond.Type] = true
+		conditions = append(conditions, migrateCondition(cond))
+	}
+	status.Conditions = conditions
+}
+
+// migrateCondition returns the condition in the format the controller sets.
+func migrateCondition(cond v1.IngressGroupCondition) v1.IngressGroupCondition {
+	if reason, ok := legacyReasons[cond.Type][cond.Reason]; ok {
+		cond.Reason = reason
+	}
+	switch {
+	case strings.EqualFold(string(cond.Status), string(corev1.ConditionTrue)):
+		cond.Status = corev1.ConditionTrue
+	case strings.EqualFold(string(cond.Status), string(corev1.ConditionFalse)):
+		cond.Status = corev1.ConditionFalse
+	default:
+		cond.Status = corev1.ConditionUnknown
+	}
+	if cond.LastTransitionTime.IsZero() {
+		cond.LastTransitionTime = metav1.Now()
+	}
+	return cond
+}
+
+// setCondition adds or updates the condition of the given type. The
+// transition time only moves when the condition's status changes.
+func setCondition(status *v1.IngressGroupStatus, condType v1.IngressGroupConditionType, condStatus corev1.ConditionStatus, reason, message string) {
+	for i := range status.Conditions {
+		cond := &status.Conditions[i]
+		if cond.Type != condType {
+			continue
+		}
+		if cond.Status != condStatus {
+			cond.Status = condStatus
+			cond.LastTransitionTime = metav1.Now()
+		}
+		cond.Reason = reason
+		cond.Message = message
+		return
+	}
+
+	status.Conditions = append(status.Conditions, v1.IngressGroupCondition{
+		Type:               condType,
+		Status:             condStatus,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// removeCondition drops the condition of the given type.
+func removeCondition(status *v1.IngressGroupStatus, condType v1.IngressGroupConditionType) {
+	var conditions []v1.IngressGroupCondition
+	for _, cond := range status.Conditions {
+		if cond.Type != condType {
+			conditions = append(conditions, cond)
+		}
+	}
+	status.Conditions = conditions
+}
+
+// findCondition returns the condition of the given type, nil if there is
+// none.
+func findCondition(status *v1.IngressGroupStatus, condType v1.IngressGroupConditionType) *v1.IngressGroupCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == condType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// setDegraded sets the Degraded condition from the conditions reporting
+// parts of the spec left out of the generated objects.
+func setDegraded(status *v1.IngressGroupStatus) {
+	if cond := findCondition(status, v1.IngressGroupFeatureDisabled); cond != nil && cond.Status == corev1.ConditionTrue {
+		setCondition(status, v1.IngressGroupDegraded, corev1.ConditionTrue, v1.ReasonFeatureDisabled, cond.Message)
+		return
+	}
+	if cond := findCondition(status, v1.IngressGroupSnippetsAccepted); cond != nil && cond.Status == corev1.ConditionFalse {
+		setCondition(status, v1.IngressGroupDegraded, corev1.ConditionTrue, v1.ReasonSnippetsDisabled, cond.Message)
+		return
+	}
+	if cond := findCondition(status, v1.IngressGroupTLSReady); cond != nil && cond.Status == corev1.ConditionFalse {
+		setCondition(status, v1.IngressGroupDegraded, corev1.ConditionTrue, cond.Reason, cond.Message)
+		return
+	}
+	if cond := findCondition(status, v1.IngressGroupAnnotationsAccepted); cond != nil && cond.Status == corev1.ConditionFalse {
+		setCondition(status, v1.IngressGroupDegraded, corev1.ConditionTrue, cond.Reason, cond.Message)
+		return
+	}
+	setCondition(status, v1.IngressGroupDegraded, corev1.ConditionFalse, v1.ReasonFullyRendered, "")
+}
+
+// isConditionTrue reports whether the condition of the given type is True.
+func isConditionTrue(status *v1.IngressGroupStatus, condType v1.IngressGroupConditionType) bool {
+	for _, cond := range status.Conditions {
+		if cond.Type == condType {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
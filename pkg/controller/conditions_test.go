@@ -0,0 +1,215 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSetCondition(t *testing.T) {
+	before := metav1.NewTime(time.Now().Add(-time.Hour))
+	tests := []struct {
+		name   string
+		status corev1.ConditionStatus
+		reason string
+		// moved tells whether the transition time of Ready moves.
+		moved bool
+	}{
+		{name: "same status and reason", status: corev1.ConditionTrue, reason: "Reconciled"},
+		{name: "same status, new reason", status: corev1.ConditionTrue, reason: "Recovered"},
+		{name: "status flips", status: corev1.ConditionFalse, reason: "Degraded", moved: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status := &v1.IngressGroupStatus{Conditions: []v1.IngressGroupCondition{
+				{Type: v1.IngressGroupReady, Status: corev1.ConditionTrue, Reason: "Reconciled", LastTransitionTime: before},
+				{Type: v1.IngressGroupValid, Status: corev1.ConditionTrue, LastTransitionTime: before},
+			}}
+			setCondition(status, v1.IngressGroupReady, test.status, test.reason, "message")
+
+			if len(status.Conditions) != 2 {
+				t.Fatalf("got %v conditions, want the Ready condition updated in place", len(status.Conditions))
+			}
+			cond := findCondition(status, v1.IngressGroupReady)
+			if cond.Status != test.status || cond.Reason != test.reason || cond.Message != "message" {
+				t.Errorf("got condition %+v, want status %v and reason %v", cond, test.status, test.reason)
+			}
+			if moved := !cond.LastTransitionTime.Equal(&before); moved != test.moved {
+				t.Errorf("transition time moved = %v, want %v", moved, test.moved)
+			}
+		})
+	}
+}
+
+func TestSetConditionFlapping(t *testing.T) {
+	before := metav1.NewTime(time.Now().Add(-time.Hour))
+	status := &v1.IngressGroupStatus{Conditions: []v1.IngressGroupCondition{
+		{Type: v1.IngressGroupReady, Status: corev1.ConditionTrue, LastTransitionTime: before},
+		{Type: v1.IngressGroupDegraded, Status: corev1.ConditionFalse, LastTransitionTime: before},
+	}}
+	// Reconciles alternating between reasons without changing the statuses.
+	for i := 0; i < 10; i++ {
+		reason := "Reconciled"
+		if i%2 == 1 {
+			reason = "Requeued"
+		}
+		setCondition(status, v1.IngressGroupReady, corev1.ConditionTrue, reason, "")
+		setCondition(status, v1.IngressGroupDegraded, corev1.ConditionFalse, reason, "")
+	}
+
+	if len(status.Conditions) != 2 {
+		t.Fatalf("got %v conditions, want 2", len(status.Conditions))
+	}
+	for _, cond := range status.Conditions {
+		if !cond.LastTransitionTime.Equal(&before) {
+			t.Errorf("got the transition time of %v moved to %v, want it kept", cond.Type, cond.LastTransitionTime)
+		}
+	}
+}
+
+func TestPruneConditions(t *testing.T) {
+	now := metav1.Now()
+	condition := func(condType v1.IngressGroupConditionType, reason string) v1.IngressGroupCondition {
+		return v1.IngressGroupCondition{Type: condType, Status: corev1.ConditionTrue, Reason: reason, LastTransitionTime: now}
+	}
+	tests := []struct {
+		name       string
+		conditions []v1.IngressGroupCondition
+		want       []v1.IngressGroupCondition
+	}{
+		{name: "none"},
+		{
+			name:       "known types",
+			conditions: []v1.IngressGroupCondition{condition(v1.IngressGroupReady, "A"), condition(v1.IngressGroupValid, "B")},
+			want:       []v1.IngressGroupCondition{condition(v1.IngressGroupReady, "A"), condition(v1.IngressGroupValid, "B")},
+		},
+		{
+			name:       "unknown type",
+			conditions: []v1.IngressGroupCondition{condition("Progressing", "A"), condition(v1.IngressGroupReady, "B")},
+			want:       []v1.IngressGroupCondition{condition(v1.IngressGroupReady, "B")},
+		},
+		{
+			name:       "duplicate type",
+			conditions: []v1.IngressGroupCondition{condition(v1.IngressGroupReady, "A"), condition(v1.IngressGroupValid, "B"), condition(v1.IngressGroupReady, "C")},
+			want:       []v1.IngressGroupCondition{condition(v1.IngressGroupReady, "A"), condition(v1.IngressGroupValid, "B")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status := &v1.IngressGroupStatus{Conditions: test.conditions}
+			pruneConditions(status)
+			if !reflect.DeepEqual(status.Conditions, test.want) {
+				t.Errorf("got conditions %+v, want %+v", status.Conditions, test.want)
+			}
+		})
+	}
+}
+
+func TestMigrateCondition(t *testing.T) {
+	before := metav1.NewTime(time.Now().Add(-time.Hour))
+	tests := []struct {
+		name       string
+		cond       v1.IngressGroupCondition
+		wantStatus corev1.ConditionStatus
+		wantReason string
+		// wantMoved tells whether the transition time is set to now.
+		wantMoved bool
+	}{
+		{
+			name:       "current format",
+			cond:       v1.IngressGroupCondition{Type: v1.IngressGroupNameConflict, Status: corev1.ConditionTrue, Reason: v1.ReasonNotManaged, LastTransitionTime: before},
+			wantStatus: corev1.ConditionTrue,
+			wantReason: v1.ReasonNotManaged,
+		},
+		{
+			name:       "legacy reason",
+			cond:       v1.IngressGroupCondition{Type: v1.IngressGroupNameConflict, Status: corev1.ConditionTrue, Reason: "IngressNotManaged", LastTransitionTime: before},
+			wantStatus: corev1.ConditionTrue,
+			wantReason: v1.ReasonNotManaged,
+		},
+		{
+			name:       "legacy reason of another type",
+			cond:       v1.IngressGroupCondition{Type: v1.IngressGroupReady, Status: corev1.ConditionTrue, Reason: "IngressNotManaged", LastTransitionTime: before},
+			wantStatus: corev1.ConditionTrue,
+			wantReason: "IngressNotManaged",
+		},
+		{
+			name:       "lowercase status",
+			cond:       v1.IngressGroupCondition{Type: v1.IngressGroupReady, Status: "false", Reason: "Failed", LastTransitionTime: before},
+			wantStatus: corev1.ConditionFalse,
+			wantReason: "Failed",
+		},
+		{
+			name:       "unknown status",
+			cond:       v1.IngressGroupCondition{Type: v1.IngressGroupReady, Status: "yes", LastTransitionTime: before},
+			wantStatus: corev1.ConditionUnknown,
+		},
+		{
+			name:       "missing transition time",
+			cond:       v1.IngressGroupCondition{Type: v1.IngressGroupReady, Status: corev1.ConditionTrue},
+			wantStatus: corev1.ConditionTrue,
+			wantMoved:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := migrateCondition(test.cond)
+			if got.Status != test.wantStatus || got.Reason != test.wantReason {
+				t.Errorf("got status %v and reason %q, want %v and %q", got.Status, got.Reason, test.wantStatus, test.wantReason)
+			}
+			if moved := !got.LastTransitionTime.Equal(&test.cond.LastTransitionTime); moved != test.wantMoved {
+				t.Errorf("transition time moved = %v, want %v", moved, test.wantMoved)
+			}
+			if got.LastTransitionTime.IsZero() {
+				t.Errorf("got a zero transition time")
+			}
+		})
+	}
+}
+
+func TestReconcileLegacyStatus(t *testing.T) {
+	shop := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80})
+	// The status as an older controller wrote it.
+	shop.Status.Conditions = []v1.IngressGroupCondition{
+		{Type: "Progressing", Status: corev1.ConditionTrue, Reason: "Syncing"},
+		{Type: v1.IngressGroupReady, Status: "true", Reason: "Reconciled"},
+		{Type: v1.IngressGroupReady, Status: corev1.ConditionFalse, Reason: "Failed"},
+		{Type: v1.IngressGroupValid, Status: "TRUE"},
+	}
+	f := newFixture(t, Config{ControllerName: "ingressgroup"}, shop, newTestService("web", 80))
+	f.reconcile(t, "shop")
+
+	ig, err := f.versionedClient.CrV1().IngressGroups(testNamespace).Get("shop", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get the group: %v", err)
+	}
+	seen := map[v1.IngressGroupConditionType]bool{}
+	for _, cond := range ig.Status.Conditions {
+		if !knownConditionTypes[cond.Type] {
+			t.Errorf("got condition of unknown type %v", cond.Type)
+		}
+		if seen[cond.Type] {
+			t.Errorf("got %v condition more than once", cond.Type)
+		}
+		seen[cond.Type] = true
+		switch cond.Status {
+		case corev1.ConditionTrue, corev1.ConditionFalse, corev1.ConditionUnknown:
+		default:
+			t.Errorf("got %v condition with status %q", cond.Type, cond.Status)
+		}
+		if cond.LastTransitionTime.IsZero() {
+			t.Errorf("got %v condition without transition time", cond.Type)
+		}
+	}
+	for _, condType := range []v1.IngressGroupConditionType{v1.IngressGroupReady, v1.IngressGroupValid} {
+		if got := f.condition(t, "shop", condType); got != corev1.ConditionTrue {
+			t.Errorf("got %v condition %v, want %v", condType, got, corev1.ConditionTrue)
+		}
+	}
+}
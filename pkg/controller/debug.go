@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"encoding/json"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	extensionslisters "k8s.io/client-go/listers/extensions/v1beta1"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	iglisters "k8s.io/ingress-nginx/pkg/client/listers/ingressgroup/v1"
+	"net/http"
+	"sort"
+)
+
+// groupState is the controller's view of an IngressGroup as served on
+// /debug/state.
+type groupState struct {
+	IngressGroup *v1.IngressGroup `json:"ingressGroup"`
+	Ingresses    []ingressState   `json:"ingresses"`
+}
+
+// ingressState describes an Ingress generated for an IngressGroup. An Ingress
+// is ready once the ingress controller has published its address.
+type ingressState struct {
+	Name  string `json:"name"`
+	Ready bool   `json:"ready"`
+}
+
+// DebugStateHandler serves every IngressGroup held by the informer cache along
+// with the Ingresses generated for it, in the ingress namespace if set. It
+// only reads from the listers so it shows what the controller sees, which may
+// lag behind the API server.
+func DebugStateHandler(igLister iglisters.IngressGroupLister, ingLister extensionslisters.IngressLister, ingressNamespace string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groups, err := igLister.List(labels.Everything())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sort.Slice(groups, func(i, j int) bool {
+			if groups[i].Namespace != groups[j].Namespace {
+				return groups[i].Namespace < groups[j].Namespace
+			}
+			return groups[i].Name < groups[j].Name
+		})
+
+		state := make([]groupState, 0, len(groups))
+		for _, ig := range groups {
+			namespace := ig.Namespace
+			if ingressNamespace != "" {
+				namespace = ingressNamespace
+			}
+			ingresses, err := ingLister.Ingresses(namespace).List(labels.SelectorFromSet(labels.Set{IngressGroupLabel: ig.Name}))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			sort.Slice(ingresses, func(i, j int) bool {
+				return ingresses[i].Name < ingresses[j].Name
+			})
+
+			gs := groupState{IngressGroup: ig, Ingresses: []ingressState{}}
+			for _, ing := range ingresses {
+				generated := metav1.IsControlledBy(ing, ig)
+				if namespace != ig.Namespace {
+					// Ingresses placed in another namespace have no owner.
+					owner, _ := OwnerKey(ing)
+					generated = owner == ig.Namespace+"/"+ig.Name
+				}
+				if !generated {
+					continue
+				}
+				gs.Ingresses = append(gs.Ingresses, ingressState{
+					Name:  ing.Name,
+					Ready: len(ing.Status.LoadBalancer.Ingress) > 0,
+				})
+			}
+			state = append(state, gs)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(state); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package controller
+
+import (
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+)
+
+// setDefaults returns a copy of the IngressGroup with the defaults of its
+// optional fields filled in. Groups may reach the controller without passing
+// any webhook, for instance when applied with kubectl --validate=false or
+// while the webhook is down, so the controller defaults them itself rather
+// than rely on it.
+func setDefaults(ig *v1.IngressGroup) *v1.IngressGroup {
+	ig = ig.DeepCopy()
+	defaultPath := ig.Spec.DefaultPath
+	if defaultPath == "" {
+		defaultPath = "/"
+	}
+	for i := range ig.Spec.Services {
+		item := &ig.Spec.Services[i]
+		if item.Path == "" {
+			item.Path = defaultPath
+		}
+		if item.PathType == "" {
+			item.PathType = v1.PathTypePrefix
+		}
+		if len(item.Hosts) == 0 && len(ig.Spec.Hosts) > 0 {
+			item.Hosts = append([]string(nil), ig.Spec.Hosts...)
+		}
+		if item.IngressClassName == "" {
+			item.IngressClassName = ig.Spec.IngressClassName
+		}
+	}
+	return ig
+}
@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"reflect"
+	"testing"
+)
+
+func TestSetDefaults(t *testing.T) {
+	tests := []struct {
+		name string
+		spec v1.IngressGroupSpec
+		want v1.ServiceItem
+	}{
+		{
+			name: "no path fields",
+			spec: v1.IngressGroupSpec{Services: []v1.ServiceItem{{Name: "web"}}},
+			want: v1.ServiceItem{Name: "web", Path: "/", PathType: v1.PathTypePrefix},
+		},
+		{
+			name: "default path of the group",
+			spec: v1.IngressGroupSpec{DefaultPath: "/shop", Services: []v1.ServiceItem{{Name: "web"}}},
+			want: v1.ServiceItem{Name: "web", Path: "/shop", PathType: v1.PathTypePrefix},
+		},
+		{
+			name: "path fields set",
+			spec: v1.IngressGroupSpec{DefaultPath: "/shop", Services: []v1.ServiceItem{
+				{Name: "web", Path: "/api", PathType: v1.PathTypeExact},
+			}},
+			want: v1.ServiceItem{Name: "web", Path: "/api", PathType: v1.PathTypeExact},
+		},
+		{
+			name: "hosts and class of the group",
+			spec: v1.IngressGroupSpec{Hosts: []string{"example.com"}, IngressClassName: "internal", Services: []v1.ServiceItem{{Name: "web"}}},
+			want: v1.ServiceItem{Name: "web", Path: "/", PathType: v1.PathTypePrefix, Hosts: []string{"example.com"}, IngressClassName: "internal"},
+		},
+		{
+			name: "hosts and class of the service",
+			spec: v1.IngressGroupSpec{Hosts: []string{"example.com"}, IngressClassName: "internal", Services: []v1.ServiceItem{
+				{Name: "web", Hosts: []string{"shop.example.com"}, IngressClassName: "external"},
+			}},
+			want: v1.ServiceItem{Name: "web", Path: "/", PathType: v1.PathTypePrefix, Hosts: []string{"shop.example.com"}, IngressClassName: "external"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ig := &v1.IngressGroup{Spec: test.spec}
+			original := ig.DeepCopy()
+			defaulted := setDefaults(ig)
+			if got := defaulted.Spec.Services[0]; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+			if !reflect.DeepEqual(ig, original) {
+				t.Errorf("setDefaults modified the group it was given")
+			}
+		})
+	}
+}
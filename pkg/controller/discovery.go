@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"github.com/liabio/ingressgroup/pkg/features"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"k8s.io/klog"
+	"sort"
+	"strings"
+)
+
+// With the ServiceDiscovery feature gate, the service selector of a group
+// adds the Services it selects to the services of the group on every sync.
+// The Services are read from a cluster-wide cache, and a change to a Service
+// queues the groups selecting it before or after the change.
+
+// SelectsService reports whether the service selector of the group selects
+// the Service. An invalid selector selects nothing.
+func SelectsService(ig *v1.IngressGroup, svc *corev1.Service) bool {
+	selector, namespace, ok := serviceSelector(ig)
+	return ok && svc.Namespace == namespace && selector.Matches(labels.Set(svc.Labels))
+}
+
+// ReferencesService reports whether one of the services of the group is the
+// Service.
+func ReferencesService(ig *v1.IngressGroup, svc *corev1.Service) bool {
+	for _, item := range ig.Spec.Services {
+		if item.Name == svc.Name && item.Namespace == svc.Namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceSelector returns the parsed service selector of the group and the
+// namespace it selects in, false if the group has none or it is invalid.
+func serviceSelector(ig *v1.IngressGroup) (labels.Selector, string, bool) {
+	if ig.Spec.ServiceSelector == nil || ig.Spec.ServiceSelector.Selector == nil {
+		return nil, "", false
+	}
+	selector, err := metav1.LabelSelectorAsSelector(ig.Spec.ServiceSelector.Selector)
+	if err != nil || selector.Empty() {
+		return nil, "", false
+	}
+	namespace := ig.Spec.ServiceSelector.Namespace
+	if namespace == "" {
+		namespace = ig.Namespace
+	}
+	return selector, namespace, true
+}
+
+// discoverServices returns the group with the Services its service selector
+// selects appended to its services, in the order of their names. Each is
+// routed on the path of its path annotation, or else on a path named after
+// it, under the hosts and ingress class of the group; the Services whose path is already taken
+// are skipped. The group is returned as is without the ServiceDiscovery
+// feature gate.
+func (r *Reconciler) discoverServices(ig *v1.IngressGroup) (*v1.IngressGroup, error) {
+	if !r.config.FeatureGates.Enabled(features.ServiceDiscovery) {
+		return ig, nil
+	}
+	selector, namespace, ok := serviceSelector(ig)
+	if !ok {
+		return ig, nil
+	}
+	services, err := r.svcLister.Services(namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+
+	taken := sets.NewString()
+	for _, item := range ig.Spec.Services {
+		taken.Insert(item.Path)
+	}
+	ig = ig.DeepCopy()
+	for _, svc := range services {
+		path := svc.Annotations[ServicePathAnnotation]
+		if path == "" {
+			path = "/" + svc.Name
+		}
+		if !strings.HasPrefix(path, "/") {
+			klog.Warningf("ingress group %v/%v: skipping selected service %v/%v, its path %q does not start with /",
+				ig.Namespace, ig.Name, svc.Namespace, svc.Name, path)
+			continue
+		}
+		if taken.Has(path) {
+			klog.V(2).Infof("ingress group %v/%v: skipping selected service %v/%v, its path %v is taken",
+				ig.Namespace, ig.Name, svc.Namespace, svc.Name, path)
+			continue
+		}
+		taken.Insert(path)
+		ig.Spec.Services = append(ig.Spec.Services, v1.ServiceItem{
+			Name:             svc.Name,
+			Namespace:        namespace,
+			Port:             ig.Spec.ServiceSelector.Port,
+			Path:             path,
+			PathType:         v1.PathTypePrefix,
+			Hosts:            append([]string(nil), ig.Spec.Hosts...),
+			IngressClassName: ig.Spec.IngressClassName,
+		})
+	}
+	return ig, nil
+}
@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"github.com/liabio/ingressgroup/pkg/features"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"reflect"
+	"testing"
+)
+
+// newTestSelectedService returns a Service labeled app=shop, routed on the
+// path of its path annotation if set.
+func newTestSelectedService(name, path string, port int32) *corev1.Service {
+	svc := newTestService(name, port)
+	svc.Labels = map[string]string{"app": "shop"}
+	if path != "" {
+		svc.Annotations = map[string]string{ServicePathAnnotation: path}
+	}
+	return svc
+}
+
+func TestReconcileServiceDiscovery(t *testing.T) {
+	shop := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80, Path: "/"})
+	shop.Spec.ServiceSelector = &v1.ServiceSelector{
+		Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "shop"}},
+	}
+	tests := []struct {
+		name      string
+		discovery bool
+		objects   []runtime.Object
+		want      map[string][]string
+	}{
+		{
+			name:      "no matching services",
+			discovery: true,
+			objects:   []runtime.Object{newTestService("cart", 8080)},
+			want:      map[string][]string{"shop": {"/->web:80"}},
+		},
+		{
+			name:      "adds matching services on their name",
+			discovery: true,
+			objects:   []runtime.Object{newTestSelectedService("cart", "", 8080), newTestSelectedService("search", "", 9090)},
+			want:      map[string][]string{"shop": {"/->web:80", "/cart->cart:8080", "/search->search:9090"}},
+		},
+		{
+			name:      "adds a matching service on its path annotation",
+			discovery: true,
+			objects:   []runtime.Object{newTestSelectedService("cart", "/basket", 8080)},
+			want:      map[string][]string{"shop": {"/->web:80", "/basket->cart:8080"}},
+		},
+		{
+			name:      "skips a matching service whose path is taken",
+			discovery: true,
+			objects:   []runtime.Object{newTestSelectedService("cart", "/", 8080)},
+			want:      map[string][]string{"shop": {"/->web:80"}},
+		},
+		{
+			name:      "removes a service no longer matching",
+			discovery: true,
+			objects: []runtime.Object{newTestService("cart", 8080),
+				newTestIngress("shop", "shop", shop, "/cart", "cart", 8080)},
+			want: map[string][]string{"shop": {"/->web:80"}},
+		},
+		{
+			name:    "feature gate disabled",
+			objects: []runtime.Object{newTestSelectedService("cart", "", 8080)},
+			want:    map[string][]string{"shop": {"/->web:80"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gates := features.NewFeatureGate()
+			gates.SetEnabled(features.ServiceDiscovery, test.discovery)
+			objects := append([]runtime.Object{shop, newTestService("web", 80)}, test.objects...)
+			f := newFixture(t, Config{ControllerName: "ingressgroup", FeatureGates: gates}, objects...)
+			f.reconcile(t, "shop")
+
+			if got := f.ingresses(t); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got ingresses %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSelectsService(t *testing.T) {
+	selector := func(namespace string, matchLabels map[string]string) *v1.ServiceSelector {
+		return &v1.ServiceSelector{Namespace: namespace, Selector: &metav1.LabelSelector{MatchLabels: matchLabels}}
+	}
+	tests := []struct {
+		name     string
+		selector *v1.ServiceSelector
+		labels   map[string]string
+		want     bool
+	}{
+		{name: "no selector", labels: map[string]string{"app": "shop"}},
+		{name: "matching labels", selector: selector("", map[string]string{"app": "shop"}), labels: map[string]string{"app": "shop"}, want: true},
+		{name: "other labels", selector: selector("", map[string]string{"app": "shop"}), labels: map[string]string{"app": "blog"}},
+		{name: "other namespace", selector: selector("team-b", map[string]string{"app": "shop"}), labels: map[string]string{"app": "shop"}},
+		{name: "empty selector", selector: selector("", nil), labels: map[string]string{"app": "shop"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ig := newTestGroup("shop")
+			ig.Spec.ServiceSelector = test.selector
+			svc := newTestService("cart", 8080)
+			svc.Labels = test.labels
+			if got := SelectsService(ig, svc); got != test.want {
+				t.Errorf("got selected %v, want %v", got, test.want)
+			}
+		})
+	}
+}
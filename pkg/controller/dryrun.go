@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"fmt"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// rejectedError is returned when the API server, or one of its admission
+// webhooks, rejects a generated Ingress in a dry run.
+type rejectedError struct {
+	name string
+	err  error
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("ingress %q was rejected by the API server: %v", e.name, e.err)
+}
+
+// dryRunIngress sends the create, or the update, of the Ingress to the API
+// server with dryRun=All so it goes through validation and admission without
+// being persisted. The typed client of this Kubernetes version takes no
+// options on writes, hence the raw request.
+func (r *Reconciler) dryRunIngress(ing *extensionsv1beta1.Ingress, update bool) error {
+	if !r.config.ServerDryRun {
+		return nil
+	}
+
+	req := r.kubeClient.ExtensionsV1beta1().RESTClient().Post()
+	if update {
+		req = r.kubeClient.ExtensionsV1beta1().RESTClient().Put().Name(ing.Name)
+	}
+	err := req.Namespace(ing.Namespace).
+		Resource("ingresses").
+		Param("dryRun", metav1.DryRunAll).
+		Body(ing).
+		Do().
+		Error()
+	if errors.IsInvalid(err) || errors.IsForbidden(err) || errors.IsBadRequest(err) {
+		return &rejectedError{name: ing.Name, err: err}
+	}
+	return err
+}
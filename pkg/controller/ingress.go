@@ -0,0 +1,554 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"k8s.io/klog"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultAnnotationsPrefix is the prefix of the annotations understood by
+	// ingress-nginx unless it runs with a different --annotations-prefix.
+	DefaultAnnotationsPrefix = "nginx.ingress.kubernetes.io"
+
+	// IngressGroupLabel is set on every generated object to the name of the
+	// IngressGroup it was rendered from.
+	IngressGroupLabel = "ingressgroup.ingress-nginx.k8s.io/name"
+
+	// NamespaceOptInLabel marks the namespaces whose groups are processed
+	// when the controller requires namespaces to opt in.
+	NamespaceOptInLabel = "ingressgroup.ingress-nginx.k8s.io/enabled"
+
+	// ForceSyncAnnotation set on an IngressGroup to a new value, such as a
+	// timestamp, makes the controller sync the group even though its spec did
+	// not change.
+	ForceSyncAnnotation = "ingressgroup.ingress-nginx.k8s.io/force-sync"
+
+	// ConfirmPruneAnnotation set on an IngressGroup with the confirm prune
+	// strategy to its current generation withdraws the paths of the services
+	// removed from it.
+	ConfirmPruneAnnotation = "ingressgroup.ingress-nginx.k8s.io/confirm-prune"
+
+	// ServicePathAnnotation set on a Service selected by the service
+	// selector of a group sets the path it is routed on.
+	ServicePathAnnotation = "ingressgroup.ingress-nginx.k8s.io/path"
+
+	// CleanupFinalizer holds back the deletion of an IngressGroup whose
+	// Ingresses are generated in another namespace until the controller
+	// deleted them, since they cannot be garbage collected along with it.
+	CleanupFinalizer = "ingressgroup.ingress-nginx.k8s.io/cleanup"
+
+	// managedByLabel is set on the objects generated by the controller to
+	// its name. The controller never modifies an object without it.
+	managedByLabel = "app.kubernetes.io/managed-by"
+
+	// ownerAnnotation is set on every generated Ingress to the namespace/name
+	// of the IngressGroup it was rendered from.
+	ownerAnnotation = "ingressgroup.ingress-nginx.k8s.io/owner"
+
+	// managedAnnotationsAnnotation is set on every generated Ingress to the
+	// comma-separated keys of the annotations the controller set, so it can
+	// remove the ones it no longer sets without touching the annotations of
+	// other actors.
+	managedAnnotationsAnnotation = "ingressgroup.ingress-nginx.k8s.io/managed-annotations"
+
+	// ingressClassAnnotation selects the ingress controller serving an
+	// Ingress.
+	ingressClassAnnotation = "kubernetes.io/ingress.class"
+)
+
+// ingressKey identifies the Ingress a path is rendered into among the
+// non-canary Ingresses of a group.
+type ingressKey struct {
+	rewriteTarget string
+	regex         bool
+	exact         bool
+	class         string
+}
+
+// ingressPath is a path of a generated Ingress and the hosts it is routed
+// for, any host if there are none.
+type ingressPath struct {
+	hosts []string
+	path  extensionsv1beta1.HTTPIngressPath
+}
+
+// newIngresses renders the IngressGroup into its Ingresses. The rewrite
+// target, regex matching and ingress class are Ingress-wide annotations, so
+// services are split into one Ingress per distinct combination of them;
+// plain prefix paths without a rewrite target or class share the Ingress
+// named after the group. Exact paths, matched as anchored regular
+// expressions, get an Ingress of their own apart from the regex paths.
+// Every service that takes a weighted share of a path it has in common with
+// other services gets its own canary Ingress. The items are routed to the
+// backends resolved for their service names. The ingress-nginx annotations
+// are set under the given prefix.
+func newIngresses(ig *v1.IngressGroup, items []v1.ServiceItem, backends map[string]extensionsv1beta1.IngressBackend, prefix string) []*extensionsv1beta1.Ingress {
+	var keys []ingressKey
+	paths := map[ingressKey][]ingressPath{}
+	var canaries []string
+	canaryPaths := map[string][]ingressPath{}
+	canaryWeights := map[string]int{}
+	canaryTargets := map[string]string{}
+	canaryRegex := map[string]bool{}
+	canaryClass := map[string]string{}
+
+	for _, group := range servicesByPath(items) {
+		primary := group[0]
+		key := ingressKey{
+			rewriteTarget: primary.RewriteTarget,
+			regex:         primary.PathType == v1.PathTypeImplementationSpecific,
+			exact:         primary.PathType == v1.PathTypeExact,
+			class:         primary.IngressClassName,
+		}
+		if _, ok := paths[key]; !ok {
+			keys = append(keys, key)
+		}
+		paths[key] = append(paths[key], ingressPath{
+			hosts: primary.Hosts,
+			path: extensionsv1beta1.HTTPIngressPath{
+				Path:    renderedPath(primary),
+				Backend: backends[backendKey(primary)],
+			},
+		})
+
+		for _, canary := range group[1:] {
+			if _, ok := canaryPaths[canary.Name]; !ok {
+				canaries = append(canaries, canary.Name)
+			}
+			canaryPaths[canary.Name] = append(canaryPaths[canary.Name], ingressPath{
+				hosts: canary.Hosts,
+				path: extensionsv1beta1.HTTPIngressPath{
+					Path:    renderedPath(canary),
+					Backend: backends[backendKey(canary)],
+				},
+			})
+			canaryWeights[canary.Name] = *canary.Weight
+			canaryTargets[canary.Name] = canary.RewriteTarget
+			canaryRegex[canary.Name] = canaryRegex[canary.Name] || isRegexPath(canary)
+			canaryClass[canary.Name] = canary.IngressClassName
+		}
+	}
+
+	var ingresses []*extensionsv1beta1.Ingress
+	for _, key := range keys {
+		ing := newIngress(ig, ingressName(ig, key), paths[key], prefix)
+		setRewriteTarget(ing, prefix, key.rewriteTarget)
+		setUseRegex(ing, prefix, key.regex || key.exact)
+		setIngressClass(ing, key.class)
+		ingresses = append(ingresses, ing)
+	}
+	for _, name := range canaries {
+		ing := newIngress(ig, canaryIngressName(ig, name), canaryPaths[name], prefix)
+		ing.Annotations[nginxAnnotation(prefix, "canary")] = "true"
+		ing.Annotations[nginxAnnotation(prefix, "canary-weight")] = strconv.Itoa(canaryWeights[name])
+		setRewriteTarget(ing, prefix, canaryTargets[name])
+		setUseRegex(ing, prefix, canaryRegex[name])
+		setIngressClass(ing, canaryClass[name])
+		ingresses = append(ingresses, ing)
+	}
+	return ingresses
+}
+
+func setRewriteTarget(ing *extensionsv1beta1.Ingress, prefix, target string) {
+	if target != "" {
+		ing.Annotations[nginxAnnotation(prefix, "rewrite-target")] = target
+	}
+}
+
+func setUseRegex(ing *extensionsv1beta1.Ingress, prefix string, regex bool) {
+	if regex {
+		ing.Annotations[nginxAnnotation(prefix, "use-regex")] = "true"
+	}
+}
+
+func setIngressClass(ing *extensionsv1beta1.Ingress, class string) {
+	if class != "" {
+		ing.Annotations[ingressClassAnnotation] = class
+	}
+}
+
+// nginxAnnotation returns the key of the ingress-nginx annotation with the
+// given name under the prefix.
+func nginxAnnotation(prefix, name string) string {
+	return prefix + "/" + name
+}
+
+// ingressName returns the name of the Ingress holding the paths with the
+// given key. The rewrite target part is derived from a hash of the target so
+// the name stays the same when other services of the group change.
+func ingressName(ig *v1.IngressGroup, key ingressKey) string {
+	name := ingressBaseName(ig)
+	if key.class != "" {
+		name += "-class-" + key.class
+	}
+	if key.regex {
+		name += "-regex"
+	}
+	if key.exact {
+		name += "-exact"
+	}
+	if key.rewriteTarget != "" {
+		h := fnv.New32a()
+		h.Write([]byte(key.rewriteTarget))
+		name += fmt.Sprintf("-rewrite-%08x", h.Sum32())
+	}
+	return name
+}
+
+// canaryIngressName returns the name of the canary Ingress routing the
+// weighted share of the service's paths.
+func canaryIngressName(ig *v1.IngressGroup, service string) string {
+	return ingressBaseName(ig) + "-canary-" + service
+}
+
+// ingressBaseName returns the name of the main Ingress of the group, which
+// the names of its other Ingresses are derived from.
+func ingressBaseName(ig *v1.IngressGroup) string {
+	if ig.Spec.IngressName != "" {
+		return ig.Spec.IngressName
+	}
+	return ig.Name
+}
+
+// newIngress renders the IngressGroup into an Ingress with the given name,
+// owned by the group so it is garbage collected along with it. The paths go
+// into one rule per host, in the order the hosts first appear; paths without
+// hosts go into a rule without a host, which matches requests for any host.
+func newIngress(ig *v1.IngressGroup, name string, paths []ingressPath, prefix string) *extensionsv1beta1.Ingress {
+	var rules []extensionsv1beta1.IngressRule
+	index := map[string]int{}
+	for _, p := range paths {
+		hosts := p.hosts
+		if len(hosts) == 0 {
+			hosts = []string{""}
+		}
+		for _, host := range hosts {
+			i, ok := index[host]
+			if !ok {
+				i = len(rules)
+				index[host] = i
+				rules = append(rules, extensionsv1beta1.IngressRule{
+					Host: host,
+					IngressRuleValue: extensionsv1beta1.IngressRuleValue{
+						HTTP: &extensionsv1beta1.HTTPIngressRuleValue{},
+					},
+				})
+			}
+			rules[i].HTTP.Paths = append(rules[i].HTTP.Paths, p.path)
+		}
+	}
+
+	return &extensionsv1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ig.Namespace,
+			Labels: map[string]string{
+				IngressGroupLabel: ig.Name,
+			},
+			Annotations: buildAnnotations(ig, prefix),
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(ig, v1.SchemeGroupVersion.WithKind("IngressGroup")),
+			},
+		},
+		Spec: extensionsv1beta1.IngressSpec{
+			TLS:   ingressTLS(ig.Spec.TLS, rules),
+			Rules: rules,
+		},
+	}
+}
+
+// ingressTLS returns the TLS entries of the group covering the hosts of the
+// rules, each narrowed to the hosts it covers. Entries without hosts hold the
+// default certificate and go on every Ingress.
+func ingressTLS(entries []v1.IngressTLS, rules []extensionsv1beta1.IngressRule) []extensionsv1beta1.IngressTLS {
+	var tls []extensionsv1beta1.IngressTLS
+	for _, entry := range entries {
+		if len(entry.Hosts) == 0 {
+			tls = append(tls, extensionsv1beta1.IngressTLS{SecretName: entry.SecretName})
+			continue
+		}
+		var hosts []string
+		for _, host := range entry.Hosts {
+			for _, rule := range rules {
+				if rule.Host != "" && coversHost(host, rule.Host) {
+					hosts = append(hosts, host)
+					break
+				}
+			}
+		}
+		if len(hosts) > 0 {
+			tls = append(tls, extensionsv1beta1.IngressTLS{Hosts: hosts, SecretName: entry.SecretName})
+		}
+	}
+	return tls
+}
+
+// coversHost reports whether a certificate for the TLS host, possibly a
+// wildcard such as *.example.com, is valid for the host.
+func coversHost(tlsHost, host string) bool {
+	if tlsHost == host {
+		return true
+	}
+	if !strings.HasPrefix(tlsHost, "*.") {
+		return false
+	}
+	i := strings.Index(host, ".")
+	return i > 0 && host[i:] == tlsHost[1:]
+}
+
+// buildAnnotations returns the annotations of the Ingresses generated for the
+// IngressGroup. They are merged from layers of increasing precedence: the
+// annotations the group passes through, then the annotations of the features
+// enabled on the group, then the annotations the controller manages itself,
+// which always win. A key set by more than one
+// layer is logged, since the lower layer silently loses.
+func buildAnnotations(ig *v1.IngressGroup, prefix string) map[string]string {
+	annotations := map[string]string{}
+	for _, layer := range []map[string]string{ig.Spec.Annotations, featureAnnotations(ig, prefix), controllerAnnotations(ig)} {
+		for key, value := range layer {
+			if previous, ok := annotations[key]; ok && previous != value {
+				klog.Warningf("ingress group %v/%v: annotation %v=%q overrides %q", ig.Namespace, ig.Name, key, value, previous)
+			}
+			annotations[key] = value
+		}
+	}
+	return annotations
+}
+
+// setManagedAnnotations records the keys of the annotations of the Ingress in
+// its managedAnnotationsAnnotation.
+func setManagedAnnotations(ing *extensionsv1beta1.Ingress) {
+	var keys []string
+	for key := range ing.Annotations {
+		if key != managedAnnotationsAnnotation {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	ing.Annotations[managedAnnotationsAnnotation] = strings.Join(keys, ",")
+}
+
+// mergeAnnotations returns the annotations of the existing Ingress updated to
+// the desired ones: the annotations the controller set before but no longer
+// sets are removed, the desired ones set, and those of other actors kept. An
+// Ingress generated before the keys were recorded had all its annotations
+// replaced, so they all count as set by the controller.
+func mergeAnnotations(existing, desired map[string]string) map[string]string {
+	merged := map[string]string{}
+	for key, value := range existing {
+		merged[key] = value
+	}
+	if recorded, ok := existing[managedAnnotationsAnnotation]; ok {
+		for _, key := range strings.Split(recorded, ",") {
+			delete(merged, key)
+		}
+	} else {
+		merged = map[string]string{}
+	}
+	for key, value := range desired {
+		merged[key] = value
+	}
+	return merged
+}
+
+// mergeLabels returns the labels of the existing object with the desired ones
+// set. The controller always sets the same label keys, so the others belong
+// to other actors and are kept.
+func mergeLabels(existing, desired map[string]string) map[string]string {
+	merged := map[string]string{}
+	for key, value := range existing {
+		merged[key] = value
+	}
+	for key, value := range desired {
+		merged[key] = value
+	}
+	return merged
+}
+
+// mergeOwnerReferences returns the owner references of the existing object
+// with the desired ones set in place. The controller reference, of the group
+// or of a deleted group of the same name, is replaced since an object has a
+// single controller; the references of other actors are kept.
+func mergeOwnerReferences(existing, desired []metav1.OwnerReference) []metav1.OwnerReference {
+	var merged []metav1.OwnerReference
+	placed := map[types.UID]bool{}
+	place := func(ref metav1.OwnerReference) bool {
+		for _, want := range desired {
+			if ref.UID == want.UID || ref.Controller != nil && *ref.Controller && want.Controller != nil && *want.Controller {
+				if !placed[want.UID] {
+					merged = append(merged, want)
+					placed[want.UID] = true
+				}
+				return true
+			}
+		}
+		return false
+	}
+	for _, ref := range existing {
+		if !place(ref) {
+			merged = append(merged, ref)
+		}
+	}
+	for _, want := range desired {
+		if !placed[want.UID] {
+			merged = append(merged, want)
+		}
+	}
+	return merged
+}
+
+// controllerAnnotations returns the annotations the controller relies on to
+// recognize the objects it generated.
+func controllerAnnotations(ig *v1.IngressGroup) map[string]string {
+	return map[string]string{
+		ownerAnnotation: ig.Namespace + "/" + ig.Name,
+	}
+}
+
+// featureAnnotations returns the ingress-nginx annotations for the features
+// enabled on the IngressGroup, under the given prefix.
+func featureAnnotations(ig *v1.IngressGroup, prefix string) map[string]string {
+	annotations := map[string]string{}
+	if ig.Spec.BasicAuthSecret != "" {
+		annotations[nginxAnnotation(prefix, "auth-type")] = "basic"
+		annotations[nginxAnnotation(prefix, "auth-secret")] = ig.Spec.BasicAuthSecret
+		if ig.Spec.BasicAuthRealm != "" {
+			annotations[nginxAnnotation(prefix, "auth-realm")] = ig.Spec.BasicAuthRealm
+		}
+	}
+	if ig.Spec.ServerSnippet != "" {
+		annotations[nginxAnnotation(prefix, "server-snippet")] = ig.Spec.ServerSnippet
+	}
+	if len(ig.Spec.ResponseHeaders) > 0 {
+		annotations[nginxAnnotation(prefix, "configuration-snippet")] = responseHeadersSnippet(ig.Spec.ResponseHeaders)
+	}
+	return annotations
+}
+
+// responseHeadersSnippet renders the response headers into nginx
+// more_set_headers directives, sorted by name so the snippet is stable.
+func responseHeadersSnippet(headers map[string]string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "more_set_headers \"%s: %s\";\n", name, headers[name])
+	}
+	return b.String()
+}
+
+// ingressesHash returns a hash of the names, labels, annotations and specs of
+// the Ingresses, in order.
+func ingressesHash(ingresses []*extensionsv1beta1.Ingress) string {
+	h := fnv.New64a()
+	for _, ing := range ingresses {
+		data, err := json.Marshal([]interface{}{ing.Name, ing.Labels, ing.Annotations, ing.Spec})
+		if err != nil {
+			klog.Errorf("failed to hash ingress %v: %v", ing.Name, err)
+			continue
+		}
+		h.Write(data)
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// backendKey identifies the backend of the service: the service and the port
+// it is routed to.
+func backendKey(item v1.ServiceItem) string {
+	return fmt.Sprintf("%s:%d:%s", item.Name, item.Port, item.PortName)
+}
+
+// renderedPath returns the path of the service as written into its Ingress.
+// An exact path is rendered as a regular expression matching only itself,
+// anchored at both ends. ingress-nginx matches regular expressions case
+// insensitively, so it matches the path in any case.
+func renderedPath(item v1.ServiceItem) string {
+	if item.PathType == v1.PathTypeExact {
+		return "^" + regexp.QuoteMeta(item.Path) + "$"
+	}
+	return item.Path
+}
+
+// isRegexPath reports whether the path of the service is matched as a regular
+// expression.
+func isRegexPath(item v1.ServiceItem) bool {
+	return item.PathType == v1.PathTypeImplementationSpecific || item.PathType == v1.PathTypeExact
+}
+
+// sortedServices returns the services in the order their paths are generated:
+// by descending priority, then longest path first so more specific paths win,
+// then by path and service name so the order is stable across syncs.
+func sortedServices(items []v1.ServiceItem) []v1.ServiceItem {
+	sorted := make([]v1.ServiceItem, len(items))
+	copy(sorted, items)
+
+	priority := func(item v1.ServiceItem) int {
+		if item.Priority == nil {
+			return 0
+		}
+		return *item.Priority
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if priority(a) != priority(b) {
+			return priority(a) > priority(b)
+		}
+		pathA, pathB := a.Path, b.Path
+		if len(pathA) != len(pathB) {
+			return len(pathA) > len(pathB)
+		}
+		if pathA != pathB {
+			return pathA < pathB
+		}
+		return a.Name < b.Name
+	})
+	return sorted
+}
+
+// servicesByPath groups the services by the path, hosts and ingress class
+// they are exposed on, in the order the paths first appear. Within a group
+// the service with the largest weight comes first and serves as the primary
+// backend of the path.
+func servicesByPath(items []v1.ServiceItem) [][]v1.ServiceItem {
+	var groups [][]v1.ServiceItem
+	index := map[string]int{}
+	for _, item := range items {
+		hosts := append([]string(nil), item.Hosts...)
+		sort.Strings(hosts)
+		path := renderedPath(item) + " " + strings.Join(hosts, ",") + " " + item.IngressClassName
+		i, ok := index[path]
+		if !ok {
+			i = len(groups)
+			index[path] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], item)
+	}
+
+	weight := func(item v1.ServiceItem) int {
+		if item.Weight == nil {
+			return 0
+		}
+		return *item.Weight
+	}
+	for _, group := range groups {
+		sort.SliceStable(group, func(i, j int) bool {
+			return weight(group[i]) > weight(group[j])
+		})
+	}
+	return groups
+}
@@ -0,0 +1,482 @@
+package controller
+
+import (
+	"fmt"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func intPtr(i int) *int {
+	return &i
+}
+
+// serviceNames returns the names of the services, in order.
+func serviceNames(items []v1.ServiceItem) []string {
+	var names []string
+	for _, item := range items {
+		names = append(names, item.Name)
+	}
+	return names
+}
+
+func TestSortedServices(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []v1.ServiceItem
+		want  []string
+	}{
+		{
+			name: "longest path first",
+			items: []v1.ServiceItem{
+				{Name: "root", Path: "/"},
+				{Name: "api", Path: "/api"},
+				{Name: "api-v1", Path: "/api/v1"},
+			},
+			want: []string{"api-v1", "api", "root"},
+		},
+		{
+			name: "paths of equal length by path",
+			items: []v1.ServiceItem{
+				{Name: "b", Path: "/bbb"},
+				{Name: "a", Path: "/aaa"},
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "same path by service name",
+			items: []v1.ServiceItem{
+				{Name: "web-b", Path: "/"},
+				{Name: "web-a", Path: "/"},
+			},
+			want: []string{"web-a", "web-b"},
+		},
+		{
+			name: "higher priority before longer path",
+			items: []v1.ServiceItem{
+				{Name: "api", Path: "/api"},
+				{Name: "catch-all", Path: "/", Priority: intPtr(10)},
+				{Name: "last", Path: "/last/resort", Priority: intPtr(-1)},
+			},
+			want: []string{"catch-all", "api", "last"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := serviceNames(sortedServices(test.items)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+			// The order must not depend on the order of the spec.
+			reversed := make([]v1.ServiceItem, len(test.items))
+			for i, item := range test.items {
+				reversed[len(test.items)-1-i] = item
+			}
+			if got := serviceNames(sortedServices(reversed)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v from the reversed services, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// testBackends returns the backends of the services as resolveBackends would
+// for services listing their port.
+func testBackends(items []v1.ServiceItem) map[string]extensionsv1beta1.IngressBackend {
+	backends := map[string]extensionsv1beta1.IngressBackend{}
+	for _, item := range items {
+		backends[backendKey(item)] = extensionsv1beta1.IngressBackend{
+			ServiceName: item.Name,
+			ServicePort: intstr.FromInt(int(item.Port)),
+		}
+	}
+	return backends
+}
+
+// renderIngresses renders the group's services the way the Reconciler does,
+// after defaulting and sorting them.
+func renderIngresses(ig *v1.IngressGroup) []*extensionsv1beta1.Ingress {
+	ig = setDefaults(ig)
+	items := sortedServices(ig.Spec.Services)
+	return newIngresses(ig, items, testBackends(items), DefaultAnnotationsPrefix)
+}
+
+func TestNewIngressesCanary(t *testing.T) {
+	type canary struct {
+		paths  []string
+		weight string
+	}
+	tests := []struct {
+		name  string
+		items []v1.ServiceItem
+		// want is keyed by Ingress name, with an empty weight for the
+		// Ingresses that are not canaries.
+		want map[string]canary
+	}{
+		{
+			name: "single backend per path",
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80},
+				{Name: "api", Namespace: testNamespace, Port: 8080, Path: "/api"},
+			},
+			want: map[string]canary{
+				"shop": {paths: []string{"/->web:80", "/api->api:8080"}},
+			},
+		},
+		{
+			name: "weighted backends of one path",
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80, Weight: intPtr(80)},
+				{Name: "web-v2", Namespace: testNamespace, Port: 80, Weight: intPtr(20)},
+			},
+			want: map[string]canary{
+				"shop":               {paths: []string{"/->web:80"}},
+				"shop-canary-web-v2": {paths: []string{"/->web-v2:80"}, weight: "20"},
+			},
+		},
+		{
+			name: "largest weight is the primary backend",
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80, Weight: intPtr(10)},
+				{Name: "web-v2", Namespace: testNamespace, Port: 80, Weight: intPtr(60)},
+				{Name: "web-v3", Namespace: testNamespace, Port: 80, Weight: intPtr(30)},
+			},
+			want: map[string]canary{
+				"shop":               {paths: []string{"/->web-v2:80"}},
+				"shop-canary-web-v3": {paths: []string{"/->web-v3:80"}, weight: "30"},
+				"shop-canary-web":    {paths: []string{"/->web:80"}, weight: "10"},
+			},
+		},
+		{
+			name: "canary of several paths",
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80, Weight: intPtr(90)},
+				{Name: "web-v2", Namespace: testNamespace, Port: 80, Weight: intPtr(10)},
+				{Name: "web", Namespace: testNamespace, Port: 80, Path: "/shop", Weight: intPtr(90)},
+				{Name: "web-v2", Namespace: testNamespace, Port: 80, Path: "/shop", Weight: intPtr(10)},
+			},
+			want: map[string]canary{
+				"shop":               {paths: []string{"/->web:80", "/shop->web:80"}},
+				"shop-canary-web-v2": {paths: []string{"/->web-v2:80", "/shop->web-v2:80"}, weight: "10"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := map[string]canary{}
+			for _, ing := range renderIngresses(newTestGroup("shop", test.items...)) {
+				c := canary{paths: ingressPaths(ing)}
+				if ing.Annotations[nginxAnnotation(DefaultAnnotationsPrefix, "canary")] == "true" {
+					c.weight = ing.Annotations[nginxAnnotation(DefaultAnnotationsPrefix, "canary-weight")]
+				}
+				got[ing.Name] = c
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got ingresses %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewIngressesRegex(t *testing.T) {
+	tests := []struct {
+		name     string
+		pathType v1.PathType
+		path     string
+		want     map[string][]string
+	}{
+		{
+			name:     "prefix path",
+			pathType: v1.PathTypePrefix,
+			path:     "/api",
+			want:     map[string][]string{"shop": {"/api->api:8080"}},
+		},
+		{
+			name:     "regex path",
+			pathType: v1.PathTypeImplementationSpecific,
+			path:     "/api/v[0-9]+",
+			want:     map[string][]string{"shop-regex": {"/api/v[0-9]+->api:8080"}},
+		},
+		{
+			name:     "exact path",
+			pathType: v1.PathTypeExact,
+			path:     "/api/v1.0",
+			want:     map[string][]string{"shop-exact": {"^/api/v1\\.0$->api:8080"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ig := newTestGroup("shop", v1.ServiceItem{Name: "api", Namespace: testNamespace, Port: 8080, Path: test.path, PathType: test.pathType})
+			got := map[string][]string{}
+			for _, ing := range renderIngresses(ig) {
+				got[ing.Name] = ingressPaths(ing)
+				regex := ing.Annotations[nginxAnnotation(DefaultAnnotationsPrefix, "use-regex")] == "true"
+				if wantRegex := test.pathType != v1.PathTypePrefix; regex != wantRegex {
+					t.Errorf("got use-regex %v on %v, want %v", regex, ing.Name, wantRegex)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got ingresses %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewIngressesHosts(t *testing.T) {
+	type rule struct {
+		host  string
+		paths int
+	}
+	tests := []struct {
+		name  string
+		hosts []string
+		items []v1.ServiceItem
+		want  []rule
+	}{
+		{
+			name: "hostless",
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80},
+				{Name: "api", Namespace: testNamespace, Port: 8080, Path: "/api"},
+			},
+			want: []rule{{host: "", paths: 2}},
+		},
+		{
+			name:  "hosts of the group",
+			hosts: []string{"example.com", "www.example.com"},
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80},
+				{Name: "api", Namespace: testNamespace, Port: 8080, Path: "/api"},
+			},
+			want: []rule{{host: "example.com", paths: 2}, {host: "www.example.com", paths: 2}},
+		},
+		{
+			name: "hosted and hostless services",
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80},
+				{Name: "api", Namespace: testNamespace, Port: 8080, Path: "/api", Hosts: []string{"api.example.com"}},
+			},
+			want: []rule{{host: "api.example.com", paths: 1}, {host: "", paths: 1}},
+		},
+		{
+			name: "service under several hosts",
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80, Hosts: []string{"a.example.com", "b.example.com", "c.example.com"}},
+			},
+			want: []rule{{host: "a.example.com", paths: 1}, {host: "b.example.com", paths: 1}, {host: "c.example.com", paths: 1}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ig := newTestGroup("shop", test.items...)
+			ig.Spec.Hosts = test.hosts
+			ingresses := renderIngresses(ig)
+			if len(ingresses) != 1 {
+				t.Fatalf("got %d ingresses, want 1", len(ingresses))
+			}
+			var got []rule
+			for _, r := range ingresses[0].Spec.Rules {
+				got = append(got, rule{host: r.Host, paths: len(r.HTTP.Paths)})
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got rules %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewIngressesMultiHostService(t *testing.T) {
+	for _, n := range []int{1, 2, 5} {
+		t.Run(fmt.Sprintf("%d hosts", n), func(t *testing.T) {
+			var hosts []string
+			for i := 0; i < n; i++ {
+				hosts = append(hosts, fmt.Sprintf("host-%d.example.com", i))
+			}
+			ig := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80, Path: "/shop", Hosts: hosts})
+			ingresses := renderIngresses(ig)
+			if len(ingresses) != 1 {
+				t.Fatalf("got %d ingresses, want 1", len(ingresses))
+			}
+			rules := ingresses[0].Spec.Rules
+			if len(rules) != n {
+				t.Fatalf("got %d rules, want one per host", len(rules))
+			}
+			for i, r := range rules {
+				if r.Host != hosts[i] {
+					t.Errorf("got rule %d for host %q, want %q", i, r.Host, hosts[i])
+				}
+				if len(r.HTTP.Paths) != 1 {
+					t.Fatalf("got %d paths for host %q, want 1", len(r.HTTP.Paths), r.Host)
+				}
+				path := r.HTTP.Paths[0]
+				if path.Path != "/shop" || path.Backend.ServiceName != "web" || path.Backend.ServicePort.IntValue() != 80 {
+					t.Errorf("got path %+v for host %q, want /shop to web:80", path, r.Host)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildAnnotations(t *testing.T) {
+	authType := nginxAnnotation(DefaultAnnotationsPrefix, "auth-type")
+	authSecret := nginxAnnotation(DefaultAnnotationsPrefix, "auth-secret")
+	bodySize := nginxAnnotation(DefaultAnnotationsPrefix, "proxy-body-size")
+	tests := []struct {
+		name string
+		spec v1.IngressGroupSpec
+		want map[string]string
+	}{
+		{
+			name: "controller annotations only",
+			want: map[string]string{ownerAnnotation: "default/shop"},
+		},
+		{
+			name: "passed through annotations",
+			spec: v1.IngressGroupSpec{Annotations: map[string]string{bodySize: "8m"}},
+			want: map[string]string{ownerAnnotation: "default/shop", bodySize: "8m"},
+		},
+		{
+			name: "feature fields",
+			spec: v1.IngressGroupSpec{BasicAuthSecret: "htpasswd"},
+			want: map[string]string{ownerAnnotation: "default/shop", authType: "basic", authSecret: "htpasswd"},
+		},
+		{
+			name: "feature fields over passed through annotations",
+			spec: v1.IngressGroupSpec{
+				BasicAuthSecret: "htpasswd",
+				Annotations:     map[string]string{authSecret: "other", bodySize: "8m"},
+			},
+			want: map[string]string{ownerAnnotation: "default/shop", authType: "basic", authSecret: "htpasswd", bodySize: "8m"},
+		},
+		{
+			name: "controller annotations over passed through annotations",
+			spec: v1.IngressGroupSpec{Annotations: map[string]string{ownerAnnotation: "default/other"}},
+			want: map[string]string{ownerAnnotation: "default/shop"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ig := newTestGroup("shop")
+			ig.Spec = test.spec
+			if got := buildAnnotations(ig, DefaultAnnotationsPrefix); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewIngressesAnnotationsPrefix(t *testing.T) {
+	ig := newTestGroup("shop",
+		v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80, Weight: intPtr(80), RewriteTarget: "/"},
+		v1.ServiceItem{Name: "web-v2", Namespace: testNamespace, Port: 80, Weight: intPtr(20)},
+		v1.ServiceItem{Name: "api", Namespace: testNamespace, Port: 8080, Path: "/api", PathType: v1.PathTypeExact},
+	)
+	ig.Spec.BasicAuthSecret = "htpasswd"
+	ig.Spec.BasicAuthRealm = "shop"
+	ig.Spec.ServerSnippet = "gzip on;"
+	ig.Spec.ResponseHeaders = map[string]string{"X-Frame-Options": "DENY"}
+	want := []string{
+		"auth-realm", "auth-secret", "auth-type", "canary", "canary-weight",
+		"configuration-snippet", "rewrite-target", "server-snippet", "use-regex",
+	}
+
+	for _, prefix := range []string{DefaultAnnotationsPrefix, "custom.example.com"} {
+		t.Run(prefix, func(t *testing.T) {
+			ig := setDefaults(ig)
+			items := sortedServices(ig.Spec.Services)
+			names := map[string]bool{}
+			for _, ing := range newIngresses(ig, items, testBackends(items), prefix) {
+				for key := range ing.Annotations {
+					// The controller's own annotations are not nginx ones.
+					if strings.HasPrefix(key, "ingressgroup.ingress-nginx.k8s.io/") {
+						continue
+					}
+					if !strings.HasPrefix(key, prefix+"/") {
+						t.Errorf("ingress %v: annotation %v is not under the prefix", ing.Name, key)
+						continue
+					}
+					names[strings.TrimPrefix(key, prefix+"/")] = true
+				}
+			}
+			var got []string
+			for name := range names {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got annotations %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestNewIngressesDefaultPath(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultPath string
+		want        []string
+	}{
+		{name: "no default path", want: []string{"/->web:80", "/api->api:8080"}},
+		{name: "default path", defaultPath: "/app", want: []string{"/api->api:8080", "/app->web:80"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ig := newTestGroup("shop",
+				v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80},
+				v1.ServiceItem{Name: "api", Namespace: testNamespace, Port: 8080, Path: "/api"},
+			)
+			ig.Spec.DefaultPath = test.defaultPath
+			ingresses := renderIngresses(ig)
+			if len(ingresses) != 1 {
+				t.Fatalf("got %d ingresses, want 1", len(ingresses))
+			}
+			if got := ingressPaths(ingresses[0]); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got paths %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMergeAnnotations(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing map[string]string
+		desired  map[string]string
+		want     map[string]string
+	}{
+		{
+			name:     "foreign annotation kept",
+			existing: map[string]string{"a": "1", "ordering.example.com/priority": "10", managedAnnotationsAnnotation: "a"},
+			desired:  map[string]string{"a": "2", managedAnnotationsAnnotation: "a"},
+			want:     map[string]string{"a": "2", "ordering.example.com/priority": "10", managedAnnotationsAnnotation: "a"},
+		},
+		{
+			name:     "annotation no longer set removed",
+			existing: map[string]string{"a": "1", "b": "1", "other": "x", managedAnnotationsAnnotation: "a,b"},
+			desired:  map[string]string{"a": "1", managedAnnotationsAnnotation: "a"},
+			want:     map[string]string{"a": "1", "other": "x", managedAnnotationsAnnotation: "a"},
+		},
+		{
+			name:     "keys never recorded",
+			existing: map[string]string{"a": "1", "b": "1"},
+			desired:  map[string]string{"a": "2", managedAnnotationsAnnotation: "a"},
+			want:     map[string]string{"a": "2", managedAnnotationsAnnotation: "a"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := mergeAnnotations(test.existing, test.desired); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got annotations %v, want %v", got, test.want)
+			}
+		})
+	}
+}
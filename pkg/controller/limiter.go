@@ -0,0 +1,28 @@
+package controller
+
+import (
+	"github.com/liabio/ingressgroup/pkg/metrics"
+)
+
+// writeLimiter bounds the number of write calls the Reconciler has in flight
+// against the API server, however many workers run. A nil writeLimiter does
+// not bound them.
+type writeLimiter chan struct{}
+
+func newWriteLimiter(max int) writeLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return make(writeLimiter, max)
+}
+
+// do makes the write call once a slot is free.
+func (l writeLimiter) do(call func() error) error {
+	if l != nil {
+		l <- struct{}{}
+		defer func() { <-l }()
+	}
+	metrics.APICallsInFlight.Inc()
+	defer metrics.APICallsInFlight.Dec()
+	return call()
+}
@@ -0,0 +1,172 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	extensionslisters "k8s.io/client-go/listers/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	iglisters "k8s.io/ingress-nginx/pkg/client/listers/ingressgroup/v1"
+)
+
+// multiNamespaceLister serves IngressGroups from the listers of several
+// namespace-scoped informers, keyed by namespace. A lister keyed by
+// metav1.NamespaceAll serves every namespace.
+type multiNamespaceLister struct {
+	listers map[string]iglisters.IngressGroupLister
+	// empty serves the namespaces no informer watches.
+	empty iglisters.IngressGroupLister
+}
+
+// NewMultiNamespaceLister returns an IngressGroupLister combining the listers
+// of the given namespaces.
+func NewMultiNamespaceLister(listers map[string]iglisters.IngressGroupLister) iglisters.IngressGroupLister {
+	return &multiNamespaceLister{
+		listers: listers,
+		empty:   iglisters.NewIngressGroupLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+	}
+}
+
+func (l *multiNamespaceLister) List(selector labels.Selector) ([]*v1.IngressGroup, error) {
+	var all []*v1.IngressGroup
+	for _, lister := range l.listers {
+		igs, err := lister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, igs...)
+	}
+	return all, nil
+}
+
+func (l *multiNamespaceLister) IngressGroups(namespace string) iglisters.IngressGroupNamespaceLister {
+	if lister, ok := l.listers[namespace]; ok {
+		return lister.IngressGroups(namespace)
+	}
+	if lister, ok := l.listers[""]; ok {
+		return lister.IngressGroups(namespace)
+	}
+	return l.empty.IngressGroups(namespace)
+}
+
+// multiNamespaceIngressLister is the multiNamespaceLister of Ingresses.
+type multiNamespaceIngressLister struct {
+	listers map[string]extensionslisters.IngressLister
+	empty   extensionslisters.IngressLister
+}
+
+// NewMultiNamespaceIngressLister returns an IngressLister combining the
+// listers of the given namespaces.
+func NewMultiNamespaceIngressLister(listers map[string]extensionslisters.IngressLister) extensionslisters.IngressLister {
+	return &multiNamespaceIngressLister{
+		listers: listers,
+		empty:   extensionslisters.NewIngressLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+	}
+}
+
+func (l *multiNamespaceIngressLister) List(selector labels.Selector) ([]*extensionsv1beta1.Ingress, error) {
+	var all []*extensionsv1beta1.Ingress
+	for _, lister := range l.listers {
+		ings, err := lister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, ings...)
+	}
+	return all, nil
+}
+
+func (l *multiNamespaceIngressLister) Ingresses(namespace string) extensionslisters.IngressNamespaceLister {
+	if lister, ok := l.listers[namespace]; ok {
+		return lister.Ingresses(namespace)
+	}
+	if lister, ok := l.listers[""]; ok {
+		return lister.Ingresses(namespace)
+	}
+	return l.empty.Ingresses(namespace)
+}
+
+// multiNamespaceServiceLister is the multiNamespaceLister of Services. The
+// Services of the namespaces no informer watches may well exist, such as
+// those a group bridges to, so they are read from the API server instead.
+type multiNamespaceServiceLister struct {
+	listers map[string]corelisters.ServiceLister
+	client  corev1client.ServicesGetter
+}
+
+// NewMultiNamespaceServiceLister returns a ServiceLister combining the
+// listers of the given namespaces, reading the Services of the other
+// namespaces through the client.
+func NewMultiNamespaceServiceLister(listers map[string]corelisters.ServiceLister, client corev1client.ServicesGetter) corelisters.ServiceLister {
+	return &multiNamespaceServiceLister{listers: listers, client: client}
+}
+
+func (l *multiNamespaceServiceLister) List(selector labels.Selector) ([]*corev1.Service, error) {
+	var all []*corev1.Service
+	for _, lister := range l.listers {
+		svcs, err := lister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, svcs...)
+	}
+	return all, nil
+}
+
+func (l *multiNamespaceServiceLister) Services(namespace string) corelisters.ServiceNamespaceLister {
+	if lister, ok := l.listers[namespace]; ok {
+		return lister.Services(namespace)
+	}
+	if lister, ok := l.listers[""]; ok {
+		return lister.Services(namespace)
+	}
+	return unwatchedServiceLister{namespace: namespace, client: l.client}
+}
+
+func (l *multiNamespaceServiceLister) GetPodServices(pod *corev1.Pod) ([]*corev1.Service, error) {
+	if lister, ok := l.listers[pod.Namespace]; ok {
+		return lister.GetPodServices(pod)
+	}
+	if lister, ok := l.listers[""]; ok {
+		return lister.GetPodServices(pod)
+	}
+	svcs, err := unwatchedServiceLister{namespace: pod.Namespace, client: l.client}.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var selecting []*corev1.Service
+	for _, svc := range svcs {
+		if svc.Spec.Selector != nil && labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(pod.Labels)) {
+			selecting = append(selecting, svc)
+		}
+	}
+	return selecting, nil
+}
+
+// unwatchedServiceLister serves the Services of a namespace no informer
+// watches from the API server, failing as forbidden if the controller may
+// not read them.
+type unwatchedServiceLister struct {
+	namespace string
+	client    corev1client.ServicesGetter
+}
+
+func (l unwatchedServiceLister) List(selector labels.Selector) ([]*corev1.Service, error) {
+	list, err := l.client.Services(l.namespace).List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	svcs := make([]*corev1.Service, 0, len(list.Items))
+	for i := range list.Items {
+		svcs = append(svcs, &list.Items[i])
+	}
+	return svcs, nil
+}
+
+func (l unwatchedServiceLister) Get(name string) (*corev1.Service, error) {
+	return l.client.Services(l.namespace).Get(name, metav1.GetOptions{})
+}
@@ -0,0 +1,137 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"k8s.io/klog"
+	"strings"
+)
+
+// With --ingress-namespace, the Ingresses of every group are generated in a
+// namespace of their own rather than the group's, for clusters keeping their
+// Ingresses in one place. An Ingress only routes to Services of its own
+// namespace, so every service of the group is reached through a bridge
+// there, and the Secrets of its TLS block and basic auth are read from there.
+//
+// Owner references cannot cross namespaces: the Ingresses and bridges placed
+// in the ingress namespace carry none and are recognized by their managed-by
+// label and owner annotation instead. Nor can the garbage collector delete
+// them, so the groups carry CleanupFinalizer, and the controller deletes
+// their objects before it lets a deleted group go.
+
+// ingressNamespace returns the namespace the Ingresses of the group are
+// generated in.
+func (r *Reconciler) ingressNamespace(ig *v1.IngressGroup) string {
+	if r.config.IngressNamespace != "" {
+		return r.config.IngressNamespace
+	}
+	return ig.Namespace
+}
+
+// place moves an object generated for the group into the namespace of its
+// Ingresses, dropping its owner references if that is not the group's.
+func (r *Reconciler) place(ig *v1.IngressGroup, obj metav1.Object) {
+	if namespace := r.ingressNamespace(ig); namespace != ig.Namespace {
+		obj.SetNamespace(namespace)
+		obj.SetOwnerReferences(nil)
+	}
+}
+
+// generatedFor reports whether the existing object was generated for the
+// group: controlled by the group in its namespace, or managed by the
+// controller for the group in another one, where it cannot be owned.
+func (r *Reconciler) generatedFor(obj metav1.Object, ig *v1.IngressGroup) bool {
+	if obj.GetNamespace() == ig.Namespace {
+		return metav1.IsControlledBy(obj, ig)
+	}
+	return r.managedBy(obj, ig)
+}
+
+// generatedIngresses returns the cached Ingresses generated for the group.
+func (r *Reconciler) generatedIngresses(ig *v1.IngressGroup) ([]*extensionsv1beta1.Ingress, error) {
+	list, err := r.ingLister.Ingresses(r.ingressNamespace(ig)).List(labels.SelectorFromSet(labels.Set{IngressGroupLabel: ig.Name}))
+	if err != nil {
+		return nil, err
+	}
+	var ingresses []*extensionsv1beta1.Ingress
+	for _, ing := range list {
+		if r.generatedFor(ing, ig) {
+			ingresses = append(ingresses, ing)
+		}
+	}
+	return ingresses, nil
+}
+
+// OwnerKey returns the namespace/name key of the IngressGroup the object was
+// generated for according to its owner annotation, false if it has none. It
+// identifies the group of the objects generated outside its namespace, which
+// carry no owner reference.
+func OwnerKey(obj metav1.Object) (string, bool) {
+	key := obj.GetAnnotations()[ownerAnnotation]
+	if parts := strings.Split(key, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", false
+	}
+	return key, true
+}
+
+// hasCleanupFinalizer reports whether the group carries CleanupFinalizer.
+func hasCleanupFinalizer(ig *v1.IngressGroup) bool {
+	for _, finalizer := range ig.Finalizers {
+		if finalizer == CleanupFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureCleanupFinalizer adds CleanupFinalizer to the group whose Ingresses
+// are generated outside its namespace, before any of them is, and returns the
+// updated group.
+func (r *Reconciler) ensureCleanupFinalizer(ig *v1.IngressGroup) (*v1.IngressGroup, error) {
+	if r.ingressNamespace(ig) == ig.Namespace || hasCleanupFinalizer(ig) || r.config.ObserveOnly {
+		return ig, nil
+	}
+	update := ig.DeepCopy()
+	update.Finalizers = append(update.Finalizers, CleanupFinalizer)
+	err := r.writes.do(func() error {
+		var err error
+		update, err = r.versionedClient.CrV1().IngressGroups(ig.Namespace).Update(update)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+// finalize deletes the Ingresses and bridges generated for the deleted group
+// in the ingress namespace, then removes CleanupFinalizer so the group goes.
+func (r *Reconciler) finalize(ig *v1.IngressGroup) error {
+	klog.V(2).Infof("cleaning up after deleted ingress group %v/%v", ig.Namespace, ig.Name)
+	if err := r.pruneIngresses(ig, nil); err != nil {
+		return err
+	}
+	if err := r.pruneServicesIn(ig, r.ingressNamespace(ig), sets.NewString()); err != nil {
+		return err
+	}
+
+	update := ig.DeepCopy()
+	update.Finalizers = nil
+	for _, finalizer := range ig.Finalizers {
+		if finalizer != CleanupFinalizer {
+			update.Finalizers = append(update.Finalizers, finalizer)
+		}
+	}
+	if err := r.writes.do(func() error {
+		_, err := r.versionedClient.CrV1().IngressGroups(ig.Namespace).Update(update)
+		return err
+	}); err != nil {
+		return err
+	}
+	r.recorder.Eventf(ig, corev1.EventTypeNormal, "CleanedUp", "Deleted the objects generated in namespace %v", r.ingressNamespace(ig))
+	return nil
+}
@@ -0,0 +1,247 @@
+package controller
+
+import (
+	"context"
+	"github.com/liabio/ingressgroup/pkg/features"
+	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const testIngressNamespace = "ingresses"
+
+// placedObjects returns the Ingresses and Services of the namespace in the
+// fake API server, keyed by name: the paths of the Ingresses and the external
+// names of the Services.
+func (f *fixture) placedObjects(t *testing.T, namespace string) (map[string][]string, map[string]string) {
+	ingList, err := f.kubeClient.ExtensionsV1beta1().Ingresses(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list ingresses: %v", err)
+	}
+	ingresses := map[string][]string{}
+	for i := range ingList.Items {
+		ingresses[ingList.Items[i].Name] = ingressPaths(&ingList.Items[i])
+	}
+	svcList, err := f.kubeClient.CoreV1().Services(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list services: %v", err)
+	}
+	services := map[string]string{}
+	for _, svc := range svcList.Items {
+		services[svc.Name] = svc.Spec.ExternalName
+	}
+	return ingresses, services
+}
+
+func TestReconcileIngressNamespace(t *testing.T) {
+	gates := features.NewFeatureGate()
+	gates.SetEnabled(features.SelectorServices, true)
+	shop := newTestGroup("shop",
+		v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80},
+		v1.ServiceItem{Selector: map[string]string{"app": "api"}, Namespace: testNamespace, Port: 8080, Path: "/api"},
+	)
+	webBridge := bridgeServiceName(shop, testIngressNamespace, shop.Spec.Services[0])
+	selectorName := selectorServiceName(shop, map[string]string{"app": "api"})
+	selectorBridge := bridgeServiceName(shop, testIngressNamespace, v1.ServiceItem{Name: selectorName, Namespace: testNamespace})
+	tests := []struct {
+		name             string
+		ingressNamespace string
+		namespaces       []string
+		// want and wantServices are keyed by namespace.
+		want          map[string]map[string][]string
+		wantServices  map[string]map[string]string
+		wantOwned     bool
+		wantFinalizer bool
+		wantReason    string
+	}{
+		{
+			name: "group namespace",
+			want: map[string]map[string][]string{
+				testNamespace: {"shop": {"/->web:80", "/api->" + selectorName + ":8080"}},
+			},
+			wantServices: map[string]map[string]string{
+				testNamespace: {"web": "", selectorName: ""},
+			},
+			wantOwned:  true,
+			wantReason: v1.ReasonReady,
+		},
+		{
+			name:             "ingress namespace set to the group namespace",
+			ingressNamespace: testNamespace,
+			want: map[string]map[string][]string{
+				testNamespace: {"shop": {"/->web:80", "/api->" + selectorName + ":8080"}},
+			},
+			wantServices: map[string]map[string]string{
+				testNamespace: {"web": "", selectorName: ""},
+			},
+			wantOwned:  true,
+			wantReason: v1.ReasonReady,
+		},
+		{
+			name:             "ingress namespace",
+			ingressNamespace: testIngressNamespace,
+			namespaces:       []string{testIngressNamespace},
+			want: map[string]map[string][]string{
+				testNamespace:        {},
+				testIngressNamespace: {"shop": {"/->" + webBridge + ":80", "/api->" + selectorBridge + ":8080"}},
+			},
+			wantServices: map[string]map[string]string{
+				testNamespace: {"web": "", selectorName: ""},
+				testIngressNamespace: {
+					webBridge:      "web.default.svc.cluster.local",
+					selectorBridge: selectorName + ".default.svc.cluster.local",
+				},
+			},
+			wantFinalizer: true,
+			wantReason:    v1.ReasonReady,
+		},
+		{
+			name:             "missing ingress namespace",
+			ingressNamespace: testIngressNamespace,
+			want: map[string]map[string][]string{
+				testNamespace:        {},
+				testIngressNamespace: {},
+			},
+			wantFinalizer: true,
+			wantReason:    v1.ReasonIngressNamespaceNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			objects := []runtime.Object{shop, newTestService("web", 80)}
+			for _, namespace := range test.namespaces {
+				objects = append(objects, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})
+			}
+			config := Config{
+				ControllerName:   "ingressgroup",
+				FeatureGates:     gates,
+				ClusterDomain:    "cluster.local",
+				IngressNamespace: test.ingressNamespace,
+			}
+			f := newFixture(t, config, objects...)
+			requeue, err := f.reconciler.Reconcile(context.Background(), testNamespace+"/shop")
+			if err != nil {
+				t.Fatalf("failed to reconcile: %v", err)
+			}
+
+			for namespace, want := range test.want {
+				ingresses, _ := f.placedObjects(t, namespace)
+				if !reflect.DeepEqual(ingresses, want) {
+					t.Errorf("got ingresses %v in %v, want %v", ingresses, namespace, want)
+				}
+			}
+			for namespace, want := range test.wantServices {
+				_, services := f.placedObjects(t, namespace)
+				if !reflect.DeepEqual(services, want) {
+					t.Errorf("got services %v in %v, want %v", services, namespace, want)
+				}
+			}
+			if test.wantReason == v1.ReasonReady {
+				ing, err := f.kubeClient.ExtensionsV1beta1().Ingresses(f.reconciler.ingressNamespace(shop)).Get("shop", metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("failed to get the ingress: %v", err)
+				}
+				if owned := metav1.IsControlledBy(ing, shop); owned != test.wantOwned {
+					t.Errorf("got ingress owned by the group %v, want %v", owned, test.wantOwned)
+				}
+				if got := ing.Annotations[ownerAnnotation]; got != testNamespace+"/shop" {
+					t.Errorf("got owner annotation %q, want %q", got, testNamespace+"/shop")
+				}
+			}
+
+			ig, err := f.versionedClient.CrV1().IngressGroups(testNamespace).Get("shop", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get the group: %v", err)
+			}
+			if got := hasCleanupFinalizer(ig); got != test.wantFinalizer {
+				t.Errorf("got cleanup finalizer %v, want %v", got, test.wantFinalizer)
+			}
+			if got := f.reason(t, "shop", v1.IngressGroupReady); got != test.wantReason {
+				t.Errorf("got ready reason %q, want %q", got, test.wantReason)
+			}
+			if wantRequeue := test.wantReason == v1.ReasonIngressNamespaceNotFound; (requeue == unresolvedRequeue) != wantRequeue {
+				t.Errorf("got requeue %v, want a retry %v", requeue, wantRequeue)
+			}
+		})
+	}
+}
+
+func TestReconcileIngressNamespaceCleanup(t *testing.T) {
+	now := metav1.Now()
+	shop := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80})
+	shop.DeletionTimestamp = &now
+	shop.Finalizers = []string{CleanupFinalizer, "example.com/other"}
+	placed := func(owner, name string) (*extensionsv1beta1.Ingress, *corev1.Service) {
+		meta := metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   testIngressNamespace,
+			Labels:      map[string]string{IngressGroupLabel: "shop", managedByLabel: "ingressgroup"},
+			Annotations: map[string]string{ownerAnnotation: owner},
+		}
+		return &extensionsv1beta1.Ingress{ObjectMeta: meta}, &corev1.Service{ObjectMeta: meta}
+	}
+	ing, bridge := placed(testNamespace+"/shop", "shop")
+	// The group of the same name in another namespace keeps its objects.
+	otherIng, otherBridge := placed("other/shop", "other-shop")
+	tests := []struct {
+		name         string
+		objects      []runtime.Object
+		want         []string
+		wantServices []string
+	}{
+		{
+			name:         "objects generated in the ingress namespace",
+			objects:      []runtime.Object{ing, bridge, otherIng, otherBridge},
+			want:         []string{"other-shop"},
+			wantServices: []string{"other-shop"},
+		},
+		{
+			name:         "objects already gone",
+			objects:      []runtime.Object{otherIng, otherBridge},
+			want:         []string{"other-shop"},
+			wantServices: []string{"other-shop"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			objects := append([]runtime.Object{shop, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testIngressNamespace}}}, test.objects...)
+			f := newFixture(t, Config{ControllerName: "ingressgroup", IngressNamespace: testIngressNamespace}, objects...)
+			f.reconcile(t, "shop")
+
+			ingresses, services := f.placedObjects(t, testIngressNamespace)
+			var got, gotServices []string
+			for name := range ingresses {
+				got = append(got, name)
+			}
+			for name := range services {
+				gotServices = append(gotServices, name)
+			}
+			sort.Strings(got)
+			sort.Strings(gotServices)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got ingresses %v, want %v", got, test.want)
+			}
+			if !reflect.DeepEqual(gotServices, test.wantServices) {
+				t.Errorf("got services %v, want %v", gotServices, test.wantServices)
+			}
+			ig, err := f.versionedClient.CrV1().IngressGroups(testNamespace).Get("shop", metav1.GetOptions{})
+			if errors.IsNotFound(err) {
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to get the group: %v", err)
+			}
+			if want := []string{"example.com/other"}; !reflect.DeepEqual(ig.Finalizers, want) {
+				t.Errorf("got finalizers %v, want %v", ig.Finalizers, want)
+			}
+		})
+	}
+}
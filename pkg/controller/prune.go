@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parsePruneStrategy returns the prune strategy of a group, one of
+// immediate, confirm or the grace prefix, and the grace period of the latter.
+func parsePruneStrategy(strategy string) (string, time.Duration, error) {
+	switch {
+	case strategy == "" || strategy == v1.PruneStrategyImmediate:
+		return v1.PruneStrategyImmediate, 0, nil
+	case strategy == v1.PruneStrategyConfirm:
+		return v1.PruneStrategyConfirm, 0, nil
+	case strings.HasPrefix(strategy, v1.PruneStrategyGracePrefix):
+		grace, err := time.ParseDuration(strings.TrimPrefix(strategy, v1.PruneStrategyGracePrefix))
+		if err != nil {
+			return "", 0, err
+		}
+		if grace <= 0 {
+			return "", 0, fmt.Errorf("grace period %v is not positive", grace)
+		}
+		return v1.PruneStrategyGracePrefix, grace, nil
+	}
+	return "", 0, fmt.Errorf("unknown prune strategy %q", strategy)
+}
+
+// prunedPath identifies a path routed by a generated Ingress, prefixed by its
+// host like in the status of the group.
+type prunedPath struct {
+	ingress string
+	path    string
+}
+
+// retainPruned keeps routing the paths the existing Ingresses of the group
+// route but the desired ones no longer do, for as long as the prune strategy
+// of the group asks, and records them in the status. The kept paths are added
+// back to the desired Ingress of the same name; the existing Ingresses no
+// longer desired at all are returned to be kept as they are.
+func (r *Reconciler) retainPruned(ig *v1.IngressGroup, ingresses []*extensionsv1beta1.Ingress, status *v1.IngressGroupStatus) ([]*extensionsv1beta1.Ingress, error) {
+	strategy, grace, err := parsePruneStrategy(ig.Spec.PruneStrategy)
+	if err != nil {
+		return nil, err
+	}
+	if strategy == v1.PruneStrategyImmediate {
+		status.PendingPrunes = nil
+		removeCondition(status, v1.IngressGroupPrunePending)
+		return nil, nil
+	}
+
+	existing, err := r.generatedIngresses(ig)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(existing, func(i, j int) bool { return existing[i].Name < existing[j].Name })
+
+	desired := map[string]*extensionsv1beta1.Ingress{}
+	routed := map[prunedPath]bool{}
+	for _, ing := range ingresses {
+		desired[ing.Name] = ing
+		for _, path := range generatedIngress(ing).Paths {
+			routed[prunedPath{ingress: ing.Name, path: path}] = true
+		}
+	}
+	since := map[prunedPath]metav1.Time{}
+	for _, pending := range status.PendingPrunes {
+		since[prunedPath{ingress: pending.Ingress, path: pending.Path}] = pending.Since
+	}
+
+	confirmed := ig.Annotations[ConfirmPruneAnnotation] == strconv.FormatInt(ig.Generation, 10)
+	now := metav1.Now()
+	var pending []v1.PendingPrune
+	var kept []*extensionsv1beta1.Ingress
+	for _, ing := range existing {
+		keep := false
+		for _, rule := range ing.Spec.Rules {
+			if rule.HTTP == nil {
+				continue
+			}
+			for _, path := range rule.HTTP.Paths {
+				key := prunedPath{ingress: ing.Name, path: rule.Host + path.Path}
+				if routed[key] {
+					continue
+				}
+				removed, ok := since[key]
+				if !ok {
+					removed = now
+				}
+				if strategy == v1.PruneStrategyConfirm && confirmed ||
+					strategy == v1.PruneStrategyGracePrefix && now.Sub(removed.Time) >= grace {
+					continue
+				}
+				pending = append(pending, v1.PendingPrune{Ingress: key.ingress, Path: key.path, Since: removed})
+				if d, ok := desired[ing.Name]; ok {
+					addIngressPath(d, rule.Host, path)
+				} else {
+					keep = true
+				}
+			}
+		}
+		if keep {
+			kept = append(kept, ing)
+		}
+	}
+
+	status.PendingPrunes = pending
+	if len(pending) == 0 {
+		removeCondition(status, v1.IngressGroupPrunePending)
+		return kept, nil
+	}
+	if strategy == v1.PruneStrategyConfirm {
+		setCondition(status, v1.IngressGroupPrunePending, corev1.ConditionTrue, v1.ReasonAwaitingConfirmation,
+			fmt.Sprintf("%d removed paths are still routed; annotate the group with %v=%d to withdraw them",
+				len(pending), ConfirmPruneAnnotation, ig.Generation))
+	} else {
+		setCondition(status, v1.IngressGroupPrunePending, corev1.ConditionTrue, v1.ReasonGracePeriod,
+			fmt.Sprintf("%d removed paths are still routed for up to %v", len(pending), grace))
+	}
+	return kept, nil
+}
+
+// addIngressPath adds the path to the rule of the Ingress for the host,
+// adding the rule if there is none.
+func addIngressPath(ing *extensionsv1beta1.Ingress, host string, path extensionsv1beta1.HTTPIngressPath) {
+	for i := range ing.Spec.Rules {
+		rule := &ing.Spec.Rules[i]
+		if rule.Host == host && rule.HTTP != nil {
+			rule.HTTP.Paths = append(rule.HTTP.Paths, path)
+			return
+		}
+	}
+	ing.Spec.Rules = append(ing.Spec.Rules, extensionsv1beta1.IngressRule{
+		Host: host,
+		IngressRuleValue: extensionsv1beta1.IngressRuleValue{
+			HTTP: &extensionsv1beta1.HTTPIngressRuleValue{Paths: []extensionsv1beta1.HTTPIngressPath{path}},
+		},
+	})
+}
+
+// pruneRequeue returns how soon the group must be synced again to withdraw
+// the paths its grace period keeps, 0 if there are none.
+func pruneRequeue(ig *v1.IngressGroup, status *v1.IngressGroupStatus, now time.Time) time.Duration {
+	strategy, grace, err := parsePruneStrategy(ig.Spec.PruneStrategy)
+	if err != nil || strategy != v1.PruneStrategyGracePrefix {
+		return 0
+	}
+	var next time.Duration
+	for _, pending := range status.PendingPrunes {
+		remaining := pending.Since.Add(grace).Sub(now)
+		if remaining < time.Second {
+			remaining = time.Second
+		}
+		if next == 0 || remaining < next {
+			next = remaining
+		}
+	}
+	return next
+}
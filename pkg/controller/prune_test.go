@@ -0,0 +1,170 @@
+package controller
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePruneStrategy(t *testing.T) {
+	tests := []struct {
+		strategy  string
+		want      string
+		wantGrace time.Duration
+		wantErr   bool
+	}{
+		{strategy: "", want: v1.PruneStrategyImmediate},
+		{strategy: "immediate", want: v1.PruneStrategyImmediate},
+		{strategy: "confirm", want: v1.PruneStrategyConfirm},
+		{strategy: "grace:10m", want: v1.PruneStrategyGracePrefix, wantGrace: 10 * time.Minute},
+		{strategy: "grace:0s", wantErr: true},
+		{strategy: "grace:soon", wantErr: true},
+		{strategy: "later", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.strategy, func(t *testing.T) {
+			got, grace, err := parsePruneStrategy(test.strategy)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want || grace != test.wantGrace {
+				t.Errorf("got strategy %q with grace %v, want %q with %v", got, grace, test.want, test.wantGrace)
+			}
+		})
+	}
+}
+
+func TestReconcilePruneStrategy(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		// confirm is the generation the group is annotated to confirm, if set.
+		confirm string
+		// removedAgo backdates the removal of /api recorded in the status.
+		removedAgo  time.Duration
+		want        []string
+		wantPending corev1.ConditionStatus
+		wantRequeue bool
+	}{
+		{
+			name:        "immediate withdraws the removed path",
+			strategy:    "immediate",
+			want:        []string{"/->web:80"},
+			wantPending: corev1.ConditionUnknown,
+		},
+		{
+			name:        "confirm keeps the removed path until confirmed",
+			strategy:    "confirm",
+			want:        []string{"/->web:80", "/api->api:8080"},
+			wantPending: corev1.ConditionTrue,
+		},
+		{
+			name:        "confirm withdraws the removed path once confirmed",
+			strategy:    "confirm",
+			confirm:     "2",
+			want:        []string{"/->web:80"},
+			wantPending: corev1.ConditionUnknown,
+		},
+		{
+			name:        "confirm of an older generation keeps the removed path",
+			strategy:    "confirm",
+			confirm:     "1",
+			want:        []string{"/->web:80", "/api->api:8080"},
+			wantPending: corev1.ConditionTrue,
+		},
+		{
+			name:        "grace keeps the removed path for the period",
+			strategy:    "grace:10m",
+			want:        []string{"/->web:80", "/api->api:8080"},
+			wantPending: corev1.ConditionTrue,
+			wantRequeue: true,
+		},
+		{
+			name:        "grace withdraws the removed path after the period",
+			strategy:    "grace:10m",
+			removedAgo:  time.Hour,
+			want:        []string{"/->web:80"},
+			wantPending: corev1.ConditionUnknown,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shop := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80})
+			shop.Generation = 2
+			shop.Spec.PruneStrategy = test.strategy
+			if test.confirm != "" {
+				shop.Annotations = map[string]string{ConfirmPruneAnnotation: test.confirm}
+			}
+			if test.removedAgo != 0 {
+				shop.Status.PendingPrunes = []v1.PendingPrune{{
+					Ingress: "shop",
+					Path:    "/api",
+					Since:   metav1.NewTime(time.Now().Add(-test.removedAgo)),
+				}}
+			}
+			// The Ingress still routes /api, which the group no longer does.
+			ing := newTestIngress("shop", "shop", shop, "/", "web", 80)
+			addIngressPath(ing, "", extensionsv1beta1.HTTPIngressPath{
+				Path:    "/api",
+				Backend: extensionsv1beta1.IngressBackend{ServiceName: "api", ServicePort: intstr.FromInt(8080)},
+			})
+			f := newFixture(t, Config{ControllerName: "ingressgroup"}, shop, ing,
+				newTestService("web", 80), newTestService("api", 8080))
+
+			requeue, err := f.reconciler.Reconcile(context.Background(), testNamespace+"/shop")
+			if err != nil {
+				t.Fatalf("failed to reconcile shop: %v", err)
+			}
+			if got := f.ingresses(t)["shop"]; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got paths %v, want %v", got, test.want)
+			}
+			if got := f.condition(t, "shop", v1.IngressGroupPrunePending); got != test.wantPending {
+				t.Errorf("got PrunePending condition %v, want %v", got, test.wantPending)
+			}
+			if test.wantRequeue && (requeue <= 0 || requeue > 10*time.Minute) {
+				t.Errorf("got requeue after %v, want within the grace period", requeue)
+			}
+		})
+	}
+}
+
+func TestPruneRequeue(t *testing.T) {
+	now := time.Now()
+	pending := func(ago ...time.Duration) *v1.IngressGroupStatus {
+		status := &v1.IngressGroupStatus{}
+		for _, d := range ago {
+			status.PendingPrunes = append(status.PendingPrunes, v1.PendingPrune{Since: metav1.NewTime(now.Add(-d))})
+		}
+		return status
+	}
+	tests := []struct {
+		name     string
+		strategy string
+		status   *v1.IngressGroupStatus
+		want     time.Duration
+	}{
+		{name: "immediate", strategy: "immediate", status: pending(time.Minute), want: 0},
+		{name: "confirm", strategy: "confirm", status: pending(time.Minute), want: 0},
+		{name: "grace without pending paths", strategy: "grace:10m", status: pending(), want: 0},
+		{name: "grace of the oldest pending path", strategy: "grace:10m", status: pending(time.Minute, 4*time.Minute), want: 6 * time.Minute},
+		{name: "grace already elapsed", strategy: "grace:10m", status: pending(time.Hour), want: time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ig := newTestGroup("shop")
+			ig.Spec.PruneStrategy = test.strategy
+			if got := pruneRequeue(ig, test.status, now); got != test.want {
+				t.Errorf("got requeue after %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,1106 @@
+// Package controller renders IngressGroups into the Ingresses served by
+// ingress-nginx.
+package controller
+
+import (
+	"context"
+	"fmt"
+	"github.com/liabio/ingressgroup/pkg/features"
+	"github.com/liabio/ingressgroup/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	extensionslisters "k8s.io/client-go/listers/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"k8s.io/ingress-nginx/pkg/client/clientset/versioned"
+	iglisters "k8s.io/ingress-nginx/pkg/client/listers/ingressgroup/v1"
+	"k8s.io/klog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config holds the settings of the Reconciler.
+type Config struct {
+	// ControllerName is set as the managed-by label of the generated objects.
+	ControllerName string
+	// FeatureGates tells which features of IngressGroups are enabled. The
+	// defaults apply if nil.
+	FeatureGates *features.FeatureGate
+	// ClusterDomain is the DNS domain of the cluster, used to address the
+	// services bridged from other namespaces.
+	ClusterDomain string
+	// APIErrorThreshold is the number of consecutive throttling or server
+	// errors from the API server after which the syncs pause for
+	// APIErrorCoolDown. 0 disables the pause.
+	APIErrorThreshold int
+	APIErrorCoolDown  time.Duration
+	// MaxConcurrentAPICalls bounds the write calls in flight against the API
+	// server. 0 leaves them unbounded.
+	MaxConcurrentAPICalls int
+	// ServerDryRun sends every write of an Ingress as a dry run first, so
+	// rejections by the API server or its admission webhooks are reported in
+	// the Admitted condition instead of failing the sync.
+	ServerDryRun bool
+	// AnnotationsPrefix is the prefix of the annotations ingress-nginx reads,
+	// DefaultAnnotationsPrefix if empty.
+	AnnotationsPrefix string
+	// DeletionPropagation is the propagation policy of the deletes of
+	// generated objects the group no longer needs. Background if empty.
+	DeletionPropagation metav1.DeletionPropagation
+	// RequireNamespaceOptIn makes the controller ignore the groups of the
+	// namespaces not labeled NamespaceOptInLabel=true.
+	RequireNamespaceOptIn bool
+	// ValidateIngressClass checks that the ingress classes the services of a
+	// group use exist as IngressClasses. Only set it for clusters serving
+	// networking.k8s.io/v1 IngressClasses, on which the check would fail
+	// every group otherwise.
+	ValidateIngressClass bool
+	// ObserveOnly computes the objects of the groups and reports the outcome
+	// in their status, but never writes the generated objects.
+	ObserveOnly bool
+	// TCPServicesConfigMap and UDPServicesConfigMap are the namespace/name
+	// of the ConfigMaps ingress-nginx reads its TCP and UDP services from.
+	// The stream services of the groups are skipped for an empty one.
+	TCPServicesConfigMap string
+	UDPServicesConfigMap string
+	// MissingCRDFields are the spec fields the installed CRD does not define,
+	// reported on the OutdatedCRD condition of every group.
+	MissingCRDFields []string
+	// DisableIngressStatusSync stops copying the addresses published on the
+	// generated Ingresses into the status of their groups, for clusters where
+	// another tool owns the status of Ingresses.
+	DisableIngressStatusSync bool
+	// StatusUpdateInterval holds back the status updates of the groups so
+	// the ones computed for a group within the interval are written once,
+	// by FlushStatusUpdates. 0 writes them right away.
+	StatusUpdateInterval time.Duration
+	// AnnotationsAllowlist are the keys of the annotations of the groups
+	// passed through to the generated Ingresses; a key ending in * allows
+	// the keys starting with the rest. Any key is passed through if empty.
+	AnnotationsAllowlist []string
+	// IngressNamespace is the namespace the Ingresses of every group are
+	// generated in, along with the bridges to its services and where its
+	// Secrets are read from. The group's namespace if empty.
+	IngressNamespace string
+}
+
+// Reconciler makes the Ingresses generated for IngressGroups match their spec.
+type Reconciler struct {
+	kubeClient      kubernetes.Interface
+	versionedClient versioned.Interface
+	igLister        iglisters.IngressGroupLister
+	ingLister       extensionslisters.IngressLister
+	nsLister        corelisters.NamespaceLister
+	svcLister       corelisters.ServiceLister
+	recorder        record.EventRecorder
+	config          Config
+	breaker         *circuitBreaker
+	writes          writeLimiter
+	// statuses holds back the status updates when they are batched, nil
+	// otherwise.
+	statuses *statusWriter
+
+	// generations records when the controller first saw each generation of
+	// the groups, keyed by namespace/name.
+	generationsLock sync.Mutex
+	generations     map[string]generationSeen
+}
+
+type generationSeen struct {
+	generation int64
+	time       time.Time
+}
+
+// NewReconciler returns a Reconciler reading IngressGroups, the Ingresses
+// generated for them, namespaces and Services from the listers and writing
+// through the given clients. The Service lister must cover the namespaces of
+// the services the groups reference, and all namespaces with the
+// ServiceDiscovery feature gate.
+func NewReconciler(kubeClient kubernetes.Interface, versionedClient versioned.Interface, igLister iglisters.IngressGroupLister, ingLister extensionslisters.IngressLister, nsLister corelisters.NamespaceLister, svcLister corelisters.ServiceLister, recorder record.EventRecorder, config Config) *Reconciler {
+	if config.FeatureGates == nil {
+		config.FeatureGates = features.NewFeatureGate()
+	}
+	if config.DeletionPropagation == "" {
+		config.DeletionPropagation = metav1.DeletePropagationBackground
+	}
+	if config.AnnotationsPrefix == "" {
+		config.AnnotationsPrefix = DefaultAnnotationsPrefix
+	}
+	r := &Reconciler{
+		kubeClient:      kubeClient,
+		versionedClient: versionedClient,
+		igLister:        igLister,
+		ingLister:       ingLister,
+		nsLister:        nsLister,
+		svcLister:       svcLister,
+		recorder:        recorder,
+		config:          config,
+		breaker:         newCircuitBreaker(config.APIErrorThreshold, config.APIErrorCoolDown),
+		writes:          newWriteLimiter(config.MaxConcurrentAPICalls),
+		generations:     map[string]generationSeen{},
+	}
+	if config.StatusUpdateInterval > 0 {
+		r.statuses = newStatusWriter()
+	}
+	return r
+}
+
+// Reconcile syncs the IngressGroup with the given namespace/name key. Deleted
+// groups need no work since their Ingresses are garbage collected through
+// their owner references, unless they were generated in another namespace
+// and the group waits on CleanupFinalizer. It returns how soon the group must
+// be synced again without any event, 0 if it need not.
+func (r *Reconciler) Reconcile(ctx context.Context, key string) (time.Duration, error) {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	ig, err := r.igLister.IngressGroups(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		klog.V(4).Infof("ingress group %v has been deleted", key)
+		r.generationsLock.Lock()
+		delete(r.generations, key)
+		r.generationsLock.Unlock()
+		metrics.MissingServices.DeleteLabelValues(namespace, name)
+		metrics.ReconcileErrors.DeleteLabelValues(namespace, name)
+		return 0, r.releaseStreamServices(key)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if ig.DeletionTimestamp != nil && hasCleanupFinalizer(ig) {
+		return 0, r.finalize(ig)
+	}
+
+	// The groups of a namespace being deleted go away with it, and syncing
+	// them would only fail on the writes the namespace no longer accepts.
+	ns, err := r.nsLister.Get(namespace)
+	if errors.IsNotFound(err) {
+		klog.V(2).Infof("skipping ingress group %v, namespace %v is gone", key, namespace)
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if ns.Status.Phase == corev1.NamespaceTerminating {
+		klog.V(2).Infof("skipping ingress group %v, namespace %v is terminating", key, namespace)
+		return 0, nil
+	}
+	if r.config.RequireNamespaceOptIn && ns.Labels[NamespaceOptInLabel] != "true" {
+		klog.V(2).Infof("skipping ingress group %v, namespace %v is not labeled %v=true", key, namespace, NamespaceOptInLabel)
+		return 0, nil
+	}
+
+	if err := r.breaker.wait(ctx); err != nil {
+		return 0, err
+	}
+	if ig, err = r.ensureCleanupFinalizer(ig); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	requeue, err := r.syncIngressGroup(ig)
+	r.breaker.record(err)
+	if err != nil {
+		metrics.Reconciles.WithLabelValues("error").Inc()
+		metrics.ReconcileDuration.WithLabelValues("error").Observe(time.Since(start).Seconds())
+		metrics.ReconcileErrors.WithLabelValues(namespace, name).Inc()
+		r.recorder.Eventf(ig, corev1.EventTypeWarning, "SyncFailed", "Failed to sync ingress group: %v", err)
+		return 0, err
+	}
+	metrics.Reconciles.WithLabelValues("success").Inc()
+	metrics.ReconcileDuration.WithLabelValues("success").Observe(time.Since(start).Seconds())
+	return requeue, nil
+}
+
+// syncIngressGroup makes the Ingresses generated for the IngressGroup match
+// its spec and records the outcome in the group's status. It returns how soon
+// the group must be synced again, see syncRequeue.
+func (r *Reconciler) syncIngressGroup(ig *v1.IngressGroup) (time.Duration, error) {
+	start := r.generationStart(ig)
+
+	// A status held back for a later write is newer than the cached one.
+	current := &ig.Status
+	if r.statuses != nil {
+		if pending := r.statuses.status(ig); pending != nil {
+			current = pending
+		}
+	}
+	status := current.DeepCopy()
+	pruneConditions(status)
+	if status.ObservedGeneration != ig.Generation {
+		status.ObservedGeneration = ig.Generation
+		status.ReadyTime = nil
+	}
+
+	if len(r.config.MissingCRDFields) > 0 {
+		setCondition(status, v1.IngressGroupOutdatedCRD, corev1.ConditionTrue, v1.ReasonFieldsMissing,
+			fmt.Sprintf("the installed CRD lacks the fields %v, which the API server may drop; update the CRD or run the controller with --install-crd",
+				strings.Join(r.config.MissingCRDFields, ", ")))
+	} else {
+		removeCondition(status, v1.IngressGroupOutdatedCRD)
+	}
+
+	err := r.syncIngress(ig, status)
+	if err != nil {
+		setCondition(status, v1.IngressGroupReady, corev1.ConditionFalse, v1.ReasonSyncFailed, err.Error())
+	}
+	if lbErr := r.syncLoadBalancer(ig, status); lbErr != nil && err == nil {
+		err = lbErr
+	}
+	if err != nil {
+		setCondition(status, v1.IngressGroupSynced, corev1.ConditionFalse, v1.ReasonSyncFailed, err.Error())
+	} else {
+		setCondition(status, v1.IngressGroupSynced, corev1.ConditionTrue, v1.ReasonSynced, "")
+	}
+	setDegraded(status)
+	if status.ReadyTime == nil && isConditionTrue(status, v1.IngressGroupReady) {
+		now := metav1.Now()
+		status.ReadyTime = &now
+		metrics.TimeToReady.Observe(now.Sub(start).Seconds())
+	}
+
+	if !apiequality.Semantic.DeepEqual(current, status) {
+		newIG := ig.DeepCopy()
+		newIG.Status = *status
+		if r.statuses != nil {
+			r.statuses.queue(newIG)
+		} else if updateErr := r.writes.do(func() error {
+			_, err := r.versionedClient.CrV1().IngressGroups(ig.Namespace).UpdateStatus(newIG)
+			return err
+		}); updateErr != nil && err == nil {
+			err = updateErr
+		}
+	}
+	return syncRequeue(ig, status, time.Now()), err
+}
+
+// unresolvedRequeue is how soon a group is synced again while it references a
+// service the controller may not read or a port its service lacks, or while
+// the ingress namespace is missing. Granting the controller access raises no
+// event, nor does a change to a Service of a namespace it does not watch or
+// the creation of a namespace.
+const unresolvedRequeue = 30 * time.Second
+
+// syncRequeue returns how soon the group must be synced again without any
+// event, to withdraw the paths its prune strategy keeps for a grace period or
+// to retry its unresolved services, 0 if it need not.
+func syncRequeue(ig *v1.IngressGroup, status *v1.IngressGroupStatus, now time.Time) time.Duration {
+	requeue := pruneRequeue(ig, status, now)
+	ready := findCondition(status, v1.IngressGroupReady)
+	if ready == nil || ready.Reason != v1.ReasonServiceForbidden && ready.Reason != v1.ReasonPortNotFound &&
+		ready.Reason != v1.ReasonIngressNamespaceNotFound {
+		return requeue
+	}
+	if requeue == 0 || requeue > unresolvedRequeue {
+		requeue = unresolvedRequeue
+	}
+	return requeue
+}
+
+// syncLoadBalancer copies the addresses published on the Ingresses generated
+// for the group into its status. The Ingresses are read from the cache, which
+// is updated as ingress-nginx publishes their status. With the status sync
+// disabled, the addresses and the Addressed condition are cleared instead.
+func (r *Reconciler) syncLoadBalancer(ig *v1.IngressGroup, status *v1.IngressGroupStatus) error {
+	if r.config.DisableIngressStatusSync {
+		status.LoadBalancer = corev1.LoadBalancerStatus{}
+		removeCondition(status, v1.IngressGroupAddressed)
+		return nil
+	}
+	ingresses, err := r.generatedIngresses(ig)
+	if err != nil {
+		return err
+	}
+	sort.Slice(ingresses, func(i, j int) bool { return ingresses[i].Name < ingresses[j].Name })
+
+	var addresses []corev1.LoadBalancerIngress
+	seen := map[corev1.LoadBalancerIngress]bool{}
+	for _, ing := range ingresses {
+		for _, address := range ing.Status.LoadBalancer.Ingress {
+			if !seen[address] {
+				seen[address] = true
+				addresses = append(addresses, address)
+			}
+		}
+	}
+	status.LoadBalancer = corev1.LoadBalancerStatus{Ingress: addresses}
+
+	if len(addresses) == 0 {
+		setCondition(status, v1.IngressGroupAddressed, corev1.ConditionFalse, v1.ReasonNoAddress,
+			"no address has been published on the generated ingresses yet")
+	} else {
+		setCondition(status, v1.IngressGroupAddressed, corev1.ConditionTrue, v1.ReasonAddressAssigned, "")
+	}
+	return nil
+}
+
+// generationStart returns when the current generation of the group came to
+// be: its creation time for the first generation, otherwise when the
+// controller first saw the generation, which is late if the spec changed
+// while the controller was down.
+func (r *Reconciler) generationStart(ig *v1.IngressGroup) time.Time {
+	if ig.Generation <= 1 {
+		return ig.CreationTimestamp.Time
+	}
+
+	key := ig.Namespace + "/" + ig.Name
+	r.generationsLock.Lock()
+	defer r.generationsLock.Unlock()
+	seen, ok := r.generations[key]
+	if !ok || seen.generation != ig.Generation {
+		seen = generationSeen{generation: ig.Generation, time: time.Now()}
+		r.generations[key] = seen
+	}
+	return seen.time
+}
+
+func (r *Reconciler) syncIngress(ig *v1.IngressGroup, status *v1.IngressGroupStatus) error {
+	ig = setDefaults(ig)
+
+	if namespace := r.ingressNamespace(ig); namespace != ig.Namespace {
+		_, err := r.nsLister.Get(namespace)
+		if errors.IsNotFound(err) {
+			setCondition(status, v1.IngressGroupReady, corev1.ConditionFalse, v1.ReasonIngressNamespaceNotFound,
+				fmt.Sprintf("the ingress namespace %v does not exist", namespace))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	ok, err := r.syncBasicAuth(ig, status)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// Leave the current Ingress as is rather than expose the group
+		// without the authentication it asks for.
+		setCondition(status, v1.IngressGroupReady, corev1.ConditionFalse, v1.ReasonBasicAuthNotReady,
+			"the basic auth secret of the group is not usable")
+		return nil
+	}
+
+	ig = r.syncSnippets(ig, status)
+	ig = r.syncAnnotations(ig, status)
+	ig, err = r.discoverServices(ig)
+	if err != nil {
+		return err
+	}
+
+	invalidErr := validateIngressGroup(ig)
+	if invalidErr == nil && r.config.ValidateIngressClass {
+		if invalidErr, err = r.checkIngressClasses(ig); err != nil {
+			return err
+		}
+	}
+	if invalidErr != nil {
+		setCondition(status, v1.IngressGroupValid, corev1.ConditionFalse, invalidErr.reason, invalidErr.message)
+		setCondition(status, v1.IngressGroupReady, corev1.ConditionFalse, v1.ReasonInvalid, invalidErr.message)
+		return nil
+	}
+	setCondition(status, v1.IngressGroupValid, corev1.ConditionTrue, v1.ReasonValid, "")
+
+	if err := r.syncTLS(ig, status); err != nil {
+		return err
+	}
+
+	if disabled := r.disabledFeatures(ig); len(disabled) > 0 {
+		message := fmt.Sprintf("the group uses features disabled on the controller: %s; enable them with --feature-gates",
+			strings.Join(disabled, ", "))
+		setCondition(status, v1.IngressGroupFeatureDisabled, corev1.ConditionTrue, v1.ReasonFeatureDisabled, message)
+		// Without canaries the weighted services cannot be rendered;
+		// the other features degrade by dropping what they cover.
+		if r.usesCanary(ig) && !r.config.FeatureGates.Enabled(features.Canary) {
+			setCondition(status, v1.IngressGroupReady, corev1.ConditionFalse, v1.ReasonFeatureDisabled, message)
+			return nil
+		}
+	} else {
+		removeCondition(status, v1.IngressGroupFeatureDisabled)
+	}
+
+	err = r.syncGenerated(ig, status)
+	if forbidden, ok := err.(*serviceForbiddenError); ok {
+		r.recorder.Eventf(ig, corev1.EventTypeWarning, "ServiceForbidden", "%v", forbidden)
+		setCondition(status, v1.IngressGroupServiceForbidden, corev1.ConditionTrue, v1.ReasonForbidden, forbidden.Error())
+		setCondition(status, v1.IngressGroupReady, corev1.ConditionFalse, v1.ReasonServiceForbidden, forbidden.Error())
+		return nil
+	}
+	removeCondition(status, v1.IngressGroupServiceForbidden)
+	if notFound, ok := err.(*portNotFoundError); ok {
+		r.recorder.Eventf(ig, corev1.EventTypeWarning, "PortNotFound", "%v", notFound)
+		setCondition(status, v1.IngressGroupPortsResolved, corev1.ConditionFalse, v1.ReasonPortNotFound, notFound.Error())
+		setCondition(status, v1.IngressGroupReady, corev1.ConditionFalse, v1.ReasonPortNotFound, notFound.Error())
+		return nil
+	}
+	if conflict, ok := err.(*nameConflictError); ok {
+		r.recorder.Eventf(ig, corev1.EventTypeWarning, "NameConflict", "%v", conflict)
+		setCondition(status, v1.IngressGroupNameConflict, corev1.ConditionTrue, v1.ReasonNotManaged, conflict.Error())
+		setCondition(status, v1.IngressGroupReady, corev1.ConditionFalse, v1.ReasonNameConflict, conflict.Error())
+		return nil
+	}
+	if rejected, ok := err.(*rejectedError); ok {
+		r.recorder.Eventf(ig, corev1.EventTypeWarning, "Rejected", "%v", rejected)
+		setCondition(status, v1.IngressGroupAdmitted, corev1.ConditionFalse, v1.ReasonRejected, rejected.Error())
+		setCondition(status, v1.IngressGroupReady, corev1.ConditionFalse, v1.ReasonRejected, rejected.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	removeCondition(status, v1.IngressGroupNameConflict)
+	setCondition(status, v1.IngressGroupPortsResolved, corev1.ConditionTrue, v1.ReasonPortsResolved, "")
+	if r.config.ServerDryRun {
+		setCondition(status, v1.IngressGroupAdmitted, corev1.ConditionTrue, v1.ReasonAdmitted, "")
+	} else {
+		removeCondition(status, v1.IngressGroupAdmitted)
+	}
+	setCondition(status, v1.IngressGroupReady, corev1.ConditionTrue, v1.ReasonReady, "")
+	return nil
+}
+
+// syncGenerated makes the Ingresses and Services generated for the group
+// match its spec, and lists them in the status once they do, along with the
+// paths each Ingress routes.
+func (r *Reconciler) syncGenerated(ig *v1.IngressGroup, status *v1.IngressGroupStatus) error {
+	items, backends, err := r.resolveBackends(ig)
+	if err != nil {
+		return err
+	}
+	var managed []v1.TypedObjectReference
+	var generated []v1.GeneratedIngress
+	var ingresses []*extensionsv1beta1.Ingress
+	if len(items) == 0 {
+		klog.Warningf("ingress group %v/%v has no services to expose", ig.Namespace, ig.Name)
+	} else {
+		ingresses = newIngresses(ig, items, backends, r.config.AnnotationsPrefix)
+		for _, ing := range ingresses {
+			r.place(ig, ing)
+		}
+		kept, err := r.retainPruned(ig, ingresses, status)
+		if err != nil {
+			return err
+		}
+		if err := r.syncIngresses(ig, ingresses, kept); err != nil {
+			return err
+		}
+		for _, ing := range append(ingresses, kept...) {
+			managed = append(managed, v1.TypedObjectReference{APIVersion: "extensions/v1beta1", Kind: "Ingress", Name: ing.Name})
+			generated = append(generated, generatedIngress(ing))
+		}
+	}
+	if err := r.pruneServices(ig); err != nil {
+		return err
+	}
+	if err := r.syncStreamServices(ig); err != nil {
+		return err
+	}
+	for _, name := range r.generatedServiceNames(ig).List() {
+		managed = append(managed, v1.TypedObjectReference{APIVersion: "v1", Kind: "Service", Name: name})
+	}
+	status.ManagedResources = managed
+	status.Ingresses = generated
+	if hash := ingressesHash(ingresses); hash != status.AppliedHash {
+		now := metav1.Now()
+		status.AppliedHash = hash
+		status.LastAppliedTime = &now
+	}
+	return nil
+}
+
+// generatedIngress describes the Ingress for the status of its group.
+func generatedIngress(ing *extensionsv1beta1.Ingress) v1.GeneratedIngress {
+	generated := v1.GeneratedIngress{Name: ing.Name, IngressClassName: ing.Annotations[ingressClassAnnotation]}
+	for _, rule := range ing.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			generated.Paths = append(generated.Paths, rule.Host+path.Path)
+		}
+	}
+	return generated
+}
+
+// checkIngressClasses checks that the ingress classes the services of the
+// group use exist. The vendored client has no IngressClass type, so they
+// are read through the raw REST client.
+func (r *Reconciler) checkIngressClasses(ig *v1.IngressGroup) (*validationError, error) {
+	classes := sets.NewString()
+	for _, item := range ig.Spec.Services {
+		if item.IngressClassName != "" {
+			classes.Insert(item.IngressClassName)
+		}
+	}
+	for _, class := range classes.List() {
+		err := r.kubeClient.ExtensionsV1beta1().RESTClient().Get().
+			AbsPath("/apis/networking.k8s.io/v1/ingressclasses", class).
+			Do().Error()
+		if errors.IsNotFound(err) {
+			return invalid(v1.ReasonInvalidIngressClass, "ingress class %q does not exist", class), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get ingress class %q: %v", class, err)
+		}
+	}
+	return nil, nil
+}
+
+// observing reports whether the controller only observes, in which case it
+// logs the write it skips.
+func (r *Reconciler) observing(format string, args ...interface{}) bool {
+	if !r.config.ObserveOnly {
+		return false
+	}
+	klog.V(2).Infof(format, args...)
+	return true
+}
+
+// deleteOptions returns the options of the deletes of generated objects.
+func (r *Reconciler) deleteOptions() *metav1.DeleteOptions {
+	policy := r.config.DeletionPropagation
+	return &metav1.DeleteOptions{PropagationPolicy: &policy}
+}
+
+// managedBy reports whether the existing object was generated for the
+// IngressGroup. Objects generated before the managed-by marker existed, or
+// under a previous controller name, are recognized by their controller
+// reference.
+func (r *Reconciler) managedBy(obj metav1.Object, ig *v1.IngressGroup) bool {
+	if metav1.IsControlledBy(obj, ig) {
+		return true
+	}
+	return obj.GetLabels()[managedByLabel] == r.config.ControllerName &&
+		obj.GetAnnotations()[ownerAnnotation] == ig.Namespace+"/"+ig.Name
+}
+
+// nameConflictError is returned when an object the group would generate
+// already exists but was not generated for the group.
+type nameConflictError struct {
+	kind string
+	name string
+}
+
+func (e *nameConflictError) Error() string {
+	return fmt.Sprintf("%s %q already exists and is not managed by this ingress group", e.kind, e.name)
+}
+
+// disabledFeatures returns the names of the features the group uses that are
+// disabled on the controller.
+func (r *Reconciler) disabledFeatures(ig *v1.IngressGroup) []string {
+	var disabled []string
+	if r.usesCanary(ig) && !r.config.FeatureGates.Enabled(features.Canary) {
+		disabled = append(disabled, string(features.Canary))
+	}
+	if !r.config.FeatureGates.Enabled(features.CrossNamespace) {
+		for _, item := range ig.Spec.Services {
+			if item.Namespace != ig.Namespace {
+				disabled = append(disabled, string(features.CrossNamespace))
+				break
+			}
+		}
+	}
+	if usesSnippets(ig) && !r.config.FeatureGates.Enabled(features.Snippets) {
+		disabled = append(disabled, string(features.Snippets))
+	}
+	if !r.config.FeatureGates.Enabled(features.SelectorServices) {
+		for _, item := range ig.Spec.Services {
+			if len(item.Selector) > 0 {
+				disabled = append(disabled, string(features.SelectorServices))
+				break
+			}
+		}
+	}
+	if ig.Spec.ServiceSelector != nil && !r.config.FeatureGates.Enabled(features.ServiceDiscovery) {
+		disabled = append(disabled, string(features.ServiceDiscovery))
+	}
+	return disabled
+}
+
+// usesCanary reports whether services of the group share a path, which is
+// rendered as canary Ingresses.
+func (r *Reconciler) usesCanary(ig *v1.IngressGroup) bool {
+	for _, group := range servicesByPath(ig.Spec.Services) {
+		if len(group) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceForbiddenError is returned when the API server forbids the
+// controller to read a service the group references.
+type serviceForbiddenError struct {
+	namespace string
+	name      string
+}
+
+func (e *serviceForbiddenError) Error() string {
+	return fmt.Sprintf("the controller is forbidden to read service %s/%s: grant it get on the services of namespace %s",
+		e.namespace, e.name, e.namespace)
+}
+
+// portNotFoundError is returned when a service item refers to a port name
+// or number its service does not define.
+type portNotFoundError struct {
+	namespace string
+	name      string
+	portName  string
+	port      int32
+	available []string
+}
+
+func newPortNotFoundError(svc *corev1.Service, portName string) *portNotFoundError {
+	var available []string
+	for _, port := range svc.Spec.Ports {
+		if port.Name != "" {
+			available = append(available, port.Name)
+		}
+	}
+	return &portNotFoundError{namespace: svc.Namespace, name: svc.Name, portName: portName, available: available}
+}
+
+func newPortNumberNotFoundError(svc *corev1.Service, number int32) *portNotFoundError {
+	var available []string
+	for _, port := range svc.Spec.Ports {
+		available = append(available, strconv.Itoa(int(port.Port)))
+	}
+	return &portNotFoundError{namespace: svc.Namespace, name: svc.Name, port: number, available: available}
+}
+
+func (e *portNotFoundError) Error() string {
+	if e.portName == "" {
+		return fmt.Sprintf("service %s/%s has no port %d, its ports are %s",
+			e.namespace, e.name, e.port, strings.Join(e.available, ", "))
+	}
+	if len(e.available) == 0 {
+		return fmt.Sprintf("service %s/%s has no port named %q, none of its ports is named", e.namespace, e.name, e.portName)
+	}
+	return fmt.Sprintf("service %s/%s has no port named %q, its ports are named %s",
+		e.namespace, e.name, e.portName, strings.Join(e.available, ", "))
+}
+
+// hasPortName reports whether the service defines a port with the name.
+func hasPortName(svc *corev1.Service, name string) bool {
+	for _, port := range svc.Spec.Ports {
+		if port.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPortNumber reports whether the service defines a port with the number.
+func hasPortNumber(svc *corev1.Service, number int32) bool {
+	for _, port := range svc.Spec.Ports {
+		if port.Port == number {
+			return true
+		}
+	}
+	return false
+}
+
+// syncBasicAuth checks that the basic auth secret referenced by the group
+// exists next to its Ingresses and holds an htpasswd file, reporting the
+// result as a condition.
+func (r *Reconciler) syncBasicAuth(ig *v1.IngressGroup, status *v1.IngressGroupStatus) (bool, error) {
+	name := ig.Spec.BasicAuthSecret
+	if name == "" {
+		removeCondition(status, v1.IngressGroupBasicAuthReady)
+		return true, nil
+	}
+
+	secret, err := r.kubeClient.CoreV1().Secrets(r.ingressNamespace(ig)).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		setCondition(status, v1.IngressGroupBasicAuthReady, corev1.ConditionFalse, v1.ReasonSecretNotFound,
+			fmt.Sprintf("secret %q not found", name))
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(secret.Data["auth"]) == 0 {
+		setCondition(status, v1.IngressGroupBasicAuthReady, corev1.ConditionFalse, v1.ReasonInvalidSecret,
+			fmt.Sprintf("secret %q has no %q key", name, "auth"))
+		return false, nil
+	}
+
+	setCondition(status, v1.IngressGroupBasicAuthReady, corev1.ConditionTrue, v1.ReasonSecretFound, "")
+	return true, nil
+}
+
+// syncTLS checks that the Secrets the TLS block of the group references exist
+// next to its Ingresses and hold a certificate and key, reporting the outcome
+// as a condition. The Ingresses are generated either way: ingress-nginx serves
+// its default certificate for the hosts whose Secret is missing.
+func (r *Reconciler) syncTLS(ig *v1.IngressGroup, status *v1.IngressGroupStatus) error {
+	names := sets.NewString()
+	for _, entry := range ig.Spec.TLS {
+		names.Insert(entry.SecretName)
+	}
+	if names.Len() == 0 {
+		removeCondition(status, v1.IngressGroupTLSReady)
+		return nil
+	}
+
+	var missing, incomplete []string
+	for _, name := range names.List() {
+		secret, err := r.kubeClient.CoreV1().Secrets(r.ingressNamespace(ig)).Get(name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			missing = append(missing, name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(secret.Data[corev1.TLSCertKey]) == 0 || len(secret.Data[corev1.TLSPrivateKeyKey]) == 0 {
+			incomplete = append(incomplete, name)
+		}
+	}
+
+	switch {
+	case len(missing) > 0:
+		setCondition(status, v1.IngressGroupTLSReady, corev1.ConditionFalse, v1.ReasonSecretNotFound,
+			fmt.Sprintf("TLS secrets not found: %v", strings.Join(missing, ", ")))
+	case len(incomplete) > 0:
+		setCondition(status, v1.IngressGroupTLSReady, corev1.ConditionFalse, v1.ReasonInvalidSecret,
+			fmt.Sprintf("TLS secrets without %v and %v: %v", corev1.TLSCertKey, corev1.TLSPrivateKeyKey, strings.Join(incomplete, ", ")))
+	default:
+		setCondition(status, v1.IngressGroupTLSReady, corev1.ConditionTrue, v1.ReasonSecretFound, "")
+	}
+	return nil
+}
+
+// syncSnippets drops the nginx snippets of the group, its server snippet and
+// the response headers rendered into a snippet, unless the controller allows
+// them, reporting the outcome as a condition.
+func (r *Reconciler) syncSnippets(ig *v1.IngressGroup, status *v1.IngressGroupStatus) *v1.IngressGroup {
+	if !usesSnippets(ig) {
+		removeCondition(status, v1.IngressGroupSnippetsAccepted)
+		return ig
+	}
+	if r.config.FeatureGates.Enabled(features.Snippets) {
+		setCondition(status, v1.IngressGroupSnippetsAccepted, corev1.ConditionTrue, v1.ReasonSnippetsAllowed, "")
+		return ig
+	}
+
+	klog.Warningf("ingress group %v/%v: dropping server snippet and response headers, snippets are not allowed", ig.Namespace, ig.Name)
+	setCondition(status, v1.IngressGroupSnippetsAccepted, corev1.ConditionFalse, v1.ReasonSnippetsDisabled,
+		"server snippet and response headers dropped: the Snippets feature gate is disabled")
+	ig = ig.DeepCopy()
+	ig.Spec.ServerSnippet = ""
+	ig.Spec.ResponseHeaders = nil
+	return ig
+}
+
+// syncAnnotations drops the annotations of the group the controller does not
+// pass through, reporting them on the AnnotationsAccepted condition: those
+// outside the allowlist, and the snippet annotations unless snippets are
+// allowed, since they would bypass the Snippets feature gate.
+func (r *Reconciler) syncAnnotations(ig *v1.IngressGroup, status *v1.IngressGroupStatus) *v1.IngressGroup {
+	if len(ig.Spec.Annotations) == 0 {
+		removeCondition(status, v1.IngressGroupAnnotationsAccepted)
+		return ig
+	}
+	var dropped []string
+	for key := range ig.Spec.Annotations {
+		if !r.allowsAnnotation(key) {
+			dropped = append(dropped, key)
+		}
+	}
+	if len(dropped) == 0 {
+		setCondition(status, v1.IngressGroupAnnotationsAccepted, corev1.ConditionTrue, v1.ReasonAnnotationsAllowed, "")
+		return ig
+	}
+
+	sort.Strings(dropped)
+	klog.Warningf("ingress group %v/%v: dropping annotations %v, they are not allowed", ig.Namespace, ig.Name, strings.Join(dropped, ", "))
+	setCondition(status, v1.IngressGroupAnnotationsAccepted, corev1.ConditionFalse, v1.ReasonAnnotationsNotAllowed,
+		fmt.Sprintf("annotations dropped, the controller does not allow them: %s", strings.Join(dropped, ", ")))
+	ig = ig.DeepCopy()
+	for _, key := range dropped {
+		delete(ig.Spec.Annotations, key)
+	}
+	return ig
+}
+
+// allowsAnnotation reports whether the controller passes the annotation of a
+// group through to the generated Ingresses.
+func (r *Reconciler) allowsAnnotation(key string) bool {
+	if strings.HasSuffix(key, "-snippet") && !r.config.FeatureGates.Enabled(features.Snippets) {
+		return false
+	}
+	if len(r.config.AnnotationsAllowlist) == 0 {
+		return true
+	}
+	for _, allowed := range r.config.AnnotationsAllowlist {
+		if key == allowed || strings.HasSuffix(allowed, "*") && strings.HasPrefix(key, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// usesSnippets reports whether the group needs nginx snippets.
+func usesSnippets(ig *v1.IngressGroup) bool {
+	return ig.Spec.ServerSnippet != "" || len(ig.Spec.ResponseHeaders) > 0
+}
+
+// resolveBackends resolves the services of the IngressGroup into Ingress
+// backends keyed by backendKey, returning the services to expose in the order
+// their paths are generated. An Ingress can only route to services of its own
+// namespace, so services living elsewhere are skipped unless they can be
+// bridged, in which case the returned item names the bridge Service.
+func (r *Reconciler) resolveBackends(ig *v1.IngressGroup) ([]v1.ServiceItem, map[string]extensionsv1beta1.IngressBackend, error) {
+	var items []v1.ServiceItem
+	backends := map[string]extensionsv1beta1.IngressBackend{}
+	missing := sets.NewString()
+	selectorServices := r.selectorServices(ig)
+	namespace := r.ingressNamespace(ig)
+	for _, item := range sortedServices(ig.Spec.Services) {
+		if len(item.Selector) > 0 {
+			name := selectorServiceName(ig, item.Selector)
+			svc, ok := selectorServices[name]
+			if !ok {
+				klog.Warningf("ingress group %v/%v: skipping service selected by %v, selector services are disabled",
+					ig.Namespace, ig.Name, labels.SelectorFromSet(item.Selector))
+				continue
+			}
+			target := selectorItem(ig, item)
+			if namespace != ig.Namespace {
+				target.Name, target.Namespace = bridgeServiceName(ig, namespace, target), namespace
+			}
+			items = append(items, target)
+			key := backendKey(target)
+			if _, ok := backends[key]; ok {
+				continue
+			}
+			if err := r.applyService(ig, svc); err != nil {
+				return nil, nil, err
+			}
+			if namespace != ig.Namespace {
+				bridge := newBridgeService(ig, target.Name, svc, r.config.ClusterDomain)
+				r.place(ig, bridge)
+				if err := r.applyService(ig, bridge); err != nil {
+					return nil, nil, err
+				}
+			}
+			backends[key] = extensionsv1beta1.IngressBackend{
+				ServiceName: target.Name,
+				ServicePort: intstr.FromInt(int(item.Port)),
+			}
+			continue
+		}
+
+		if item.Namespace != ig.Namespace && !r.config.FeatureGates.Enabled(features.CrossNamespace) {
+			klog.Warningf("ingress group %v/%v: skipping service %v/%v outside the group's namespace",
+				ig.Namespace, ig.Name, item.Namespace, item.Name)
+			continue
+		}
+		remote := r.bridged(ig, item)
+		target := item
+		if remote {
+			target.Name, target.Namespace = bridgeServiceName(ig, namespace, item), namespace
+		}
+		items = append(items, target)
+		key := backendKey(target)
+		if _, ok := backends[key]; ok {
+			continue
+		}
+
+		svc, err := r.svcLister.Services(item.Namespace).Get(item.Name)
+		if errors.IsNotFound(err) {
+			missing.Insert(item.Namespace + "/" + item.Name)
+			continue
+		}
+		if errors.IsForbidden(err) {
+			return nil, nil, &serviceForbiddenError{namespace: item.Namespace, name: item.Name}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		// ExternalName services often list no ports since traffic goes
+		// straight to the external host; the item must then set the port.
+		if len(svc.Spec.Ports) == 0 {
+			if svc.Spec.Type != corev1.ServiceTypeExternalName {
+				return nil, nil, fmt.Errorf("service %v/%v has no ports", svc.Namespace, svc.Name)
+			}
+			if item.Port == 0 {
+				return nil, nil, fmt.Errorf("external name service %v/%v has no ports, the port must be set on the service item", svc.Namespace, svc.Name)
+			}
+		}
+		if item.PortName != "" && !hasPortName(svc, item.PortName) {
+			return nil, nil, newPortNotFoundError(svc, item.PortName)
+		}
+		if item.Port != 0 && len(svc.Spec.Ports) > 0 && !hasPortNumber(svc, item.Port) {
+			return nil, nil, newPortNumberNotFoundError(svc, item.Port)
+		}
+		if remote {
+			bridge := newBridgeService(ig, target.Name, svc, r.config.ClusterDomain)
+			r.place(ig, bridge)
+			if err := r.applyService(ig, bridge); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		var port intstr.IntOrString
+		switch {
+		case item.Port != 0:
+			port = intstr.FromInt(int(item.Port))
+		case item.PortName != "":
+			port = intstr.FromString(item.PortName)
+		default:
+			port = intstr.FromInt(int(svc.Spec.Ports[0].Port))
+		}
+		backends[key] = extensionsv1beta1.IngressBackend{
+			ServiceName: target.Name,
+			ServicePort: port,
+		}
+	}
+
+	metrics.MissingServices.WithLabelValues(ig.Namespace, ig.Name).Set(float64(missing.Len()))
+	if missing.Len() > 0 {
+		return nil, nil, fmt.Errorf("services not found: %v", strings.Join(missing.List(), ", "))
+	}
+	return items, backends, nil
+}
+
+// syncIngresses applies the desired Ingresses of the group and deletes the
+// ones it generated earlier that are no longer wanted, except the kept ones.
+func (r *Reconciler) syncIngresses(ig *v1.IngressGroup, ingresses, kept []*extensionsv1beta1.Ingress) error {
+	desired := map[string]bool{}
+	for _, ing := range kept {
+		desired[ing.Name] = true
+	}
+	for _, ing := range ingresses {
+		if err := r.applyIngress(ig, ing); err != nil {
+			return err
+		}
+		desired[ing.Name] = true
+	}
+	return r.pruneIngresses(ig, desired)
+}
+
+// pruneIngresses deletes the Ingresses generated for the group that are not
+// desired.
+func (r *Reconciler) pruneIngresses(ig *v1.IngressGroup, desired map[string]bool) error {
+	ingClient := r.kubeClient.ExtensionsV1beta1().Ingresses(r.ingressNamespace(ig))
+	existing, err := r.generatedIngresses(ig)
+	if err != nil {
+		return err
+	}
+	for _, ing := range existing {
+		if desired[ing.Name] {
+			continue
+		}
+		if r.observing("ingress group %v/%v: would delete stale ingress %v", ig.Namespace, ig.Name, ing.Name) {
+			continue
+		}
+		klog.Infof("ingress group %v/%v: deleting stale ingress %v", ig.Namespace, ig.Name, ing.Name)
+		if err := r.writes.do(func() error {
+			return ingClient.Delete(ing.Name, r.deleteOptions())
+		}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		r.recorder.Eventf(ig, corev1.EventTypeNormal, "IngressDeleted", "Deleted ingress %v", ing.Name)
+	}
+	return nil
+}
+
+// applyIngress creates the Ingress, or updates the existing one if it differs.
+// An existing Ingress that was not generated for the group is left alone.
+func (r *Reconciler) applyIngress(ig *v1.IngressGroup, ing *extensionsv1beta1.Ingress) error {
+	ing.Labels[managedByLabel] = r.config.ControllerName
+	setManagedAnnotations(ing)
+	ingClient := r.kubeClient.ExtensionsV1beta1().Ingresses(ing.Namespace)
+
+	existing, err := r.getIngress(ing.Namespace, ing.Name)
+	if errors.IsNotFound(err) {
+		if r.observing("ingress group %v/%v: would create ingress %v", ig.Namespace, ig.Name, ing.Name) {
+			return nil
+		}
+		if err := r.writes.do(func() error {
+			if err := r.dryRunIngress(ing, false); err != nil {
+				return err
+			}
+			_, err := ingClient.Create(ing)
+			return err
+		}); err != nil {
+			return err
+		}
+		r.recorder.Eventf(ig, corev1.EventTypeNormal, "IngressCreated", "Created ingress %v", ing.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		if !r.managedBy(existing, ig) {
+			return &nameConflictError{kind: "ingress", name: ing.Name}
+		}
+		mergedLabels := mergeLabels(existing.Labels, ing.Labels)
+		mergedAnnotations := mergeAnnotations(existing.Annotations, ing.Annotations)
+		mergedOwners := mergeOwnerReferences(existing.OwnerReferences, ing.OwnerReferences)
+		if apiequality.Semantic.DeepEqual(existing.Spec, ing.Spec) &&
+			apiequality.Semantic.DeepEqual(existing.Labels, mergedLabels) &&
+			apiequality.Semantic.DeepEqual(existing.Annotations, mergedAnnotations) &&
+			apiequality.Semantic.DeepEqual(existing.OwnerReferences, mergedOwners) {
+			return nil
+		}
+
+		update := existing.DeepCopy()
+		update.Labels = mergedLabels
+		update.Annotations = mergedAnnotations
+		update.OwnerReferences = mergedOwners
+		update.Spec = ing.Spec
+		if r.observing("ingress group %v/%v: would update ingress %v", ig.Namespace, ig.Name, ing.Name) {
+			return nil
+		}
+		err := r.writes.do(func() error {
+			if err := r.dryRunIngress(update, true); err != nil {
+				return err
+			}
+			_, err := ingClient.Update(update)
+			return err
+		})
+		if errors.IsConflict(err) {
+			// The cached copy was stale, retry against the live one.
+			latest, getErr := ingClient.Get(ing.Name, metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			existing = latest
+		}
+		if err != nil {
+			return err
+		}
+		r.recorder.Eventf(ig, corev1.EventTypeNormal, "IngressUpdated", "Updated ingress %v", ing.Name)
+		return nil
+	})
+}
+
+// getIngress returns the Ingress from the cache, falling back to the API
+// server when the cache does not hold it: the cache only holds generated
+// Ingresses and may lag behind a create.
+func (r *Reconciler) getIngress(namespace, name string) (*extensionsv1beta1.Ingress, error) {
+	ing, err := r.ingLister.Ingresses(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return r.kubeClient.ExtensionsV1beta1().Ingresses(namespace).Get(name, metav1.GetOptions{})
+	}
+	return ing, err
+}
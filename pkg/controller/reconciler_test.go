@@ -0,0 +1,1348 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"github.com/liabio/ingressgroup/pkg/features"
+	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	extensionsclient "k8s.io/client-go/kubernetes/typed/extensions/v1beta1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	extensionslisters "k8s.io/client-go/listers/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	versionedfake "k8s.io/ingress-nginx/pkg/client/clientset/versioned/fake"
+	iglisters "k8s.io/ingress-nginx/pkg/client/listers/ingressgroup/v1"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const testNamespace = "default"
+
+// fixture is a Reconciler whose listers hold the given objects and whose
+// clients write to fake clientsets seeded with the same objects, as if the
+// informer caches had synced.
+type fixture struct {
+	kubeClient      *kubefake.Clientset
+	versionedClient *versionedfake.Clientset
+	reconciler      *Reconciler
+	igIndexer       cache.Indexer
+	ingIndexer      cache.Indexer
+	svcIndexer      cache.Indexer
+}
+
+func newFixture(t *testing.T, config Config, objects ...runtime.Object) *fixture {
+	igIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	ingIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nsIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	svcIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+	hasNamespace := false
+	for _, obj := range objects {
+		if ns, ok := obj.(*corev1.Namespace); ok && ns.Name == testNamespace {
+			hasNamespace = true
+		}
+	}
+	if !hasNamespace {
+		objects = append(objects, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace}})
+	}
+	var kubeObjects, versionedObjects []runtime.Object
+	for _, obj := range objects {
+		var indexer cache.Indexer
+		switch obj.(type) {
+		case *v1.IngressGroup:
+			indexer = igIndexer
+			versionedObjects = append(versionedObjects, obj)
+		case *extensionsv1beta1.Ingress:
+			indexer = ingIndexer
+			kubeObjects = append(kubeObjects, obj)
+		case *corev1.Namespace:
+			indexer = nsIndexer
+			kubeObjects = append(kubeObjects, obj)
+		case *corev1.Service:
+			indexer = svcIndexer
+			kubeObjects = append(kubeObjects, obj)
+		default:
+			kubeObjects = append(kubeObjects, obj)
+			continue
+		}
+		if err := indexer.Add(obj); err != nil {
+			t.Fatalf("failed to add %T to the cache: %v", obj, err)
+		}
+	}
+
+	f := &fixture{
+		kubeClient:      kubefake.NewSimpleClientset(kubeObjects...),
+		versionedClient: versionedfake.NewSimpleClientset(versionedObjects...),
+		igIndexer:       igIndexer,
+		ingIndexer:      ingIndexer,
+		svcIndexer:      svcIndexer,
+	}
+	f.reconciler = NewReconciler(f.kubeClient, f.versionedClient,
+		iglisters.NewIngressGroupLister(igIndexer),
+		extensionslisters.NewIngressLister(ingIndexer),
+		corelisters.NewNamespaceLister(nsIndexer),
+		corelisters.NewServiceLister(svcIndexer),
+		record.NewFakeRecorder(100), config)
+	return f
+}
+
+// reconcile syncs the group with the given name and fails the test if the
+// sync does.
+func (f *fixture) reconcile(t *testing.T, name string) {
+	if _, err := f.reconciler.Reconcile(context.Background(), testNamespace+"/"+name); err != nil {
+		t.Fatalf("failed to reconcile %v: %v", name, err)
+	}
+}
+
+// refreshCaches replaces the cached IngressGroups and Ingresses with those in
+// the fake API server, as the informers would after the writes of a sync.
+func (f *fixture) refreshCaches(t *testing.T) {
+	groups, err := f.versionedClient.CrV1().IngressGroups(testNamespace).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list ingress groups: %v", err)
+	}
+	var igObjects []interface{}
+	for i := range groups.Items {
+		igObjects = append(igObjects, &groups.Items[i])
+	}
+	ingresses, err := f.kubeClient.ExtensionsV1beta1().Ingresses(testNamespace).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list ingresses: %v", err)
+	}
+	var ingObjects []interface{}
+	for i := range ingresses.Items {
+		ingObjects = append(ingObjects, &ingresses.Items[i])
+	}
+	if err := f.igIndexer.Replace(igObjects, ""); err != nil {
+		t.Fatalf("failed to refresh the ingress group cache: %v", err)
+	}
+	if err := f.ingIndexer.Replace(ingObjects, ""); err != nil {
+		t.Fatalf("failed to refresh the ingress cache: %v", err)
+	}
+}
+
+// ingresses returns the paths of the Ingresses in the fake API server, keyed
+// by Ingress name.
+func (f *fixture) ingresses(t *testing.T) map[string][]string {
+	list, err := f.kubeClient.ExtensionsV1beta1().Ingresses(testNamespace).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list ingresses: %v", err)
+	}
+	ingresses := map[string][]string{}
+	for i := range list.Items {
+		ingresses[list.Items[i].Name] = ingressPaths(&list.Items[i])
+	}
+	return ingresses
+}
+
+// services returns the Services of the test namespace in the fake API
+// server, keyed by name, with their external name if they have one.
+func (f *fixture) services(t *testing.T) map[string]string {
+	list, err := f.kubeClient.CoreV1().Services(testNamespace).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list services: %v", err)
+	}
+	services := map[string]string{}
+	for _, svc := range list.Items {
+		services[svc.Name] = svc.Spec.ExternalName
+	}
+	return services
+}
+
+// ingressPaths returns the paths of the Ingress, sorted, each rendered as
+// host+path->service:port.
+func ingressPaths(ing *extensionsv1beta1.Ingress) []string {
+	paths := []string{}
+	for _, rule := range ing.Spec.Rules {
+		for _, path := range rule.HTTP.Paths {
+			paths = append(paths, fmt.Sprintf("%s%s->%s:%s", rule.Host, path.Path, path.Backend.ServiceName, path.Backend.ServicePort.String()))
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// condition returns the status of the condition of the given type on the
+// group in the fake API server.
+func (f *fixture) condition(t *testing.T, name string, condType v1.IngressGroupConditionType) corev1.ConditionStatus {
+	if cond := f.findCondition(t, name, condType); cond != nil {
+		return cond.Status
+	}
+	return corev1.ConditionUnknown
+}
+
+// reason returns the reason of the condition of the given type on the group
+// in the fake API server.
+func (f *fixture) reason(t *testing.T, name string, condType v1.IngressGroupConditionType) string {
+	if cond := f.findCondition(t, name, condType); cond != nil {
+		return cond.Reason
+	}
+	return ""
+}
+
+func (f *fixture) findCondition(t *testing.T, name string, condType v1.IngressGroupConditionType) *v1.IngressGroupCondition {
+	ig, err := f.versionedClient.CrV1().IngressGroups(testNamespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get ingress group %v: %v", name, err)
+	}
+	return findCondition(&ig.Status, condType)
+}
+
+func newTestGroup(name string, items ...v1.ServiceItem) *v1.IngressGroup {
+	return &v1.IngressGroup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       name,
+			Namespace:  testNamespace,
+			UID:        types.UID("uid-" + name),
+			Generation: 1,
+		},
+		Spec: v1.IngressGroupSpec{Services: items},
+	}
+}
+
+func newTestService(name string, ports ...int32) *corev1.Service {
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace}}
+	for _, port := range ports {
+		svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{Port: port})
+	}
+	return svc
+}
+
+// newTestIngress returns an Ingress routing the path to the service, labeled
+// with the group name and owned by the group if it is not nil.
+func newTestIngress(name, groupName string, owner *v1.IngressGroup, path, service string, port int) *extensionsv1beta1.Ingress {
+	ing := &extensionsv1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			Labels:    map[string]string{IngressGroupLabel: groupName},
+		},
+		Spec: extensionsv1beta1.IngressSpec{
+			Rules: []extensionsv1beta1.IngressRule{{
+				IngressRuleValue: extensionsv1beta1.IngressRuleValue{
+					HTTP: &extensionsv1beta1.HTTPIngressRuleValue{
+						Paths: []extensionsv1beta1.HTTPIngressPath{{
+							Path: path,
+							Backend: extensionsv1beta1.IngressBackend{
+								ServiceName: service,
+								ServicePort: intstr.FromInt(port),
+							},
+						}},
+					},
+				},
+			}},
+		},
+	}
+	if owner != nil {
+		ing.OwnerReferences = []metav1.OwnerReference{
+			*metav1.NewControllerRef(owner, v1.SchemeGroupVersion.WithKind("IngressGroup")),
+		}
+	}
+	return ing
+}
+
+func TestReconcileIngresses(t *testing.T) {
+	shop := newTestGroup("shop",
+		v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80},
+		v1.ServiceItem{Name: "api", Namespace: testNamespace, Port: 8080, Path: "/api"},
+	)
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		want    map[string][]string
+	}{
+		{
+			name:    "creates the ingress of a new group",
+			objects: []runtime.Object{shop, newTestService("web", 80), newTestService("api", 8080)},
+			want: map[string][]string{
+				"shop": {"/->web:80", "/api->api:8080"},
+			},
+		},
+		{
+			name: "updates an ingress that differs from the group",
+			objects: []runtime.Object{shop, newTestService("web", 80), newTestService("api", 8080),
+				newTestIngress("shop", "shop", shop, "/", "old", 8000)},
+			want: map[string][]string{
+				"shop": {"/->web:80", "/api->api:8080"},
+			},
+		},
+		{
+			name: "deletes an ingress the group no longer needs",
+			objects: []runtime.Object{shop, newTestService("web", 80), newTestService("api", 8080),
+				newTestIngress("shop-regex", "shop", shop, "/v[0-9]+", "web", 80)},
+			want: map[string][]string{
+				"shop": {"/->web:80", "/api->api:8080"},
+			},
+		},
+		{
+			name: "leaves an ingress the group does not own",
+			objects: []runtime.Object{shop, newTestService("web", 80), newTestService("api", 8080),
+				newTestIngress("shop-legacy", "shop", nil, "/legacy", "web", 80)},
+			want: map[string][]string{
+				"shop":        {"/->web:80", "/api->api:8080"},
+				"shop-legacy": {"/legacy->web:80"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t, Config{ControllerName: "ingressgroup"}, test.objects...)
+			f.reconcile(t, "shop")
+
+			if got := f.ingresses(t); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got ingresses %v, want %v", got, test.want)
+			}
+			if got := f.condition(t, "shop", v1.IngressGroupReady); got != corev1.ConditionTrue {
+				t.Errorf("got Ready condition %v, want %v", got, corev1.ConditionTrue)
+			}
+		})
+	}
+}
+
+func TestReconcileMissingService(t *testing.T) {
+	f := newFixture(t, Config{ControllerName: "ingressgroup"},
+		newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80}))
+	if _, err := f.reconciler.Reconcile(context.Background(), testNamespace+"/shop"); err == nil {
+		t.Fatalf("expected the sync to fail on the missing service")
+	}
+
+	if got := f.ingresses(t); len(got) != 0 {
+		t.Errorf("got ingresses %v, want none", got)
+	}
+	if got := f.condition(t, "shop", v1.IngressGroupSynced); got != corev1.ConditionFalse {
+		t.Errorf("got Synced condition %v, want %v", got, corev1.ConditionFalse)
+	}
+}
+
+func TestReconcileExternalNameService(t *testing.T) {
+	external := func(ports ...int32) *corev1.Service {
+		svc := newTestService("payments", ports...)
+		svc.Spec.Type = corev1.ServiceTypeExternalName
+		svc.Spec.ExternalName = "payments.example.com"
+		return svc
+	}
+	tests := []struct {
+		name    string
+		item    v1.ServiceItem
+		svc     *corev1.Service
+		want    map[string][]string
+		wantErr bool
+	}{
+		{
+			name: "explicit port",
+			item: v1.ServiceItem{Name: "payments", Namespace: testNamespace, Port: 443},
+			svc:  external(),
+			want: map[string][]string{"shop": {"/->payments:443"}},
+		},
+		{
+			name:    "no port",
+			item:    v1.ServiceItem{Name: "payments", Namespace: testNamespace},
+			svc:     external(),
+			want:    map[string][]string{},
+			wantErr: true,
+		},
+		{
+			name: "listed port",
+			item: v1.ServiceItem{Name: "payments", Namespace: testNamespace},
+			svc:  external(8443),
+			want: map[string][]string{"shop": {"/->payments:8443"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t, Config{ControllerName: "ingressgroup"}, newTestGroup("shop", test.item), test.svc)
+			_, err := f.reconciler.Reconcile(context.Background(), testNamespace+"/shop")
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if got := f.ingresses(t); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got ingresses %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReconcileNamedPorts(t *testing.T) {
+	named := newTestService("web")
+	named.Spec.Ports = []corev1.ServicePort{{Name: "http", Port: 80}, {Name: "metrics", Port: 9090}}
+	tests := []struct {
+		name         string
+		item         v1.ServiceItem
+		want         map[string][]string
+		wantResolved corev1.ConditionStatus
+		wantMessage  string
+	}{
+		{
+			name:         "matching port name",
+			item:         v1.ServiceItem{Name: "web", Namespace: testNamespace, PortName: "http"},
+			want:         map[string][]string{"shop": {"/->web:http"}},
+			wantResolved: corev1.ConditionTrue,
+		},
+		{
+			name:         "non-matching port name",
+			item:         v1.ServiceItem{Name: "web", Namespace: testNamespace, PortName: "grpc"},
+			want:         map[string][]string{},
+			wantResolved: corev1.ConditionFalse,
+			wantMessage:  `service default/web has no port named "grpc", its ports are named http, metrics`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t, Config{ControllerName: "ingressgroup"}, newTestGroup("shop", test.item), named)
+			f.reconcile(t, "shop")
+
+			if got := f.ingresses(t); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got ingresses %v, want %v", got, test.want)
+			}
+			cond := f.findCondition(t, "shop", v1.IngressGroupPortsResolved)
+			got, message := corev1.ConditionUnknown, ""
+			if cond != nil {
+				got, message = cond.Status, cond.Message
+			}
+			if got != test.wantResolved || message != test.wantMessage {
+				t.Errorf("got PortsResolved condition %v %q, want %v %q", got, message, test.wantResolved, test.wantMessage)
+			}
+		})
+	}
+}
+
+func TestReconcileMissingPortRecovers(t *testing.T) {
+	tests := []struct {
+		name string
+		item v1.ServiceItem
+	}{
+		{name: "port name", item: v1.ServiceItem{Name: "web", Namespace: testNamespace, PortName: "grpc"}},
+		{name: "port number", item: v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 9000}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svc := newTestService("web")
+			svc.Spec.Ports = []corev1.ServicePort{{Name: "http", Port: 80}}
+			f := newFixture(t, Config{ControllerName: "ingressgroup"}, newTestGroup("shop", test.item), svc)
+			requeue, err := f.reconciler.Reconcile(context.Background(), testNamespace+"/shop")
+			if err != nil {
+				t.Fatalf("failed to reconcile shop: %v", err)
+			}
+			if got := f.condition(t, "shop", v1.IngressGroupPortsResolved); got != corev1.ConditionFalse {
+				t.Fatalf("got PortsResolved condition %v, want %v", got, corev1.ConditionFalse)
+			}
+			if requeue != unresolvedRequeue {
+				t.Errorf("got requeue after %v, want %v to retry the missing port", requeue, unresolvedRequeue)
+			}
+
+			// The user adds the missing port to the service.
+			fixed := svc.DeepCopy()
+			fixed.Spec.Ports = append(fixed.Spec.Ports, corev1.ServicePort{Name: "grpc", Port: 9000})
+			if err := f.svcIndexer.Update(fixed); err != nil {
+				t.Fatalf("failed to update the service cache: %v", err)
+			}
+			f.refreshCaches(t)
+			requeue, err = f.reconciler.Reconcile(context.Background(), testNamespace+"/shop")
+			if err != nil {
+				t.Fatalf("failed to reconcile shop: %v", err)
+			}
+			if got := f.condition(t, "shop", v1.IngressGroupPortsResolved); got != corev1.ConditionTrue {
+				t.Errorf("got PortsResolved condition %v, want %v", got, corev1.ConditionTrue)
+			}
+			if got := f.condition(t, "shop", v1.IngressGroupReady); got != corev1.ConditionTrue {
+				t.Errorf("got Ready condition %v, want %v", got, corev1.ConditionTrue)
+			}
+			if requeue != 0 {
+				t.Errorf("got requeue after %v, want none once the port is resolved", requeue)
+			}
+		})
+	}
+}
+
+func TestReconcileWithoutGroup(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{name: "malformed key", key: "default/shop/web", wantErr: true},
+		{name: "deleted group", key: testNamespace + "/shop"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t, Config{ControllerName: "ingressgroup"})
+			if _, err := f.reconciler.Reconcile(context.Background(), test.key); (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error %v", err, test.wantErr)
+			}
+			if actions := f.kubeClient.Actions(); len(actions) != 0 {
+				t.Errorf("got API calls %v, want none", actions)
+			}
+		})
+	}
+}
+
+func TestReconcileRenamedController(t *testing.T) {
+	shop := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80})
+	previous := func(name, path string) *extensionsv1beta1.Ingress {
+		ing := newTestIngress(name, "shop", shop, path, "old", 8000)
+		ing.Labels[managedByLabel] = "ingress-group"
+		return ing
+	}
+	f := newFixture(t, Config{ControllerName: "ingressgroup"}, shop, newTestService("web", 80),
+		previous("shop", "/"), previous("shop-regex", "/api/.*"))
+	f.reconcile(t, "shop")
+
+	want := map[string][]string{"shop": {"/->web:80"}}
+	if got := f.ingresses(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("got ingresses %v, want %v", got, want)
+	}
+	ing, err := f.kubeClient.ExtensionsV1beta1().Ingresses(testNamespace).Get("shop", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get the ingress: %v", err)
+	}
+	if got := ing.Labels[managedByLabel]; got != "ingressgroup" {
+		t.Errorf("got managed-by %q, want the ingress taken over by ingressgroup", got)
+	}
+}
+
+func TestReconcileOutdatedCRD(t *testing.T) {
+	tests := []struct {
+		name       string
+		missing    []string
+		want       corev1.ConditionStatus
+		wantReason string
+	}{
+		{name: "up to date CRD", want: corev1.ConditionUnknown},
+		{name: "pruned port", missing: []string{"spec.services[].port"}, want: corev1.ConditionTrue, wantReason: v1.ReasonFieldsMissing},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shop := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80})
+			// A condition left over from before the CRD was updated.
+			shop.Status.Conditions = []v1.IngressGroupCondition{
+				{Type: v1.IngressGroupOutdatedCRD, Status: corev1.ConditionTrue, Reason: v1.ReasonFieldsMissing, LastTransitionTime: metav1.Now()},
+			}
+			f := newFixture(t, Config{ControllerName: "ingressgroup", MissingCRDFields: test.missing}, shop, newTestService("web", 80))
+			f.reconcile(t, "shop")
+
+			if got := f.condition(t, "shop", v1.IngressGroupOutdatedCRD); got != test.want {
+				t.Errorf("got OutdatedCRD %v, want %v", got, test.want)
+			}
+			if got := f.reason(t, "shop", v1.IngressGroupOutdatedCRD); got != test.wantReason {
+				t.Errorf("got reason %q, want %q", got, test.wantReason)
+			}
+		})
+	}
+}
+
+func TestReconcileKeepsForeignAnnotations(t *testing.T) {
+	shop := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80})
+	existing := newTestIngress("shop", "shop", shop, "/", "old", 8000)
+	existing.Labels[managedByLabel] = "ingressgroup"
+	existing.Labels["team"] = "payments"
+	existing.Annotations = map[string]string{
+		"ordering.example.com/priority":                        "10",
+		nginxAnnotation(DefaultAnnotationsPrefix, "use-regex"): "true",
+		managedAnnotationsAnnotation:                           nginxAnnotation(DefaultAnnotationsPrefix, "use-regex"),
+	}
+	f := newFixture(t, Config{ControllerName: "ingressgroup"}, shop, newTestService("web", 80), existing)
+	f.reconcile(t, "shop")
+
+	ing, err := f.kubeClient.ExtensionsV1beta1().Ingresses(testNamespace).Get("shop", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get the ingress: %v", err)
+	}
+	if got := ingressPaths(ing); !reflect.DeepEqual(got, []string{"/->web:80"}) {
+		t.Errorf("got paths %v, want the ingress updated", got)
+	}
+	if got := ing.Annotations["ordering.example.com/priority"]; got != "10" {
+		t.Errorf("got foreign annotation %q, want it kept", got)
+	}
+	if _, ok := ing.Annotations[nginxAnnotation(DefaultAnnotationsPrefix, "use-regex")]; ok {
+		t.Errorf("got the use-regex annotation the controller no longer sets kept")
+	}
+	if got := ing.Labels["team"]; got != "payments" {
+		t.Errorf("got foreign label %q, want it kept", got)
+	}
+}
+
+func TestReconcileKeepsForeignOwnerReferences(t *testing.T) {
+	shop := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80})
+	stale := newTestGroup("shop")
+	stale.UID = "uid-deleted"
+	foreign := metav1.OwnerReference{APIVersion: "v1", Kind: "ConfigMap", Name: "release", UID: "uid-release"}
+	tests := []struct {
+		name   string
+		owners []metav1.OwnerReference
+	}{
+		{
+			name:   "controller reference of the group",
+			owners: []metav1.OwnerReference{foreign, *metav1.NewControllerRef(shop, v1.SchemeGroupVersion.WithKind("IngressGroup"))},
+		},
+		{
+			name:   "controller reference of a deleted group",
+			owners: []metav1.OwnerReference{foreign, *metav1.NewControllerRef(stale, v1.SchemeGroupVersion.WithKind("IngressGroup"))},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			existing := newTestIngress("shop", "shop", shop, "/", "old", 8000)
+			existing.Labels[managedByLabel] = "ingressgroup"
+			existing.Annotations = map[string]string{ownerAnnotation: testNamespace + "/shop"}
+			existing.OwnerReferences = test.owners
+			f := newFixture(t, Config{ControllerName: "ingressgroup"}, shop, newTestService("web", 80), existing)
+			f.reconcile(t, "shop")
+
+			ing, err := f.kubeClient.ExtensionsV1beta1().Ingresses(testNamespace).Get("shop", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get the ingress: %v", err)
+			}
+			want := []metav1.OwnerReference{foreign, *metav1.NewControllerRef(shop, v1.SchemeGroupVersion.WithKind("IngressGroup"))}
+			if !reflect.DeepEqual(ing.OwnerReferences, want) {
+				t.Errorf("got owner references %+v, want %+v", ing.OwnerReferences, want)
+			}
+		})
+	}
+}
+
+func TestReconcileObserveOnly(t *testing.T) {
+	tests := []struct {
+		name        string
+		observeOnly bool
+		want        map[string][]string
+	}{
+		{name: "writing", want: map[string][]string{"shop": {"/->web:80"}}},
+		{
+			name:        "observe only",
+			observeOnly: true,
+			want:        map[string][]string{"shop": {"/->old:8000"}, "shop-regex": {"/api/.*->api:80"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shop := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80})
+			shop.Spec.TCPServices = []v1.StreamServiceItem{{Port: 9000, Service: "db", ServicePort: 5432}}
+			outdated := newTestIngress("shop", "shop", shop, "/", "old", 8000)
+			stale := newTestIngress("shop-regex", "shop", shop, "/api/.*", "api", 80)
+			f := newFixture(t, Config{ControllerName: "ingressgroup", ObserveOnly: test.observeOnly, TCPServicesConfigMap: "ingress-nginx/tcp-services"},
+				shop, newTestService("web", 80), outdated, stale, newTestStreamConfigMap(t, nil, nil))
+			f.kubeClient.ClearActions()
+			f.reconcile(t, "shop")
+
+			var writes []string
+			for _, action := range f.kubeClient.Actions() {
+				switch action.GetVerb() {
+				case "create", "update", "patch", "delete":
+					writes = append(writes, action.GetVerb()+" "+action.GetResource().Resource)
+				}
+			}
+			if test.observeOnly && len(writes) != 0 {
+				t.Errorf("got writes %v in observe-only mode, want none", writes)
+			}
+			if !test.observeOnly && len(writes) == 0 {
+				t.Errorf("got no writes, want the generated objects written")
+			}
+			if got := f.ingresses(t); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got ingresses %v, want %v", got, test.want)
+			}
+			if got := f.condition(t, "shop", v1.IngressGroupValid); got != corev1.ConditionTrue {
+				t.Errorf("got Valid %v, want the status updated", got)
+			}
+		})
+	}
+}
+
+func TestReconcileAppliedHash(t *testing.T) {
+	tests := []struct {
+		name string
+		// change edits the group between the two syncs, if set.
+		change      func(ig *v1.IngressGroup)
+		wantChanged bool
+	}{
+		{name: "unchanged group"},
+		{
+			name:        "changed port",
+			change:      func(ig *v1.IngressGroup) { ig.Spec.Services[0].Port = 8080 },
+			wantChanged: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t, Config{ControllerName: "ingressgroup"}, newTestService("web", 80, 8080),
+				newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80}))
+			f.reconcile(t, "shop")
+			first, err := f.versionedClient.CrV1().IngressGroups(testNamespace).Get("shop", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get the group: %v", err)
+			}
+			if first.Status.AppliedHash == "" || first.Status.LastAppliedTime == nil {
+				t.Fatalf("got applied hash %q at %v, want both set", first.Status.AppliedHash, first.Status.LastAppliedTime)
+			}
+
+			if test.change != nil {
+				changed := first.DeepCopy()
+				test.change(changed)
+				changed.Generation++
+				if _, err := f.versionedClient.CrV1().IngressGroups(testNamespace).Update(changed); err != nil {
+					t.Fatalf("failed to update the group: %v", err)
+				}
+			}
+			f.refreshCaches(t)
+			f.versionedClient.ClearActions()
+			f.reconcile(t, "shop")
+
+			second, err := f.versionedClient.CrV1().IngressGroups(testNamespace).Get("shop", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get the group: %v", err)
+			}
+			if changed := second.Status.AppliedHash != first.Status.AppliedHash; changed != test.wantChanged {
+				t.Errorf("got applied hash changed %v, want %v", changed, test.wantChanged)
+			}
+			if !test.wantChanged {
+				// Writing the hash must not cause another write, or the
+				// status update would feed a sync loop.
+				for _, action := range f.versionedClient.Actions() {
+					if action.GetVerb() == "update" {
+						t.Errorf("got %v of the %v of an unchanged group, want none", action.GetVerb(), action.GetSubresource())
+					}
+				}
+				if !second.Status.LastAppliedTime.Equal(first.Status.LastAppliedTime) {
+					t.Errorf("got last applied time moved to %v, want %v", second.Status.LastAppliedTime, first.Status.LastAppliedTime)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileIngressStatusSync(t *testing.T) {
+	published := []corev1.LoadBalancerIngress{{IP: "10.0.0.1"}}
+	tests := []struct {
+		name        string
+		disabled    bool
+		want        []corev1.LoadBalancerIngress
+		wantAddress corev1.ConditionStatus
+	}{
+		{name: "status synced", want: published, wantAddress: corev1.ConditionTrue},
+		{name: "status sync disabled", disabled: true, wantAddress: corev1.ConditionUnknown},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shop := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80})
+			// The group carries the addresses of an earlier sync.
+			shop.Status.LoadBalancer.Ingress = published
+			setCondition(&shop.Status, v1.IngressGroupAddressed, corev1.ConditionTrue, v1.ReasonAddressAssigned, "")
+			ing := newTestIngress("shop", "shop", shop, "/", "web", 80)
+			ing.Status.LoadBalancer.Ingress = published
+			f := newFixture(t, Config{ControllerName: "ingressgroup", DisableIngressStatusSync: test.disabled},
+				shop, ing, newTestService("web", 80))
+			f.reconcile(t, "shop")
+
+			ig, err := f.versionedClient.CrV1().IngressGroups(testNamespace).Get("shop", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get the group: %v", err)
+			}
+			if got := ig.Status.LoadBalancer.Ingress; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got addresses %v, want %v", got, test.want)
+			}
+			if got := f.condition(t, "shop", v1.IngressGroupAddressed); got != test.wantAddress {
+				t.Errorf("got Addressed condition %v, want %v", got, test.wantAddress)
+			}
+		})
+	}
+}
+
+func TestReconcileIngressClasses(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []v1.ServiceItem
+		// class is the ingress class of the group.
+		class string
+		// want maps the names of the generated Ingresses to their class.
+		want       map[string]string
+		wantStatus []v1.GeneratedIngress
+	}{
+		{
+			name: "no class",
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80, Path: "/"},
+				{Name: "api", Namespace: testNamespace, Port: 80, Path: "/api"},
+			},
+			want:       map[string]string{"shop": ""},
+			wantStatus: []v1.GeneratedIngress{{Name: "shop", Paths: []string{"/api", "/"}}},
+		},
+		{
+			name: "one service of another class",
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80, Path: "/", IngressClassName: "external"},
+				{Name: "api", Namespace: testNamespace, Port: 80, Path: "/api"},
+			},
+			want: map[string]string{"shop": "", "shop-class-external": "external"},
+			wantStatus: []v1.GeneratedIngress{
+				{Name: "shop", Paths: []string{"/api"}},
+				{Name: "shop-class-external", Paths: []string{"/"}, IngressClassName: "external"},
+			},
+		},
+		{
+			name: "services split across two classes",
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80, Path: "/", IngressClassName: "external"},
+				{Name: "api", Namespace: testNamespace, Port: 80, Path: "/api", IngressClassName: "internal"},
+			},
+			want: map[string]string{"shop-class-external": "external", "shop-class-internal": "internal"},
+			wantStatus: []v1.GeneratedIngress{
+				{Name: "shop-class-internal", Paths: []string{"/api"}, IngressClassName: "internal"},
+				{Name: "shop-class-external", Paths: []string{"/"}, IngressClassName: "external"},
+			},
+		},
+		{
+			name: "class of the group",
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80, Path: "/"},
+				{Name: "api", Namespace: testNamespace, Port: 80, Path: "/api", IngressClassName: "internal"},
+			},
+			class: "external",
+			want:  map[string]string{"shop-class-external": "external", "shop-class-internal": "internal"},
+			wantStatus: []v1.GeneratedIngress{
+				{Name: "shop-class-internal", Paths: []string{"/api"}, IngressClassName: "internal"},
+				{Name: "shop-class-external", Paths: []string{"/"}, IngressClassName: "external"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shop := newTestGroup("shop", test.items...)
+			shop.Spec.IngressClassName = test.class
+			f := newFixture(t, Config{ControllerName: "ingressgroup"}, newTestService("web", 80), newTestService("api", 80), shop)
+			f.reconcile(t, "shop")
+
+			list, err := f.kubeClient.ExtensionsV1beta1().Ingresses(testNamespace).List(metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("failed to list ingresses: %v", err)
+			}
+			got := map[string]string{}
+			for _, ing := range list.Items {
+				got[ing.Name] = ing.Annotations[ingressClassAnnotation]
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got ingresses with classes %v, want %v", got, test.want)
+			}
+
+			ig, err := f.versionedClient.CrV1().IngressGroups(testNamespace).Get("shop", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get the group: %v", err)
+			}
+			if !reflect.DeepEqual(ig.Status.Ingresses, test.wantStatus) {
+				t.Errorf("got generated ingresses %+v in the status, want %+v", ig.Status.Ingresses, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestReconcileNameConflict(t *testing.T) {
+	shop := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80})
+	marked := func(owner string) *extensionsv1beta1.Ingress {
+		ing := newTestIngress("shop", "shop", nil, "/", "old", 8000)
+		ing.Labels[managedByLabel] = "ingressgroup"
+		ing.Annotations = map[string]string{ownerAnnotation: owner}
+		return ing
+	}
+	tests := []struct {
+		name         string
+		existing     *extensionsv1beta1.Ingress
+		want         []string
+		wantConflict bool
+	}{
+		{
+			name:         "unmarked ingress",
+			existing:     newTestIngress("shop", "other", nil, "/", "old", 8000),
+			want:         []string{"/->old:8000"},
+			wantConflict: true,
+		},
+		{
+			name:         "ingress marked for another group",
+			existing:     marked(testNamespace + "/other"),
+			want:         []string{"/->old:8000"},
+			wantConflict: true,
+		},
+		{
+			name:     "ingress marked for the group",
+			existing: marked(testNamespace + "/shop"),
+			want:     []string{"/->web:80"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t, Config{ControllerName: "ingressgroup"}, shop, newTestService("web", 80), test.existing)
+			f.reconcile(t, "shop")
+
+			if got := f.ingresses(t)["shop"]; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got paths %v, want %v", got, test.want)
+			}
+			wantConflict, wantReady := corev1.ConditionUnknown, corev1.ConditionTrue
+			if test.wantConflict {
+				wantConflict, wantReady = corev1.ConditionTrue, corev1.ConditionFalse
+			}
+			if got := f.condition(t, "shop", v1.IngressGroupNameConflict); got != wantConflict {
+				t.Errorf("got NameConflict condition %v, want %v", got, wantConflict)
+			}
+			if got := f.condition(t, "shop", v1.IngressGroupReady); got != wantReady {
+				t.Errorf("got Ready condition %v, want %v", got, wantReady)
+			}
+		})
+	}
+}
+
+func TestReconcileMinimalSpec(t *testing.T) {
+	f := newFixture(t, Config{ControllerName: "ingressgroup"},
+		newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace}),
+		newTestService("web", 8080))
+	f.reconcile(t, "shop")
+
+	want := map[string][]string{"shop": {"/->web:8080"}}
+	if got := f.ingresses(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("got ingresses %v, want %v", got, want)
+	}
+	if got := f.condition(t, "shop", v1.IngressGroupReady); got != corev1.ConditionTrue {
+		t.Errorf("got Ready condition %v, want %v", got, corev1.ConditionTrue)
+	}
+}
+
+func TestReconcileAnnotationsPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		want   string
+	}{
+		{name: "default prefix", want: "nginx.ingress.kubernetes.io/auth-secret"},
+		{name: "custom prefix", prefix: "custom.example.com", want: "custom.example.com/auth-secret"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ig := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80})
+			ig.Spec.BasicAuthSecret = "htpasswd"
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "htpasswd", Namespace: testNamespace},
+				Data:       map[string][]byte{"auth": []byte("user:hash")},
+			}
+			f := newFixture(t, Config{ControllerName: "ingressgroup", AnnotationsPrefix: test.prefix}, ig, secret, newTestService("web", 80))
+			f.reconcile(t, "shop")
+
+			ing, err := f.kubeClient.ExtensionsV1beta1().Ingresses(testNamespace).Get("shop", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get the ingress: %v", err)
+			}
+			if got := ing.Annotations[test.want]; got != "htpasswd" {
+				t.Errorf("got %v=%q, want %q", test.want, got, "htpasswd")
+			}
+		})
+	}
+}
+
+func TestReconcileFeatureGates(t *testing.T) {
+	weighted := newTestGroup("shop",
+		v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80, Weight: intPtr(80)},
+		v1.ServiceItem{Name: "web-v2", Namespace: testNamespace, Port: 80, Weight: intPtr(20)})
+	snippet := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80})
+	snippet.Spec.ServerSnippet = "gzip on;"
+	tests := []struct {
+		name  string
+		gates string
+		group *v1.IngressGroup
+		want  map[string][]string
+		// condType is the condition reporting the gate, which is
+		// SnippetsAccepted for snippets since they are dropped rather than
+		// failing the group.
+		condType  v1.IngressGroupConditionType
+		wantCond  corev1.ConditionStatus
+		wantReady corev1.ConditionStatus
+	}{
+		{
+			name:      "canary enabled",
+			group:     weighted,
+			want:      map[string][]string{"shop": {"/->web:80"}, "shop-canary-web-v2": {"/->web-v2:80"}},
+			condType:  v1.IngressGroupFeatureDisabled,
+			wantCond:  corev1.ConditionUnknown,
+			wantReady: corev1.ConditionTrue,
+		},
+		{
+			name:      "canary disabled",
+			gates:     "Canary=false",
+			group:     weighted,
+			want:      map[string][]string{},
+			condType:  v1.IngressGroupFeatureDisabled,
+			wantCond:  corev1.ConditionTrue,
+			wantReady: corev1.ConditionFalse,
+		},
+		{
+			name:      "snippets disabled",
+			group:     snippet,
+			want:      map[string][]string{"shop": {"/->web:80"}},
+			condType:  v1.IngressGroupSnippetsAccepted,
+			wantCond:  corev1.ConditionFalse,
+			wantReady: corev1.ConditionTrue,
+		},
+		{
+			name:      "snippets enabled",
+			gates:     "Snippets=true",
+			group:     snippet,
+			want:      map[string][]string{"shop": {"/->web:80"}},
+			condType:  v1.IngressGroupSnippetsAccepted,
+			wantCond:  corev1.ConditionTrue,
+			wantReady: corev1.ConditionTrue,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gates := features.NewFeatureGate()
+			if err := gates.Set(test.gates); err != nil {
+				t.Fatalf("failed to parse the feature gates: %v", err)
+			}
+			f := newFixture(t, Config{ControllerName: "ingressgroup", FeatureGates: gates},
+				test.group, newTestService("web", 80), newTestService("web-v2", 80))
+			f.reconcile(t, "shop")
+
+			if got := f.ingresses(t); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got ingresses %v, want %v", got, test.want)
+			}
+			if got := f.condition(t, "shop", test.condType); got != test.wantCond {
+				t.Errorf("got %v condition %v, want %v", test.condType, got, test.wantCond)
+			}
+			if got := f.condition(t, "shop", v1.IngressGroupReady); got != test.wantReady {
+				t.Errorf("got Ready condition %v, want %v", got, test.wantReady)
+			}
+		})
+	}
+}
+
+// deleteRecorder is a fake clientset recording the propagation policy of the
+// Ingress deletes, keyed by Ingress name.
+type deleteRecorder struct {
+	*kubefake.Clientset
+	policies map[string]metav1.DeletionPropagation
+}
+
+func (c *deleteRecorder) ExtensionsV1beta1() extensionsclient.ExtensionsV1beta1Interface {
+	return &recordingExtensions{ExtensionsV1beta1Interface: c.Clientset.ExtensionsV1beta1(), recorder: c}
+}
+
+type recordingExtensions struct {
+	extensionsclient.ExtensionsV1beta1Interface
+	recorder *deleteRecorder
+}
+
+func (e *recordingExtensions) Ingresses(namespace string) extensionsclient.IngressInterface {
+	return &recordingIngresses{IngressInterface: e.ExtensionsV1beta1Interface.Ingresses(namespace), recorder: e.recorder}
+}
+
+type recordingIngresses struct {
+	extensionsclient.IngressInterface
+	recorder *deleteRecorder
+}
+
+func (i *recordingIngresses) Delete(name string, options *metav1.DeleteOptions) error {
+	var policy metav1.DeletionPropagation
+	if options != nil && options.PropagationPolicy != nil {
+		policy = *options.PropagationPolicy
+	}
+	i.recorder.policies[name] = policy
+	return i.IngressInterface.Delete(name, options)
+}
+
+func TestReconcileDeletionPropagation(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy metav1.DeletionPropagation
+		want   metav1.DeletionPropagation
+	}{
+		{name: "default", want: metav1.DeletePropagationBackground},
+		{name: "background", policy: metav1.DeletePropagationBackground, want: metav1.DeletePropagationBackground},
+		{name: "foreground", policy: metav1.DeletePropagationForeground, want: metav1.DeletePropagationForeground},
+		{name: "orphan", policy: metav1.DeletePropagationOrphan, want: metav1.DeletePropagationOrphan},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shop := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80})
+			f := newFixture(t, Config{ControllerName: "ingressgroup", DeletionPropagation: test.policy},
+				shop, newTestService("web", 80), newTestIngress("shop-stale", "shop", shop, "/old", "web", 80))
+			recorder := &deleteRecorder{Clientset: f.kubeClient, policies: map[string]metav1.DeletionPropagation{}}
+			f.reconciler.kubeClient = recorder
+			f.reconcile(t, "shop")
+
+			want := map[string]metav1.DeletionPropagation{"shop-stale": test.want}
+			if !reflect.DeepEqual(recorder.policies, want) {
+				t.Errorf("got deletes %v, want %v", recorder.policies, want)
+			}
+		})
+	}
+}
+
+func TestReconcileNamespaceOptIn(t *testing.T) {
+	namespace := func(labels map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace, Labels: labels}}
+	}
+	tests := []struct {
+		name      string
+		require   bool
+		namespace *corev1.Namespace
+		want      map[string][]string
+	}{
+		{
+			name:      "opt-in not required",
+			namespace: namespace(nil),
+			want:      map[string][]string{"shop": {"/->web:80"}},
+		},
+		{
+			name:      "opted-in namespace",
+			require:   true,
+			namespace: namespace(map[string]string{NamespaceOptInLabel: "true"}),
+			want:      map[string][]string{"shop": {"/->web:80"}},
+		},
+		{
+			name:      "namespace not opted in",
+			require:   true,
+			namespace: namespace(nil),
+			want:      map[string][]string{},
+		},
+		{
+			name:      "namespace opted out",
+			require:   true,
+			namespace: namespace(map[string]string{NamespaceOptInLabel: "false"}),
+			want:      map[string][]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t, Config{ControllerName: "ingressgroup", RequireNamespaceOptIn: test.require},
+				test.namespace, newTestService("web", 80),
+				newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80}))
+			f.reconcile(t, "shop")
+
+			if got := f.ingresses(t); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got ingresses %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReconcileTerminatingNamespace(t *testing.T) {
+	tests := []struct {
+		name  string
+		phase corev1.NamespacePhase
+		want  map[string][]string
+	}{
+		{name: "active namespace", phase: corev1.NamespaceActive, want: map[string][]string{"shop": {"/->web:80"}}},
+		{name: "terminating namespace", phase: corev1.NamespaceTerminating, want: map[string][]string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ns := &corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{Name: testNamespace},
+				Status:     corev1.NamespaceStatus{Phase: test.phase},
+			}
+			f := newFixture(t, Config{ControllerName: "ingressgroup"}, ns, newTestService("web", 80),
+				newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80}))
+			f.kubeClient.ClearActions()
+			f.versionedClient.ClearActions()
+			f.reconcile(t, "shop")
+
+			if test.phase == corev1.NamespaceTerminating {
+				if actions := append(f.kubeClient.Actions(), f.versionedClient.Actions()...); len(actions) != 0 {
+					t.Errorf("got %d API calls for a group of a terminating namespace, want none: %v", len(actions), actions)
+				}
+			}
+			if got := f.ingresses(t); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got ingresses %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReconcileIngressSplit(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []v1.ServiceItem
+		// want maps the names of the generated Ingresses to their rewrite
+		// targets.
+		want       map[string]string
+		wantStatus []v1.GeneratedIngress
+	}{
+		{
+			name: "same rewrite target",
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80, Path: "/web", RewriteTarget: "/"},
+				{Name: "api", Namespace: testNamespace, Port: 80, Path: "/api", RewriteTarget: "/"},
+			},
+			want:       map[string]string{"shop-rewrite-2a0c975e": "/"},
+			wantStatus: []v1.GeneratedIngress{{Name: "shop-rewrite-2a0c975e", Paths: []string{"/api", "/web"}}},
+		},
+		{
+			name: "mixed rewrite targets",
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80, Path: "/web", RewriteTarget: "/"},
+				{Name: "api", Namespace: testNamespace, Port: 80, Path: "/api", RewriteTarget: "/v2"},
+				{Name: "blog", Namespace: testNamespace, Port: 80, Path: "/blog"},
+			},
+			want: map[string]string{"shop": "", "shop-rewrite-2a0c975e": "/", "shop-rewrite-2f82c6fe": "/v2"},
+			wantStatus: []v1.GeneratedIngress{
+				{Name: "shop", Paths: []string{"/blog"}},
+				{Name: "shop-rewrite-2f82c6fe", Paths: []string{"/api"}},
+				{Name: "shop-rewrite-2a0c975e", Paths: []string{"/web"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t, Config{ControllerName: "ingressgroup"},
+				newTestService("web", 80), newTestService("api", 80), newTestService("blog", 80),
+				newTestGroup("shop", test.items...))
+			f.reconcile(t, "shop")
+
+			list, err := f.kubeClient.ExtensionsV1beta1().Ingresses(testNamespace).List(metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("failed to list ingresses: %v", err)
+			}
+			got := map[string]string{}
+			for _, ing := range list.Items {
+				got[ing.Name] = ing.Annotations[nginxAnnotation(DefaultAnnotationsPrefix, "rewrite-target")]
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got ingresses with rewrite targets %v, want %v", got, test.want)
+			}
+
+			ig, err := f.versionedClient.CrV1().IngressGroups(testNamespace).Get("shop", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get the group: %v", err)
+			}
+			if !reflect.DeepEqual(ig.Status.Ingresses, test.wantStatus) {
+				t.Errorf("got generated ingresses %+v in the status, want %+v", ig.Status.Ingresses, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestReconcileIngressName(t *testing.T) {
+	named := func(ingressName string) *v1.IngressGroup {
+		ig := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80})
+		ig.Spec.IngressName = ingressName
+		return ig
+	}
+	tests := []struct {
+		name      string
+		group     *v1.IngressGroup
+		existing  []runtime.Object
+		want      map[string][]string
+		wantReady corev1.ConditionStatus
+	}{
+		{
+			name:      "name of the group",
+			group:     named(""),
+			want:      map[string][]string{"shop": {"/->web:80"}},
+			wantReady: corev1.ConditionTrue,
+		},
+		{
+			name:      "renamed",
+			group:     named("store"),
+			existing:  []runtime.Object{newTestIngress("shop", "shop", named(""), "/", "web", 80)},
+			want:      map[string][]string{"store": {"/->web:80"}},
+			wantReady: corev1.ConditionTrue,
+		},
+		{
+			name:      "colliding with a foreign ingress",
+			group:     named("legacy"),
+			existing:  []runtime.Object{newTestIngress("legacy", "", nil, "/", "legacy", 80)},
+			want:      map[string][]string{"legacy": {"/->legacy:80"}},
+			wantReady: corev1.ConditionFalse,
+		},
+		{
+			name:      "invalid name",
+			group:     named("Store_1"),
+			want:      map[string][]string{},
+			wantReady: corev1.ConditionFalse,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			objects := append([]runtime.Object{test.group, newTestService("web", 80)}, test.existing...)
+			f := newFixture(t, Config{ControllerName: "ingressgroup"}, objects...)
+			f.reconcile(t, "shop")
+
+			if got := f.ingresses(t); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got ingresses %v, want %v", got, test.want)
+			}
+			if got := f.condition(t, "shop", v1.IngressGroupReady); got != test.wantReady {
+				t.Errorf("got Ready condition %v, want %v", got, test.wantReady)
+			}
+		})
+	}
+}
+
+func TestReconcileReasons(t *testing.T) {
+	web := v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80}
+	tests := []struct {
+		name       string
+		objects    []runtime.Object
+		wantErr    bool
+		wantReason string
+	}{
+		{
+			name:       "ready",
+			objects:    []runtime.Object{newTestGroup("shop", web), newTestService("web", 80)},
+			wantReason: v1.ReasonReady,
+		},
+		{
+			name:       "invalid",
+			objects:    []runtime.Object{newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 70000})},
+			wantReason: v1.ReasonInvalid,
+		},
+		{
+			name:       "port not found",
+			objects:    []runtime.Object{newTestGroup("shop", web), newTestService("web", 8080)},
+			wantReason: v1.ReasonPortNotFound,
+		},
+		{
+			name: "name conflict",
+			objects: []runtime.Object{newTestGroup("shop", web), newTestService("web", 80),
+				newTestIngress("shop", "", nil, "/", "other", 80)},
+			wantReason: v1.ReasonNameConflict,
+		},
+		{
+			name:       "service not found",
+			objects:    []runtime.Object{newTestGroup("shop", web)},
+			wantErr:    true,
+			wantReason: v1.ReasonSyncFailed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t, Config{ControllerName: "ingressgroup"}, test.objects...)
+			if _, err := f.reconciler.Reconcile(context.Background(), testNamespace+"/shop"); (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if got := f.reason(t, "shop", v1.IngressGroupReady); got != test.wantReason {
+				t.Errorf("got Ready reason %q, want %q", got, test.wantReason)
+			}
+		})
+	}
+}
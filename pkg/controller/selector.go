@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/liabio/ingressgroup/pkg/features"
+	"hash/fnv"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"sort"
+)
+
+// With the SelectorServices feature gate, a service item may pick pods by
+// label selector instead of naming a Service. The controller then creates a
+// ClusterIP Service in the group's namespace selecting those pods, exposing
+// the ports of all the items sharing the selector, each targeting the same
+// port on the pods.
+//
+// Selector Services are labeled and owned like the generated Ingresses: they
+// are garbage collected along with the group, and one no service item of the
+// group selects anymore is deleted on the next sync.
+
+// selectorServiceNamePrefixMax is the longest group name prefix of a selector
+// Service name, whose -selector- and hash suffix take 18 characters.
+const selectorServiceNamePrefixMax = validation.DNS1035LabelMaxLength - 18
+
+// selectorServiceName returns the name of the Service selecting the pods
+// matching the selector. It is derived from a hash of the selector so it
+// stays within the Service name length limit. Longer group names are
+// truncated, and then hashed along with the selector so two groups sharing
+// the truncated prefix get distinct Services.
+func selectorServiceName(ig *v1.IngressGroup, selector map[string]string) string {
+	h := fnv.New32a()
+	prefix := ig.Name
+	if len(prefix) > selectorServiceNamePrefixMax {
+		prefix = prefix[:selectorServiceNamePrefixMax]
+		h.Write([]byte(ig.Name + "/"))
+	}
+	h.Write([]byte(labels.SelectorFromSet(selector).String()))
+	return fmt.Sprintf("%s-selector-%08x", prefix, h.Sum32())
+}
+
+// selectorServices returns the Services selecting the pods of the group's
+// service items with a selector, keyed by name.
+func (r *Reconciler) selectorServices(ig *v1.IngressGroup) map[string]*corev1.Service {
+	services := map[string]*corev1.Service{}
+	if !r.config.FeatureGates.Enabled(features.SelectorServices) {
+		return services
+	}
+
+	selectors := map[string]map[string]string{}
+	ports := map[string]sets.Int{}
+	for _, item := range ig.Spec.Services {
+		if len(item.Selector) == 0 {
+			continue
+		}
+		name := selectorServiceName(ig, item.Selector)
+		if _, ok := ports[name]; !ok {
+			selectors[name] = item.Selector
+			ports[name] = sets.NewInt()
+		}
+		ports[name].Insert(int(item.Port))
+	}
+	for name, selector := range selectors {
+		services[name] = newSelectorService(ig, name, selector, ports[name].List())
+	}
+	return services
+}
+
+// newSelectorService returns the ClusterIP Service selecting the pods
+// matching the selector on the given ports.
+func newSelectorService(ig *v1.IngressGroup, name string, selector map[string]string, ports []int) *corev1.Service {
+	sort.Ints(ports)
+	var servicePorts []corev1.ServicePort
+	for _, port := range ports {
+		servicePorts = append(servicePorts, corev1.ServicePort{
+			Name:       fmt.Sprintf("port-%d", port),
+			Protocol:   corev1.ProtocolTCP,
+			Port:       int32(port),
+			TargetPort: intstr.FromInt(port),
+		})
+	}
+
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ig.Namespace,
+			Labels: map[string]string{
+				IngressGroupLabel: ig.Name,
+			},
+			Annotations: map[string]string{
+				ownerAnnotation: ig.Namespace + "/" + ig.Name,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(ig, v1.SchemeGroupVersion.WithKind("IngressGroup")),
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceTypeClusterIP,
+			Selector: selector,
+			Ports:    servicePorts,
+		},
+	}
+}
@@ -0,0 +1,172 @@
+package controller
+
+import (
+	"github.com/liabio/ingressgroup/pkg/features"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSelectorServiceName(t *testing.T) {
+	selector := map[string]string{"app": "web"}
+	tests := []struct {
+		name       string
+		groupName  string
+		wantPrefix string
+	}{
+		{name: "short name", groupName: "shop", wantPrefix: "shop-selector-"},
+		{
+			name:       "name at the limit",
+			groupName:  strings.Repeat("a", selectorServiceNamePrefixMax),
+			wantPrefix: strings.Repeat("a", selectorServiceNamePrefixMax) + "-selector-",
+		},
+		{
+			name:       "name over the limit",
+			groupName:  strings.Repeat("a", validation.DNS1123SubdomainMaxLength),
+			wantPrefix: strings.Repeat("a", selectorServiceNamePrefixMax) + "-selector-",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := selectorServiceName(newTestGroup(test.groupName), selector)
+			if !strings.HasPrefix(got, test.wantPrefix) {
+				t.Errorf("got %q, want prefix %q", got, test.wantPrefix)
+			}
+			if errs := validation.IsDNS1035Label(got); len(errs) > 0 {
+				t.Errorf("%q is not a valid service name: %v", got, errs)
+			}
+		})
+	}
+
+	long := strings.Repeat("a", selectorServiceNamePrefixMax)
+	if selectorServiceName(newTestGroup(long+"-one"), selector) == selectorServiceName(newTestGroup(long+"-two"), selector) {
+		t.Errorf("groups sharing a truncated name got the same selector service")
+	}
+}
+
+func TestValidateSelectors(t *testing.T) {
+	item := v1.ServiceItem{Namespace: testNamespace, Port: 8080, Selector: map[string]string{"app": "web"}}
+	tests := []struct {
+		name      string
+		groupName string
+		item      v1.ServiceItem
+		want      string
+	}{
+		{name: "selector", groupName: "shop", item: item},
+		{name: "named service", groupName: "shop", item: v1.ServiceItem{Name: "web", Namespace: testNamespace}},
+		{name: "long group name", groupName: strings.Repeat("a", validation.DNS1123SubdomainMaxLength), item: item},
+		{name: "group name with dots", groupName: "shop.example", item: item, want: v1.ReasonInvalidSelector},
+		{name: "group name starting with a digit", groupName: "1shop", item: item, want: v1.ReasonInvalidSelector},
+		{
+			name:      "name and selector",
+			groupName: "shop",
+			item:      v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 8080, Selector: item.Selector},
+			want:      v1.ReasonInvalidSelector,
+		},
+		{
+			name:      "selector without port",
+			groupName: "shop",
+			item:      v1.ServiceItem{Namespace: testNamespace, Selector: item.Selector},
+			want:      v1.ReasonInvalidSelector,
+		},
+		{
+			name:      "selector in another namespace",
+			groupName: "shop",
+			item:      v1.ServiceItem{Namespace: "backend", Port: 8080, Selector: item.Selector},
+			want:      v1.ReasonInvalidSelector,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := reasonOf(validateSelectors(newTestGroup(test.groupName, test.item))); got != test.want {
+				t.Errorf("got reason %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReconcileSelectorServices(t *testing.T) {
+	web := map[string]string{"app": "web"}
+	shop := newTestGroup("shop", v1.ServiceItem{Namespace: testNamespace, Port: 8080, Selector: web})
+	name := selectorServiceName(shop, web)
+	stale := newSelectorService(shop, selectorServiceName(shop, map[string]string{"app": "old"}), map[string]string{"app": "old"}, []int{80})
+	foreign := newTestService("shop-selector-foreign", 80)
+	foreign.Labels = map[string]string{IngressGroupLabel: "shop"}
+
+	tests := []struct {
+		name          string
+		enabled       bool
+		objects       []runtime.Object
+		wantIngresses map[string][]string
+		wantServices  []string
+	}{
+		{
+			name:          "skipped without the feature gate",
+			objects:       []runtime.Object{shop},
+			wantIngresses: map[string][]string{},
+			wantServices:  []string{},
+		},
+		{
+			name:          "service created",
+			enabled:       true,
+			objects:       []runtime.Object{shop},
+			wantIngresses: map[string][]string{"shop": {"/->" + name + ":8080"}},
+			wantServices:  []string{name},
+		},
+		{
+			name:          "stale service deleted and foreign one kept",
+			enabled:       true,
+			objects:       []runtime.Object{shop, stale, foreign},
+			wantIngresses: map[string][]string{"shop": {"/->" + name + ":8080"}},
+			wantServices:  []string{name, foreign.Name},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gates := features.NewFeatureGate()
+			gates.SetEnabled(features.SelectorServices, test.enabled)
+			f := newFixture(t, Config{ControllerName: "ingressgroup", FeatureGates: gates}, test.objects...)
+			f.reconcile(t, "shop")
+
+			if got := f.ingresses(t); !reflect.DeepEqual(got, test.wantIngresses) {
+				t.Errorf("got ingresses %v, want %v", got, test.wantIngresses)
+			}
+			got := []string{}
+			for svcName := range f.services(t) {
+				got = append(got, svcName)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, test.wantServices) {
+				t.Errorf("got services %v, want %v", got, test.wantServices)
+			}
+			if !test.enabled {
+				return
+			}
+
+			svc, err := f.kubeClient.CoreV1().Services(testNamespace).Get(name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get the selector service: %v", err)
+			}
+			if !reflect.DeepEqual(svc.Spec.Selector, web) {
+				t.Errorf("got selector %v, want %v", svc.Spec.Selector, web)
+			}
+			wantPorts := []corev1.ServicePort{{Name: "port-8080", Protocol: corev1.ProtocolTCP, Port: 8080, TargetPort: intstr.FromInt(8080)}}
+			if !reflect.DeepEqual(svc.Spec.Ports, wantPorts) {
+				t.Errorf("got ports %v, want %v", svc.Spec.Ports, wantPorts)
+			}
+			if !metav1.IsControlledBy(svc, shop) {
+				t.Errorf("the selector service is not owned by the group")
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"k8s.io/klog"
+	"sync"
+)
+
+// statusWriter coalesces the status updates of IngressGroups: the latest
+// status computed for a group replaces any pending one, and the pending
+// statuses are written when flushed, so a group whose status changes many
+// times between two flushes is written once, with its last status.
+type statusWriter struct {
+	lock    sync.Mutex
+	pending map[string]*v1.IngressGroup
+}
+
+func newStatusWriter() *statusWriter {
+	return &statusWriter{pending: map[string]*v1.IngressGroup{}}
+}
+
+// queue records the group, carrying the status to write, replacing the
+// pending status of the group if any.
+func (w *statusWriter) queue(ig *v1.IngressGroup) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.pending[ig.Namespace+"/"+ig.Name] = ig
+}
+
+// status returns the pending status of the group, nil if there is none.
+func (w *statusWriter) status(ig *v1.IngressGroup) *v1.IngressGroupStatus {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if pending, ok := w.pending[ig.Namespace+"/"+ig.Name]; ok && pending.UID == ig.UID {
+		return &pending.Status
+	}
+	return nil
+}
+
+// take removes and returns the pending status of every group.
+func (w *statusWriter) take() map[string]*v1.IngressGroup {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	pending := w.pending
+	w.pending = map[string]*v1.IngressGroup{}
+	return pending
+}
+
+// requeue puts back a status that failed to be written, unless a newer one
+// was queued meanwhile.
+func (w *statusWriter) requeue(key string, ig *v1.IngressGroup) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.pending[key]; !ok {
+		w.pending[key] = ig
+	}
+}
+
+// FlushStatusUpdates writes the status updates held back by
+// Config.StatusUpdateInterval. The statuses that fail to be written are kept
+// for the next flush; those of deleted groups are dropped. It is a no-op when
+// status updates are written right away.
+func (r *Reconciler) FlushStatusUpdates() {
+	if r.statuses == nil {
+		return
+	}
+	for key, ig := range r.statuses.take() {
+		err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+			return r.writes.do(func() error {
+				_, err := r.versionedClient.CrV1().IngressGroups(ig.Namespace).UpdateStatus(ig)
+				if !errors.IsConflict(err) {
+					return err
+				}
+				// The group changed since its status was computed; write
+				// the status onto the latest version.
+				latest, getErr := r.versionedClient.CrV1().IngressGroups(ig.Namespace).Get(ig.Name, metav1.GetOptions{})
+				if getErr != nil {
+					return getErr
+				}
+				status := ig.Status
+				ig = latest.DeepCopy()
+				ig.Status = status
+				return err
+			})
+		})
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			klog.Errorf("failed to update status of ingress group %v: %v", key, err)
+			r.statuses.requeue(key, ig)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"testing"
+	"time"
+)
+
+// statusWrites returns the number of status updates sent to the fake API
+// server.
+func (f *fixture) statusWrites() int {
+	writes := 0
+	for _, action := range f.versionedClient.Actions() {
+		if action.GetVerb() == "update" && action.GetSubresource() == "status" {
+			writes++
+		}
+	}
+	return writes
+}
+
+func TestStatusUpdateBatching(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		// wantWrites are the status writes before and after the flush.
+		wantWrites, wantFlushed int
+	}{
+		{name: "written right away", wantWrites: 4, wantFlushed: 4},
+		{name: "batched", interval: time.Minute, wantFlushed: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t, Config{ControllerName: "ingressgroup", StatusUpdateInterval: test.interval},
+				newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80}),
+				newTestService("web", 80))
+
+			// The group flips between valid and invalid, ending invalid.
+			for _, port := range []int32{80, -1, 80, -1} {
+				ig, err := f.versionedClient.CrV1().IngressGroups(testNamespace).Get("shop", metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("failed to get the group: %v", err)
+				}
+				ig.Spec.Services[0].Port = port
+				ig.Generation++
+				if _, err := f.versionedClient.CrV1().IngressGroups(testNamespace).Update(ig); err != nil {
+					t.Fatalf("failed to update the group: %v", err)
+				}
+				f.refreshCaches(t)
+				f.reconcile(t, "shop")
+			}
+			if got := f.statusWrites(); got != test.wantWrites {
+				t.Errorf("got %v status writes before the flush, want %v", got, test.wantWrites)
+			}
+
+			f.reconciler.FlushStatusUpdates()
+			if got := f.statusWrites(); got != test.wantFlushed {
+				t.Errorf("got %v status writes after the flush, want %v", got, test.wantFlushed)
+			}
+			if got := f.condition(t, "shop", v1.IngressGroupValid); got != corev1.ConditionFalse {
+				t.Errorf("got Valid condition %v, want the last one, %v", got, corev1.ConditionFalse)
+			}
+		})
+	}
+}
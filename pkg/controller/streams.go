@@ -0,0 +1,177 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"k8s.io/klog"
+	"strconv"
+)
+
+// ingress-nginx exposes TCP and UDP services through ConfigMaps mapping the
+// ports it listens on to <namespace>/<service>:<port>, given by its
+// --tcp-services-configmap and --udp-services-configmap. The controller adds
+// the stream services of the groups to those ConfigMaps and records which
+// group each port belongs to in the streamOwnersAnnotation of the ConfigMap,
+// a JSON object from port to the namespace/name of the group. Entries it did
+// not add are left alone.
+//
+// ConfigMap entries have no owner references, so the entries of a group are
+// removed when the controller sees the group deleted. Entries of groups
+// deleted while the controller was down are removed on the next sync of any
+// group.
+
+// streamOwnersAnnotation records the group each port of a stream services
+// ConfigMap was added for.
+const streamOwnersAnnotation = "ingressgroup.ingress-nginx.k8s.io/owners"
+
+// streamPortConflictError is returned when a port of a stream service is
+// already mapped in the ConfigMap by another group or by hand.
+type streamPortConflictError struct {
+	configMap string
+	port      string
+	owner     string
+}
+
+func (e *streamPortConflictError) Error() string {
+	if e.owner == "" {
+		return fmt.Sprintf("port %v is already mapped in configmap %v", e.port, e.configMap)
+	}
+	return fmt.Sprintf("port %v is already mapped in configmap %v by ingress group %v", e.port, e.configMap, e.owner)
+}
+
+// syncStreamServices maps the TCP and UDP services of the group in the
+// stream services ConfigMaps, removing the ports it no longer exposes.
+func (r *Reconciler) syncStreamServices(ig *v1.IngressGroup) error {
+	key := ig.Namespace + "/" + ig.Name
+	for _, stream := range []struct {
+		configMap string
+		items     []v1.StreamServiceItem
+	}{
+		{r.config.TCPServicesConfigMap, ig.Spec.TCPServices},
+		{r.config.UDPServicesConfigMap, ig.Spec.UDPServices},
+	} {
+		if stream.configMap == "" {
+			if len(stream.items) > 0 {
+				klog.Warningf("ingress group %v: skipping stream services, no services configmap is configured for their protocol", key)
+			}
+			continue
+		}
+		desired := map[string]string{}
+		for _, item := range stream.items {
+			desired[strconv.Itoa(int(item.Port))] = fmt.Sprintf("%s/%s:%d", ig.Namespace, item.Service, item.ServicePort)
+		}
+		if err := r.syncStreamConfigMap(stream.configMap, key, desired); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseStreamServices removes the ports mapped for the deleted group with
+// the given key from the stream services ConfigMaps.
+func (r *Reconciler) releaseStreamServices(key string) error {
+	for _, configMap := range []string{r.config.TCPServicesConfigMap, r.config.UDPServicesConfigMap} {
+		if configMap == "" {
+			continue
+		}
+		if err := r.syncStreamConfigMap(configMap, key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncStreamConfigMap makes the ports mapped for the group with the given key
+// in the ConfigMap, given as namespace/name, match desired. Ports of groups
+// that no longer exist are removed along the way.
+func (r *Reconciler) syncStreamConfigMap(configMap, key string, desired map[string]string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(configMap)
+	if err != nil {
+		return err
+	}
+	cmClient := r.kubeClient.CoreV1().ConfigMaps(namespace)
+
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		cm, err := cmClient.Get(name, metav1.GetOptions{})
+		if errors.IsNotFound(err) && len(desired) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		owners := map[string]string{}
+		if raw := cm.Annotations[streamOwnersAnnotation]; raw != "" {
+			if err := json.Unmarshal([]byte(raw), &owners); err != nil {
+				return fmt.Errorf("invalid %v annotation on configmap %v: %v", streamOwnersAnnotation, configMap, err)
+			}
+		}
+
+		update := cm.DeepCopy()
+		if update.Data == nil {
+			update.Data = map[string]string{}
+		}
+		for port, owner := range owners {
+			if _, ok := desired[port]; ok && owner == key {
+				continue
+			}
+			if owner == key || !r.groupExists(owner) {
+				delete(update.Data, port)
+				delete(owners, port)
+			}
+		}
+		for port, value := range desired {
+			owner, owned := owners[port]
+			if owned && owner != key {
+				return &streamPortConflictError{configMap: configMap, port: port, owner: owner}
+			}
+			if _, mapped := update.Data[port]; mapped && !owned {
+				return &streamPortConflictError{configMap: configMap, port: port}
+			}
+			update.Data[port] = value
+			owners[port] = key
+		}
+
+		raw, err := json.Marshal(owners)
+		if err != nil {
+			return err
+		}
+		if update.Annotations == nil {
+			update.Annotations = map[string]string{}
+		}
+		update.Annotations[streamOwnersAnnotation] = string(raw)
+		if apiequality.Semantic.DeepEqual(cm.Data, update.Data) &&
+			apiequality.Semantic.DeepEqual(cm.Annotations, update.Annotations) {
+			return nil
+		}
+		if r.observing("ingress group %v: would update configmap %v", key, configMap) {
+			return nil
+		}
+		return r.writes.do(func() error {
+			_, err := cmClient.Update(update)
+			return err
+		})
+	})
+}
+
+// groupExists reports whether the group with the given namespace/name key
+// exists. The cache only holds the groups the controller watches, so a miss
+// is confirmed against the API server; only a group the API server does not
+// know is considered gone.
+func (r *Reconciler) groupExists(key string) bool {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return true
+	}
+	if _, err := r.igLister.IngressGroups(namespace).Get(name); err == nil {
+		return true
+	}
+	_, err = r.versionedClient.CrV1().IngressGroups(namespace).Get(name, metav1.GetOptions{})
+	return !errors.IsNotFound(err)
+}
@@ -0,0 +1,127 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"reflect"
+	"testing"
+)
+
+// newTestStreamConfigMap returns the TCP services ConfigMap of ingress-nginx
+// with the given entries, each owned by the group in owners if listed.
+func newTestStreamConfigMap(t *testing.T, data, owners map[string]string) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ingress-nginx", Name: "tcp-services"},
+		Data:       data,
+	}
+	if owners != nil {
+		raw, err := json.Marshal(owners)
+		if err != nil {
+			t.Fatalf("failed to encode the owners: %v", err)
+		}
+		cm.Annotations = map[string]string{streamOwnersAnnotation: string(raw)}
+	}
+	return cm
+}
+
+func TestReconcileStreamServices(t *testing.T) {
+	shopKey := testNamespace + "/shop"
+	shop := func(ports ...int32) *v1.IngressGroup {
+		ig := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, Port: 80})
+		for _, port := range ports {
+			ig.Spec.TCPServices = append(ig.Spec.TCPServices, v1.StreamServiceItem{Port: port, Service: "db", ServicePort: 5432})
+		}
+		return ig
+	}
+	tests := []struct {
+		name       string
+		group      *v1.IngressGroup
+		configMap  *corev1.ConfigMap
+		wantData   map[string]string
+		wantOwners map[string]string
+		wantErr    bool
+	}{
+		{
+			name:       "port added",
+			group:      shop(9000),
+			configMap:  newTestStreamConfigMap(t, nil, nil),
+			wantData:   map[string]string{"9000": testNamespace + "/db:5432"},
+			wantOwners: map[string]string{"9000": shopKey},
+		},
+		{
+			name:  "port removed",
+			group: shop(9000),
+			configMap: newTestStreamConfigMap(t,
+				map[string]string{"9000": testNamespace + "/db:5432", "9001": testNamespace + "/db:5432"},
+				map[string]string{"9000": shopKey, "9001": shopKey}),
+			wantData:   map[string]string{"9000": testNamespace + "/db:5432"},
+			wantOwners: map[string]string{"9000": shopKey},
+		},
+		{
+			name:       "entry added by hand kept",
+			group:      shop(9000),
+			configMap:  newTestStreamConfigMap(t, map[string]string{"8000": "other/mqtt:1883"}, nil),
+			wantData:   map[string]string{"8000": "other/mqtt:1883", "9000": testNamespace + "/db:5432"},
+			wantOwners: map[string]string{"9000": shopKey},
+		},
+		{
+			name:  "entry of a deleted group removed",
+			group: shop(9000),
+			configMap: newTestStreamConfigMap(t,
+				map[string]string{"7000": testNamespace + "/cache:6379"},
+				map[string]string{"7000": testNamespace + "/gone"}),
+			wantData:   map[string]string{"9000": testNamespace + "/db:5432"},
+			wantOwners: map[string]string{"9000": shopKey},
+		},
+		{
+			name:      "port mapped by hand",
+			group:     shop(8000),
+			configMap: newTestStreamConfigMap(t, map[string]string{"8000": "other/mqtt:1883"}, nil),
+			wantData:  map[string]string{"8000": "other/mqtt:1883"},
+			wantErr:   true,
+		},
+		{
+			name: "group deleted",
+			configMap: newTestStreamConfigMap(t,
+				map[string]string{"8000": "other/mqtt:1883", "9000": testNamespace + "/db:5432"},
+				map[string]string{"9000": shopKey}),
+			wantData:   map[string]string{"8000": "other/mqtt:1883"},
+			wantOwners: map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			objects := []runtime.Object{test.configMap, newTestService("web", 80)}
+			if test.group != nil {
+				objects = append(objects, test.group)
+			}
+			f := newFixture(t, Config{ControllerName: "ingressgroup", TCPServicesConfigMap: "ingress-nginx/tcp-services"}, objects...)
+			_, err := f.reconciler.Reconcile(context.Background(), shopKey)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+
+			cm, err := f.kubeClient.CoreV1().ConfigMaps("ingress-nginx").Get("tcp-services", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get the configmap: %v", err)
+			}
+			if !reflect.DeepEqual(cm.Data, test.wantData) {
+				t.Errorf("got data %v, want %v", cm.Data, test.wantData)
+			}
+			var owners map[string]string
+			if raw := cm.Annotations[streamOwnersAnnotation]; raw != "" {
+				if err := json.Unmarshal([]byte(raw), &owners); err != nil {
+					t.Fatalf("failed to decode the owners: %v", err)
+				}
+			}
+			if !reflect.DeepEqual(owners, test.wantOwners) {
+				t.Errorf("got owners %v, want %v", owners, test.wantOwners)
+			}
+		})
+	}
+}
@@ -0,0 +1,609 @@
+package controller
+
+import (
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// captureReference matches the references to path capture groups, such as $1,
+// in a rewrite target.
+var captureReference = regexp.MustCompile(`\$(\d+)`)
+
+// unsafeRewriteChars are characters that would break out of the nginx rewrite
+// directive the target ends up in.
+var unsafeRewriteChars = regexp.MustCompile(`[\s;{}'"]`)
+
+// headerName matches a valid HTTP header name, an RFC 7230 token.
+var headerName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// unsafeHeaderValueChars are characters that would break the header or the
+// quoted nginx string it is rendered into.
+var unsafeHeaderValueChars = regexp.MustCompile(`[\x00-\x1f\x7f"\\]`)
+
+// validationError explains why the spec of an IngressGroup cannot be rendered.
+// The reason is reported on the group's Valid condition.
+type validationError struct {
+	reason  string
+	message string
+}
+
+func (e *validationError) Error() string {
+	return e.message
+}
+
+func invalid(reason, format string, args ...interface{}) *validationError {
+	return &validationError{reason: reason, message: fmt.Sprintf(format, args...)}
+}
+
+// Validate checks the rules of the IngressGroup's spec the CRD schema cannot
+// express, the same way the controller does before rendering it.
+func Validate(ig *v1.IngressGroup) error {
+	if err := validateIngressGroup(setDefaults(ig)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ValidationReason returns the reason of an error returned by Validate, as
+// reported on the Valid condition of the group.
+func ValidationReason(err error) string {
+	if verr, ok := err.(*validationError); ok {
+		return verr.reason
+	}
+	return v1.ReasonInvalid
+}
+
+// validateIngressGroup checks the rules of the spec the CRD schema cannot
+// express.
+func validateIngressGroup(ig *v1.IngressGroup) *validationError {
+	if name := ig.Spec.IngressName; name != "" {
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			return invalid(v1.ReasonInvalidIngressName, "ingress name %q is not a valid DNS-1123 subdomain: %v",
+				name, strings.Join(errs, ", "))
+		}
+	}
+	if path := ig.Spec.DefaultPath; path != "" && !strings.HasPrefix(path, "/") {
+		return invalid(v1.ReasonInvalidDefaultPath, "default path %q does not start with /", path)
+	}
+	if _, _, err := parsePruneStrategy(ig.Spec.PruneStrategy); err != nil {
+		return invalid(v1.ReasonInvalidPruneStrategy, "invalid prune strategy: %v; use immediate, confirm or grace:<duration>", err)
+	}
+	if err := validateServiceSelector(ig.Spec.ServiceSelector); err != nil {
+		return err
+	}
+	if err := validateTLS(ig.Spec.TLS); err != nil {
+		return err
+	}
+	if err := validateAnnotations(ig.Spec.Annotations); err != nil {
+		return err
+	}
+	if err := validateResponseHeaders(ig.Spec.ResponseHeaders); err != nil {
+		return err
+	}
+	if err := validateStreamServices("tcp", ig.Spec.TCPServices); err != nil {
+		return err
+	}
+	if err := validateStreamServices("udp", ig.Spec.UDPServices); err != nil {
+		return err
+	}
+	if err := validateIngressClasses(ig.Spec.Services); err != nil {
+		return err
+	}
+	if err := validateHosts(ig.Spec.Services); err != nil {
+		return err
+	}
+	if err := validateSelectors(ig); err != nil {
+		return err
+	}
+	if err := validateBridges(ig); err != nil {
+		return err
+	}
+	if err := validatePorts(ig.Spec.Services); err != nil {
+		return err
+	}
+	if err := validatePaths(ig.Spec.Services); err != nil {
+		return err
+	}
+	if err := validateDuplicates(ig.Spec.Services); err != nil {
+		return err
+	}
+	if err := validateWeights(ig.Spec.Services); err != nil {
+		return err
+	}
+	if err := validateIngressNames(ig); err != nil {
+		return err
+	}
+	return validateRewriteTargets(ig.Spec.Services)
+}
+
+// validateAnnotations checks that the keys of the annotations the group
+// passes through are valid annotation keys.
+func validateAnnotations(annotations map[string]string) *validationError {
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if errs := validation.IsQualifiedName(strings.ToLower(key)); len(errs) > 0 {
+			return invalid(v1.ReasonInvalidAnnotation, "annotation key %q is invalid: %v", key, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// validateTLS checks that every TLS entry names a Secret and lists valid
+// hostnames.
+func validateTLS(entries []v1.IngressTLS) *validationError {
+	for _, entry := range entries {
+		if errs := validation.IsDNS1123Subdomain(entry.SecretName); len(errs) > 0 {
+			return invalid(v1.ReasonInvalidTLS, "TLS secret name %q is not a valid secret name: %v",
+				entry.SecretName, strings.Join(errs, ", "))
+		}
+		for _, host := range entry.Hosts {
+			errs := validation.IsDNS1123Subdomain(host)
+			if strings.HasPrefix(host, "*.") {
+				errs = validation.IsWildcardDNS1123Subdomain(host)
+			}
+			if len(errs) > 0 {
+				return invalid(v1.ReasonInvalidTLS, "TLS host %q of secret %v is not a valid hostname: %v",
+					host, entry.SecretName, strings.Join(errs, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// validateServiceSelector checks that the service selector of the group, if
+// any, parses and does not select every Service of its namespace.
+func validateServiceSelector(selector *v1.ServiceSelector) *validationError {
+	if selector == nil {
+		return nil
+	}
+	if selector.Port < 0 || selector.Port > 65535 {
+		return invalid(v1.ReasonInvalidServiceSelector, "port %d of the service selector is not within 1-65535", selector.Port)
+	}
+	if selector.Selector == nil {
+		return invalid(v1.ReasonInvalidServiceSelector, "the service selector has no selector")
+	}
+	parsed, err := metav1.LabelSelectorAsSelector(selector.Selector)
+	if err != nil {
+		return invalid(v1.ReasonInvalidServiceSelector, "invalid service selector: %v", err)
+	}
+	if parsed.Empty() {
+		return invalid(v1.ReasonInvalidServiceSelector, "the service selector is empty and would select every service")
+	}
+	return nil
+}
+
+// validateResponseHeaders checks that the response headers are valid HTTP
+// headers that can be quoted into an nginx directive.
+func validateResponseHeaders(headers map[string]string) *validationError {
+	for name, value := range headers {
+		if !headerName.MatchString(name) {
+			return invalid(v1.ReasonInvalidResponseHeader, "response header name %q is not a valid HTTP header name", name)
+		}
+		if unsafeHeaderValueChars.MatchString(value) {
+			return invalid(v1.ReasonInvalidResponseHeader, "value of response header %v contains control characters, quotes or backslashes", name)
+		}
+	}
+	return nil
+}
+
+// validateStreamServices checks that the stream services of a protocol use
+// valid ports, each port ingress-nginx listens on once, and valid service
+// names.
+func validateStreamServices(protocol string, items []v1.StreamServiceItem) *validationError {
+	seen := map[int32]bool{}
+	for _, item := range items {
+		if errs := validation.IsValidPortNum(int(item.Port)); len(errs) > 0 {
+			return invalid(v1.ReasonInvalidStreamService, "%v port %d is not within 1-65535", protocol, item.Port)
+		}
+		if seen[item.Port] {
+			return invalid(v1.ReasonInvalidStreamService, "%v port %d is listed more than once", protocol, item.Port)
+		}
+		seen[item.Port] = true
+		if errs := validation.IsDNS1035Label(item.Service); len(errs) > 0 {
+			return invalid(v1.ReasonInvalidStreamService, "service %q of %v port %d is not a valid service name: %v",
+				item.Service, protocol, item.Port, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsValidPortNum(int(item.ServicePort)); len(errs) > 0 {
+			return invalid(v1.ReasonInvalidStreamService, "service port %d of %v port %d is not within 1-65535",
+				item.ServicePort, protocol, item.Port)
+		}
+	}
+	return nil
+}
+
+// validateHosts checks that the hosts of the services are DNS-1123
+// subdomains, optionally with a leading wildcard label, and that no service
+// lists a host twice. Services sharing a path are weighed against each other
+// only when they list the same hosts, so a host listed for a path by services
+// with different hosts would route it to several services at once.
+func validateHosts(items []v1.ServiceItem) *validationError {
+	for _, item := range items {
+		seen := map[string]bool{}
+		for _, host := range item.Hosts {
+			errs := validation.IsDNS1123Subdomain(host)
+			if strings.HasPrefix(host, "*.") {
+				errs = validation.IsWildcardDNS1123Subdomain(host)
+			}
+			if len(errs) > 0 {
+				return invalid(v1.ReasonInvalidHost, "host %q of service %v is not a valid hostname: %v",
+					host, item.Name, strings.Join(errs, ", "))
+			}
+			if seen[host] {
+				return invalid(v1.ReasonInvalidHost, "service %v lists host %q more than once", item.Name, host)
+			}
+			seen[host] = true
+		}
+	}
+
+	// routes holds the first service routing each host and path, and the
+	// hosts it lists.
+	type route struct {
+		service string
+		hosts   string
+	}
+	routes := map[string]route{}
+	for _, item := range items {
+		hosts := append([]string(nil), item.Hosts...)
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			key := host + " " + renderedPath(item) + " " + item.IngressClassName
+			first, ok := routes[key]
+			if !ok {
+				routes[key] = route{service: item.Name, hosts: strings.Join(hosts, ",")}
+				continue
+			}
+			if first.hosts != strings.Join(hosts, ",") {
+				return invalid(v1.ReasonInvalidHost, "services %v and %v both route host %q and path %q but list different hosts, list the same hosts to split the path between them",
+					first.service, item.Name, host, item.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// validateSelectors checks that every service item either names a service or
+// selects pods, and that items selecting pods are in the group's namespace,
+// set the port the pods listen on and get a valid Service name, which a
+// group name with dots or starting with a digit is not.
+func validateSelectors(ig *v1.IngressGroup) *validationError {
+	for _, item := range ig.Spec.Services {
+		if (item.Name == "") == (len(item.Selector) == 0) {
+			return invalid(v1.ReasonInvalidSelector, "service item %q must set exactly one of name and selector", item.Name)
+		}
+		if len(item.Selector) == 0 {
+			continue
+		}
+		selector := labels.SelectorFromSet(item.Selector)
+		if item.Namespace != ig.Namespace {
+			return invalid(v1.ReasonInvalidSelector, "service item selecting %v must be in the namespace of the group", selector)
+		}
+		if item.Port == 0 || item.PortName != "" {
+			return invalid(v1.ReasonInvalidSelector, "service item selecting %v must set port and not portName", selector)
+		}
+		if name := selectorServiceName(ig, item.Selector); len(validation.IsDNS1035Label(name)) > 0 {
+			return invalid(v1.ReasonInvalidSelector, "service %q selecting %v is not a valid DNS-1035 label, rename the group", name, selector)
+		}
+		for key, value := range item.Selector {
+			if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+				return invalid(v1.ReasonInvalidSelector, "selector key %q is not a valid label name: %v", key, strings.Join(errs, ", "))
+			}
+			if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+				return invalid(v1.ReasonInvalidSelector, "selector value %q is not a valid label value: %v", value, strings.Join(errs, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// validateBridges checks that the services of other namespaces get a valid
+// bridge Service name, which a group name with dots or starting with a digit
+// does not.
+func validateBridges(ig *v1.IngressGroup) *validationError {
+	for _, item := range ig.Spec.Services {
+		if item.Name == "" || item.Namespace == ig.Namespace {
+			continue
+		}
+		if name := bridgeServiceName(ig, ig.Namespace, item); len(validation.IsDNS1035Label(name)) > 0 {
+			return invalid(v1.ReasonInvalidBridgeName, "service %q bridging to %v/%v is not a valid DNS-1035 label, rename the group",
+				name, item.Namespace, item.Name)
+		}
+	}
+	return nil
+}
+
+// validatePorts checks that service ports are valid port numbers, port names
+// are valid IANA service names, and no service sets both, which would leave
+// the port routed to ambiguous.
+func validatePorts(items []v1.ServiceItem) *validationError {
+	for _, item := range items {
+		if item.Port < 0 || item.Port > 65535 {
+			return invalid(v1.ReasonInvalidPort, "port %d of service %v is not within 1-65535", item.Port, item.Name)
+		}
+		if item.PortName == "" {
+			continue
+		}
+		if item.Port != 0 {
+			return invalid(v1.ReasonInvalidPort, "service %v sets both port %d and port name %q, set only one",
+				item.Name, item.Port, item.PortName)
+		}
+		if errs := validation.IsValidPortName(item.PortName); len(errs) > 0 {
+			return invalid(v1.ReasonInvalidPort, "port name %q of service %v is not a valid service name: %v",
+				item.PortName, item.Name, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// validatePaths checks that the path types are known, that the paths
+// matched as regular expressions are not broken in any flavour and that exact
+// paths share no host with prefix paths. ingress-nginx turns on regex
+// matching for every path of a host once one of its Ingresses uses it, so
+// the prefix paths would be matched as unanchored, case insensitive regular
+// expressions.
+func validatePaths(items []v1.ServiceItem) *validationError {
+	for _, item := range items {
+		switch item.PathType {
+		case v1.PathTypePrefix, v1.PathTypeExact, v1.PathTypeImplementationSpecific:
+		default:
+			return invalid(v1.ReasonInvalidPath, "path type %q of service %v is not Prefix, Exact or ImplementationSpecific",
+				item.PathType, item.Name)
+		}
+		if item.PathType != v1.PathTypeImplementationSpecific {
+			continue
+		}
+		if err := regexSyntaxError(item.Path); err != nil {
+			return invalid(v1.ReasonInvalidPath, "path %q of service %v is not a valid regular expression: %v",
+				item.Path, item.Name, err)
+		}
+	}
+
+	// exact and prefix hold the first service with an exact and a prefix
+	// path on each host and ingress class, the empty host standing for any.
+	exact, prefix := map[string]string{}, map[string]string{}
+	for _, item := range items {
+		hosts := item.Hosts
+		if len(hosts) == 0 {
+			hosts = []string{""}
+		}
+		for _, host := range hosts {
+			key := host + " " + item.IngressClassName
+			switch item.PathType {
+			case v1.PathTypeExact:
+				if _, ok := exact[key]; !ok {
+					exact[key] = item.Name
+				}
+			case v1.PathTypePrefix:
+				if _, ok := prefix[key]; !ok {
+					prefix[key] = item.Name
+				}
+			}
+			exactService, hasExact := exact[key]
+			prefixService, hasPrefix := prefix[key]
+			if hasExact && hasPrefix {
+				if host == "" {
+					host = "*"
+				}
+				return invalid(v1.ReasonInvalidPath, "service %v has an exact path and service %v a prefix path on host %q, which ingress-nginx would match as a regular expression; put them on different hosts",
+					exactService, prefixService, host)
+			}
+		}
+	}
+	return nil
+}
+
+// regexSyntaxError returns why the expression is not a regular expression
+// in any flavour, nil if it may be one. nginx matches regex paths with PCRE,
+// which accepts constructs Go's RE2 parser rejects, such as lookarounds,
+// backreferences and possessive quantifiers, so only the errors PCRE reports
+// too are returned.
+func regexSyntaxError(expr string) error {
+	_, err := syntax.Parse(expr, syntax.Perl)
+	if serr, ok := err.(*syntax.Error); ok {
+		switch serr.Code {
+		case syntax.ErrMissingParen, syntax.ErrUnexpectedParen, syntax.ErrMissingBracket,
+			syntax.ErrMissingRepeatArgument, syntax.ErrTrailingBackslash,
+			syntax.ErrInvalidCharRange, syntax.ErrInvalidCharClass:
+			return err
+		}
+	}
+	return nil
+}
+
+// captureGroups returns the number of capture groups of the regular
+// expression, counted the way PCRE does: every ( that is neither escaped nor
+// in a character class opens one, except the (?...) and (*...) groups other
+// than named ones.
+func captureGroups(expr string) int {
+	groups := 0
+	inClass := false
+	for i := 0; i < len(expr); i++ {
+		switch c := expr[i]; {
+		case c == '\\':
+			i++
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+			// A ] right after the opening [ or [^ is a literal.
+			if strings.HasPrefix(expr[i+1:], "^") {
+				i++
+			}
+			if strings.HasPrefix(expr[i+1:], "]") {
+				i++
+			}
+		case c == '(':
+			rest := expr[i+1:]
+			named := strings.HasPrefix(rest, "?P<") || strings.HasPrefix(rest, "?'") ||
+				strings.HasPrefix(rest, "?<") && !strings.HasPrefix(rest, "?<=") && !strings.HasPrefix(rest, "?<!")
+			if named || !strings.HasPrefix(rest, "?") && !strings.HasPrefix(rest, "*") {
+				groups++
+			}
+		}
+	}
+	return groups
+}
+
+// validateIngressNames checks that the names of the Ingresses generated for
+// the group fit in a DNS-1123 subdomain. They are derived from the group name
+// plus suffixes, so a long group name can push them over the limit. It
+// relies on the weights having been validated.
+func validateIngressNames(ig *v1.IngressGroup) *validationError {
+	items := make([]v1.ServiceItem, len(ig.Spec.Services))
+	for i, item := range ig.Spec.Services {
+		if len(item.Selector) > 0 {
+			item.Name = selectorServiceName(ig, item.Selector)
+		} else if item.Namespace != ig.Namespace {
+			item.Name = bridgeServiceName(ig, ig.Namespace, item)
+		}
+		items[i] = item
+	}
+	for _, ing := range newIngresses(ig, sortedServices(items), nil, DefaultAnnotationsPrefix) {
+		if len(ing.Name) > validation.DNS1123SubdomainMaxLength {
+			return invalid(v1.ReasonInvalidIngressName, "generated ingress name %q is longer than %d characters, set ingressName to a shorter name",
+				ing.Name, validation.DNS1123SubdomainMaxLength)
+		}
+	}
+	return nil
+}
+
+// validateDuplicates checks that no path lists the same service twice. The
+// weights of such a path would split traffic between a service and itself,
+// and its canary Ingress would collide with the primary one.
+func validateDuplicates(items []v1.ServiceItem) *validationError {
+	for _, group := range servicesByPath(items) {
+		seen := map[string]bool{}
+		for _, item := range group {
+			service := item.Namespace + "/" + item.Name
+			if len(item.Selector) > 0 {
+				service = item.Namespace + "/" + labels.SelectorFromSet(item.Selector).String()
+			}
+			if seen[service] {
+				return invalid(v1.ReasonDuplicateService, "service %v is listed more than once for path %q", service, item.Path)
+			}
+			seen[service] = true
+		}
+	}
+	return nil
+}
+
+// validateWeights checks that services sharing a path all carry a weight and
+// that their weights add up to 100, and that a service taking a canary share
+// of several paths uses the same weight for all of them, since its canary
+// Ingress carries a single weight.
+func validateWeights(items []v1.ServiceItem) *validationError {
+	canaryWeights := map[string]int{}
+	for _, group := range servicesByPath(items) {
+		if len(group) == 1 {
+			continue
+		}
+
+		total := 0
+		for _, item := range group {
+			if item.Weight == nil {
+				return invalid(v1.ReasonInvalidWeights, "service %v shares path %q with other services but has no weight",
+					item.Name, item.Path)
+			}
+			total += *item.Weight
+		}
+		if total != 100 {
+			return invalid(v1.ReasonInvalidWeights, "weights of the services sharing path %q add up to %d, not 100",
+				group[0].Path, total)
+		}
+
+		for _, canary := range group[1:] {
+			if weight, ok := canaryWeights[canary.Name]; ok && weight != *canary.Weight {
+				return invalid(v1.ReasonInvalidWeights, "service %v takes a canary share of several paths with different weights",
+					canary.Name)
+			}
+			canaryWeights[canary.Name] = *canary.Weight
+		}
+	}
+	return nil
+}
+
+// validateRewriteTargets checks that rewrite targets are safe to put into the
+// nginx configuration and only reference capture groups their path defines,
+// and that a service taking a canary share of several paths uses the same
+// rewrite target for all of them, since its canary Ingress carries a single
+// rewrite target.
+func validateRewriteTargets(items []v1.ServiceItem) *validationError {
+	for _, item := range items {
+		target := item.RewriteTarget
+		if target == "" {
+			continue
+		}
+		if unsafeRewriteChars.MatchString(target) {
+			return invalid(v1.ReasonInvalidRewriteTarget, "rewrite target %q of service %v contains whitespace, quotes, braces or semicolons",
+				target, item.Name)
+		}
+
+		groups := 0
+		for _, ref := range captureReference.FindAllStringSubmatch(target, -1) {
+			if n, _ := strconv.Atoi(ref[1]); n > groups {
+				groups = n
+			}
+		}
+		if groups == 0 {
+			continue
+		}
+		if err := regexSyntaxError(item.Path); err != nil {
+			return invalid(v1.ReasonInvalidRewriteTarget, "rewrite target %q of service %v references capture groups but path %q is not a valid regular expression: %v",
+				target, item.Name, item.Path, err)
+		}
+		if n := captureGroups(item.Path); n < groups {
+			return invalid(v1.ReasonInvalidRewriteTarget, "rewrite target %q of service %v references capture group $%d but path %q only has %d",
+				target, item.Name, groups, item.Path, n)
+		}
+	}
+
+	canaryTargets := map[string]string{}
+	for _, group := range servicesByPath(items) {
+		for _, canary := range group[1:] {
+			if target, ok := canaryTargets[canary.Name]; ok && target != canary.RewriteTarget {
+				return invalid(v1.ReasonInvalidRewriteTarget, "service %v takes a canary share of several paths with different rewrite targets",
+					canary.Name)
+			}
+			canaryTargets[canary.Name] = canary.RewriteTarget
+		}
+	}
+	return nil
+}
+
+// validateIngressClasses checks that the ingress classes are valid names,
+// and that a service taking a canary share of several paths does so
+// in a single class, since its canary Ingress carries a single class.
+func validateIngressClasses(items []v1.ServiceItem) *validationError {
+	for _, item := range items {
+		if item.IngressClassName == "" {
+			continue
+		}
+		if errs := validation.IsDNS1123Subdomain(item.IngressClassName); len(errs) > 0 {
+			return invalid(v1.ReasonInvalidIngressClass, "ingress class %q of service %v is not a valid DNS-1123 subdomain: %v",
+				item.IngressClassName, item.Name, strings.Join(errs, ", "))
+		}
+	}
+
+	canaryClasses := map[string]string{}
+	for _, group := range servicesByPath(items) {
+		for _, canary := range group[1:] {
+			if class, ok := canaryClasses[canary.Name]; ok && class != canary.IngressClassName {
+				return invalid(v1.ReasonInvalidIngressClass, "service %v takes a canary share of paths of different ingress classes",
+					canary.Name)
+			}
+			canaryClasses[canary.Name] = canary.IngressClassName
+		}
+	}
+	return nil
+}
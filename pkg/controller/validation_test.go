@@ -0,0 +1,565 @@
+package controller
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"strings"
+	"testing"
+)
+
+// reasonOf returns the reason of the validation error, empty if there is
+// none.
+func reasonOf(err *validationError) string {
+	if err == nil {
+		return ""
+	}
+	return err.reason
+}
+
+func TestValidateWeights(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []v1.ServiceItem
+		want  string
+	}{
+		{
+			name: "paths of single services need no weight",
+			items: []v1.ServiceItem{
+				{Name: "web", Path: "/"},
+				{Name: "api", Path: "/api"},
+			},
+		},
+		{
+			name: "weights adding up to 100",
+			items: []v1.ServiceItem{
+				{Name: "web", Path: "/", Weight: intPtr(70)},
+				{Name: "web-v2", Path: "/", Weight: intPtr(30)},
+			},
+		},
+		{
+			name: "shared path without weight",
+			items: []v1.ServiceItem{
+				{Name: "web", Path: "/", Weight: intPtr(100)},
+				{Name: "web-v2", Path: "/"},
+			},
+			want: v1.ReasonInvalidWeights,
+		},
+		{
+			name: "weights not adding up to 100",
+			items: []v1.ServiceItem{
+				{Name: "web", Path: "/", Weight: intPtr(70)},
+				{Name: "web-v2", Path: "/", Weight: intPtr(20)},
+			},
+			want: v1.ReasonInvalidWeights,
+		},
+		{
+			name: "same path on different hosts is not shared",
+			items: []v1.ServiceItem{
+				{Name: "web", Path: "/", Hosts: []string{"a.example.com"}},
+				{Name: "web-v2", Path: "/", Hosts: []string{"b.example.com"}},
+			},
+		},
+		{
+			name: "canary with different weights on several paths",
+			items: []v1.ServiceItem{
+				{Name: "web", Path: "/", Weight: intPtr(90)},
+				{Name: "web-v2", Path: "/", Weight: intPtr(10)},
+				{Name: "web", Path: "/shop", Weight: intPtr(80)},
+				{Name: "web-v2", Path: "/shop", Weight: intPtr(20)},
+			},
+			want: v1.ReasonInvalidWeights,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := reasonOf(validateWeights(test.items)); got != test.want {
+				t.Errorf("got reason %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidatePaths(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		pathType v1.PathType
+		want     string
+	}{
+		{name: "prefix", path: "/api", pathType: v1.PathTypePrefix},
+		{name: "exact path with regex characters", path: "/api/(v1", pathType: v1.PathTypeExact},
+		{name: "unknown path type", path: "/api", pathType: "Glob", want: v1.ReasonInvalidPath},
+		{name: "regex", path: "/api/v[0-9]+/(.*)", pathType: v1.PathTypeImplementationSpecific},
+		{name: "lookahead", path: "/(?!internal)(.*)", pathType: v1.PathTypeImplementationSpecific},
+		{name: "lookbehind", path: "/(.*)(?<!\\.php)$", pathType: v1.PathTypeImplementationSpecific},
+		{name: "backreference", path: "/(a|b)/\\1", pathType: v1.PathTypeImplementationSpecific},
+		{name: "possessive quantifier", path: "/a++b", pathType: v1.PathTypeImplementationSpecific},
+		{name: "atomic group", path: "/(?>a|ab)c", pathType: v1.PathTypeImplementationSpecific},
+		{name: "unclosed group", path: "/api/(v1", pathType: v1.PathTypeImplementationSpecific, want: v1.ReasonInvalidPath},
+		{name: "unopened group", path: "/api/v1)", pathType: v1.PathTypeImplementationSpecific, want: v1.ReasonInvalidPath},
+		{name: "unclosed class", path: "/api/[a-z", pathType: v1.PathTypeImplementationSpecific, want: v1.ReasonInvalidPath},
+		{name: "reversed range", path: "/[z-a]", pathType: v1.PathTypeImplementationSpecific, want: v1.ReasonInvalidPath},
+		{name: "nothing to repeat", path: "*.php", pathType: v1.PathTypeImplementationSpecific, want: v1.ReasonInvalidPath},
+		{name: "trailing backslash", path: "/api\\", pathType: v1.PathTypeImplementationSpecific, want: v1.ReasonInvalidPath},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items := []v1.ServiceItem{{Name: "web", Path: test.path, PathType: test.pathType}}
+			if got := reasonOf(validatePaths(items)); got != test.want {
+				t.Errorf("got reason %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidatePathsExactHosts(t *testing.T) {
+	exact := v1.ServiceItem{Name: "api", Path: "/api", PathType: v1.PathTypeExact}
+	prefix := v1.ServiceItem{Name: "web", Path: "/", PathType: v1.PathTypePrefix}
+	regex := v1.ServiceItem{Name: "docs", Path: "/docs/.*", PathType: v1.PathTypeImplementationSpecific}
+	on := func(item v1.ServiceItem, class string, hosts ...string) v1.ServiceItem {
+		item.Hosts = hosts
+		item.IngressClassName = class
+		return item
+	}
+	tests := []struct {
+		name  string
+		items []v1.ServiceItem
+		want  string
+	}{
+		{name: "exact and prefix on a host", items: []v1.ServiceItem{on(exact, "", "shop.example.com"), on(prefix, "", "shop.example.com")}, want: v1.ReasonInvalidPath},
+		{name: "exact and prefix on any host", items: []v1.ServiceItem{exact, prefix}, want: v1.ReasonInvalidPath},
+		{name: "exact and prefix sharing one of their hosts", items: []v1.ServiceItem{on(exact, "", "a.example.com", "b.example.com"), on(prefix, "", "b.example.com")}, want: v1.ReasonInvalidPath},
+		{name: "exact and prefix on different hosts", items: []v1.ServiceItem{on(exact, "", "api.example.com"), on(prefix, "", "shop.example.com")}},
+		{name: "exact on a host and prefix on any host", items: []v1.ServiceItem{on(exact, "", "api.example.com"), prefix}},
+		{name: "exact and prefix of different classes", items: []v1.ServiceItem{on(exact, "internal", "shop.example.com"), on(prefix, "", "shop.example.com")}},
+		{name: "exact and regex on a host", items: []v1.ServiceItem{on(exact, "", "shop.example.com"), on(regex, "", "shop.example.com")}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := reasonOf(validatePaths(test.items)); got != test.want {
+				t.Errorf("got reason %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCaptureGroups(t *testing.T) {
+	tests := []struct {
+		expr string
+		want int
+	}{
+		{expr: "/api", want: 0},
+		{expr: "/api/(.*)", want: 1},
+		{expr: "/(v[0-9]+)/(.*)", want: 2},
+		{expr: "/(?:v1|v2)/(.*)", want: 1},
+		{expr: "/(?!internal)(.*)", want: 1},
+		{expr: "/(?<version>v[0-9]+)/(?P<rest>.*)", want: 2},
+		{expr: "/(.*)(?<!\\.php)$", want: 1},
+		{expr: "/\\(literal\\)/(.*)", want: 1},
+		{expr: "/[()]/(.*)", want: 1},
+		{expr: "/[](]/(.*)", want: 1},
+		{expr: "/[^](]/(.*)", want: 1},
+	}
+
+	for _, test := range tests {
+		if got := captureGroups(test.expr); got != test.want {
+			t.Errorf("captureGroups(%q) = %d, want %d", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestValidateRewriteTargets(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		target string
+		want   string
+	}{
+		{name: "no capture reference", path: "/api", target: "/"},
+		{name: "defined capture group", path: "/api/(.*)", target: "/$1"},
+		{name: "capture group after a lookahead", path: "/(?!internal)(.*)", target: "/$1"},
+		{name: "undefined capture group", path: "/api/(.*)", target: "/$2", want: v1.ReasonInvalidRewriteTarget},
+		{name: "broken path", path: "/api/(.*", target: "/$1", want: v1.ReasonInvalidRewriteTarget},
+		{name: "unsafe characters", path: "/api", target: "/; return 200", want: v1.ReasonInvalidRewriteTarget},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items := []v1.ServiceItem{{Name: "web", Path: test.path, RewriteTarget: test.target}}
+			if got := reasonOf(validateRewriteTargets(items)); got != test.want {
+				t.Errorf("got reason %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidatePorts(t *testing.T) {
+	tests := []struct {
+		name     string
+		port     int32
+		portName string
+		want     string
+	}{
+		{name: "no port"},
+		{name: "lowest port", port: 1},
+		{name: "highest port", port: 65535},
+		{name: "negative port", port: -1, want: v1.ReasonInvalidPort},
+		{name: "port above range", port: 65536, want: v1.ReasonInvalidPort},
+		{name: "port name", portName: "http"},
+		{name: "longest port name", portName: "abcdefghijklmno"},
+		{name: "port name too long", portName: "abcdefghijklmnop", want: v1.ReasonInvalidPort},
+		{name: "uppercase port name", portName: "HTTP", want: v1.ReasonInvalidPort},
+		{name: "port name with leading hyphen", portName: "-http", want: v1.ReasonInvalidPort},
+		{name: "port name with trailing hyphen", portName: "http-", want: v1.ReasonInvalidPort},
+		{name: "port name without letters", portName: "8080", want: v1.ReasonInvalidPort},
+		{name: "port and port name", port: 80, portName: "http", want: v1.ReasonInvalidPort},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items := []v1.ServiceItem{{Name: "web", Port: test.port, PortName: test.portName}}
+			if got := reasonOf(validatePorts(items)); got != test.want {
+				t.Errorf("got reason %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidatePortCombinations(t *testing.T) {
+	tests := []struct {
+		name     string
+		port     int32
+		portName string
+		// wantSelector is the reason for an item selecting its services.
+		want, wantSelector string
+	}{
+		{name: "neither routes to the first port", wantSelector: v1.ReasonInvalidSelector},
+		{name: "port only", port: 80},
+		{name: "port name only", portName: "http", wantSelector: v1.ReasonInvalidSelector},
+		{name: "both", port: 80, portName: "http", want: v1.ReasonInvalidPort, wantSelector: v1.ReasonInvalidSelector},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ig := newTestGroup("shop", v1.ServiceItem{Name: "web", Namespace: testNamespace, PathType: v1.PathTypePrefix, Port: test.port, PortName: test.portName})
+			if got := reasonOf(validateIngressGroup(ig)); got != test.want {
+				t.Errorf("got reason %q, want %q", got, test.want)
+			}
+			ig.Spec.Services[0].Name = ""
+			ig.Spec.Services[0].Selector = map[string]string{"app": "web"}
+			if got := reasonOf(validateIngressGroup(ig)); got != test.wantSelector {
+				t.Errorf("got reason %q selecting the services, want %q", got, test.wantSelector)
+			}
+		})
+	}
+}
+
+func TestValidateServiceSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector *v1.ServiceSelector
+		want     string
+	}{
+		{name: "no service selector"},
+		{
+			name:     "match labels",
+			selector: &v1.ServiceSelector{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "shop"}}},
+		},
+		{
+			name: "match expressions",
+			selector: &v1.ServiceSelector{Selector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"shop", "cart"}},
+			}}},
+		},
+		{name: "no selector", selector: &v1.ServiceSelector{}, want: v1.ReasonInvalidServiceSelector},
+		{name: "empty selector", selector: &v1.ServiceSelector{Selector: &metav1.LabelSelector{}}, want: v1.ReasonInvalidServiceSelector},
+		{
+			name: "unknown operator",
+			selector: &v1.ServiceSelector{Selector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "app", Operator: "Near", Values: []string{"shop"}},
+			}}},
+			want: v1.ReasonInvalidServiceSelector,
+		},
+		{
+			name:     "invalid label value",
+			selector: &v1.ServiceSelector{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "shop!"}}},
+			want:     v1.ReasonInvalidServiceSelector,
+		},
+		{
+			name: "port above range",
+			selector: &v1.ServiceSelector{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "shop"}},
+				Port:     65536,
+			},
+			want: v1.ReasonInvalidServiceSelector,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := reasonOf(validateServiceSelector(test.selector)); got != test.want {
+				t.Errorf("got reason %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateBridges(t *testing.T) {
+	tests := []struct {
+		name      string
+		groupName string
+		namespace string
+		want      string
+	}{
+		{name: "same namespace", groupName: "shop.example.com", namespace: testNamespace},
+		{name: "other namespace", groupName: "shop", namespace: "backend"},
+		{name: "long group name", groupName: strings.Repeat("a", validation.DNS1123SubdomainMaxLength), namespace: "backend"},
+		{name: "group name with dots", groupName: "shop.example.com", namespace: "backend", want: v1.ReasonInvalidBridgeName},
+		{name: "group name starting with a digit", groupName: "1shop", namespace: "backend", want: v1.ReasonInvalidBridgeName},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ig := newTestGroup(test.groupName, v1.ServiceItem{Name: "web", Namespace: test.namespace, Port: 80})
+			if got := reasonOf(validateBridges(ig)); got != test.want {
+				t.Errorf("got reason %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateDefaultPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: ""},
+		{path: "/"},
+		{path: "/app"},
+		{path: "app", want: v1.ReasonInvalidDefaultPath},
+	}
+
+	for _, test := range tests {
+		ig := &v1.IngressGroup{Spec: v1.IngressGroupSpec{DefaultPath: test.path}}
+		if got := reasonOf(validateIngressGroup(setDefaults(ig))); got != test.want {
+			t.Errorf("got reason %q for default path %q, want %q", got, test.path, test.want)
+		}
+	}
+}
+
+func TestValidateIngressNames(t *testing.T) {
+	// name returns a group name that makes the longest generated Ingress
+	// name, the canary one, exactly length characters long.
+	suffix := "-canary-web-v2"
+	name := func(length int) string {
+		return strings.Repeat("a", length-len(suffix))
+	}
+	canary := []v1.ServiceItem{
+		{Name: "web", Namespace: testNamespace, Port: 80, Weight: intPtr(80)},
+		{Name: "web-v2", Namespace: testNamespace, Port: 80, Weight: intPtr(20)},
+	}
+	tests := []struct {
+		name        string
+		groupName   string
+		ingressName string
+		items       []v1.ServiceItem
+		want        string
+	}{
+		{
+			name:      "group name at the limit",
+			groupName: strings.Repeat("a", validation.DNS1123SubdomainMaxLength),
+			items:     []v1.ServiceItem{{Name: "web", Namespace: testNamespace, Port: 80}},
+		},
+		{
+			name:      "canary name at the limit",
+			groupName: name(validation.DNS1123SubdomainMaxLength),
+			items:     canary,
+		},
+		{
+			name:      "canary name over the limit",
+			groupName: name(validation.DNS1123SubdomainMaxLength + 1),
+			items:     canary,
+			want:      v1.ReasonInvalidIngressName,
+		},
+		{
+			name:        "shorter ingress name",
+			groupName:   name(validation.DNS1123SubdomainMaxLength + 1),
+			ingressName: "shop",
+			items:       canary,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ig := newTestGroup(test.groupName, test.items...)
+			ig.Spec.IngressName = test.ingressName
+			if got := reasonOf(validateIngressNames(ig)); got != test.want {
+				t.Errorf("got reason %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateHosts(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []v1.ServiceItem
+		want  string
+	}{
+		{
+			name: "distinct hosts",
+			items: []v1.ServiceItem{
+				{Name: "web", Path: "/", Hosts: []string{"shop.example.com"}},
+				{Name: "blog", Path: "/", Hosts: []string{"blog.example.com"}},
+			},
+		},
+		{
+			name:  "wildcard host",
+			items: []v1.ServiceItem{{Name: "web", Path: "/", Hosts: []string{"*.example.com"}}},
+		},
+		{
+			name: "same hosts in another order",
+			items: []v1.ServiceItem{
+				{Name: "web", Path: "/", Hosts: []string{"a.example.com", "b.example.com"}, Weight: intPtr(80)},
+				{Name: "web-v2", Path: "/", Hosts: []string{"b.example.com", "a.example.com"}, Weight: intPtr(20)},
+			},
+		},
+		{
+			name: "shared host on different paths",
+			items: []v1.ServiceItem{
+				{Name: "web", Path: "/", Hosts: []string{"a.example.com", "b.example.com"}},
+				{Name: "api", Path: "/api", Hosts: []string{"a.example.com"}},
+			},
+		},
+		{
+			name:  "invalid host",
+			items: []v1.ServiceItem{{Name: "web", Path: "/", Hosts: []string{"shop_example.com"}}},
+			want:  v1.ReasonInvalidHost,
+		},
+		{
+			name:  "host listed twice",
+			items: []v1.ServiceItem{{Name: "web", Path: "/", Hosts: []string{"shop.example.com", "shop.example.com"}}},
+			want:  v1.ReasonInvalidHost,
+		},
+		{
+			name: "host and path routed under different hosts",
+			items: []v1.ServiceItem{
+				{Name: "web", Path: "/", Hosts: []string{"a.example.com", "b.example.com"}},
+				{Name: "web-v2", Path: "/", Hosts: []string{"a.example.com"}},
+			},
+			want: v1.ReasonInvalidHost,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := reasonOf(validateHosts(test.items)); got != test.want {
+				t.Errorf("got reason %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateContradictions(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []v1.ServiceItem
+		want  string
+	}{
+		{
+			name: "same host and path to two services without weights",
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80, Hosts: []string{"shop.example.com"}},
+				{Name: "web-v2", Namespace: testNamespace, Port: 80, Hosts: []string{"shop.example.com"}},
+			},
+			want: v1.ReasonInvalidWeights,
+		},
+		{
+			name: "same service twice on a path",
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80, Weight: intPtr(50)},
+				{Name: "web", Namespace: testNamespace, Port: 80, Weight: intPtr(50)},
+			},
+			want: v1.ReasonDuplicateService,
+		},
+		{
+			name: "same path under different hosts",
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80, Hosts: []string{"shop.example.com"}},
+				{Name: "blog", Namespace: testNamespace, Port: 80, Hosts: []string{"blog.example.com"}},
+			},
+		},
+		{
+			name: "same host and path split by weight",
+			items: []v1.ServiceItem{
+				{Name: "web", Namespace: testNamespace, Port: 80, Hosts: []string{"shop.example.com"}, Weight: intPtr(90)},
+				{Name: "web-v2", Namespace: testNamespace, Port: 80, Hosts: []string{"shop.example.com"}, Weight: intPtr(10)},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Validate(newTestGroup("shop", test.items...))
+			got := ""
+			if err != nil {
+				got = ValidationReason(err)
+			}
+			if got != test.want {
+				t.Errorf("got reason %q (%v), want %q", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateIngressClasses(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []v1.ServiceItem
+		want  string
+	}{
+		{
+			name: "two classes",
+			items: []v1.ServiceItem{
+				{Name: "web", Path: "/", IngressClassName: "external"},
+				{Name: "api", Path: "/api", IngressClassName: "internal"},
+			},
+		},
+		{
+			name:  "invalid class",
+			items: []v1.ServiceItem{{Name: "web", Path: "/", IngressClassName: "External_Class"}},
+			want:  v1.ReasonInvalidIngressClass,
+		},
+		{
+			name: "canary within one class",
+			items: []v1.ServiceItem{
+				{Name: "web", Path: "/", Weight: intPtr(90), IngressClassName: "external"},
+				{Name: "web-v2", Path: "/", Weight: intPtr(10), IngressClassName: "external"},
+				{Name: "web", Path: "/shop", Weight: intPtr(90), IngressClassName: "external"},
+				{Name: "web-v2", Path: "/shop", Weight: intPtr(10), IngressClassName: "external"},
+			},
+		},
+		{
+			name: "canary across classes",
+			items: []v1.ServiceItem{
+				{Name: "web", Path: "/", Weight: intPtr(90), IngressClassName: "external"},
+				{Name: "web-v2", Path: "/", Weight: intPtr(10), IngressClassName: "external"},
+				{Name: "web", Path: "/", Weight: intPtr(90), IngressClassName: "internal"},
+				{Name: "web-v2", Path: "/", Weight: intPtr(10), IngressClassName: "internal"},
+			},
+			want: v1.ReasonInvalidIngressClass,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := reasonOf(validateIngressClasses(test.items)); got != test.want {
+				t.Errorf("got reason %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// Package features defines the feature gates of the controller, which let
+// operators opt into experimental or risky features of IngressGroups.
+package features
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Feature is the name of a feature gate.
+type Feature string
+
+const (
+	// Canary renders services sharing a path as weighted canary Ingresses.
+	Canary Feature = "Canary"
+	// Snippets renders raw nginx snippets. Snippets can reach other tenants'
+	// traffic, so only enable this on trusted clusters.
+	Snippets Feature = "Snippets"
+	// CrossNamespace routes to services of other namespaces through bridge
+	// Services created in the namespace of the group. The services must be
+	// in a watched namespace.
+	CrossNamespace Feature = "CrossNamespace"
+	// SelectorServices lets service items select pods by label, routing to a
+	// Service the controller creates for the selector.
+	SelectorServices Feature = "SelectorServices"
+	// ServiceDiscovery routes to the Services the service selector of a group
+	// selects. The controller then caches all Services cluster-wide, and
+	// needs RBAC to list and watch them.
+	ServiceDiscovery Feature = "ServiceDiscovery"
+)
+
+// defaults holds whether each known feature is enabled by default.
+var defaults = map[Feature]bool{
+	Canary:           true,
+	Snippets:         false,
+	CrossNamespace:   false,
+	SelectorServices: false,
+	ServiceDiscovery: false,
+}
+
+// FeatureGate tells whether features are enabled. It implements flag.Value,
+// parsing a comma-separated list of Name=true|false.
+type FeatureGate struct {
+	enabled map[Feature]bool
+}
+
+// NewFeatureGate returns a FeatureGate with every feature at its default.
+func NewFeatureGate() *FeatureGate {
+	enabled := map[Feature]bool{}
+	for feature, on := range defaults {
+		enabled[feature] = on
+	}
+	return &FeatureGate{enabled: enabled}
+}
+
+// Enabled reports whether the feature is enabled.
+func (g *FeatureGate) Enabled(feature Feature) bool {
+	return g.enabled[feature]
+}
+
+// SetEnabled enables or disables the feature.
+func (g *FeatureGate) SetEnabled(feature Feature, on bool) {
+	g.enabled[feature] = on
+}
+
+// Set parses a comma-separated list of Name=true|false, rejecting unknown
+// features.
+func (g *FeatureGate) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("missing =true or =false in %q", pair)
+		}
+		feature := Feature(strings.TrimSpace(parts[0]))
+		if _, ok := defaults[feature]; !ok {
+			return fmt.Errorf("unknown feature %q, known features are %v", feature, Known())
+		}
+		on, err := strconv.ParseBool(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return fmt.Errorf("invalid value of feature %q: %v", feature, err)
+		}
+		g.enabled[feature] = on
+	}
+	return nil
+}
+
+// String returns the state of all features in the format Set parses.
+func (g *FeatureGate) String() string {
+	var pairs []string
+	for _, feature := range Known() {
+		pairs = append(pairs, fmt.Sprintf("%s=%t", feature, g.enabled[Feature(feature)]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Known returns the names of the known features, sorted.
+func Known() []string {
+	var names []string
+	for feature := range defaults {
+		names = append(names, string(feature))
+	}
+	sort.Strings(names)
+	return names
+}
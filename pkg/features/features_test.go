@@ -0,0 +1,69 @@
+package features
+
+import (
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[Feature]bool
+		wantErr bool
+	}{
+		{
+			name:  "empty",
+			value: "",
+			want:  map[Feature]bool{Canary: true, Snippets: false, CrossNamespace: false},
+		},
+		{
+			name:  "enable and disable",
+			value: "Snippets=true,Canary=false",
+			want:  map[Feature]bool{Canary: false, Snippets: true, CrossNamespace: false},
+		},
+		{
+			name:  "spaces and trailing comma",
+			value: " CrossNamespace = true ,",
+			want:  map[Feature]bool{Canary: true, CrossNamespace: true},
+		},
+		{
+			name:  "last value wins",
+			value: "Snippets=true,Snippets=false",
+			want:  map[Feature]bool{Snippets: false},
+		},
+		{name: "unknown feature", value: "Unknown=true", wantErr: true},
+		{name: "missing value", value: "Snippets", wantErr: true},
+		{name: "invalid value", value: "Snippets=yes", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gates := NewFeatureGate()
+			err := gates.Set(test.value)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			for feature, want := range test.want {
+				if got := gates.Enabled(feature); got != want {
+					t.Errorf("%v enabled = %v, want %v", feature, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestString(t *testing.T) {
+	gates := NewFeatureGate()
+	gates.SetEnabled(Snippets, true)
+
+	parsed := NewFeatureGate()
+	if err := parsed.Set(gates.String()); err != nil {
+		t.Fatalf("failed to parse %q: %v", gates.String(), err)
+	}
+	for _, name := range Known() {
+		feature := Feature(name)
+		if parsed.Enabled(feature) != gates.Enabled(feature) {
+			t.Errorf("%v enabled = %v after a round trip, want %v", feature, parsed.Enabled(feature), gates.Enabled(feature))
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"github.com/liabio/ingressgroup/pkg/metrics"
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// LeaderElectionConfig configures the election, through a Lease, of the
+// replica that reconciles when several run.
+type LeaderElectionConfig struct {
+	// Client reads and writes the Lease, the KubeClient of the Controller if
+	// nil. A client of its own keeps the syncs from delaying the renewals.
+	Client kubernetes.Interface
+	// Namespace and Name locate the Lease.
+	Namespace string
+	Name      string
+	// Identity identifies the replica in the Lease, its hostname if empty.
+	Identity string
+	// LeaseDuration is how long the other replicas wait before taking over a
+	// Lease that is no longer renewed, RenewDeadline how long the leader
+	// retries renewing it before it stops reconciling, and RetryPeriod how
+	// often the replicas try to acquire or renew it.
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// Leading reports whether the Controller reconciles: always without leader
+// election, only while it holds the Lease with it.
+func (c *Controller) Leading() bool {
+	return c.config.LeaderElection == nil || atomic.LoadInt32(&c.leading) == 1
+}
+
+// runLeaderElection reconciles the groups while this replica holds the Lease,
+// until the context is done. The informers and queue of a Controller cannot
+// be started twice, so losing the Lease is returned as an error, after which
+// the replica is expected to restart.
+func (c *Controller) runLeaderElection(ctx context.Context) error {
+	config := c.config.LeaderElection
+	identity := config.Identity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to get the hostname to identify with in the lease: %v", err)
+		}
+		identity = hostname
+	}
+	client := config.Client
+	if client == nil {
+		client = c.config.KubeClient
+	}
+	lock := &leaseLock{
+		client:    client.CoordinationV1beta1(),
+		namespace: config.Namespace,
+		name:      config.Name,
+		identity:  identity,
+		recorder: c.broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{
+			Component: c.config.Reconciler.ControllerName,
+			Host:      identity,
+		}),
+	}
+
+	done := make(chan error, 1)
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: config.LeaseDuration,
+		RenewDeadline: config.RenewDeadline,
+		RetryPeriod:   config.RetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				klog.Infof("Acquired lease %v, reconciling", lock.Describe())
+				atomic.StoreInt32(&c.leading, 1)
+				metrics.Standby.Set(0)
+				done <- c.run(ctx)
+			},
+			OnStoppedLeading: func() {
+				atomic.StoreInt32(&c.leading, 0)
+				metrics.Standby.Set(1)
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("invalid leader election: %v", err)
+	}
+
+	klog.Infof("Waiting to acquire lease %v as %v", lock.Describe(), identity)
+	metrics.Standby.Set(1)
+	elector.Run(ctx)
+	// The elector only starts leading once it wrote the Lease; it then
+	// returns once the context is done or the Lease is lost, without waiting
+	// for the reconciles.
+	if !lock.acquired {
+		return nil
+	}
+	err = <-done
+	if ctx.Err() == nil {
+		return fmt.Errorf("lost lease %v", lock.Describe())
+	}
+	// The reconciles are over, so a standby can take over right away rather
+	// than wait for the Lease to expire.
+	if releaseErr := lock.release(); releaseErr != nil {
+		klog.Errorf("Failed to release lease %v: %v", lock.Describe(), releaseErr)
+	} else {
+		klog.Infof("Released lease %v", lock.Describe())
+	}
+	return err
+}
+
+// leaseLock is a resourcelock.Interface keeping the leader election record in
+// the spec of a coordination.k8s.io Lease. The vendored client-go only locks
+// on ConfigMaps and Endpoints, whose updates every watcher of them receives.
+//
+// A leader releases the Lease on shutdown by clearing its holder. The
+// vendored elector waits for a Lease to expire even without a holder, so the
+// lock reports a released Lease as held by its own replica, which the
+// elector then takes over at once.
+type leaseLock struct {
+	client    coordinationclient.LeasesGetter
+	namespace string
+	name      string
+	identity  string
+	recorder  record.EventRecorder
+
+	lease *coordinationv1beta1.Lease
+	// acquired tells whether the lock wrote the Lease, which the elector
+	// only does to acquire or renew it.
+	acquired bool
+	// released tells whether the Lease last read had been released.
+	released bool
+}
+
+func (l *leaseLock) Get() (*resourcelock.LeaderElectionRecord, error) {
+	lease, err := l.client.Leases(l.namespace).Get(l.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	l.lease = lease
+	ler := leaseSpecToRecord(&lease.Spec)
+	l.released = ler.HolderIdentity == ""
+	if l.released {
+		ler.HolderIdentity = l.identity
+	}
+	return ler, nil
+}
+
+func (l *leaseLock) Create(ler resourcelock.LeaderElectionRecord) error {
+	lease, err := l.client.Leases(l.namespace).Create(&coordinationv1beta1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: l.name, Namespace: l.namespace},
+		Spec:       recordToLeaseSpec(&ler),
+	})
+	if err != nil {
+		return err
+	}
+	l.lease, l.acquired = lease, true
+	return nil
+}
+
+func (l *leaseLock) Update(ler resourcelock.LeaderElectionRecord) error {
+	if l.lease == nil {
+		return fmt.Errorf("lease %v not read before its update", l.Describe())
+	}
+	if l.released {
+		// The elector took the released Lease for its own.
+		ler.AcquireTime = ler.RenewTime
+		ler.LeaderTransitions++
+	}
+	lease := l.lease.DeepCopy()
+	lease.Spec = recordToLeaseSpec(&ler)
+	lease, err := l.client.Leases(l.namespace).Update(lease)
+	if err != nil {
+		return err
+	}
+	l.lease, l.acquired, l.released = lease, true, false
+	return nil
+}
+
+// release clears the holder of the Lease if the lock still holds it, so
+// another replica acquires it without waiting for it to expire.
+func (l *leaseLock) release() error {
+	if l.lease == nil || l.lease.Spec.HolderIdentity == nil || *l.lease.Spec.HolderIdentity != l.identity {
+		return nil
+	}
+	lease := l.lease.DeepCopy()
+	holder := ""
+	now := metav1.NowMicro()
+	lease.Spec.HolderIdentity = &holder
+	lease.Spec.RenewTime = &now
+	lease, err := l.client.Leases(l.namespace).Update(lease)
+	if err != nil {
+		return err
+	}
+	l.lease = lease
+	l.RecordEvent("released lease")
+	return nil
+}
+
+func (l *leaseLock) RecordEvent(s string) {
+	if l.lease == nil {
+		return
+	}
+	l.recorder.Eventf(l.lease, corev1.EventTypeNormal, "LeaderElection", "%v %v", l.identity, s)
+}
+
+func (l *leaseLock) Identity() string {
+	return l.identity
+}
+
+func (l *leaseLock) Describe() string {
+	return l.namespace + "/" + l.name
+}
+
+// leaseSpecToRecord returns the leader election record the spec of a Lease
+// holds.
+func leaseSpecToRecord(spec *coordinationv1beta1.LeaseSpec) *resourcelock.LeaderElectionRecord {
+	ler := &resourcelock.LeaderElectionRecord{}
+	if spec.HolderIdentity != nil {
+		ler.HolderIdentity = *spec.HolderIdentity
+	}
+	if spec.LeaseDurationSeconds != nil {
+		ler.LeaseDurationSeconds = int(*spec.LeaseDurationSeconds)
+	}
+	if spec.AcquireTime != nil {
+		ler.AcquireTime = metav1.Time{Time: spec.AcquireTime.Time}
+	}
+	if spec.RenewTime != nil {
+		ler.RenewTime = metav1.Time{Time: spec.RenewTime.Time}
+	}
+	if spec.LeaseTransitions != nil {
+		ler.LeaderTransitions = int(*spec.LeaseTransitions)
+	}
+	return ler
+}
+
+// recordToLeaseSpec returns the spec of a Lease holding the leader election
+// record.
+func recordToLeaseSpec(ler *resourcelock.LeaderElectionRecord) coordinationv1beta1.LeaseSpec {
+	holder := ler.HolderIdentity
+	duration := int32(ler.LeaseDurationSeconds)
+	transitions := int32(ler.LeaderTransitions)
+	return coordinationv1beta1.LeaseSpec{
+		HolderIdentity:       &holder,
+		LeaseDurationSeconds: &duration,
+		AcquireTime:          &metav1.MicroTime{Time: ler.AcquireTime.Time},
+		RenewTime:            &metav1.MicroTime{Time: ler.RenewTime.Time},
+		LeaseTransitions:     &transitions,
+	}
+}
@@ -0,0 +1,201 @@
+package manager
+
+import (
+	"context"
+	"github.com/liabio/ingressgroup/pkg/metrics"
+	dto "github.com/prometheus/client_model/go"
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	versionedfake "k8s.io/ingress-nginx/pkg/client/clientset/versioned/fake"
+	"testing"
+	"time"
+)
+
+func newTestLease(holder string, transitions int32) *coordinationv1beta1.Lease {
+	duration := int32(15)
+	renewed := metav1.NewMicroTime(time.Now())
+	return &coordinationv1beta1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "ingressgroup"},
+		Spec: coordinationv1beta1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			AcquireTime:          &renewed,
+			RenewTime:            &renewed,
+			LeaseTransitions:     &transitions,
+		},
+	}
+}
+
+func newTestLeaseLock(client *kubefake.Clientset, identity string) *leaseLock {
+	return &leaseLock{
+		client:    client.CoordinationV1beta1(),
+		namespace: "kube-system",
+		name:      "ingressgroup",
+		identity:  identity,
+		recorder:  record.NewFakeRecorder(10),
+	}
+}
+
+func leaseHolder(t *testing.T, client *kubefake.Clientset) string {
+	lease, err := client.CoordinationV1beta1().Leases("kube-system").Get("ingressgroup", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get the lease: %v", err)
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+func TestReleaseLease(t *testing.T) {
+	tests := []struct {
+		name   string
+		holder string
+		read   bool
+		want   string
+	}{
+		{name: "held", holder: "replica-1", read: true, want: ""},
+		{name: "held by another replica", holder: "replica-2", read: true, want: "replica-2"},
+		{name: "never read", holder: "replica-1", want: "replica-1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := kubefake.NewSimpleClientset(newTestLease(test.holder, 0))
+			lock := newTestLeaseLock(client, "replica-1")
+			if test.read {
+				if _, err := lock.Get(); err != nil {
+					t.Fatalf("failed to read the lease: %v", err)
+				}
+			}
+			if err := lock.release(); err != nil {
+				t.Fatalf("failed to release the lease: %v", err)
+			}
+			if got := leaseHolder(t, client); got != test.want {
+				t.Errorf("holder = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAcquireReleasedLease(t *testing.T) {
+	client := kubefake.NewSimpleClientset(newTestLease("", 3))
+	lock := newTestLeaseLock(client, "replica-2")
+
+	ler, err := lock.Get()
+	if err != nil {
+		t.Fatalf("failed to read the lease: %v", err)
+	}
+	// The elector takes over a Lease it believes to hold without waiting
+	// for it to expire.
+	if ler.HolderIdentity != "replica-2" {
+		t.Fatalf("holder = %q, want the released lease reported as ours", ler.HolderIdentity)
+	}
+	now := metav1.Now()
+	ler.RenewTime = now
+	if err := lock.Update(*ler); err != nil {
+		t.Fatalf("failed to update the lease: %v", err)
+	}
+
+	lease, err := client.CoordinationV1beta1().Leases("kube-system").Get("ingressgroup", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get the lease: %v", err)
+	}
+	if got := *lease.Spec.HolderIdentity; got != "replica-2" {
+		t.Errorf("holder = %q, want replica-2", got)
+	}
+	if got := *lease.Spec.LeaseTransitions; got != 4 {
+		t.Errorf("transitions = %v, want 4", got)
+	}
+	if !lease.Spec.AcquireTime.Time.Equal(now.Time) {
+		t.Errorf("acquire time = %v, want %v", lease.Spec.AcquireTime.Time, now.Time)
+	}
+}
+
+// standbyGauge returns the value of the standby gauge.
+func standbyGauge(t *testing.T) float64 {
+	metric := &dto.Metric{}
+	if err := metrics.Standby.Write(metric); err != nil {
+		t.Fatalf("failed to read the standby gauge: %v", err)
+	}
+	return metric.GetGauge().GetValue()
+}
+
+func TestLeaderElection(t *testing.T) {
+	tests := []struct {
+		name string
+		// lease is the Lease existing before the replica starts, if any.
+		lease       *coordinationv1beta1.Lease
+		wantLeading bool
+		// wantHolder is the holder of the Lease once the replica stopped.
+		wantHolder string
+	}{
+		{name: "leader", wantLeading: true, wantHolder: ""},
+		{name: "standby", lease: newTestLease("replica-2", 0), wantHolder: "replica-2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var objects []runtime.Object
+			if test.lease != nil {
+				objects = append(objects, test.lease)
+			}
+			client := kubefake.NewSimpleClientset(objects...)
+			config := Config{
+				KubeClient:      client,
+				VersionedClient: versionedfake.NewSimpleClientset(),
+				ShutdownTimeout: time.Second,
+				LeaderElection: &LeaderElectionConfig{
+					Namespace:     "kube-system",
+					Name:          "ingressgroup",
+					Identity:      "replica-1",
+					LeaseDuration: 10 * time.Second,
+					RenewDeadline: 5 * time.Second,
+					RetryPeriod:   50 * time.Millisecond,
+				},
+			}
+			config.Reconciler.ControllerName = "ingressgroup"
+			c, err := New(config)
+			if err != nil {
+				t.Fatalf("failed to create the controller: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			stopped := make(chan error, 1)
+			go func() { stopped <- c.Start(ctx) }()
+
+			if test.wantLeading {
+				if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+					return c.Leading() && c.HasSynced(), nil
+				}); err != nil {
+					t.Fatalf("the replica did not start leading: %v", err)
+				}
+				if got := standbyGauge(t); got != 0 {
+					t.Errorf("got standby gauge %v while leading, want 0", got)
+				}
+			} else {
+				// Give the replica a few tries at acquiring the Lease.
+				time.Sleep(10 * config.LeaderElection.RetryPeriod)
+				if c.Leading() || c.HasSynced() {
+					t.Errorf("the standby replica is leading or synced its caches")
+				}
+				if got := standbyGauge(t); got != 1 {
+					t.Errorf("got standby gauge %v on standby, want 1", got)
+				}
+			}
+
+			cancel()
+			select {
+			case err := <-stopped:
+				if err != nil {
+					t.Fatalf("the replica stopped with an error: %v", err)
+				}
+			case <-time.After(wait.ForeverTestTimeout):
+				t.Fatal("timed out waiting for the replica to stop")
+			}
+			if got := leaseHolder(t, client); got != test.wantHolder {
+				t.Errorf("got lease holder %q once stopped, want %q", got, test.wantHolder)
+			}
+		})
+	}
+}
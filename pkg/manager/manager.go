@@ -0,0 +1,517 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"github.com/liabio/ingressgroup/pkg/controller"
+	"github.com/liabio/ingressgroup/pkg/features"
+	"github.com/liabio/ingressgroup/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	extensionslisters "k8s.io/client-go/listers/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"k8s.io/ingress-nginx/pkg/client/clientset/versioned"
+	igscheme "k8s.io/ingress-nginx/pkg/client/clientset/versioned/scheme"
+	inggroupInformers "k8s.io/ingress-nginx/pkg/client/informers/externalversions"
+	iglisters "k8s.io/ingress-nginx/pkg/client/listers/ingressgroup/v1"
+	"k8s.io/klog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config configures a Controller.
+type Config struct {
+	// KubeClient and VersionedClient are the clients the controller reads and
+	// writes through.
+	KubeClient      kubernetes.Interface
+	VersionedClient versioned.Interface
+	// EventClient records the events of the controller, KubeClient if nil.
+	// A client of its own keeps a storm of events from starving the syncs.
+	EventClient kubernetes.Interface
+	// Namespaces are the namespaces to watch IngressGroups in, all if empty.
+	Namespaces []string
+	// FieldSelector restricts the watched IngressGroups.
+	FieldSelector fields.Selector
+	// InformerResync is the resync period of the IngressGroup informers, 0
+	// for none.
+	InformerResync time.Duration
+	// MinWatchTimeout is the minimum duration of the watches of the
+	// informers, each closed after a random duration between it and twice
+	// it. 0 leaves the timeouts to the reflector.
+	MinWatchTimeout time.Duration
+	// RequeueAfter reconciles every group again this long after it synced
+	// successfully. 0 disables it.
+	RequeueAfter time.Duration
+	// EnqueueDebounce delays the syncs queued by events by this long, so a
+	// burst of events results in a single sync.
+	EnqueueDebounce time.Duration
+	// Workers is the number of groups reconciled concurrently, 1 if not
+	// positive. A group is never reconciled by two workers at once.
+	Workers int
+	// ShutdownTimeout bounds how long Start waits for in-flight reconciles
+	// once its context is done.
+	ShutdownTimeout time.Duration
+	// LeaderElection makes the replicas of the controller elect the one that
+	// reconciles. Every replica reconciles if nil.
+	LeaderElection *LeaderElectionConfig
+	// Reconciler configures the syncs of the groups.
+	Reconciler controller.Config
+}
+
+// groupReconciler syncs the IngressGroup of a key. It is satisfied by
+// *controller.Reconciler.
+type groupReconciler interface {
+	Reconcile(ctx context.Context, key string) (time.Duration, error)
+	FlushStatusUpdates()
+}
+
+// Controller watches IngressGroups and the Ingresses generated for them and
+// reconciles the groups, so it can be embedded in another binary alongside
+// other controllers.
+type Controller struct {
+	config     Config
+	queue      workqueue.RateLimitingInterface
+	reconciler groupReconciler
+	igLister   iglisters.IngressGroupLister
+	ingLister  extensionslisters.IngressLister
+
+	igFactories   []inggroupInformers.SharedInformerFactory
+	kubeFactories []informers.SharedInformerFactory
+	nsFactory     informers.SharedInformerFactory
+	svcFactories  []informers.SharedInformerFactory
+	cachesSynced  []cache.InformerSynced
+	broadcaster   record.EventBroadcaster
+	// logEvent logs every event recorded, klog.Infof.
+	logEvent func(format string, args ...interface{})
+	// leading is 1 while the Controller holds the Lease of its leader
+	// election, synced once its caches synced.
+	leading int32
+	synced  int32
+}
+
+// New builds the informers, work queue and reconciler of a Controller. Nothing
+// is listed or watched until Start.
+func New(config Config) (*Controller, error) {
+	if config.KubeClient == nil || config.VersionedClient == nil {
+		return nil, fmt.Errorf("the kube and versioned clients must be set")
+	}
+	if config.EventClient == nil {
+		config.EventClient = config.KubeClient
+	}
+	if config.FieldSelector == nil {
+		config.FieldSelector = fields.Everything()
+	}
+	namespaces := config.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+
+	c := &Controller{config: config}
+
+	// Each watched namespace gets its own informer factory; an empty list
+	// watches all namespaces through a single one.
+	var igInformers []cache.SharedIndexInformer
+	igListers := map[string]iglisters.IngressGroupLister{}
+	var ingInformers []cache.SharedIndexInformer
+	ingListers := map[string]extensionslisters.IngressLister{}
+	for _, namespace := range namespaces {
+		factory := inggroupInformers.NewSharedInformerFactoryWithOptions(config.VersionedClient, config.InformerResync,
+			inggroupInformers.WithNamespace(namespace),
+			inggroupInformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.FieldSelector = config.FieldSelector.String()
+				setWatchTimeout(options, "ingressgroups", config.MinWatchTimeout)
+			}))
+		igInformer := factory.Cr().V1().IngressGroups()
+		c.igFactories = append(c.igFactories, factory)
+		igInformers = append(igInformers, igInformer.Informer())
+		igListers[namespace] = igInformer.Lister()
+	}
+
+	// Only the Ingresses generated for IngressGroups are cached, to follow
+	// their status. The ones generated under a previous controller name are
+	// cached too: the reconciler recognizes its Ingresses by their controller
+	// reference, not their managed-by label, and would otherwise never clean
+	// them up. They live next to their groups, or in the ingress namespace
+	// if set, which is then watched too unless all namespaces are.
+	ingNamespaces := namespaces
+	if ingressNamespace := config.Reconciler.IngressNamespace; ingressNamespace != "" && namespaces[0] != metav1.NamespaceAll {
+		ingNamespaces = sets.NewString(append([]string{ingressNamespace}, namespaces...)...).List()
+	}
+	for _, namespace := range ingNamespaces {
+		kubeFactory := informers.NewSharedInformerFactoryWithOptions(config.KubeClient, time.Duration(0)*time.Second,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = controller.IngressGroupLabel
+				setWatchTimeout(options, "ingresses", config.MinWatchTimeout)
+			}))
+		ingInformer := kubeFactory.Extensions().V1beta1().Ingresses()
+		c.kubeFactories = append(c.kubeFactories, kubeFactory)
+		ingInformers = append(ingInformers, ingInformer.Informer())
+		ingListers[namespace] = ingInformer.Lister()
+	}
+	c.igLister = controller.NewMultiNamespaceLister(igListers)
+	c.ingLister = controller.NewMultiNamespaceIngressLister(ingListers)
+
+	// Namespaces are cluster-scoped, so they are watched cluster-wide even
+	// when the IngressGroups are only watched in some namespaces.
+	c.nsFactory = informers.NewSharedInformerFactoryWithOptions(config.KubeClient, time.Duration(0)*time.Second,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			setWatchTimeout(options, "namespaces", config.MinWatchTimeout)
+		}))
+	nsInformer := c.nsFactory.Core().V1().Namespaces()
+
+	for _, informer := range igInformers {
+		c.cachesSynced = append(c.cachesSynced, informer.HasSynced)
+	}
+	for _, informer := range ingInformers {
+		c.cachesSynced = append(c.cachesSynced, informer.HasSynced)
+	}
+	c.cachesSynced = append(c.cachesSynced, nsInformer.Informer().HasSynced)
+
+	// The Services the groups route to are cached in the watched namespaces.
+	// Those service selectors select may live in any namespace, so with the
+	// feature they are cached cluster-wide instead.
+	discovery := config.Reconciler.FeatureGates != nil && config.Reconciler.FeatureGates.Enabled(features.ServiceDiscovery)
+	svcNamespaces := namespaces
+	if discovery {
+		svcNamespaces = []string{metav1.NamespaceAll}
+	}
+	svcListers := map[string]corelisters.ServiceLister{}
+	for _, namespace := range svcNamespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(config.KubeClient, time.Duration(0)*time.Second,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				setWatchTimeout(options, "services", config.MinWatchTimeout)
+			}))
+		svcInformer := factory.Core().V1().Services()
+		svcInformer.Informer().AddEventHandler(c.serviceHandler())
+		c.svcFactories = append(c.svcFactories, factory)
+		svcListers[namespace] = svcInformer.Lister()
+		c.cachesSynced = append(c.cachesSynced, svcInformer.Informer().HasSynced)
+	}
+	svcLister := controller.NewMultiNamespaceServiceLister(svcListers, config.KubeClient.CoreV1())
+
+	// Events are also logged, since the sink throttles and aggregates
+	// repeated events.
+	c.broadcaster = record.NewBroadcaster()
+	c.logEvent = klog.Infof
+	recorder := c.broadcaster.NewRecorder(igscheme.Scheme, corev1.EventSource{Component: config.Reconciler.ControllerName})
+
+	c.reconciler = controller.NewReconciler(config.KubeClient, config.VersionedClient, c.igLister, c.ingLister,
+		nsInformer.Lister(), svcLister, recorder, config.Reconciler)
+
+	workqueue.SetProvider(metrics.WorkqueueProvider{})
+	c.queue = workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "ingressgroups")
+
+	for _, informer := range igInformers {
+		informer.AddEventHandler(c.ingressGroupHandler())
+	}
+	for _, informer := range ingInformers {
+		informer.AddEventHandler(c.ingressHandler())
+	}
+	return c, nil
+}
+
+// IngressGroupLister returns the lister of the watched IngressGroups.
+func (c *Controller) IngressGroupLister() iglisters.IngressGroupLister {
+	return c.igLister
+}
+
+// IngressLister returns the lister of the Ingresses generated by the
+// controller.
+func (c *Controller) IngressLister() extensionslisters.IngressLister {
+	return c.ingLister
+}
+
+// HasSynced reports whether the caches of the Controller synced, after which
+// it reconciles.
+func (c *Controller) HasSynced() bool {
+	return atomic.LoadInt32(&c.synced) == 1
+}
+
+// Start starts the informers, waits for their caches to sync and reconciles
+// the queued groups until the context is done. It then waits up to the
+// shutdown timeout for the in-flight reconcile to finish. With leader
+// election, all this only happens once the Controller is elected. A
+// Controller can only be started once.
+func (c *Controller) Start(ctx context.Context) error {
+	logging := c.broadcaster.StartLogging(c.logEvent)
+	defer logging.Stop()
+	recording := c.broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: c.config.EventClient.CoreV1().Events("")})
+	defer recording.Stop()
+
+	if c.config.LeaderElection != nil {
+		return c.runLeaderElection(ctx)
+	}
+	return c.run(ctx)
+}
+
+// run reconciles the groups until the context is done.
+func (c *Controller) run(ctx context.Context) error {
+	stopCh := ctx.Done()
+	for _, factory := range c.igFactories {
+		factory.Start(stopCh)
+	}
+	for _, factory := range c.kubeFactories {
+		factory.Start(stopCh)
+	}
+	c.nsFactory.Start(stopCh)
+	for _, factory := range c.svcFactories {
+		factory.Start(stopCh)
+	}
+
+	if !cache.WaitForCacheSync(stopCh, c.cachesSynced...) {
+		return fmt.Errorf("failed to wait for caches to sync")
+	}
+	atomic.StoreInt32(&c.synced, 1)
+
+	count := c.config.Workers
+	if count < 1 {
+		count = 1
+	}
+	var workers sync.WaitGroup
+	workers.Add(count)
+	for i := 0; i < count; i++ {
+		go func() {
+			defer workers.Done()
+			wait.Until(func() {
+				for c.processNextWorkItem(ctx) {
+				}
+			}, time.Second, stopCh)
+		}()
+	}
+	if interval := c.config.Reconciler.StatusUpdateInterval; interval > 0 {
+		go wait.Until(c.reconciler.FlushStatusUpdates, interval, stopCh)
+	}
+
+	<-stopCh
+	c.queue.ShutDown()
+	waitForWorkers(&workers, c.config.ShutdownTimeout)
+	// Write the statuses the last reconciles held back.
+	c.reconciler.FlushStatusUpdates()
+	return nil
+}
+
+// addKey queues the key after the debounce window. The delaying queue keeps a
+// single entry per key, so the events arriving within the window coalesce
+// into one sync.
+func (c *Controller) addKey(key string) {
+	if c.config.EnqueueDebounce > 0 {
+		c.queue.AddAfter(key, c.config.EnqueueDebounce)
+		return
+	}
+	c.queue.Add(key)
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		klog.Errorf("failed to get key for %#v: %v", obj, err)
+		return
+	}
+	c.addKey(key)
+}
+
+// ingressGroupHandler queues the groups that need a sync. Status updates,
+// mostly the controller's own, leave the generation alone and need no sync. A
+// changed force-sync annotation asks for one without a spec change, and so
+// does a changed confirm-prune annotation. Resyncs deliver the cached object
+// as both old and new and are always synced.
+func (c *Controller) ingressGroupHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			ig := obj.(*v1.IngressGroup)
+			klog.V(4).Infof("ingress group %v/%v added", ig.Namespace, ig.Name)
+			c.enqueue(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.enqueue(obj)
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			oldIngGroup := old.(*v1.IngressGroup)
+			curIngGroup := cur.(*v1.IngressGroup)
+			if oldIngGroup.ResourceVersion != curIngGroup.ResourceVersion &&
+				oldIngGroup.Generation == curIngGroup.Generation &&
+				oldIngGroup.DeletionTimestamp.Equal(curIngGroup.DeletionTimestamp) &&
+				oldIngGroup.Annotations[controller.ForceSyncAnnotation] == curIngGroup.Annotations[controller.ForceSyncAnnotation] &&
+				oldIngGroup.Annotations[controller.ConfirmPruneAnnotation] == curIngGroup.Annotations[controller.ConfirmPruneAnnotation] {
+				return
+			}
+			klog.V(4).Infof("ingress group %v/%v changed", curIngGroup.Namespace, curIngGroup.Name)
+			c.enqueue(cur)
+		},
+	}
+}
+
+// ingressHandler queues the group controlling a generated Ingress when the
+// Ingress comes, goes or its load balancer status changes, unless the
+// status is not synced.
+func (c *Controller) ingressHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueueOwner,
+		DeleteFunc: c.enqueueOwner,
+		UpdateFunc: func(old, cur interface{}) {
+			if c.config.Reconciler.DisableIngressStatusSync {
+				return
+			}
+			oldIng := old.(*extensionsv1beta1.Ingress)
+			curIng := cur.(*extensionsv1beta1.Ingress)
+			if !apiequality.Semantic.DeepEqual(oldIng.Status.LoadBalancer, curIng.Status.LoadBalancer) {
+				c.enqueueOwner(cur)
+			}
+		},
+	}
+}
+
+// serviceHandler queues the groups referencing a Service, or whose service
+// selector selected it, when it comes or goes and before and after a change
+// to its labels, path annotation or ports, so a group waiting for a Service
+// or one of its ports syncs as soon as it is there.
+func (c *Controller) serviceHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.enqueueSelecting(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.enqueueSelecting(obj)
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			oldSvc := old.(*corev1.Service)
+			curSvc := cur.(*corev1.Service)
+			if apiequality.Semantic.DeepEqual(oldSvc.Labels, curSvc.Labels) &&
+				oldSvc.Annotations[controller.ServicePathAnnotation] == curSvc.Annotations[controller.ServicePathAnnotation] &&
+				apiequality.Semantic.DeepEqual(oldSvc.Spec.Ports, curSvc.Spec.Ports) {
+				return
+			}
+			c.enqueueSelecting(old)
+			c.enqueueSelecting(cur)
+		},
+	}
+}
+
+// enqueueSelecting enqueues the IngressGroups referencing the Service or
+// whose service selector selects it.
+func (c *Controller) enqueueSelecting(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	svc, ok := obj.(*corev1.Service)
+	if !ok {
+		return
+	}
+	groups, err := c.igLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("failed to list ingress groups: %v", err)
+		return
+	}
+	discovery := c.config.Reconciler.FeatureGates != nil && c.config.Reconciler.FeatureGates.Enabled(features.ServiceDiscovery)
+	for _, ig := range groups {
+		if controller.ReferencesService(ig, svc) || discovery && controller.SelectsService(ig, svc) {
+			c.addKey(ig.Namespace + "/" + ig.Name)
+		}
+	}
+}
+
+// enqueueOwner enqueues the IngressGroup controlling a generated Ingress, or
+// the one named by its owner annotation if it has no controller, as in the
+// ingress namespace.
+func (c *Controller) enqueueOwner(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	ing, ok := obj.(*extensionsv1beta1.Ingress)
+	if !ok {
+		return
+	}
+	ref := metav1.GetControllerOf(ing)
+	if ref == nil {
+		if key, ok := controller.OwnerKey(ing); ok {
+			c.addKey(key)
+		}
+		return
+	}
+	if ref.Kind != "IngressGroup" || ref.APIVersion != v1.SchemeGroupVersion.String() {
+		return
+	}
+	c.addKey(ing.Namespace + "/" + ref.Name)
+}
+
+// processNextWorkItem reconciles the next key of the queue, requeueing it with
+// backoff when it fails, or when it succeeds after RequeueAfter if set, or
+// sooner if the reconciler asks for it. The queue holds a single pending
+// requeue per key and drops requeues once it is shut down. It returns false
+// once the queue is shut down.
+//
+// A key is never reconciled twice at once: it stays marked as processing from
+// Get until the deferred Done, and the queue holds back a key added meanwhile,
+// from an event or a requeue, until Done, then hands it out once however
+// often it was added. Every key taken from the queue must therefore reach
+// Done, on every path.
+func (c *Controller) processNextWorkItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	after, err := c.reconciler.Reconcile(ctx, key.(string))
+	if err != nil {
+		klog.Errorf("failed to sync ingress group %v: %v", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	if requeueAfter := c.config.RequeueAfter; requeueAfter > 0 && (after == 0 || requeueAfter < after) {
+		after = requeueAfter
+	}
+	if after > 0 {
+		c.queue.AddAfter(key, after)
+	}
+	return true
+}
+
+// setWatchTimeout replaces the timeout the reflector picked for a watch with
+// a random one between min and twice min, and counts the watch in the
+// restarts of the resource. List calls carry no timeout and are left alone.
+func setWatchTimeout(options *metav1.ListOptions, resource string, min time.Duration) {
+	if options.TimeoutSeconds == nil {
+		return
+	}
+	metrics.WatchRestarts.WithLabelValues(resource).Inc()
+	if min > 0 {
+		timeout := int64(min.Seconds() * (rand.Float64() + 1.0))
+		options.TimeoutSeconds = &timeout
+	}
+}
+
+// waitForWorkers waits for the workers to drain the queue, giving up after
+// timeout so a hung reconcile cannot keep the process from exiting.
+func waitForWorkers(workers *sync.WaitGroup, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		klog.Infof("Workers drained, exiting")
+	case <-time.After(timeout):
+		klog.Warningf("Workers did not drain within %v, exiting anyway", timeout)
+	}
+}
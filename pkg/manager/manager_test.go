@@ -0,0 +1,1018 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"github.com/liabio/ingressgroup/pkg/controller"
+	"github.com/liabio/ingressgroup/pkg/features"
+	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"k8s.io/ingress-nginx/pkg/client/clientset/versioned"
+	versionedfake "k8s.io/ingress-nginx/pkg/client/clientset/versioned/fake"
+	igscheme "k8s.io/ingress-nginx/pkg/client/clientset/versioned/scheme"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestGroup(namespace, name string) *v1.IngressGroup {
+	return &v1.IngressGroup{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+}
+
+// newTestController returns a Controller of the given config on fake clients
+// seeded with the IngressGroups, with its IngressGroup informers started and
+// synced. The informers stop with the test.
+func newTestController(t *testing.T, config Config, groups ...runtime.Object) *Controller {
+	config.KubeClient = kubefake.NewSimpleClientset()
+	config.VersionedClient = versionedfake.NewSimpleClientset(groups...)
+	config.Reconciler.ControllerName = "ingressgroup"
+	c, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create the controller: %v", err)
+	}
+
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	for _, factory := range c.igFactories {
+		factory.Start(stopCh)
+		for informer, synced := range factory.WaitForCacheSync(stopCh) {
+			if !synced {
+				t.Fatalf("failed to sync the informer of %v", informer)
+			}
+		}
+	}
+	return c
+}
+
+// queuedKeys drains the queue of the Controller and returns its keys, sorted.
+func queuedKeys(c *Controller) []string {
+	var keys []string
+	for c.queue.Len() > 0 {
+		key, _ := c.queue.Get()
+		keys = append(keys, key.(string))
+		c.queue.Done(key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestNamespaces(t *testing.T) {
+	groups := []runtime.Object{
+		newTestGroup("team-a", "shop"),
+		newTestGroup("team-b", "blog"),
+		newTestGroup("team-c", "wiki"),
+	}
+	tests := []struct {
+		name       string
+		namespaces []string
+		want       []string
+	}{
+		{
+			name: "all namespaces",
+			want: []string{"team-a/shop", "team-b/blog", "team-c/wiki"},
+		},
+		{
+			name:       "two watched namespaces and one ignored",
+			namespaces: []string{"team-a", "team-b"},
+			want:       []string{"team-a/shop", "team-b/blog"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestController(t, Config{Namespaces: test.namespaces}, groups...)
+
+			if got := queuedKeys(c); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got queued keys %v, want %v", got, test.want)
+			}
+			listed, err := c.IngressGroupLister().List(labels.Everything())
+			if err != nil {
+				t.Fatalf("failed to list ingress groups: %v", err)
+			}
+			var got []string
+			for _, ig := range listed {
+				key, _ := cache.MetaNamespaceKeyFunc(ig)
+				got = append(got, key)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got listed groups %v, want %v", got, test.want)
+			}
+			for _, obj := range groups {
+				ig := obj.(*v1.IngressGroup)
+				_, err := c.IngressGroupLister().IngressGroups(ig.Namespace).Get(ig.Name)
+				if watched := len(test.namespaces) == 0 || ig.Namespace != "team-c"; watched && err != nil {
+					t.Errorf("failed to get %v/%v: %v", ig.Namespace, ig.Name, err)
+				} else if !watched && !errors.IsNotFound(err) {
+					t.Errorf("got error %v for %v/%v of an ignored namespace, want not found", err, ig.Namespace, ig.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestWaitForWorkers(t *testing.T) {
+	tests := []struct {
+		name string
+		// work is how long the worker takes to finish, forever if negative.
+		work time.Duration
+		// want is about how long waitForWorkers is expected to wait.
+		want time.Duration
+	}{
+		{name: "drained worker", work: 0, want: 0},
+		{name: "worker draining in time", work: 50 * time.Millisecond, want: 50 * time.Millisecond},
+		{name: "hung worker", work: -1, want: 200 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hung := make(chan struct{})
+			defer close(hung)
+			var workers sync.WaitGroup
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				if test.work < 0 {
+					<-hung
+					return
+				}
+				time.Sleep(test.work)
+			}()
+
+			start := time.Now()
+			waitForWorkers(&workers, 200*time.Millisecond)
+			if waited := time.Since(start); waited < test.want || waited > test.want+time.Second {
+				t.Errorf("waited %v, want about %v", waited, test.want)
+			}
+		})
+	}
+}
+
+func TestMinWatchTimeout(t *testing.T) {
+	tests := []struct {
+		name            string
+		minWatchTimeout time.Duration
+		// The reflector picks a timeout between 5 and 10 minutes on its own.
+		wantMin, wantMax int64
+	}{
+		{name: "reflector timeout", wantMin: 300, wantMax: 600},
+		{name: "min watch timeout", minWatchTimeout: time.Minute, wantMin: 60, wantMax: 120},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			timeouts := make(chan string, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if r.URL.Query().Get("watch") == "true" {
+					select {
+					case timeouts <- r.URL.Query().Get("timeoutSeconds"):
+					default:
+					}
+					return
+				}
+				fmt.Fprint(w, `{"apiVersion":"harmonycloud.cn/v1","kind":"IngressGroupList","metadata":{"resourceVersion":"1"},"items":[]}`)
+			}))
+			defer server.Close()
+
+			versionedClient, err := versioned.NewForConfig(&rest.Config{Host: server.URL})
+			if err != nil {
+				t.Fatalf("failed to create the client: %v", err)
+			}
+			config := Config{
+				KubeClient:      kubefake.NewSimpleClientset(),
+				VersionedClient: versionedClient,
+				MinWatchTimeout: test.minWatchTimeout,
+			}
+			config.Reconciler.ControllerName = "ingressgroup"
+			c, err := New(config)
+			if err != nil {
+				t.Fatalf("failed to create the controller: %v", err)
+			}
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			for _, factory := range c.igFactories {
+				factory.Start(stopCh)
+			}
+
+			select {
+			case value := <-timeouts:
+				timeout, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					t.Fatalf("invalid watch timeout %q: %v", value, err)
+				}
+				if timeout < test.wantMin || timeout > test.wantMax {
+					t.Errorf("got watch timeout %vs, want between %vs and %vs", timeout, test.wantMin, test.wantMax)
+				}
+			case <-time.After(wait.ForeverTestTimeout):
+				t.Fatal("timed out waiting for the watch")
+			}
+		})
+	}
+}
+
+func TestServiceInformers(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespaces []string
+		discovery  bool
+		want       int
+	}{
+		{name: "all namespaces", want: 1},
+		{name: "watched namespaces", namespaces: []string{"team-a", "team-b"}, want: 2},
+		{name: "service discovery", namespaces: []string{"team-a", "team-b"}, discovery: true, want: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := Config{Namespaces: test.namespaces}
+			config.Reconciler.FeatureGates = features.NewFeatureGate()
+			config.Reconciler.FeatureGates.SetEnabled(features.ServiceDiscovery, test.discovery)
+			c := newTestController(t, config)
+			if got := len(c.svcFactories); got != test.want {
+				t.Errorf("got %v service informer factories, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEnqueueDebounce(t *testing.T) {
+	const debounce = 500 * time.Millisecond
+	var groups []runtime.Object
+	var want []string
+	for i := 0; i < 50; i++ {
+		ig := newTestGroup("team-a", fmt.Sprintf("shop-%02d", i))
+		ig.Spec.ServiceSelector = &v1.ServiceSelector{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+		}
+		groups = append(groups, ig)
+		want = append(want, "team-a/"+ig.Name)
+	}
+	config := Config{EnqueueDebounce: debounce}
+	config.Reconciler.FeatureGates = features.NewFeatureGate()
+	config.Reconciler.FeatureGates.SetEnabled(features.ServiceDiscovery, true)
+	c := newTestController(t, config, groups...)
+	// Let the adds of the informers through first.
+	time.Sleep(2 * debounce)
+	queuedKeys(c)
+
+	handler := c.serviceHandler()
+	old := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "web", Labels: map[string]string{"app": "web"}}}
+	for i := 0; i < 100; i++ {
+		cur := old.DeepCopy()
+		cur.Spec.Ports = []corev1.ServicePort{{Port: int32(8000 + i)}}
+		handler.OnUpdate(old, cur)
+		old = cur
+	}
+	if got := c.queue.Len(); got != 0 {
+		t.Errorf("got %v keys queued within the debounce window, want none", got)
+	}
+
+	time.Sleep(2 * debounce)
+	if got := queuedKeys(c); !reflect.DeepEqual(got, want) {
+		t.Errorf("got queued keys %v, want each group once", got)
+	}
+	time.Sleep(2 * debounce)
+	if got := queuedKeys(c); len(got) != 0 {
+		t.Errorf("got %v keys queued after the debounce window, want none", got)
+	}
+}
+
+// blockingReconciler records the reconciles of each key, blocking each one
+// until release is closed.
+type blockingReconciler struct {
+	release chan struct{}
+	started chan string
+
+	mu       sync.Mutex
+	inFlight map[string]int
+	calls    map[string]int
+	overlaps int
+}
+
+func (r *blockingReconciler) Reconcile(ctx context.Context, key string) (time.Duration, error) {
+	r.mu.Lock()
+	if r.inFlight[key] > 0 {
+		r.overlaps++
+	}
+	r.inFlight[key]++
+	r.calls[key]++
+	r.mu.Unlock()
+
+	r.started <- key
+	<-r.release
+
+	r.mu.Lock()
+	r.inFlight[key]--
+	r.mu.Unlock()
+	return 0, nil
+}
+
+func (r *blockingReconciler) FlushStatusUpdates() {}
+
+func TestKeyNeverInFlightTwice(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+	}{
+		{name: "one worker", workers: 1},
+		{name: "several workers", workers: 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestController(t, Config{})
+			r := &blockingReconciler{
+				release:  make(chan struct{}),
+				started:  make(chan string, 10),
+				inFlight: map[string]int{},
+				calls:    map[string]int{},
+			}
+			c.reconciler = r
+
+			var workers sync.WaitGroup
+			for i := 0; i < test.workers; i++ {
+				workers.Add(1)
+				go func() {
+					defer workers.Done()
+					for c.processNextWorkItem(context.Background()) {
+					}
+				}()
+			}
+			defer func() {
+				c.queue.ShutDown()
+				workers.Wait()
+			}()
+
+			ig := newTestGroup("team-a", "shop")
+			c.enqueue(ig)
+			select {
+			case <-r.started:
+			case <-time.After(wait.ForeverTestTimeout):
+				t.Fatal("timed out waiting for the first reconcile")
+			}
+
+			// Queue the key from an event and a requeue at once while it is
+			// being reconciled.
+			var sources sync.WaitGroup
+			sources.Add(2)
+			go func() {
+				defer sources.Done()
+				for i := 0; i < 10; i++ {
+					c.enqueue(ig)
+				}
+			}()
+			go func() {
+				defer sources.Done()
+				for i := 0; i < 10; i++ {
+					c.queue.AddRateLimited("team-a/shop")
+				}
+			}()
+			sources.Wait()
+
+			select {
+			case <-r.started:
+				t.Fatal("the key was handed to a worker while in flight")
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			close(r.release)
+			select {
+			case <-r.started:
+			case <-time.After(wait.ForeverTestTimeout):
+				t.Fatal("timed out waiting for the key queued meanwhile to be reconciled")
+			}
+			if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+				r.mu.Lock()
+				defer r.mu.Unlock()
+				return r.inFlight["team-a/shop"] == 0, nil
+			}); err != nil {
+				t.Fatalf("the reconcile did not finish: %v", err)
+			}
+			// Let a rate limited requeue come due, if any was held.
+			time.Sleep(100 * time.Millisecond)
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.overlaps != 0 {
+				t.Errorf("got %v overlapping reconciles of the key, want none", r.overlaps)
+			}
+			if got := r.calls["team-a/shop"]; got != 2 {
+				t.Errorf("got %v reconciles, want 2: the first and one for the keys queued meanwhile", got)
+			}
+		})
+	}
+}
+
+func TestIngressGroupHandlerUpdate(t *testing.T) {
+	withForceSync := func(value string) func(*v1.IngressGroup) {
+		return func(ig *v1.IngressGroup) {
+			ig.Annotations = map[string]string{controller.ForceSyncAnnotation: value}
+		}
+	}
+	tests := []struct {
+		name   string
+		old    func(*v1.IngressGroup)
+		cur    func(*v1.IngressGroup)
+		queued bool
+	}{
+		{
+			name:   "resync",
+			queued: true,
+		},
+		{
+			name: "status update",
+			cur:  func(ig *v1.IngressGroup) { ig.ResourceVersion = "2" },
+		},
+		{
+			name:   "spec change",
+			cur:    func(ig *v1.IngressGroup) { ig.ResourceVersion, ig.Generation = "2", 2 },
+			queued: true,
+		},
+		{
+			name:   "force-sync set",
+			cur:    func(ig *v1.IngressGroup) { ig.ResourceVersion = "2"; withForceSync("1")(ig) },
+			queued: true,
+		},
+		{
+			name:   "force-sync changed",
+			old:    withForceSync("1"),
+			cur:    func(ig *v1.IngressGroup) { ig.ResourceVersion = "2"; withForceSync("2")(ig) },
+			queued: true,
+		},
+		{
+			name: "force-sync unchanged",
+			old:  withForceSync("1"),
+			cur:  func(ig *v1.IngressGroup) { ig.ResourceVersion = "2"; withForceSync("1")(ig) },
+		},
+		{
+			name:   "force-sync cleared",
+			old:    withForceSync("1"),
+			cur:    func(ig *v1.IngressGroup) { ig.ResourceVersion, ig.Annotations = "2", nil },
+			queued: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestController(t, Config{})
+			old := newTestGroup("team-a", "shop")
+			old.ResourceVersion, old.Generation = "1", 1
+			if test.old != nil {
+				test.old(old)
+			}
+			cur := old.DeepCopy()
+			if test.cur != nil {
+				test.cur(cur)
+			}
+
+			c.ingressGroupHandler().OnUpdate(old, cur)
+			var want []string
+			if test.queued {
+				want = []string{"team-a/shop"}
+			}
+			if got := queuedKeys(c); !reflect.DeepEqual(got, want) {
+				t.Errorf("got queued keys %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestIngressInformerSelector(t *testing.T) {
+	shop := newTestGroup("team-a", "shop")
+	shop.UID = "shop-uid"
+	ingress := func(name string, labels map[string]string, owner *v1.IngressGroup) *extensionsv1beta1.Ingress {
+		ing := &extensionsv1beta1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: name, Labels: labels}}
+		if owner != nil {
+			ing.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(owner, v1.SchemeGroupVersion.WithKind("IngressGroup"))}
+		}
+		return ing
+	}
+	tests := []struct {
+		name    string
+		ingress *extensionsv1beta1.Ingress
+		cached  bool
+	}{
+		{
+			name:    "generated by this controller",
+			ingress: ingress("shop", map[string]string{controller.IngressGroupLabel: "shop", "app.kubernetes.io/managed-by": "ingressgroup"}, shop),
+			cached:  true,
+		},
+		{
+			name:    "generated under a previous controller name",
+			ingress: ingress("shop", map[string]string{controller.IngressGroupLabel: "shop", "app.kubernetes.io/managed-by": "ingress-group"}, shop),
+			cached:  true,
+		},
+		{
+			name:    "generated before the managed-by label",
+			ingress: ingress("shop", map[string]string{controller.IngressGroupLabel: "shop"}, shop),
+			cached:  true,
+		},
+		{
+			name:    "not generated for a group",
+			ingress: ingress("blog", map[string]string{"app": "blog"}, nil),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kubeClient := kubefake.NewSimpleClientset(test.ingress)
+			var selectors []string
+			kubeClient.PrependReactor("list", "ingresses", func(action clienttesting.Action) (bool, runtime.Object, error) {
+				selectors = append(selectors, action.(clienttesting.ListAction).GetListRestrictions().Labels.String())
+				return false, nil, nil
+			})
+			config := Config{
+				KubeClient:      kubeClient,
+				VersionedClient: versionedfake.NewSimpleClientset(shop),
+			}
+			config.Reconciler.ControllerName = "ingressgroup"
+			c, err := New(config)
+			if err != nil {
+				t.Fatalf("failed to create the controller: %v", err)
+			}
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			for _, factory := range c.kubeFactories {
+				factory.Start(stopCh)
+				for informer, synced := range factory.WaitForCacheSync(stopCh) {
+					if !synced {
+						t.Fatalf("failed to sync the informer of %v", informer)
+					}
+				}
+			}
+
+			if !reflect.DeepEqual(selectors, []string{controller.IngressGroupLabel}) {
+				t.Errorf("got ingress lists with selectors %q, want %q", selectors, controller.IngressGroupLabel)
+			}
+			_, err = c.IngressLister().Ingresses("team-a").Get(test.ingress.Name)
+			if cached := err == nil; cached != test.cached {
+				t.Errorf("got ingress cached %v, want %v", cached, test.cached)
+			}
+		})
+	}
+}
+
+func TestPeriodicReconciles(t *testing.T) {
+	tests := []struct {
+		name           string
+		informerResync time.Duration
+		requeueAfter   time.Duration
+		// wantQueued tells whether the group is queued again within the
+		// wait after its first reconcile.
+		wantQueued bool
+	}{
+		{name: "event-driven only"},
+		// Informers resync at most every second.
+		{name: "informer resync", informerResync: time.Second, wantQueued: true},
+		{name: "requeue after", requeueAfter: 200 * time.Millisecond, wantQueued: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestController(t, Config{InformerResync: test.informerResync, RequeueAfter: test.requeueAfter},
+				newTestGroup("team-a", "shop"))
+			release := make(chan struct{})
+			close(release)
+			r := &blockingReconciler{
+				release:  release,
+				started:  make(chan string, 10),
+				inFlight: map[string]int{},
+				calls:    map[string]int{},
+			}
+			c.reconciler = r
+
+			// Reconcile the group queued by the informer's add.
+			if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+				return c.queue.Len() > 0, nil
+			}); err != nil {
+				t.Fatalf("the group was not queued: %v", err)
+			}
+			c.processNextWorkItem(context.Background())
+			if got := c.queue.Len(); got != 0 {
+				t.Fatalf("got %v keys queued right after the reconcile, want none", got)
+			}
+
+			time.Sleep(2500 * time.Millisecond)
+			var want []string
+			if test.wantQueued {
+				want = []string{"team-a/shop"}
+			}
+			if got := queuedKeys(c); !reflect.DeepEqual(got, want) {
+				t.Errorf("got queued keys %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestEventsLoggedWhenSinkThrottles(t *testing.T) {
+	tests := []struct {
+		name string
+		// throttled tells whether the API server rejects the events.
+		throttled bool
+	}{
+		{name: "sink accepting events"},
+		{name: "sink throttling events", throttled: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			eventClient := kubefake.NewSimpleClientset()
+			if test.throttled {
+				eventClient.PrependReactor("*", "events", func(action clienttesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.NewTooManyRequests("slow down", 1)
+				})
+			}
+			config := Config{
+				KubeClient:      kubefake.NewSimpleClientset(),
+				VersionedClient: versionedfake.NewSimpleClientset(),
+				EventClient:     eventClient,
+				ShutdownTimeout: time.Second,
+			}
+			config.Reconciler.ControllerName = "ingressgroup"
+			c, err := New(config)
+			if err != nil {
+				t.Fatalf("failed to create the controller: %v", err)
+			}
+			var mu sync.Mutex
+			logged := 0
+			c.logEvent = func(format string, args ...interface{}) {
+				mu.Lock()
+				defer mu.Unlock()
+				logged++
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			stopped := make(chan error, 1)
+			go func() { stopped <- c.Start(ctx) }()
+			defer func() {
+				cancel()
+				<-stopped
+			}()
+			if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+				return c.HasSynced(), nil
+			}); err != nil {
+				t.Fatalf("the controller did not sync: %v", err)
+			}
+
+			const events = 200
+			recorder := c.broadcaster.NewRecorder(igscheme.Scheme, corev1.EventSource{Component: "ingressgroup"})
+			ig := newTestGroup("team-a", "shop")
+			ig.SelfLink = "/apis/harmonycloud.cn/v1/namespaces/team-a/ingressgroups/shop"
+			for i := 0; i < events; i++ {
+				recorder.Eventf(ig, corev1.EventTypeWarning, "SyncFailed", "Failed to sync ingress group: attempt %d", i)
+			}
+
+			if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				return logged >= events, nil
+			}); err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				t.Errorf("got %v events logged, want all %v", logged, events)
+			}
+		})
+	}
+}
+
+func TestNewRequiresClients(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "no clients", wantErr: true},
+		{name: "no versioned client", config: Config{KubeClient: kubefake.NewSimpleClientset()}, wantErr: true},
+		{name: "no kube client", config: Config{VersionedClient: versionedfake.NewSimpleClientset()}, wantErr: true},
+		{
+			name: "both clients",
+			config: Config{
+				KubeClient:      kubefake.NewSimpleClientset(),
+				VersionedClient: versionedfake.NewSimpleClientset(),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := New(test.config); (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	ig := newTestGroup("team-a", "shop")
+	ig.Spec.Services = []v1.ServiceItem{{Name: "web", Namespace: "team-a", Port: 80}}
+	config := Config{
+		KubeClient: kubefake.NewSimpleClientset(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}},
+			&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "web"},
+				Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+			},
+		),
+		VersionedClient: versionedfake.NewSimpleClientset(ig),
+		ShutdownTimeout: time.Second,
+	}
+	config.Reconciler.ControllerName = "ingressgroup"
+	c, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create the controller: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- c.Start(ctx) }()
+
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		_, err := config.KubeClient.ExtensionsV1beta1().Ingresses("team-a").Get("shop", metav1.GetOptions{})
+		return err == nil, nil
+	}); err != nil {
+		cancel()
+		t.Fatalf("the group was not reconciled: %v", err)
+	}
+	if !c.HasSynced() {
+		t.Errorf("got the controller reconciling before its caches synced")
+	}
+
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("got Start returning %v, want nil", err)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("Start did not return after its context was done")
+	}
+}
+
+func TestServiceHandler(t *testing.T) {
+	selecting := newTestGroup("team-a", "shop")
+	selecting.Spec.ServiceSelector = &v1.ServiceSelector{
+		Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "shop"}},
+	}
+	service := func(labels map[string]string, port int32) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "cart", Labels: labels},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: port}}},
+		}
+	}
+	matching := map[string]string{"app": "shop"}
+	other := map[string]string{"app": "blog"}
+	tests := []struct {
+		name string
+		// old is the Service before an update, nil for an add or delete.
+		old, cur *corev1.Service
+		deleted  bool
+		want     []string
+	}{
+		{name: "matching service added", cur: service(matching, 80), want: []string{"team-a/shop"}},
+		{name: "other service added", cur: service(other, 80)},
+		{name: "matching service deleted", cur: service(matching, 80), deleted: true, want: []string{"team-a/shop"}},
+		{name: "service starts matching", old: service(other, 80), cur: service(matching, 80), want: []string{"team-a/shop"}},
+		{name: "service stops matching", old: service(matching, 80), cur: service(other, 80), want: []string{"team-a/shop"}},
+		{name: "port of a matching service changed", old: service(matching, 80), cur: service(matching, 8080), want: []string{"team-a/shop"}},
+		{name: "matching service resynced", old: service(matching, 80), cur: service(matching, 80)},
+		{name: "other service changed", old: service(other, 80), cur: service(other, 8080)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := Config{}
+			config.Reconciler.FeatureGates = features.NewFeatureGate()
+			config.Reconciler.FeatureGates.SetEnabled(features.ServiceDiscovery, true)
+			c := newTestController(t, config, selecting, newTestGroup("team-a", "blog"))
+			// Drop the keys queued by the adds of the groups.
+			if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+				return c.queue.Len() == 2, nil
+			}); err != nil {
+				t.Fatalf("the groups were not queued: %v", err)
+			}
+			queuedKeys(c)
+
+			handler := c.serviceHandler()
+			switch {
+			case test.old != nil:
+				handler.OnUpdate(test.old, test.cur)
+			case test.deleted:
+				handler.OnDelete(cache.DeletedFinalStateUnknown{Key: "team-a/cart", Obj: test.cur})
+			default:
+				handler.OnAdd(test.cur)
+			}
+			if got := queuedKeys(c); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got queued keys %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIngressHandlerStatusSync(t *testing.T) {
+	owner := newTestGroup("team-a", "shop")
+	owner.UID = "uid-shop"
+	ingress := func(ip string) *extensionsv1beta1.Ingress {
+		ing := &extensionsv1beta1.Ingress{ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "team-a",
+			Name:            "shop",
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(owner, v1.SchemeGroupVersion.WithKind("IngressGroup"))},
+		}}
+		if ip != "" {
+			ing.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: ip}}
+		}
+		return ing
+	}
+	tests := []struct {
+		name     string
+		disabled bool
+		old, cur *extensionsv1beta1.Ingress
+		want     []string
+	}{
+		{name: "address published", old: ingress(""), cur: ingress("10.0.0.1"), want: []string{"team-a/shop"}},
+		{name: "address unchanged", old: ingress("10.0.0.1"), cur: ingress("10.0.0.1")},
+		{name: "address published without status sync", disabled: true, old: ingress(""), cur: ingress("10.0.0.1")},
+		{name: "added without status sync", disabled: true, cur: ingress(""), want: []string{"team-a/shop"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := Config{}
+			config.Reconciler.DisableIngressStatusSync = test.disabled
+			c := newTestController(t, config)
+
+			handler := c.ingressHandler()
+			if test.old != nil {
+				handler.OnUpdate(test.old, test.cur)
+			} else {
+				handler.OnAdd(test.cur)
+			}
+			if got := queuedKeys(c); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got queued keys %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStatusUpdatesFlushedOnShutdown(t *testing.T) {
+	ig := newTestGroup("team-a", "shop")
+	ig.Spec.Services = []v1.ServiceItem{{Name: "web", Namespace: "team-a", Port: 80}}
+	config := Config{
+		KubeClient: kubefake.NewSimpleClientset(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}},
+			&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "web"},
+				Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+			},
+		),
+		VersionedClient: versionedfake.NewSimpleClientset(ig),
+		ShutdownTimeout: time.Second,
+	}
+	config.Reconciler.ControllerName = "ingressgroup"
+	// Never flushed before the shutdown.
+	config.Reconciler.StatusUpdateInterval = time.Hour
+	c, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create the controller: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- c.Start(ctx) }()
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		_, err := config.KubeClient.ExtensionsV1beta1().Ingresses("team-a").Get("shop", metav1.GetOptions{})
+		return err == nil, nil
+	}); err != nil {
+		cancel()
+		t.Fatalf("the group was not reconciled: %v", err)
+	}
+	got, err := config.VersionedClient.CrV1().IngressGroups("team-a").Get("shop", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get the group: %v", err)
+	}
+	if len(got.Status.Conditions) != 0 {
+		t.Fatalf("got the status written before the shutdown, want it held back")
+	}
+
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Fatalf("got Start returning %v, want nil", err)
+	}
+	got, err = config.VersionedClient.CrV1().IngressGroups("team-a").Get("shop", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get the group: %v", err)
+	}
+	if len(got.Status.Conditions) == 0 {
+		t.Errorf("got no status written on shutdown, want the held back one")
+	}
+}
+
+func TestServiceHandlerReferences(t *testing.T) {
+	referencing := newTestGroup("team-a", "shop")
+	referencing.Spec.Services = []v1.ServiceItem{{Name: "web", Namespace: "team-a", Port: 9000}}
+	service := func(namespace string, port int32) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "web"},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: port}}},
+		}
+	}
+	tests := []struct {
+		name     string
+		old, cur *corev1.Service
+		want     []string
+	}{
+		{name: "referenced service added", cur: service("team-a", 80), want: []string{"team-a/shop"}},
+		{name: "port added to the referenced service", old: service("team-a", 80), cur: service("team-a", 9000), want: []string{"team-a/shop"}},
+		{name: "referenced service resynced", old: service("team-a", 80), cur: service("team-a", 80)},
+		{name: "same name in another namespace", cur: service("team-b", 80)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Without the ServiceDiscovery feature gate.
+			c := newTestController(t, Config{}, referencing)
+			if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+				return c.queue.Len() == 1, nil
+			}); err != nil {
+				t.Fatalf("the group was not queued: %v", err)
+			}
+			queuedKeys(c)
+
+			handler := c.serviceHandler()
+			if test.old != nil {
+				handler.OnUpdate(test.old, test.cur)
+			} else {
+				handler.OnAdd(test.cur)
+			}
+			if got := queuedKeys(c); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got queued keys %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIngressNamespace(t *testing.T) {
+	// Generated outside the group's namespace, so without an owner reference.
+	ing := &extensionsv1beta1.Ingress{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "ingresses",
+		Name:        "shop",
+		Labels:      map[string]string{controller.IngressGroupLabel: "shop", "app.kubernetes.io/managed-by": "ingressgroup"},
+		Annotations: map[string]string{"ingressgroup.ingress-nginx.k8s.io/owner": "team-a/shop"},
+	}}
+	tests := []struct {
+		name       string
+		namespaces []string
+	}{
+		{name: "all namespaces"},
+		{name: "watched namespaces", namespaces: []string{"team-a", "team-b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := Config{
+				KubeClient:      kubefake.NewSimpleClientset(ing),
+				VersionedClient: versionedfake.NewSimpleClientset(),
+				Namespaces:      test.namespaces,
+			}
+			config.Reconciler.ControllerName = "ingressgroup"
+			config.Reconciler.IngressNamespace = "ingresses"
+			c, err := New(config)
+			if err != nil {
+				t.Fatalf("failed to create the controller: %v", err)
+			}
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			for _, factory := range c.kubeFactories {
+				factory.Start(stopCh)
+				for informer, synced := range factory.WaitForCacheSync(stopCh) {
+					if !synced {
+						t.Fatalf("failed to sync the informer of %v", informer)
+					}
+				}
+			}
+
+			if _, err := c.IngressLister().Ingresses("ingresses").Get("shop"); err != nil {
+				t.Errorf("failed to get the ingress of the ingress namespace: %v", err)
+			}
+			c.ingressHandler().OnAdd(ing)
+			if got, want := queuedKeys(c), []string{"team-a/shop"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got queued keys %v, want %v", got, want)
+			}
+		})
+	}
+}
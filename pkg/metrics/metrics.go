@@ -0,0 +1,125 @@
+// Package metrics defines the Prometheus metrics exported by the controller.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "ingressgroup"
+
+var (
+	// TimeToReady observes how long IngressGroups take to become ready after
+	// they were created or their spec changed.
+	TimeToReady = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "time_to_ready_seconds",
+		Help:      "Time from an IngressGroup's creation or spec change until it becomes ready.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+
+	// Reconciles counts the syncs of IngressGroups by result, success or
+	// error. Groups skipped before syncing, such as those of terminating
+	// namespaces, are not counted.
+	Reconciles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconciles_total",
+		Help:      "Syncs of IngressGroups by result.",
+	}, []string{"result"})
+
+	// ReconcileDuration observes how long the syncs of IngressGroups take,
+	// by result.
+	ReconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "reconcile_duration_seconds",
+		Help:      "Duration of the syncs of IngressGroups by result.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"result"})
+
+	// ReconcileErrors counts the failed syncs by namespace and name of the
+	// group. The series of a group is deleted along with it.
+	ReconcileErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_errors_total",
+		Help:      "Failed syncs of an IngressGroup.",
+	}, []string{"namespace", "ingressgroup"})
+
+	// CRDInstalls counts the attempts to install the IngressGroup CRD by
+	// result: created, already_exists or failed.
+	CRDInstalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "crd_installs_total",
+		Help:      "Attempts to install the IngressGroup CRD by result.",
+	}, []string{"result"})
+
+	// CRDDrift is 1 when the installed IngressGroup CRD differs from the one
+	// the controller expects, 0 when it matches.
+	CRDDrift = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "crd_drift",
+		Help:      "Whether the installed IngressGroup CRD differs from the one the controller expects.",
+	})
+
+	// APICircuitOpen is 1 while the syncs are paused after consecutive API
+	// server errors, 0 otherwise.
+	APICircuitOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "api_circuit_open",
+		Help:      "Whether the syncs are paused after consecutive API server errors.",
+	})
+
+	// APICallsInFlight is the number of write calls the controller is making
+	// against the API server.
+	APICallsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "api_calls_in_flight",
+		Help:      "Number of write calls to the API server in flight.",
+	})
+
+	// MissingServices is the number of services an IngressGroup references
+	// that do not exist, by namespace and name of the group. The series of a
+	// group is deleted along with it.
+	MissingServices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "missing_services",
+		Help:      "Number of services referenced by an IngressGroup that do not exist.",
+	}, []string{"namespace", "ingressgroup"})
+
+	// WatchRestarts counts the watches the informers started, by resource.
+	// Watches restart when they time out or their connection drops; a rate
+	// well above one per --min-watch-timeout means connections are dropped.
+	WatchRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watch_restarts_total",
+		Help:      "Watches started by the informers, by resource.",
+	}, []string{"resource"})
+
+	// APIUnauthorized counts the requests the API server rejected as
+	// unauthorized, by verb, WATCH for watches. A steady rate means the
+	// controller's credentials expired and are not refreshed.
+	APIUnauthorized = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_unauthorized_total",
+		Help:      "Requests to the API server rejected as unauthorized, by verb.",
+	}, []string{"verb"})
+
+	// AdmissionRejections counts the IngressGroups the validating webhook
+	// denied, by the reason reported on the Valid condition, or Undecodable
+	// for objects that are not IngressGroups.
+	AdmissionRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "admission_rejections_total",
+		Help:      "IngressGroups denied by the validating webhook, by reason.",
+	}, []string{"reason"})
+
+	// Standby is 1 while the replica waits to be elected leader, 0 while it
+	// reconciles. It stays 0 without leader election.
+	Standby = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "standby",
+		Help:      "Whether the replica waits to be elected leader instead of reconciling.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(TimeToReady, Reconciles, ReconcileDuration, ReconcileErrors, CRDInstalls, CRDDrift, APICircuitOpen, APICallsInFlight, MissingServices, WatchRestarts, APIUnauthorized, AdmissionRejections, Standby)
+}
@@ -0,0 +1,111 @@
+// Package webhook serves the admission webhooks for IngressGroups over HTTPS.
+// The validating webhook is served at /validate.
+package webhook
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/klog"
+	"path/filepath"
+	"sync/atomic"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion maps a version such as "1.2" to its crypto/tls constant.
+func ParseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %q, must be one of 1.0, 1.1, 1.2, 1.3", version)
+	}
+	return v, nil
+}
+
+// CertWatcher keeps the serving certificate loaded from a cert/key pair on
+// disk, reloading it whenever the files change so rotated certificates are
+// picked up without a restart.
+type CertWatcher struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Value // *tls.Certificate
+	watcher  *fsnotify.Watcher
+}
+
+// NewCertWatcher loads the key pair and starts watching the directories that
+// hold it. Directories rather than files are watched because Secret volumes
+// are updated by swapping a symlink, which drops watches on the old files.
+func NewCertWatcher(certFile, keyFile string) (*CertWatcher, error) {
+	w := &CertWatcher{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("failed to watch %v: %v", dir, err)
+		}
+	}
+	w.watcher = watcher
+	return w, nil
+}
+
+// Run reloads the key pair on every change until stopCh is closed. A failed
+// reload keeps serving the previous certificate.
+func (w *CertWatcher) Run(stopCh <-chan struct{}) {
+	defer w.watcher.Close()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case event := <-w.watcher.Events:
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			if err := w.load(); err != nil {
+				klog.Errorf("failed to reload webhook certificate after %v: %v", event, err)
+				continue
+			}
+			klog.Infof("Reloaded webhook certificate from %v", w.certFile)
+		case err := <-w.watcher.Errors:
+			klog.Errorf("error watching webhook certificate: %v", err)
+		}
+	}
+}
+
+// GetCertificate returns the current certificate, for use as
+// tls.Config.GetCertificate.
+func (w *CertWatcher) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return w.cert.Load().(*tls.Certificate), nil
+}
+
+func (w *CertWatcher) load() error {
+	cert, err := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load key pair %v/%v: %v", w.certFile, w.keyFile, err)
+	}
+	w.cert.Store(&cert)
+	return nil
+}
+
+// NewTLSConfig returns a server TLS config that serves the watcher's current
+// certificate and refuses protocol versions older than minVersion.
+func NewTLSConfig(w *CertWatcher, minVersion uint16) *tls.Config {
+	return &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: w.GetCertificate,
+	}
+}
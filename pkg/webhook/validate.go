@@ -0,0 +1,67 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/liabio/ingressgroup/pkg/controller"
+	"github.com/liabio/ingressgroup/pkg/metrics"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"k8s.io/klog"
+	"net/http"
+)
+
+// ValidateHandler serves the validating admission webhook for IngressGroups,
+// denying the specs the controller would refuse to render.
+func ValidateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		review := &admissionv1beta1.AdmissionReview{}
+		if err := json.NewDecoder(r.Body).Decode(review); err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode admission review: %v", err), http.StatusBadRequest)
+			return
+		}
+		if review.Request == nil {
+			http.Error(w, "admission review has no request", http.StatusBadRequest)
+			return
+		}
+
+		review.Response = validate(review.Request)
+		review.Response.UID = review.Request.UID
+		review.Request = nil
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(review); err != nil {
+			klog.Errorf("failed to write admission response: %v", err)
+		}
+	}
+}
+
+func validate(req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	if req.Operation != admissionv1beta1.Create && req.Operation != admissionv1beta1.Update {
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+
+	ig := &v1.IngressGroup{}
+	if err := json.Unmarshal(req.Object.Raw, ig); err != nil {
+		metrics.AdmissionRejections.WithLabelValues("Undecodable").Inc()
+		return deny(fmt.Sprintf("failed to decode ingress group: %v", err))
+	}
+	if err := controller.Validate(ig); err != nil {
+		klog.V(2).Infof("denying ingress group %v/%v: %v", req.Namespace, ig.Name, err)
+		metrics.AdmissionRejections.WithLabelValues(controller.ValidationReason(err)).Inc()
+		return deny(err.Error())
+	}
+	return &admissionv1beta1.AdmissionResponse{Allowed: true}
+}
+
+func deny(message string) *admissionv1beta1.AdmissionResponse {
+	return &admissionv1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Message: message,
+		},
+	}
+}
@@ -0,0 +1,166 @@
+package webhook
+
+import (
+	"encoding/json"
+	"github.com/liabio/ingressgroup/pkg/metrics"
+	dto "github.com/prometheus/client_model/go"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	group := func(name string) *v1.IngressGroup {
+		return &v1.IngressGroup{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: v1.IngressGroupSpec{Services: []v1.ServiceItem{
+				{Name: "web", Namespace: "default", Port: 80, Path: "/", RewriteTarget: "/app"},
+			}},
+		}
+	}
+	// The rewrite target adds a -rewrite-<hash> suffix of 17 characters.
+	tests := []struct {
+		name      string
+		operation admissionv1beta1.Operation
+		group     *v1.IngressGroup
+		want      bool
+	}{
+		{name: "valid", operation: admissionv1beta1.Create, group: group("shop"), want: true},
+		{
+			name:      "generated name at the limit",
+			operation: admissionv1beta1.Create,
+			group:     group(strings.Repeat("a", validation.DNS1123SubdomainMaxLength-17)),
+			want:      true,
+		},
+		{
+			name:      "generated name over the limit",
+			operation: admissionv1beta1.Update,
+			group:     group(strings.Repeat("a", validation.DNS1123SubdomainMaxLength-16)),
+		},
+		{
+			name:      "port and port name",
+			operation: admissionv1beta1.Create,
+			group: func() *v1.IngressGroup {
+				ig := group("shop")
+				ig.Spec.Services[0].PortName = "http"
+				return ig
+			}(),
+		},
+		{
+			name:      "delete",
+			operation: admissionv1beta1.Delete,
+			group:     group(strings.Repeat("a", validation.DNS1123SubdomainMaxLength-16)),
+			want:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw, err := json.Marshal(test.group)
+			if err != nil {
+				t.Fatalf("failed to encode the group: %v", err)
+			}
+			resp := validate(&admissionv1beta1.AdmissionRequest{
+				Operation: test.operation,
+				Namespace: "default",
+				Object:    runtime.RawExtension{Raw: raw},
+			})
+			if resp.Allowed != test.want {
+				t.Errorf("got allowed %v, want %v: %v", resp.Allowed, test.want, resp.Result)
+			}
+		})
+	}
+}
+
+// admissionRejections returns the count of admission rejections of the reason.
+func admissionRejections(t *testing.T, reason string) float64 {
+	metric := &dto.Metric{}
+	if err := metrics.AdmissionRejections.WithLabelValues(reason).Write(metric); err != nil {
+		t.Fatalf("failed to read the admission rejections: %v", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestValidateCountsRejections(t *testing.T) {
+	encode := func(ig *v1.IngressGroup) []byte {
+		raw, err := json.Marshal(ig)
+		if err != nil {
+			t.Fatalf("failed to encode the group: %v", err)
+		}
+		return raw
+	}
+	group := func(item v1.ServiceItem) *v1.IngressGroup {
+		return &v1.IngressGroup{
+			ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "default"},
+			Spec:       v1.IngressGroupSpec{Services: []v1.ServiceItem{item}},
+		}
+	}
+	tests := []struct {
+		name      string
+		operation admissionv1beta1.Operation
+		raw       []byte
+		// reason is the reason whose count the request bumps, if any.
+		reason string
+	}{
+		{
+			name:      "valid",
+			operation: admissionv1beta1.Create,
+			raw:       encode(group(v1.ServiceItem{Name: "web", Namespace: "default", Port: 80})),
+		},
+		{
+			name:      "invalid port",
+			operation: admissionv1beta1.Create,
+			raw:       encode(group(v1.ServiceItem{Name: "web", Namespace: "default", Port: 70000})),
+			reason:    v1.ReasonInvalidPort,
+		},
+		{
+			name:      "invalid host",
+			operation: admissionv1beta1.Update,
+			raw:       encode(group(v1.ServiceItem{Name: "web", Namespace: "default", Port: 80, Hosts: []string{"shop_example.com"}})),
+			reason:    v1.ReasonInvalidHost,
+		},
+		{
+			name:      "undecodable",
+			operation: admissionv1beta1.Create,
+			raw:       []byte("{"),
+			reason:    "Undecodable",
+		},
+		{
+			name:      "delete",
+			operation: admissionv1beta1.Delete,
+			raw:       []byte("{"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reasons := []string{v1.ReasonInvalidPort, v1.ReasonInvalidHost, "Undecodable"}
+			before := map[string]float64{}
+			for _, reason := range reasons {
+				before[reason] = admissionRejections(t, reason)
+			}
+
+			resp := validate(&admissionv1beta1.AdmissionRequest{
+				Operation: test.operation,
+				Namespace: "default",
+				Object:    runtime.RawExtension{Raw: test.raw},
+			})
+			if resp.Allowed != (test.reason == "") {
+				t.Errorf("got allowed %v, want %v: %v", resp.Allowed, test.reason == "", resp.Result)
+			}
+			for _, reason := range reasons {
+				want := before[reason]
+				if reason == test.reason {
+					want++
+				}
+				if got := admissionRejections(t, reason); got != want {
+					t.Errorf("got %v rejections of reason %v, want %v", got, reason, want)
+				}
+			}
+		})
+	}
+}
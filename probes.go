@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"github.com/liabio/ingressgroup/pkg/manager"
+	"net/http"
+	"sync"
+)
+
+// readiness tracks what the controller waits for before /readyz passes: the
+// API server serving IngressGroups, then the caches of the controller
+// synced. A replica waiting to be elected leader never syncs its caches, but
+// is ready to serve the webhook and metrics; /readyz reports it as standby.
+type readiness struct {
+	lock      sync.Mutex
+	crdServed bool
+	ctrl      *manager.Controller
+}
+
+func (r *readiness) setCRDServed() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.crdServed = true
+}
+
+func (r *readiness) setController(ctrl *manager.Controller) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ctrl = ctrl
+}
+
+// check returns why the controller is not ready, nil once it is.
+func (r *readiness) check() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch {
+	case !r.crdServed:
+		return fmt.Errorf("the API server does not serve IngressGroups yet")
+	case r.ctrl == nil:
+		return fmt.Errorf("the controller is not started yet")
+	case r.ctrl.Leading() && !r.ctrl.HasSynced():
+		return fmt.Errorf("the informer caches are not synced yet")
+	}
+	return nil
+}
+
+// standby reports whether the controller waits to be elected leader.
+func (r *readiness) standby() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.ctrl != nil && !r.ctrl.Leading()
+}
+
+// healthzHandler answers the liveness probe: the process serves HTTP.
+func healthzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}
+}
+
+// readyzHandler answers the readiness probe, with 503 Service Unavailable
+// and the reason until the controller is ready. A ready standby replica
+// answers "ok: standby".
+func readyzHandler(ready *readiness) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := ready.check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if ready.standby() {
+			fmt.Fprint(w, "ok: standby")
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}
+}
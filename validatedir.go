@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"github.com/liabio/ingressgroup/pkg/controller"
+	"io"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/ingress-nginx/pkg/apis/ingressgroup/v1"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// validateDir validates every IngressGroup found in the YAML files under dir,
+// without a cluster, and writes a report to out. It returns false if any
+// group is invalid or a file cannot be read.
+func validateDir(dir string, out io.Writer) bool {
+	ok := true
+	seen := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || (filepath.Ext(path) != ".yaml" && filepath.Ext(path) != ".yml") {
+			return nil
+		}
+
+		groups, err := readIngressGroups(path)
+		if err != nil {
+			fmt.Fprintf(out, "%s: %v\n", path, err)
+			ok = false
+			return nil
+		}
+		for _, ig := range groups {
+			namespace := ig.Namespace
+			if namespace == "" {
+				namespace = metav1.NamespaceDefault
+			}
+			key := namespace + "/" + ig.Name
+			if previous, dup := seen[key]; dup {
+				fmt.Fprintf(out, "%s: ingress group %s is also defined in %s\n", path, key, previous)
+				ok = false
+				continue
+			}
+			seen[key] = path
+
+			if err := controller.Validate(ig); err != nil {
+				fmt.Fprintf(out, "%s: ingress group %s is invalid: %v\n", path, key, err)
+				ok = false
+				continue
+			}
+			fmt.Fprintf(out, "%s: ingress group %s is valid\n", path, key)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(out, "%v\n", err)
+		return false
+	}
+	return ok
+}
+
+// readIngressGroups decodes the IngressGroups of a YAML file holding one or
+// more documents, skipping the documents of other kinds.
+func readIngressGroups(path string) ([]*v1.IngressGroup, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var groups []*v1.IngressGroup
+	decoder := utilyaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		ig := &v1.IngressGroup{}
+		if err := decoder.Decode(ig); err == io.EOF {
+			return groups, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if ig.Kind != "IngressGroup" || !strings.HasPrefix(ig.APIVersion, v1.SchemeGroupVersion.Group+"/") {
+			continue
+		}
+		groups = append(groups, ig)
+	}
+}